@@ -0,0 +1,129 @@
+package saga
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// admission tracks active sagas and bounds them when WithMaxInFlight is set.
+type admission struct {
+	active int64
+	// maintenance is set by EnterMaintenanceMode, no saga is admitted then
+	maintenance int32
+	// slots is nil if in-flight sagas are unbounded
+	slots chan struct{}
+	wait  time.Duration
+	mu    sync.Mutex
+	// live are sagas started by this coordinator and not ended yet, by logID
+	live map[string]*Saga
+	// starting are logIDs claimed by sagas not started yet, closed once they started or failed to
+	starting map[string]chan struct{}
+}
+
+func newAdmission(maxInFlight int, wait time.Duration) *admission {
+	a := &admission{wait: wait, live: make(map[string]*Saga), starting: make(map[string]chan struct{})}
+	if maxInFlight > 0 {
+		a.slots = make(chan struct{}, maxInFlight)
+	}
+	return a
+}
+
+// acquire takes a slot, waiting at most a.wait or until ctx is done if the limit is reached.
+func (a *admission) acquire(ctx context.Context) error {
+	if a.inMaintenance() {
+		return ErrMaintenanceMode
+	}
+	if a.slots != nil {
+		select {
+		case a.slots <- struct{}{}:
+		default:
+			if a.wait <= 0 {
+				return ErrTooManySagas
+			}
+			timer := time.NewTimer(a.wait)
+			defer timer.Stop()
+			select {
+			case a.slots <- struct{}{}:
+			case <-timer.C:
+				return ErrTooManySagas
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	atomic.AddInt64(&a.active, 1)
+	return nil
+}
+
+// claim reserves logID for a saga about to start, it returns false if saga of logID is running or starting.
+// The claim is held until finishStart.
+func (a *admission) claim(logID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.live[logID] != nil || a.starting[logID] != nil {
+		return false
+	}
+	a.starting[logID] = make(chan struct{})
+	return true
+}
+
+// finishStart drops the claim of logID, and tracks s as running unless it's nil, i.e. the saga failed to start.
+func (a *admission) finishStart(logID string, s *Saga) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s != nil {
+		a.live[logID] = s
+	}
+	close(a.starting[logID])
+	delete(a.starting, logID)
+}
+
+// find returns saga of logID running in this coordinator, nil if none. A saga starting is waited for,
+// so it's only returned once SagaStart is written.
+func (a *admission) find(logID string) *Saga {
+	for {
+		a.mu.Lock()
+		s, starting := a.live[logID], a.starting[logID]
+		a.mu.Unlock()
+		if s != nil || starting == nil {
+			return s
+		}
+		<-starting
+	}
+}
+
+// isLive reports whether saga of logID is running or starting in this coordinator.
+func (a *admission) isLive(logID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.live[logID] != nil || a.starting[logID] != nil
+}
+
+func (a *admission) inMaintenance() bool {
+	return atomic.LoadInt32(&a.maintenance) == 1
+}
+
+// release frees the slot taken by saga s.
+func (a *admission) release(s *Saga) {
+	a.mu.Lock()
+	if a.live[s.logID] == s {
+		delete(a.live, s.logID)
+	}
+	a.mu.Unlock()
+	a.releaseSlot()
+}
+
+// releaseSlot frees a slot taken by acquire.
+func (a *admission) releaseSlot() {
+	atomic.AddInt64(&a.active, -1)
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// InFlight returns the number of sagas started but not ended yet.
+func (e *ExecutionCoordinator) InFlight() int {
+	return int(atomic.LoadInt64(&e.admission.active))
+}
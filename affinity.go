@@ -0,0 +1,116 @@
+package saga
+
+import (
+	"context"
+	"sync"
+)
+
+// boundResource is a resource bound by action through BindResource.
+type boundResource struct {
+	resource interface{}
+	release  func() error
+}
+
+// boundRegistry holds resources bound by actions of running sagas, by logID and time in nanoseconds of their ActionEnd log.
+// Resources are only kept in memory, they are lost when the process exits.
+type boundRegistry struct {
+	mu    sync.Mutex
+	bound map[string]map[int64]boundResource
+}
+
+type boundResourceCtxKey struct{}
+
+// RequireBoundResource declares compensate can only run with the resource bound by its action through BindResource,
+// e.g. a *sql.Tx holding session-bound temp tables. Bound resources can't survive a restart, so compensation
+// resumed by another process, or of an action which bound nothing, fails with ErrBoundResourceLost
+// instead of running, and the saga is dead-lettered for manual repair.
+func RequireBoundResource() SubTxOption {
+	return func(def *subTxDefinition) {
+		def.requireBoundResource = true
+	}
+}
+
+// BindResource binds resource to the action of ctx, e.g. the connection or transaction it used, so that
+// compensate of the action receives the same resource through BoundResource. The resource stays in memory for
+// the saga's lifetime: release is called once the saga committed, or after compensation succeeded, so a failed
+// compensation retried by RetryCompensateFailure in this process still gets it. A nil release does nothing.
+// Binding again replaces the resource, e.g. on action retry, without releasing the replaced one, and the resource
+// of an action failed without ActionEnd log is released right away.
+// It does nothing if ctx isn't an action context given by a saga.
+func BindResource(ctx context.Context, resource interface{}, release func() error) {
+	scope, ok := ctx.Value(valuesCtxKey{}).(*valueScope)
+	if !ok || scope.written == nil {
+		return
+	}
+	scope.mu.Lock()
+	scope.bound = &boundResource{resource: resource, release: release}
+	scope.mu.Unlock()
+}
+
+// BoundResource returns resource bound by the action being compensated from compensate context,
+// ok is false if the action bound nothing, or the resource was lost by a restart.
+func BoundResource(ctx context.Context) (resource interface{}, ok bool) {
+	bound, ok := ctx.Value(boundResourceCtxKey{}).(boundResource)
+	return bound.resource, ok
+}
+
+// takeBound returns resource bound by action of scope and detaches it from scope.
+func (scope *valueScope) takeBound() *boundResource {
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	bound := scope.bound
+	scope.bound = nil
+	return bound
+}
+
+// bindResource keeps resource bound by action of scope for compensate of its ActionEnd log.
+func (s *Saga) bindResource(log *Log, scope *valueScope) {
+	bound := scope.takeBound()
+	if bound == nil {
+		return
+	}
+	r := s.sec.bound
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bound[s.logID] == nil {
+		r.bound[s.logID] = make(map[int64]boundResource)
+	}
+	r.bound[s.logID][log.Time.UnixNano()] = *bound
+}
+
+// dropBound releases resource bound by action of scope whose ActionEnd isn't logged, it won't be compensated.
+func (s *Saga) dropBound(scope *valueScope) {
+	if bound := scope.takeBound(); bound != nil {
+		s.releaseBound(*bound)
+	}
+}
+
+// boundTo returns resource bound by action of ActionEnd log tlog.
+func (s *Saga) boundTo(tlog Log) (boundResource, bool) {
+	r := s.sec.bound
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bound, ok := r.bound[s.logID][tlog.Time.UnixNano()]
+	return bound, ok
+}
+
+// releaseBoundResources releases all resources bound by actions of saga, at the end of its lifetime.
+func (s *Saga) releaseBoundResources() {
+	r := s.sec.bound
+	r.mu.Lock()
+	bound := r.bound[s.logID]
+	delete(r.bound, s.logID)
+	r.mu.Unlock()
+	for _, b := range bound {
+		s.releaseBound(b)
+	}
+}
+
+func (s *Saga) releaseBound(bound boundResource) {
+	if bound.release == nil {
+		return
+	}
+	if err := bound.release(); err != nil {
+		s.sec.opts.logger.Printf("[WARNING]Saga %s release bound resource failure: %v", s.logID, err)
+	}
+}
@@ -0,0 +1,116 @@
+package saga
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// AsyncAction marks action of the sub-transaction only submits an asynchronous operation, e.g. a job,
+// whose completion arrives later out-of-band. After the action returns, the saga pauses (ActionPaused log)
+// until Confirm is called with the result of the operation, then resumes (ActionResumed log),
+// or aborts if the result is an error or saga context is done first.
+// The action is logged as ActionEnd before pausing, so compensate cancels the submitted operation on abort.
+func AsyncAction() SubTxOption {
+	return func(def *subTxDefinition) {
+		def.async = true
+	}
+}
+
+// confirmWaiters delivers Confirm results to paused sagas of this process.
+type confirmWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]chan error
+}
+
+func confirmKey(logID, subTxID string) string {
+	return logID + "/" + subTxID
+}
+
+func (w *confirmWaiters) register(key string) chan error {
+	ch := make(chan error, 1)
+	w.mu.Lock()
+	w.waiters[key] = ch
+	w.mu.Unlock()
+	return ch
+}
+
+func (w *confirmWaiters) remove(key string) {
+	w.mu.Lock()
+	delete(w.waiters, key)
+	w.mu.Unlock()
+}
+
+func (w *confirmWaiters) deliver(key string, result error) bool {
+	w.mu.Lock()
+	ch, ok := w.waiters[key]
+	delete(w.waiters, key)
+	w.mu.Unlock()
+	if ok {
+		ch <- result
+	}
+	return ok
+}
+
+// Confirm resumes the saga paused on the async sub-transaction subTxID with result of its operation,
+// a non-nil result aborts the saga. It's meant to be called by a webhook or consumer.
+//
+// A saga paused by a process which has exited can't move forward, since the remaining steps lived in its caller.
+// Confirm rolls such a saga back by compensating every executed step including the async one,
+// it returns ErrCompensateFailed if the compensation is dead-lettered.
+// ErrNotPaused is returned if the saga isn't paused on subTxID.
+func (e *ExecutionCoordinator) Confirm(logID, subTxID string, result error) error {
+	if e.confirms.deliver(confirmKey(logID, subTxID), result) {
+		return nil
+	}
+	data, err := e.storeOf(logID).LastLog(logID)
+	if err != nil {
+		return errors.Annotatef(err, "Confirm LastLog %s failure", logID)
+	}
+	if data == "" {
+		return fmt.Errorf("Confirm %s %s: %w", logID, subTxID, ErrNotPaused)
+	}
+	if last := mustUnmarshalLog(data); last.Type != ActionPaused || last.SubTxID != subTxID {
+		return fmt.Errorf("Confirm %s %s: %w", logID, subTxID, ErrNotPaused)
+	}
+	s := e.recoverSaga(logID, nil)
+	if result == nil {
+		s.mustAppendLog(&Log{Type: ActionResumed, SubTxID: subTxID, Time: time.Now()}, "Confirm")
+		result = fmt.Errorf("saga %s resumed after its process exited", logID)
+	}
+	s.err = result
+	s.Abort()
+	s.EndSaga()
+	if s.compensateFail {
+		return fmt.Errorf("Confirm %s: %w", logID, ErrCompensateFailed)
+	}
+	return nil
+}
+
+// awaitConfirm pauses the saga until the async sub-transaction is confirmed.
+func (s *Saga) awaitConfirm(subTxID string, confirmed chan error) {
+	s.mustAppendLog(&Log{Type: ActionPaused, SubTxID: subTxID, Time: time.Now()}, "ExecSub")
+	var err error
+	select {
+	case err = <-confirmed:
+	case <-s.context.Done():
+		s.sec.confirms.remove(confirmKey(s.logID, subTxID))
+		err = s.context.Err()
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.err = fmt.Errorf("confirm %s: %w", subTxID, err)
+		s.mu.Unlock()
+		s.Abort()
+		return
+	}
+	s.mustAppendLog(&Log{Type: ActionResumed, SubTxID: subTxID, Time: time.Now()}, "ExecSub")
+}
+
+func (s *Saga) mustAppendLog(log *Log, op string) {
+	if err := s.appendLog(log); err != nil {
+		panic(fmt.Errorf("%s AppendLog: %v", op, err))
+	}
+}
@@ -0,0 +1,84 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitPaused waits until saga logID is paused on an async action.
+func waitPaused(t *testing.T, store storage.Storage, logID string) {
+	for i := 0; i < 100; i++ {
+		data, err := store.LastLog(logID)
+		assert.NoError(t, err)
+		if data != "" && mustUnmarshalLog(data).Type == ActionPaused {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("saga %s not paused", logID)
+}
+
+func TestAsyncActionConfirm(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("submit", acc.deduce, acc.deduceCompensate, AsyncAction())
+
+	s := sec.StartSaga(context.Background(), "async")
+	done := make(chan error)
+	go func() {
+		done <- s.ExecSub("submit", "foo", 10).EndSaga()
+	}()
+	waitPaused(t, sec.store, s.logID)
+	assert.NoError(t, sec.Confirm(s.logID, "submit", nil))
+	assert.NoError(t, <-done)
+	assert.Equal(t, 90, acc.balance["foo"])
+}
+
+func TestAsyncActionReject(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("submit", acc.deduce, acc.deduceCompensate, AsyncAction())
+
+	s := sec.StartSaga(context.Background(), "async")
+	done := make(chan error)
+	go func() {
+		done <- s.ExecSub("submit", "foo", 10).EndSaga()
+	}()
+	waitPaused(t, sec.store, s.logID)
+	rejected := errors.New("job failed")
+	assert.NoError(t, sec.Confirm(s.logID, "submit", rejected))
+	assert.True(t, errors.Is(<-done, rejected))
+	// compensate cancels the submitted operation
+	assert.Equal(t, 100, acc.balance["foo"])
+}
+
+func TestAsyncActionConfirmAfterRestart(t *testing.T) {
+	store, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	acc := &account{balance: map[string]int{"foo": 100}}
+	newSEC := func() *ExecutionCoordinator {
+		sec := NewSEC(store, LogPrefix)
+		sec.AddSubTxDef("submit", acc.deduce, acc.deduceCompensate, AsyncAction())
+		return &sec
+	}
+	crashed := newSEC()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := crashed.StartSaga(ctx, "async")
+	go s.ExecSub("submit", "foo", 10)
+	waitPaused(t, store, s.logID)
+
+	restarted := newSEC()
+	assert.True(t, errors.Is(restarted.Confirm(s.logID, "other", nil), ErrNotPaused))
+	assert.NoError(t, restarted.Confirm(s.logID, "submit", nil))
+	assert.Equal(t, 100, acc.balance["foo"])
+	logs, err := store.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+}
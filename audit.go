@@ -0,0 +1,44 @@
+package saga
+
+import (
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// RecordCompensateResult persists return values of compensate besides the trailing error with its CompensateEnd log,
+// e.g. the refund transaction ID, as an audit trail of what compensation produced, see ReplayEntry.Results.
+// A compensate returning (T, error) fails by its trailing error, without a custom ResultInterpreter.
+// Return types are registered like params, so they must be serializable by the codec.
+func RecordCompensateResult() SubTxOption {
+	return func(def *subTxDefinition) {
+		def.recordCompensateResult = true
+	}
+}
+
+// splitResult splits return values of compensate declared by RecordCompensateResult into outputs
+// and the trailing error value interpreted by ResultInterpreter.
+func splitResult(result []reflect.Value) (outputs, status []reflect.Value) {
+	if n := len(result); n > 0 && result[n-1].Type() == errorType {
+		return result[:n-1], result[n-1:]
+	}
+	return result, nil
+}
+
+// marshalResult marshals outputs by their declared types.
+func (e *ExecutionCoordinator) marshalResult(outputs []reflect.Value) []ParamData {
+	if len(outputs) == 0 {
+		return nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	data := make([]ParamData, 0, len(outputs))
+	for _, output := range outputs {
+		typ, ok := e.paramTypeRegister.findTypeName(output.Type())
+		if !ok {
+			panic("Find Param Name Panic: " + output.Type().String())
+		}
+		data = append(data, ParamData{ParamType: typ, Data: mustMarshal(output.Interface())})
+	}
+	return data
+}
@@ -0,0 +1,60 @@
+package saga
+
+import (
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// WithStorageSelector lets sagas of one coordinator keep their log in different storages,
+// e.g. durable SQL for high-value sagas and memory for ephemeral ones.
+// selector picks storage of saga by its logID, so recovery consults the same storage as the saga did,
+// it must be deterministic and returns nil for the storage given to NewSEC.
+// backends are the storages selector may return, they're scanned by operations listing sagas,
+// e.g. ListSagasByTimeRange and EnterMaintenanceMode.
+// Lists kept by coordinator, e.g. dead-letter list, and outcome records stay in the storage given to NewSEC.
+func WithStorageSelector(selector func(logID string) storage.Storage, backends ...storage.Storage) Option {
+	return func(o *options) {
+		o.storageSelector = selector
+		o.backends = backends
+	}
+}
+
+// storeSelector returns storage of saga by logID.
+func storeSelector(store storage.Storage, selector func(logID string) storage.Storage) func(logID string) storage.Storage {
+	return func(logID string) storage.Storage {
+		if selector != nil {
+			if selected := selector(logID); selected != nil {
+				return selected
+			}
+		}
+		return store
+	}
+}
+
+// stores returns storage given to NewSEC followed by other backends.
+func (e *ExecutionCoordinator) stores() []storage.Storage {
+	stores := []storage.Storage{e.store}
+	for _, backend := range e.opts.backends {
+		if backend != e.store {
+			stores = append(stores, backend)
+		}
+	}
+	return stores
+}
+
+// logIDs returns logIDs of all storages, a logID is only returned from the storage selected for it.
+func (e *ExecutionCoordinator) logIDs() ([]string, error) {
+	var all []string
+	for _, store := range e.stores() {
+		logIDs, err := store.LogIDs()
+		if err != nil {
+			return nil, errors.Annotate(err, "LogIDs failure")
+		}
+		for _, logID := range logIDs {
+			if e.storeOf(logID) == store {
+				all = append(all, logID)
+			}
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,129 @@
+package saga
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes delay between retries, it grows exponentially from Base and is capped by Max.
+// Zero value Backoff means retry immediately.
+type Backoff struct {
+	// Base is the delay before first retry
+	Base time.Duration
+	// Max caps the delay, no cap if zero
+	Max time.Duration
+	// Multiplier grows delay each retry, default to 2
+	Multiplier float64
+	// Jitter randomizes delay to avoid thundering-herd retries, default to NoJitter
+	Jitter Jitter `json:"-"`
+}
+
+// Delay returns delay before given retry attempt(starts from 1),
+// prev is actual delay used for previous attempt.
+func (b Backoff) Delay(attempt int, prev time.Duration) time.Duration {
+	if b.Base <= 0 {
+		return 0
+	}
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	d := float64(b.Base)
+	for i := 1; i < attempt; i++ {
+		d *= multiplier
+		if b.Max > 0 && d > float64(b.Max) {
+			break
+		}
+	}
+	delay := b.capped(time.Duration(d))
+	if b.Jitter != nil {
+		delay = b.capped(b.Jitter.Apply(delay, b.Base, prev))
+	}
+	return delay
+}
+
+func (b Backoff) capped(d time.Duration) time.Duration {
+	if b.Max > 0 && d > b.Max {
+		return b.Max
+	}
+	return d
+}
+
+// RetryPolicy defines how a failed sub-transaction action is retried.
+// Zero value RetryPolicy means no retry.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of attempts including the first one
+	MaxAttempts int
+	// Backoff is the delay between attempts
+	Backoff Backoff
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// sleepContext sleeps d, returns ctx.Err() if ctx is done before that.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Jitter randomizes backoff delay.
+type Jitter interface {
+	// Apply returns actual delay for exponential delay d,
+	// base is Backoff.Base and prev is actual delay of previous attempt.
+	Apply(d, base, prev time.Duration) time.Duration
+}
+
+// JitterFunc adapts ordinary function to Jitter.
+type JitterFunc func(d, base, prev time.Duration) time.Duration
+
+// Apply calls f(d, base, prev).
+func (f JitterFunc) Apply(d, base, prev time.Duration) time.Duration {
+	return f(d, base, prev)
+}
+
+var (
+	// NoJitter uses exponential delay as is.
+	NoJitter Jitter = JitterFunc(func(d, base, prev time.Duration) time.Duration {
+		return d
+	})
+
+	// FullJitter picks delay randomly in [0, d).
+	FullJitter Jitter = JitterFunc(func(d, base, prev time.Duration) time.Duration {
+		return randDuration(d)
+	})
+
+	// EqualJitter keeps half of delay and randomizes the other half.
+	EqualJitter Jitter = JitterFunc(func(d, base, prev time.Duration) time.Duration {
+		return d/2 + randDuration(d-d/2)
+	})
+
+	// DecorrelatedJitter picks delay randomly in [base, prev*3), ignores exponential delay.
+	DecorrelatedJitter Jitter = JitterFunc(func(d, base, prev time.Duration) time.Duration {
+		if prev < base {
+			prev = base
+		}
+		return base + randDuration(prev*3-base)
+	})
+)
+
+func randDuration(n time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(n)))
+}
@@ -0,0 +1,31 @@
+package saga
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	assert.Equal(t, 10*time.Millisecond, b.Delay(1, 0))
+	assert.Equal(t, 20*time.Millisecond, b.Delay(2, 0))
+	assert.Equal(t, 40*time.Millisecond, b.Delay(3, 0))
+	assert.Equal(t, 50*time.Millisecond, b.Delay(10, 0))
+	assert.Equal(t, time.Duration(0), Backoff{}.Delay(3, 0))
+}
+
+func TestBackoffJitter(t *testing.T) {
+	for _, jitter := range []Jitter{NoJitter, FullJitter, EqualJitter, DecorrelatedJitter} {
+		b := Backoff{Base: 10 * time.Millisecond, Max: 100 * time.Millisecond, Jitter: jitter}
+		var prev time.Duration
+		for attempt := 1; attempt < 10; attempt++ {
+			d := b.Delay(attempt, prev)
+			assert.True(t, d >= 0 && d <= b.Max, "delay %v out of range", d)
+			prev = d
+		}
+	}
+	d := Backoff{Base: 10 * time.Millisecond, Jitter: EqualJitter}.Delay(2, 0)
+	assert.True(t, d >= 10*time.Millisecond && d < 20*time.Millisecond)
+}
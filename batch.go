@@ -0,0 +1,139 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// BatchCompensateFunc compensates a sub-transaction of many sagas in one call.
+// args[i] holds the compensate arguments (without context) of the i-th saga,
+// it must return one error per item in the same order, nil means the item is compensated.
+// Items may be retried, so the downstream operation is expected to be idempotent.
+type BatchCompensateFunc func(ctx context.Context, args [][]interface{}) []error
+
+// BatchCompensate declares compensate of the sub-transaction batchable,
+// compensations of the same subTxID requested by different sagas within window are
+// coalesced into a single call of batch. Each saga gets the error of its own item back,
+// failed items are retried and dead-lettered as usual. batch is called with compensate context of the saga
+// which opened the window(see WithOnBeforeAbort), bounded by the earliest abort deadline of the coalesced sagas.
+func BatchCompensate(batch BatchCompensateFunc, window time.Duration) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.batcher = &compensateBatcher{batch: batch, window: window}
+	}
+}
+
+type batchItem struct {
+	ctx    context.Context
+	args   []interface{}
+	result chan error
+}
+
+type compensateBatcher struct {
+	batch  BatchCompensateFunc
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []batchItem
+}
+
+// compensate queues args and waits until the batch containing it is flushed. A panic of batch is recovered
+// into *PanicError, or panics again in each caller with propagatePanics(see WithRecoverActions),
+// as compensate called by the saga itself would.
+func (b *compensateBatcher) compensate(ctx context.Context, args []interface{}, propagatePanics bool) error {
+	item := batchItem{ctx: ctx, args: args, result: make(chan error, 1)}
+	b.mu.Lock()
+	b.pending = append(b.pending, item)
+	if len(b.pending) == 1 {
+		time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+	err := <-item.result
+	if p, ok := err.(*batchPanic); ok {
+		if propagatePanics {
+			panic(p.Value)
+		}
+		return p.PanicError
+	}
+	return err
+}
+
+// batchPanic is the error of every item of a panicked batch call, compensate of each item turns it
+// into *PanicError or panics again.
+type batchPanic struct {
+	*PanicError
+}
+
+func (b *compensateBatcher) flush() {
+	b.mu.Lock()
+	items := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	if len(items) == 0 {
+		return
+	}
+
+	args := make([][]interface{}, len(items))
+	for i, item := range items {
+		args[i] = item.args
+	}
+	ctx, cancel := batchContext(items)
+	defer cancel()
+	errs := b.call(ctx, args)
+	for i, item := range items {
+		if len(errs) != len(items) {
+			item.result <- fmt.Errorf("batch compensate returned %d results for %d items", len(errs), len(items))
+			continue
+		}
+		item.result <- errs[i]
+	}
+}
+
+// batchContext returns context of the first item, bounded by the earliest deadline of all items.
+func batchContext(items []batchItem) (context.Context, context.CancelFunc) {
+	ctx := items[0].ctx
+	var earliest time.Time
+	for _, item := range items {
+		if deadline, ok := item.ctx.Deadline(); ok && (earliest.IsZero() || deadline.Before(earliest)) {
+			earliest = deadline
+		}
+	}
+	if earliest.IsZero() {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, earliest)
+}
+
+func (b *compensateBatcher) call(ctx context.Context, args [][]interface{}) (errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := &batchPanic{&PanicError{Value: r, Stack: debug.Stack()}}
+			errs = make([]error, len(args))
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+	}()
+	return b.batch(ctx, args)
+}
+
+// batchCompensate queues args of compensate to batcher, ctx is bounded by deadline of the whole compensation.
+func (s *Saga) batchCompensate(ctx context.Context, batcher *compensateBatcher, args []reflect.Value) error {
+	if !s.compensateDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, s.compensateDeadline)
+		defer cancel()
+	}
+	return batcher.compensate(ctx, batchArgs(args), s.sec.opts.propagatePanics)
+}
+
+func batchArgs(args []reflect.Value) []interface{} {
+	items := make([]interface{}, len(args))
+	for i, arg := range args {
+		items[i] = arg.Interface()
+	}
+	return items
+}
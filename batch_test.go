@@ -0,0 +1,98 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchCompensate(t *testing.T) {
+	var mu sync.Mutex
+	var calls [][][]interface{}
+	var hooked []interface{}
+	var deadlines []time.Time
+	batch := func(ctx context.Context, args [][]interface{}) []error {
+		mu.Lock()
+		calls = append(calls, args)
+		hooked = append(hooked, ctx.Value(hookKey{}))
+		deadline, _ := ctx.Deadline()
+		deadlines = append(deadlines, deadline)
+		mu.Unlock()
+		errs := make([]error, len(args))
+		for i, arg := range args {
+			if arg[0] == "bad" {
+				errs[i] = Permanent(errors.New("bad account"))
+			}
+		}
+		return errs
+	}
+	acc := &account{balance: map[string]int{}}
+	sec := newTestSEC(t, WithAbortTimeout(time.Hour), WithOnBeforeAbort(func(ctx context.Context, logID string) context.Context {
+		return context.WithValue(ctx, hookKey{}, logID)
+	}))
+	// flushed by the test once every saga queued its item, not by the window
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate, BatchCompensate(batch, time.Hour)).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+	batcher := sec.MustFindSubTxDef("deduce").batcher
+	start := time.Now()
+
+	names := []string{"foo", "bar", "bad"}
+	sagas := make([]*Saga, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		sagas[i] = sec.StartSaga(context.Background(), "batch-"+name)
+		wg.Add(1)
+		go func(s *Saga, name string) {
+			defer wg.Done()
+			s.ExecSub("deduce", name, 10).ExecSub("deposit", name, 10).EndSaga()
+		}(sagas[i], name)
+	}
+	assert.Eventually(t, func() bool {
+		batcher.mu.Lock()
+		defer batcher.mu.Unlock()
+		return len(batcher.pending) == len(names)
+	}, 5*time.Second, time.Millisecond)
+	batcher.flush()
+	wg.Wait()
+
+	assert.Len(t, calls, 1)
+	assert.ElementsMatch(t, [][]interface{}{{"foo", 10}, {"bar", 10}, {"bad", 10}}, calls[0])
+	// the batch runs in compensate context of a saga, bounded by abort timeout
+	assert.Contains(t, []interface{}{sagas[0].logID, sagas[1].logID, sagas[2].logID}, hooked[0])
+	assert.WithinDuration(t, start.Add(time.Hour), deadlines[0], time.Minute)
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{sagas[2].logID}, failures)
+}
+
+func TestBatchCompensatePanic(t *testing.T) {
+	b := &compensateBatcher{
+		batch: func(ctx context.Context, args [][]interface{}) []error {
+			panic("downstream bug")
+		},
+		window: time.Millisecond,
+	}
+	var panicErr *PanicError
+	err := b.compensate(context.Background(), []interface{}{"foo"}, false)
+	assert.True(t, errors.As(err, &panicErr), "%v", err)
+	assert.Equal(t, "downstream bug", panicErr.Value)
+
+	// WithRecoverActions(false) propagates the panic to the compensating saga
+	assert.PanicsWithValue(t, "downstream bug", func() {
+		b.compensate(context.Background(), []interface{}{"foo"}, true)
+	})
+}
+
+func TestBatchCompensateResultMismatch(t *testing.T) {
+	b := &compensateBatcher{
+		batch: func(ctx context.Context, args [][]interface{}) []error {
+			return nil
+		},
+		window: time.Millisecond,
+	}
+	assert.Error(t, b.compensate(context.Background(), []interface{}{"foo"}, false))
+}
@@ -0,0 +1,111 @@
+package saga
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// WithLogChecksum chains saga log entries by a rolling SHA-256 checksum: every entry appended by saga
+// records its sequence number and checksum of itself and the previous checksum, so VerifyIntegrity
+// detects entries removed, reordered or corrupted. Removal of the newest entries can't be told from
+// a saga still running. Entries appended by Pause and Resume from outside the saga aren't chained.
+// Compensation resumed from saga log is refused with ErrLogCorrupted if verification fails.
+func WithLogChecksum() Option {
+	return func(o *options) {
+		o.logChecksum = true
+	}
+}
+
+// logChain keeps sequence number and checksum of the last entry appended by saga.
+type logChain struct {
+	mu     sync.Mutex
+	loaded bool
+	seq    int
+	sum    string
+}
+
+// seal sets sequence number and checksum of log following the chain, the chain is loaded from
+// saga log on first use, e.g. by recovered saga. It must be called with c.mu held.
+func (c *logChain) seal(store storage.Storage, logID string, log *Log) error {
+	if !c.loaded {
+		logs, err := store.Lookup(logID)
+		if err != nil {
+			return err
+		}
+		for i := len(logs) - 1; i >= 0; i-- {
+			if last := mustUnmarshalLog(logs[i]); last.Seq > 0 {
+				c.seq, c.sum = last.Seq, last.Checksum
+				break
+			}
+		}
+		c.loaded = true
+	}
+	log.Seq = c.seq + 1
+	log.Checksum = ""
+	log.Checksum = logChecksum(c.sum, log)
+	return nil
+}
+
+// advance moves the chain to log after it's appended.
+func (c *logChain) advance(log *Log) {
+	c.seq, c.sum = log.Seq, log.Checksum
+}
+
+// logChecksum returns checksum of log chained after prev, log.Checksum must be empty.
+func logChecksum(prev string, log *Log) string {
+	sum := sha256.Sum256([]byte(prev + "\n" + log.mustMarshal()))
+	return hex.EncodeToString(sum[:])
+}
+
+// legacyChecksum likes logChecksum, but for entry chained by older versions persisting built-in type as numeric code.
+func legacyChecksum(prev string, log *Log) string {
+	code, ok := log.Type.legacyCode()
+	if !ok {
+		return ""
+	}
+	data := log.mustMarshal()
+	name := `{"type":"` + string(log.Type) + `"`
+	if !strings.HasPrefix(data, name) {
+		return ""
+	}
+	data = `{"type":` + strconv.Itoa(code) + data[len(name):]
+	sum := sha256.Sum256([]byte(prev + "\n" + data))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyIntegrity recomputes checksums of saga log written with WithLogChecksum,
+// it returns false if an entry is missing, out of order, corrupted or not chained at all.
+func (e *ExecutionCoordinator) VerifyIntegrity(logID string) (bool, error) {
+	logs, err := e.storeOf(logID).Lookup(logID)
+	if err != nil {
+		return false, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	return verifyChain(unmarshalLogs(logs)) == nil, nil
+}
+
+// verifyChain returns error describing the first entry breaking the chain.
+func verifyChain(logs []Log) error {
+	prev, seq := "", 0
+	for i, log := range logs {
+		if log.Seq == 0 && (log.Type == SagaPaused || log.Type == SagaResumed) {
+			continue
+		}
+		if log.Seq != seq+1 {
+			return fmt.Errorf("entry %d: sequence %d, expected %d", i, log.Seq, seq+1)
+		}
+		sum := log.Checksum
+		log.Checksum = ""
+		if logChecksum(prev, &log) != sum && legacyChecksum(prev, &log) != sum {
+			return fmt.Errorf("entry %d: checksum mismatch", i)
+		}
+		prev, seq = sum, log.Seq
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package saga
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogChecksum(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	flaky := &flakyCompensate{failures: 10}
+	sec := NewSEC(mem, LogPrefix, WithLogChecksum())
+	sec.AddSubTxDef("flaky", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "checksum")
+	s.ExecSub("flaky", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.NoError(t, sec.Pause(s.logID))
+	ok, err := sec.VerifyIntegrity(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// tamper with an entry
+	logs, err := mem.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.NoError(t, mem.Cleanup(s.logID))
+	for i, data := range logs {
+		if i == 2 {
+			data = strings.Replace(data, "foo", "bar", 1)
+		}
+		assert.NoError(t, mem.AppendLog(s.logID, data))
+	}
+	ok, err = sec.VerifyIntegrity(s.logID)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	err = sec.RetryCompensateFailure(context.Background(), s.logID)
+	assert.True(t, errors.Is(err, ErrLogCorrupted))
+
+	// resumed compensation continues the chain
+	assert.NoError(t, mem.Cleanup(s.logID))
+	for _, data := range logs {
+		assert.NoError(t, mem.AppendLog(s.logID, data))
+	}
+	assert.NoError(t, sec.Resume(s.logID))
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+}
+
+func TestVerifyChain(t *testing.T) {
+	var c logChain
+	mem, _ := memory.NewMemStorage()
+	var logs []Log
+	for _, typ := range []LogType{SagaStart, ActionStart, ActionEnd, SagaEnd} {
+		log := Log{Type: typ}
+		assert.NoError(t, c.seal(mem, "chain", &log))
+		c.advance(&log)
+		logs = append(logs, log)
+	}
+	assert.NoError(t, verifyChain(logs))
+	assert.EqualError(t, verifyChain(logs[1:]), "entry 0: sequence 2, expected 1")
+	assert.EqualError(t, verifyChain(append(logs[:1:1], logs[2:]...)), "entry 1: sequence 3, expected 2")
+	swapped := append([]Log(nil), logs...)
+	swapped[1].SubTxID = "forged"
+	assert.EqualError(t, verifyChain(swapped), "entry 1: checksum mismatch")
+}
+
+func TestVerifyLegacyChain(t *testing.T) {
+	// chained by versions persisting type as numeric code
+	prev := ""
+	var logs []Log
+	for i, code := range []int{1, 4, 5, 2} {
+		data := fmt.Sprintf(`{"type":%d,"time":"0001-01-01T00:00:00Z","seq":%d,"nextRetry":"0001-01-01T00:00:00Z"}`, code, i+1)
+		sum := sha256.Sum256([]byte(prev + "\n" + data))
+		prev = hex.EncodeToString(sum[:])
+		log := mustUnmarshalLog(data)
+		log.Checksum = prev
+		logs = append(logs, log)
+	}
+	assert.NoError(t, verifyChain(logs))
+	logs[2].SubTxID = "forged"
+	assert.EqualError(t, verifyChain(logs), "entry 2: checksum mismatch")
+}
@@ -0,0 +1,146 @@
+package saga
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kzh125/go-saga/storage"
+)
+
+// cleanupAttempts bounds retries of a failed async cleanup before it's given up and logged.
+const cleanupAttempts = 5
+
+// cleaner cleans up saga log of ended sagas in background, see WithAsyncCleanup.
+type cleaner struct {
+	store  func(logID string) storage.Storage
+	logger *log.Logger
+	queue  chan string
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newCleaner(store func(logID string) storage.Storage, logger *log.Logger, size int) *cleaner {
+	c := &cleaner{
+		store:  store,
+		logger: logger,
+		queue:  make(chan string, size),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// enqueue queues logID to clean up, returns false if cleaner has been shut down.
+func (c *cleaner) enqueue(logID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return false
+	}
+	c.queue <- logID
+	return true
+}
+
+func (c *cleaner) run() {
+	defer close(c.done)
+	for logID := range c.queue {
+		c.cleanup(logID)
+	}
+}
+
+func (c *cleaner) cleanup(logID string) {
+	delay := 100 * time.Millisecond
+	var err error
+	for i := 0; i < cleanupAttempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = c.store(logID).Cleanup(logID); err == nil {
+			return
+		}
+		c.logger.Printf("[WARNING]Async cleanup %s failure, attempt %d: %v", logID, i+1, err)
+	}
+	c.logger.Printf("[ERROR]Async cleanup %s given up, saga log is left: %v", logID, err)
+}
+
+// shutdown stops accepting logIDs and waits for queued ones cleaned up or ctx done.
+func (c *cleaner) shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops background work of the coordinator, it drains async cleanup queue(see WithAsyncCleanup)
+// until done or ctx is done. Sagas ended after Shutdown clean up synchronously.
+func (e *ExecutionCoordinator) Shutdown(ctx context.Context) error {
+	if e.cleaner == nil {
+		return nil
+	}
+	return e.cleaner.shutdown(ctx)
+}
+
+// CleanupAction tells what to do with saga log once the saga reaches its outcome, see WithCleanupPolicy.
+type CleanupAction int
+
+const (
+	// CleanupDelete deletes saga log, it's the default
+	CleanupDelete CleanupAction = iota
+	// CleanupArchive copies saga log into archive store before deleting it
+	CleanupArchive
+	// CleanupRetain keeps saga log in place, e.g. for investigation
+	CleanupRetain
+)
+
+// CleanupPolicy decides what to do with saga log by outcome of the saga.
+type CleanupPolicy func(outcome SagaOutcome) CleanupAction
+
+// WithCleanupPolicy sets policy consulted when a saga is completed or fully compensated,
+// e.g. to retain aborted sagas for investigation, archive high-value sagas and delete routine ones.
+// Archived log is copied into archive under its logID, CleanupArchive is treated as CleanupRetain if archive is nil.
+// Log of saga whose compensation failed is always retained, since it's needed to resume compensation.
+func WithCleanupPolicy(policy CleanupPolicy, archive storage.Storage) Option {
+	return func(o *options) {
+		o.cleanupPolicy = policy
+		o.archiveStore = archive
+	}
+}
+
+// cleanupAction returns what to do with saga log of given outcome.
+func (e *ExecutionCoordinator) cleanupAction(outcome SagaOutcome) CleanupAction {
+	if e.opts.cleanupPolicy == nil {
+		return CleanupDelete
+	}
+	action := e.opts.cleanupPolicy(outcome)
+	if action == CleanupArchive && e.opts.archiveStore == nil {
+		e.opts.logger.Printf("[WARNING]Archive %s without archive store, saga log is retained", outcome.LogID)
+		return CleanupRetain
+	}
+	return action
+}
+
+// archive copies saga log into archive store.
+func (e *ExecutionCoordinator) archive(logID string) error {
+	logs, err := e.storeOf(logID).Lookup(logID)
+	if err != nil {
+		return err
+	}
+	for _, data := range logs {
+		if err := e.opts.archiveStore.AppendLog(logID, data); err != nil {
+			return err
+		}
+	}
+	return e.opts.archiveStore.Flush()
+}
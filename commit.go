@@ -0,0 +1,217 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// commitCallback is a callback queued by OnCommit.
+type commitCallback struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// WithCommitRecovery registers fn to re-run callbacks queued by OnCommit under name, for sagas whose process crashed
+// after SagaEnd was logged but before the callback succeeded, see RecoverCommits. fn gets logID of the saga instead
+// of the state captured by the lost callback, so it must look up what it needs, e.g. by State or Replay.
+func WithCommitRecovery(name string, fn func(ctx context.Context, logID string) error) Option {
+	return func(o *options) {
+		if o.commitRecovery == nil {
+			o.commitRecovery = make(map[string]func(ctx context.Context, logID string) error)
+		}
+		o.commitRecovery[name] = fn
+	}
+}
+
+// WithCommitAfterCleanup runs callbacks queued by OnCommit after saga log is cleaned up rather than before,
+// so cleanup isn't delayed by them, but their intents aren't kept for RecoverCommits.
+func WithCommitAfterCleanup() Option {
+	return func(o *options) {
+		o.commitAfterCleanup = true
+	}
+}
+
+// OnCommit queues fn to run once the whole saga committed, i.e. after EndSaga logged SagaEnd of a saga not aborted,
+// e.g. to send a confirmation email or publish a domain event. fn is never compensated,
+// and queued callbacks are discarded if the saga aborts.
+// name is logged as intent of fn before SagaEnd, if the process crashes before fn succeeds,
+// RecoverCommits re-runs it by the handler registered with WithCommitRecovery under name.
+// A failed fn is only logged and keeps saga log for RecoverCommits, EndSaga still succeeds.
+func (s *Saga) OnCommit(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commits = append(s.commits, commitCallback{name: name, fn: fn})
+}
+
+// logCommitIntents logs CommitPending for every queued callback, it's a no-op with WithCommitAfterCleanup.
+func (s *Saga) logCommitIntents() {
+	if s.sec.opts.commitAfterCleanup {
+		return
+	}
+	for _, commit := range s.commits {
+		log := &Log{Type: CommitPending, Time: time.Now(), Values: map[string]string{"callback": commit.name}}
+		if err := s.appendLog(log); err != nil {
+			panic(fmt.Errorf("OnCommit AppendLog: %v", err))
+		}
+	}
+}
+
+// runCommits runs queued callbacks in order, logging CommitDone for each succeeded unless WithCommitAfterCleanup.
+// It reports whether all succeeded.
+func (s *Saga) runCommits() bool {
+	ok := true
+	for _, commit := range s.commits {
+		if err := commit.fn(s.context); err != nil {
+			s.sec.opts.logger.Printf("[WARNING]Saga %s commit callback %s failure: %v", s.logID, commit.name, err)
+			ok = false
+			continue
+		}
+		if !s.sec.opts.commitAfterCleanup {
+			log := &Log{Type: CommitDone, Time: time.Now(), Values: map[string]string{"callback": commit.name}}
+			if err := s.appendLog(log); err != nil {
+				panic(fmt.Errorf("OnCommit AppendLog: %v", err))
+			}
+		}
+	}
+	return ok
+}
+
+// pendingCommits returns names of callbacks logged by CommitPending without CommitDone, in order.
+// Only sagas ended without abort have pending callbacks.
+func pendingCommits(logs []Log) []string {
+	var pending []string
+	ended := false
+	for _, log := range logs {
+		switch log.Type {
+		case SagaAbort:
+			return nil
+		case SagaEnd:
+			ended = true
+		case CommitPending:
+			pending = append(pending, log.Values["callback"])
+		case CommitDone:
+			for i, name := range pending {
+				if name == log.Values["callback"] {
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	if !ended {
+		return nil
+	}
+	return pending
+}
+
+// RecoverCommits re-runs callbacks queued by OnCommit of committed sagas whose callbacks didn't all succeed,
+// e.g. the process crashed after SagaEnd, by handlers registered with WithCommitRecovery.
+// Saga log is cleaned up according to cleanup policy once all callbacks succeeded.
+// It's meant to run at startup, since a saga ending in another coordinator can't be told from a crashed one,
+// sagas running in this coordinator are skipped. It returns logIDs recovered and the ones failed,
+// err is only returned when sagas can't be listed or ctx is done.
+func (e *ExecutionCoordinator) RecoverCommits(ctx context.Context) (recovered, failed []string, err error) {
+	logIDs, err := e.logIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, e.opts.recoveryConcurrency)
+	for _, logID := range logIDs {
+		if e.admission.isLive(logID) {
+			continue
+		}
+		if _, ok, err := e.startTime(logID); err != nil {
+			return recovered, failed, err
+		} else if !ok {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(logID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			done, recoverErr := e.recoverCommits(ctx, logID)
+			mu.Lock()
+			defer mu.Unlock()
+			if recoverErr != nil {
+				e.opts.logger.Printf("[WARNING]Recover commit callbacks of %s failure: %v", logID, recoverErr)
+				failed = append(failed, logID)
+			} else if done {
+				recovered = append(recovered, logID)
+			}
+		}(logID)
+	}
+	wg.Wait()
+	return recovered, failed, ctx.Err()
+}
+
+// recoverCommits re-runs pending callbacks of saga, done is false if it has none.
+func (e *ExecutionCoordinator) recoverCommits(ctx context.Context, logID string) (done bool, err error) {
+	store := e.storeOf(logID)
+	if locker, ok := store.(storage.Locker); ok {
+		unlock, locked, err := locker.TryLockSaga(logID)
+		if err != nil {
+			return false, errors.Annotatef(err, "TryLockSaga %s failure", logID)
+		}
+		if !locked {
+			// another coordinator is recovering it
+			return false, nil
+		}
+		defer func() {
+			if err := unlock(); err != nil {
+				e.opts.logger.Printf("[WARNING]Unlock saga %s failure: %v", logID, err)
+			}
+		}()
+	}
+	logs, err := store.Lookup(logID)
+	if err != nil {
+		return false, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	all := unmarshalLogs(logs)
+	pending := pendingCommits(all)
+	if len(pending) == 0 {
+		return false, nil
+	}
+	s := e.recoverSaga(logID, all)
+	s.context = ctx
+	for _, name := range pending {
+		fn, ok := e.opts.commitRecovery[name]
+		if !ok {
+			return false, fmt.Errorf("no commit recovery registered for %s", name)
+		}
+		if err := fn(ctx, logID); err != nil {
+			return false, errors.Annotatef(err, "commit callback %s", name)
+		}
+		log := &Log{Type: CommitDone, Time: time.Now(), Values: map[string]string{"callback": name}}
+		if err := s.appendLog(log); err != nil {
+			return false, errors.Annotatef(err, "AppendLog %s failure", logID)
+		}
+	}
+	switch e.cleanupAction(s.newOutcome(OutcomeCompleted)) {
+	case CleanupRetain:
+		return true, nil
+	case CleanupArchive:
+		if err := e.archive(logID); err != nil {
+			return true, errors.Annotatef(err, "Archive %s failure", logID)
+		}
+	}
+	if err := store.Cleanup(logID); err != nil {
+		return true, errors.Annotatef(err, "Cleanup %s failure", logID)
+	}
+	return true, nil
+}
@@ -0,0 +1,146 @@
+package saga
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// WithLogCompaction compacts log of a running saga every threshold entries it appends by CompactLog,
+// keeping the newest keep entries as they are. Storage must implement storage.Compactor,
+// and it can't be combined with WithLogChecksum. Default never compacts.
+func WithLogCompaction(threshold, keep int) Option {
+	return func(o *options) {
+		o.compactThreshold = threshold
+		o.compactKeep = keep
+	}
+}
+
+// CompactLog rewrites the head of saga log, all but the newest keep entries, into a checkpoint without
+// superseded entries, so abort and recovery look up less: ActionStart paired with ActionEnd, whose args are
+// inlined into ActionEnd, CompensateStart paired with CompensateEnd or CompensateFailed, and previous LogCompacted.
+// Every ActionEnd is kept, so all outstanding steps can still be compensated, and the state of the saga is kept
+// with them. The head is replaced atomically by storage.Compactor, entries appended meanwhile are kept,
+// and nothing is replaced if the log was compacted by others. It returns the number of entries removed.
+func (e *ExecutionCoordinator) CompactLog(logID string, keep int) (int, error) {
+	if e.opts.logChecksum {
+		return 0, fmt.Errorf("CompactLog %s: log entries are chained by WithLogChecksum", logID)
+	}
+	store := e.storeOf(logID)
+	compactor, ok := store.(storage.Compactor)
+	if !ok {
+		return 0, fmt.Errorf("CompactLog %s: storage doesn't implement storage.Compactor", logID)
+	}
+	data, err := store.Lookup(logID)
+	if err != nil {
+		return 0, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	n := len(data) - keep
+	if n <= 0 {
+		return 0, nil
+	}
+	logs := unmarshalLogs(data)
+	checkpoint, removed, total := compactLogs(logs, n)
+	if removed <= 1 {
+		// not worth the LogCompacted entry
+		return 0, nil
+	}
+	entries := make([]string, 0, len(checkpoint)+1)
+	for i := range checkpoint {
+		entries = append(entries, checkpoint[i].mustMarshal())
+	}
+	// dated like the last entry replaced, so the log doesn't look recently active
+	marker := &Log{
+		Type:          LogCompacted,
+		Time:          logs[n-1].Time,
+		CorrelationID: logs[0].CorrelationID,
+		Values:        map[string]string{"removed": strconv.Itoa(total)},
+	}
+	entries = append(entries, marker.mustMarshal())
+	// the head read is compared, so a concurrent compaction isn't overwritten
+	if ok, err = compactor.ReplacePrefix(logID, n, data[n-1], entries); err != nil {
+		return 0, errors.Annotatef(err, "ReplacePrefix %s failure", logID)
+	} else if !ok {
+		return 0, nil
+	}
+	return removed - 1, nil
+}
+
+// compactLogs returns the first n logs without superseded entries, the number of entries removed,
+// and the number removed by all compactions including this one.
+func compactLogs(logs []Log, n int) (checkpoint []Log, removed, total int) {
+	drop := make([]bool, n)
+	// pair ActionStart with ActionEnd like danglingActions, or by Started if ActionEnd has one,
+	// a start is only dropped with its end
+	var open []int
+	compensating := make(map[int]int)
+	for i, log := range logs {
+		switch log.Type {
+		case ActionStart:
+			open = append(open, i)
+		case ActionEnd:
+			for j, start := range open {
+				if logs[start].SubTxID == log.SubTxID && (log.Started == 0 || logs[start].Time.UnixNano() == log.Started) {
+					open = append(open[:j], open[j+1:]...)
+					if i < n {
+						drop[start] = true
+					}
+					break
+				}
+			}
+		case SagaAbort, SagaEnd:
+			open = nil
+		case CompensateStart:
+			if log.Step > 0 {
+				compensating[log.Step] = i
+			}
+		case CompensateEnd, CompensateFailed:
+			if start, ok := compensating[log.Step]; ok && i < n {
+				drop[start] = true
+				delete(compensating, log.Step)
+			}
+		case LogCompacted:
+			if i < n {
+				drop[i] = true
+				compacted, _ := strconv.Atoi(log.Values["removed"])
+				total += compacted
+			}
+		}
+	}
+	params := make(startParams)
+	for i, log := range logs[:n] {
+		params.restore(&log)
+		if drop[i] {
+			removed++
+			if log.Type != LogCompacted {
+				total++
+			}
+			continue
+		}
+		if log.Type == ActionEnd && log.Params != nil {
+			// its ActionStart may be dropped
+			log.Started = 0
+		}
+		checkpoint = append(checkpoint, log)
+	}
+	return checkpoint, removed, total
+}
+
+// compactIfDue compacts saga log by WithLogCompaction once every threshold entries appended,
+// compaction of the saga never runs concurrently.
+func (s *Saga) compactIfDue() {
+	threshold := s.sec.opts.compactThreshold
+	if threshold <= 0 || atomic.AddInt32(&s.appended, 1)%int32(threshold) != 0 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.compacting, 0)
+	if _, err := s.sec.CompactLog(s.logID, s.sec.opts.compactKeep); err != nil {
+		s.sec.opts.logger.Printf("[WARNING]Compact log of %s failure: %v", s.logID, err)
+	}
+}
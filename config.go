@@ -0,0 +1,102 @@
+package saga
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// CoordinatorConfig is a serializable export of coordinator configuration,
+// it's used to verify deployed instances have identical saga definitions and to feed documentation tooling.
+type CoordinatorConfig struct {
+	LogPrefix               string          `json:"logPrefix"`
+	Strict                  bool            `json:"strict"`
+	CompensateBackoff       Backoff         `json:"compensateBackoff"`
+	CompensateRetrySchedule []time.Duration `json:"compensateRetrySchedule,omitempty"`
+	CompensateRetryBackoff  Backoff         `json:"compensateRetryBackoff"`
+	CompensateRetryMax      int             `json:"compensateRetryMax,omitempty"`
+	AbortTimeout            time.Duration   `json:"abortTimeout,omitempty"`
+	RecoveryConcurrency     int             `json:"recoveryConcurrency"`
+	DefaultActionTimeout    time.Duration   `json:"defaultActionTimeout,omitempty"`
+	MaxInFlight             int             `json:"maxInFlight,omitempty"`
+	MaxConcurrency          int             `json:"maxConcurrency,omitempty"`
+	StoreRetry              RetryPolicy     `json:"storeRetry"`
+	ArgProviders            []string        `json:"argProviders,omitempty"`
+	SubTxs                  []SubTxConfig   `json:"subTxs"`
+}
+
+// SubTxConfig is a serializable export of sub-transaction definition.
+type SubTxConfig struct {
+	SubTxID          string   `json:"subTxID"`
+	ActionParams     []string `json:"actionParams"`
+	CompensateParams []string `json:"compensateParams"`
+	ManualCompensate bool     `json:"manualCompensate,omitempty"`
+	// IdempotentCompensate is set by IdempotentCompensate
+	IdempotentCompensate bool          `json:"idempotentCompensate,omitempty"`
+	Timeout              time.Duration `json:"timeout,omitempty"`
+	Retry                RetryPolicy   `json:"retry"`
+
+	CompensateRetries int `json:"compensateRetries"`
+	Version           int `json:"version,omitempty"`
+	// CompensateRef is the sub-transaction referenced by SubTxRef to compensate
+	CompensateRef string `json:"compensateRef,omitempty"`
+	// RecordCompensateResult is set by RecordCompensateResult
+	RecordCompensateResult bool `json:"recordCompensateResult,omitempty"`
+}
+
+// ExportConfig exports registered sub-transactions with their param type names and coordinator settings,
+// sub-transactions are sorted by subTxID so exports of identical coordinators are equal.
+func (e *ExecutionCoordinator) ExportConfig() CoordinatorConfig {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	c := CoordinatorConfig{
+		LogPrefix:               e.logPrefix,
+		Strict:                  e.opts.strict,
+		CompensateBackoff:       e.opts.compensateBackoff,
+		CompensateRetrySchedule: e.opts.compensateRetrySchedule,
+		CompensateRetryBackoff:  e.opts.compensateRetryBackoff,
+		CompensateRetryMax:      e.opts.compensateRetryMax,
+		AbortTimeout:            e.opts.abortTimeout,
+		RecoveryConcurrency:     e.opts.recoveryConcurrency,
+		DefaultActionTimeout:    e.opts.defaultActionTimeout,
+		MaxInFlight:             e.opts.maxInFlight,
+		MaxConcurrency:          e.opts.maxConcurrency,
+		StoreRetry:              e.opts.storeRetry,
+		SubTxs:                  make([]SubTxConfig, 0, len(e.subTxDefinitions)),
+	}
+	for typ := range e.paramTypeRegister.providers {
+		c.ArgProviders = append(c.ArgProviders, e.paramTypeRegister.typeToName[typ])
+	}
+	sort.Strings(c.ArgProviders)
+	for _, def := range e.subTxDefinitions {
+		c.SubTxs = append(c.SubTxs, SubTxConfig{
+			SubTxID:              def.subTxID,
+			ActionParams:         e.paramNames(def.action),
+			CompensateParams:     e.paramNames(def.compensate),
+			ManualCompensate:     def.manualCompensate,
+			IdempotentCompensate: def.idempotentCompensate,
+			Timeout:              def.timeout,
+			Retry:                def.retry,
+
+			CompensateRetries: def.compensateRetries,
+			Version:           def.version,
+			CompensateRef:     def.compensateRef,
+
+			RecordCompensateResult: def.recordCompensateResult,
+		})
+	}
+	sort.Slice(c.SubTxs, func(i, j int) bool {
+		return c.SubTxs[i].SubTxID < c.SubTxs[j].SubTxID
+	})
+	return c
+}
+
+// paramNames returns registered names of func params after context.
+func (e *ExecutionCoordinator) paramNames(fn reflect.Value) []string {
+	funcType := fn.Type()
+	names := make([]string, 0, funcType.NumIn()-1)
+	for i := 1; i < funcType.NumIn(); i++ {
+		names = append(names, e.paramTypeRegister.typeToName[funcType.In(i)])
+	}
+	return names
+}
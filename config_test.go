@@ -0,0 +1,62 @@
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportConfig(t *testing.T) {
+	acc := &account{}
+	sec := newTestSEC(t, WithAbortTimeout(time.Minute))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate, ActionTimeout(time.Second)).
+		AddSubTxDef("A1", T1, C1, ManualCompensate())
+
+	c := sec.ExportConfig()
+	assert.Equal(t, LogPrefix, c.LogPrefix)
+	assert.Equal(t, time.Minute, c.AbortTimeout)
+	if assert.Len(t, c.SubTxs, 2) {
+		assert.Equal(t, "A1", c.SubTxs[0].SubTxID)
+		assert.True(t, c.SubTxs[0].ManualCompensate)
+		assert.Equal(t, SubTxConfig{
+			SubTxID:          "deduce",
+			ActionParams:     []string{"string", "int"},
+			CompensateParams: []string{"string", "int"},
+			Timeout:          time.Second,
+
+			CompensateRetries: 9,
+		}, c.SubTxs[1])
+	}
+	_, err := json.Marshal(c)
+	assert.NoError(t, err)
+}
+
+func TestExportDiagnostics(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t, WithAbortTimeout(time.Minute))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate, ActionTimeout(time.Second)).
+		AddSubTxDef("A1", T1, C1)
+
+	s := sec.StartSaga(context.Background(), "diagnosed").ExecSub("deduce", "foo", 10)
+	data, err := sec.ExportDiagnostics(s.logID)
+	assert.NoError(t, err)
+	var bundle DiagnosticsBundle
+	assert.NoError(t, json.Unmarshal(data, &bundle))
+	assert.Equal(t, s.logID, bundle.LogID)
+	assert.Equal(t, SagaStatus{LogID: s.logID, Started: true, Completed: 1}, bundle.Status)
+	if assert.Len(t, bundle.Timeline, 3) {
+		assert.Equal(t, ActionEnd, bundle.Timeline[2].Type)
+		// args are decoded from JSON without type info
+		assert.Equal(t, []interface{}{"foo", float64(10)}, bundle.Timeline[2].Args)
+	}
+	if assert.Len(t, bundle.SubTxs, 1) {
+		assert.Equal(t, "deduce", bundle.SubTxs[0].SubTxID)
+		assert.Equal(t, time.Second, bundle.SubTxs[0].Timeout)
+	}
+	assert.Equal(t, time.Minute, bundle.Config.AbortTimeout)
+	assert.Empty(t, bundle.Config.SubTxs)
+	assert.NoError(t, s.EndSaga())
+}
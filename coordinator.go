@@ -2,9 +2,15 @@ package saga
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
+	"log"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/kzh125/go-saga/storage"
@@ -19,23 +25,67 @@ import (
 // - Sub-transaction definition with it's parameter info.
 type ExecutionCoordinator struct {
 	subTxDefinitions  subTxDefinitions
+	subTxVersions     subTxVersions
 	paramTypeRegister *paramTypeRegister
 	store             storage.Storage
-	logPrefix         string
-	mu                sync.RWMutex
+	// storeOf returns storage of saga by logID, see WithStorageSelector
+	storeOf   func(logID string) storage.Storage
+	logPrefix string
+	opts      options
+	admission *admission
+	confirms  *confirmWaiters
+	stats     *Stats
+	// cleaner is nil unless WithAsyncCleanup is set
+	cleaner *cleaner
+	// labels are label sets of sagas with their Stats, see WithLabelAllowlist
+	labels *labelRegistry
+	// bound are resources bound by actions of running sagas, see BindResource
+	bound *boundRegistry
+	// sharedResources are release funcs of shared resources by name, see AddSharedResource
+	sharedResources map[string]func(ctx context.Context, resourceID string) error
+	// plans are resolved ExecSub metadata by call shape, see mustFindStepPlan
+	plans map[planKey]*stepPlan
+	mu    sync.RWMutex
+	// listMu serializes rewriting of dead-letter lists with appending to them, for storage without storage.Remover
+	listMu sync.Mutex
 }
 
 // NewSEC creates Saga Execution Coordinator
 // This method require supply a log Storage to save & lookup log during tx execute.
-func NewSEC(store storage.Storage, logPrefix string) ExecutionCoordinator {
+func NewSEC(store storage.Storage, logPrefix string, opts ...Option) ExecutionCoordinator {
+	o := options{
+		logger:              log.New(os.Stderr, "[saga] ", log.LstdFlags),
+		recoveryConcurrency: 4,
+		resultInterpreter:   DefaultResultInterpreter,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	storeOf := storeSelector(store, o.storageSelector)
+	var c *cleaner
+	if o.asyncCleanup > 0 {
+		c = newCleaner(storeOf, o.logger, o.asyncCleanup)
+	}
 	return ExecutionCoordinator{
 		subTxDefinitions: make(subTxDefinitions),
+		subTxVersions:    make(subTxVersions),
 		paramTypeRegister: &paramTypeRegister{
 			nameToType: make(map[string]reflect.Type),
 			typeToName: make(map[reflect.Type]string),
 		},
+		plans:     make(map[planKey]*stepPlan),
 		store:     store,
+		storeOf:   storeOf,
 		logPrefix: logPrefix,
+		opts:      o,
+		admission: newAdmission(o.maxInFlight, o.maxInFlightWait),
+		confirms:  &confirmWaiters{waiters: make(map[string]chan error)},
+		stats:     &Stats{},
+		cleaner:   c,
+		labels:    &labelRegistry{sets: make(map[string]*labelSet)},
+		bound:     &boundRegistry{bound: make(map[string]map[int64]boundResource)},
+
+		sharedResources: make(map[string]func(ctx context.Context, resourceID string) error),
 	}
 }
 
@@ -43,18 +93,186 @@ func NewSEC(store storage.Storage, logPrefix string) ExecutionCoordinator {
 //
 // subTxID identifies a sub-transaction type, it also be use to persist into saga-log and be lookup for retry
 // action defines the action that sub-transaction will execute.
-// compensate defines the compensate that sub-transaction will execute when sage aborted.
+// compensate defines the compensate that sub-transaction will execute when sage aborted,
+// it can be a SubTxRef to compensate by action of another registered sub-transaction.
 //
 // action and compensate MUST a function that context.Context as first argument.
-func (e *ExecutionCoordinator) AddSubTxDef(subTxID string, action interface{}, compensate interface{}) *ExecutionCoordinator {
+// opts customizes the sub-transaction, e.g. ManualCompensate.
+//
+// It panics if the definition is invalid, e.g. compensate can't accept the arguments of action.
+// A duplicate subTxID never overwrites the existing definition: it panics in strict mode,
+// otherwise it is logged and ignored. Use AddSubTxDefE to handle these as an error, or UpdateSubTxDef to replace it.
+func (e *ExecutionCoordinator) AddSubTxDef(subTxID string, action interface{}, compensate interface{}, opts ...SubTxOption) *ExecutionCoordinator {
+	e.checkAddSubTxDef(e.AddSubTxDefE(subTxID, action, compensate, opts...))
+	return e
+}
+
+// AddSubTxDefVersion likes AddSubTxDef, but registers given version of the sub-transaction.
+// ExecSub always runs the highest registered version and records it in the ActionEnd log,
+// Abort compensates with the compensate of the version recorded, so in-flight sagas started under
+// old logic keep compensating with the old compensate during rolling deploys.
+// AddSubTxDef registers version 0.
+func (e *ExecutionCoordinator) AddSubTxDefVersion(subTxID string, version int, action interface{}, compensate interface{}, opts ...SubTxOption) *ExecutionCoordinator {
+	e.checkAddSubTxDef(e.addSubTxDef(subTxID, version, action, compensate, opts...))
+	return e
+}
+
+func (e *ExecutionCoordinator) checkAddSubTxDef(err error) {
+	if err == nil {
+		return
+	}
+	if e.opts.strict || !stderrors.Is(err, ErrDuplicateSubTx) {
+		panic(err)
+	}
+	e.opts.logger.Printf("[WARNING]AddSubTxDef ignored: %v", err)
+}
+
+// AddSubTxDefE likes AddSubTxDef, but returns ErrDuplicateSubTx instead of overwriting
+// when subTxID has already been registered, and ErrInvalidSubTx naming the offending func
+// when action or compensate doesn't take context.Context as first argument,
+// or compensate can't accept the arguments recorded for action.
+func (e *ExecutionCoordinator) AddSubTxDefE(subTxID string, action interface{}, compensate interface{}, opts ...SubTxOption) error {
+	return e.addSubTxDef(subTxID, 0, action, compensate, opts...)
+}
+
+// UpdateSubTxDef replaces definition of subTxID at runtime, e.g. on hot reconfiguration, by registering it as
+// the version next to the highest registered, it returns the version registered. Sagas running ExecSub afterwards
+// run the new action, while the replaced versions are kept, so sagas which already logged them are still
+// compensated and recovered with their own compensate, see AddSubTxDefVersion. An unregistered subTxID is added
+// as version 0. The definition is validated like AddSubTxDefE and swapped in under a single lock,
+// so concurrent StartSaga and ExecSub observe either the old or the new definition.
+func (e *ExecutionCoordinator) UpdateSubTxDef(subTxID string, action interface{}, compensate interface{}, opts ...SubTxOption) (int, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	version := 0
+	if latest, ok := e.subTxDefinitions.findDefinition(subTxID); ok {
+		version = latest.version + 1
+	}
+	if err := e.addSubTxDefLocked(subTxID, version, action, compensate, opts...); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func (e *ExecutionCoordinator) addSubTxDef(subTxID string, version int, action interface{}, compensate interface{}, opts ...SubTxOption) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.addSubTxDefLocked(subTxID, version, action, compensate, opts...)
+}
+
+// addSubTxDefLocked registers definition, it must be called with e.mu held.
+func (e *ExecutionCoordinator) addSubTxDefLocked(subTxID string, version int, action interface{}, compensate interface{}, opts ...SubTxOption) error {
+	if _, ok := e.subTxVersions.find(subTxID, version); ok {
+		if version == 0 {
+			return fmt.Errorf("subTxID %s: %w", subTxID, ErrDuplicateSubTx)
+		}
+		return fmt.Errorf("subTxID %s version %d: %w", subTxID, version, ErrDuplicateSubTx)
+	}
+	actionMethod, err := validateSubTxFunc(subTxID, "action", action)
+	if err != nil {
+		return err
+	}
+	ref, isRef := compensate.(SubTxRef)
+	if isRef {
+		refDef, ok := e.subTxDefinitions.findDefinition(string(ref))
+		if !ok {
+			return fmt.Errorf("subTxID %s: %w: compensate references unknown sub-transaction %s", subTxID, ErrInvalidSubTx, ref)
+		}
+		compensate = refDef.action.Interface()
+	}
+	compensateMethod, err := validateSubTxFunc(subTxID, "compensate", compensate)
+	if err != nil {
+		return err
+	}
+	def := newSubTxDefinition(subTxID, action, compensate, opts...)
+	if def.compensatePayload {
+		err = validateCompensatePayload(def)
+	} else {
+		err = validateCompensate(subTxID, actionMethod, compensateMethod)
+	}
+	if err != nil {
+		return err
+	}
 	e.paramTypeRegister.addParams(action)
 	e.paramTypeRegister.addParams(compensate)
-	e.subTxDefinitions.addDefinition(subTxID, action, compensate)
+	def.version = version
+	if isRef {
+		def.compensateRef = string(ref)
+	}
+	if err := validateSecretArgs(def); err != nil {
+		return err
+	}
+	if err := validatePartialCompensate(def); err != nil {
+		return err
+	}
+	if err := validateVerifier(def); err != nil {
+		return err
+	}
+	e.subTxVersions.add(def)
+	if latest, ok := e.subTxDefinitions.findDefinition(subTxID); !ok || latest.version < version {
+		e.subTxDefinitions[subTxID] = def
+	}
+	e.resetPlans()
+	return nil
+}
+
+// AddArgProvider registers provider of an ambient argument type(e.g. tenant ID, request ID), and return current SEC.
+// When ExecSub is given fewer arguments than action needs, arguments of type typ are injected
+// by calling provider with saga context, so callers don't pass it every time.
+// Injected arguments are persisted like others, so compensate receives the same value.
+func (e *ExecutionCoordinator) AddArgProvider(typ reflect.Type, provider func(ctx context.Context) interface{}) *ExecutionCoordinator {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.paramTypeRegister.addProvider(typ, provider)
+	e.resetPlans()
 	return e
 }
 
+// VerifyDefinitions checks every param type of registered actions and compensates of all versions resolves in the param type register
+// in both directions and can be persisted, so misconfiguration is caught at boot rather than by MarshalParam
+// after an action's side effect. It returns the first problem found, wrapping ErrInvalidSubTx.
+func (e *ExecutionCoordinator) VerifyDefinitions() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	subTxIDs := make([]string, 0, len(e.subTxVersions))
+	for subTxID := range e.subTxVersions {
+		subTxIDs = append(subTxIDs, subTxID)
+	}
+	sort.Strings(subTxIDs)
+	for _, subTxID := range subTxIDs {
+		// old versions are still used to compensate in-flight sagas
+		for _, def := range e.subTxVersions[subTxID] {
+			if err := e.verifyParams(subTxID, "action", def.action); err != nil {
+				return err
+			}
+			if err := e.verifyParams(subTxID, "compensate", def.compensate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *ExecutionCoordinator) verifyParams(subTxID, role string, fn reflect.Value) error {
+	funcType := fn.Type()
+	for i := 1; i < funcType.NumIn(); i++ {
+		typ := funcType.In(i)
+		switch typ.Kind() {
+		case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			return fmt.Errorf("subTxID %s: %w: %s param %d type %s can't be persisted", subTxID, ErrInvalidSubTx, role, i, typ)
+		}
+		name, ok := e.paramTypeRegister.findTypeName(typ)
+		if !ok {
+			return fmt.Errorf("subTxID %s: %w: %s param %d type %s isn't registered", subTxID, ErrInvalidSubTx, role, i, typ)
+		}
+		if resolved, ok := e.paramTypeRegister.findType(name); !ok || resolved != typ {
+			return fmt.Errorf("subTxID %s: %w: %s param %d type name %s resolves to %v instead of %s",
+				subTxID, ErrInvalidSubTx, role, i, name, resolved, typ)
+		}
+	}
+	return nil
+}
+
 // MustFindSubTxDef returns sub transaction definition by given subTxID.
 // Panic if not found sub-transaction.
 func (e *ExecutionCoordinator) MustFindSubTxDef(subTxID string) subTxDefinition {
@@ -67,6 +285,33 @@ func (e *ExecutionCoordinator) MustFindSubTxDef(subTxID string) subTxDefinition
 	return define
 }
 
+// mustFindSubTxDefVersion returns given version of sub transaction definition, the one recorded in saga log.
+// Panic if not found.
+func (e *ExecutionCoordinator) mustFindSubTxDefVersion(subTxID string, version int) subTxDefinition {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	define, ok := e.subTxVersions.find(subTxID, version)
+	if !ok {
+		panic(fmt.Sprintf("SubTxID: %s version %d not found in context", subTxID, version))
+	}
+	return define
+}
+
+// compensateOf returns compensate of def, a SubTxRef is resolved to action of the latest definition referenced,
+// or the one resolved at registration if the latest isn't arg-compatible any more.
+func (e *ExecutionCoordinator) compensateOf(def subTxDefinition) reflect.Value {
+	if def.compensateRef == "" {
+		return def.compensate
+	}
+	e.mu.RLock()
+	refDef, ok := e.subTxDefinitions.findDefinition(def.compensateRef)
+	e.mu.RUnlock()
+	if !ok || validateCompensate(def.subTxID, def.action, refDef.action) != nil {
+		return def.compensate
+	}
+	return refDef.action
+}
+
 // MustFindParamName return param name by given reflect type.
 // Panic if param name not found.
 func (e *ExecutionCoordinator) MustFindParamName(typ reflect.Type) string {
@@ -91,31 +336,138 @@ func (e *ExecutionCoordinator) MustFindParamType(name string) reflect.Type {
 	return typ
 }
 
+// StartCoordinator scans stored sagas at startup. Storage calls of the scan are retried by WithScanRetry,
+// a saga whose last log still can't be read is skipped, and reported by *ScanError once the others are scanned.
 func (e *ExecutionCoordinator) StartCoordinator() error {
-	logIDs, err := e.store.LogIDs()
+	var logIDs []string
+	err := e.retryScan(func() (err error) {
+		logIDs, err = e.logIDs()
+		return err
+	})
 	if err != nil {
 		return errors.Annotate(err, "Fetch logs failure")
 	}
+	failed := make(map[string]error)
 	for _, logID := range logIDs {
-		lastLogData, err := e.store.LastLog(logID)
+		err := e.retryScan(func() error {
+			_, err := e.storeOf(logID).LastLog(logID)
+			return err
+		})
 		if err != nil {
-			return errors.Annotate(err, "Fetch last log panic")
+			e.opts.logger.Printf("[WARNING]Fetch last log of %s failure: %v", logID, err)
+			failed[logID] = err
 		}
-		fmt.Println(lastLogData)
+	}
+	if len(failed) > 0 {
+		return &ScanError{Failed: failed}
 	}
 	return nil
 }
 
+// retryScan calls fn until it succeeds or attempts of WithScanRetry are used up.
+func (e *ExecutionCoordinator) retryScan(fn func() error) error {
+	policy := e.opts.scanRetry
+	var delay time.Duration
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || i >= policy.attempts() {
+			return err
+		}
+		delay = policy.Backoff.Delay(i, delay)
+		time.Sleep(delay)
+	}
+}
+
 // StartSaga start a new saga, returns the saga was started.
 // This method need execute context and UNIQUE id to identify saga instance.
+// It panics if the saga can't be started, use StartSagaE to handle the error instead.
 func (e *ExecutionCoordinator) StartSaga(ctx context.Context, id string) *Saga {
-	s := &Saga{
+	s, err := e.StartSagaE(ctx, id)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// StartSagaE likes StartSaga, but returns error instead of panic when the saga can't be started,
+// e.g. a *StoreError when log storage is unreachable, so callers can reject the request gracefully.
+// With WithMaxInFlight set, it returns ErrTooManySagas if no saga ends in time.
+// It returns ErrMaintenanceMode after EnterMaintenanceMode.
+// With WithIdempotentStart, it returns the running saga of id, or ErrSagaExists if its log exists in storage.
+func (e *ExecutionCoordinator) StartSagaE(ctx context.Context, id string) (s *Saga, err error) {
+	if e.opts.idempotentStart {
+		if existing := e.admission.find(e.logIDOf(id)); existing != nil {
+			return existing, nil
+		}
+	}
+	if err := e.admission.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("StartSaga %s: %w", id, err)
+	}
+	defer func() {
+		if s == nil {
+			e.admission.releaseSlot()
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			s, err = nil, fmt.Errorf("StartSaga %s: %v", id, r)
+		}
+	}()
+	if e.opts.onStart != nil {
+		if ctx, err = e.opts.onStart(ctx); err != nil {
+			return nil, errors.Annotatef(err, "StartSaga %s OnStart hook", id)
+		}
+	}
+	logID := e.logIDOf(id)
+	if e.opts.logIDFunc != nil && !strings.HasPrefix(logID, e.logPrefix) {
+		return nil, fmt.Errorf("StartSaga %s: logID %s doesn't start with prefix %s", id, logID, e.logPrefix)
+	}
+	for !e.admission.claim(logID) {
+		if !e.opts.idempotentStart {
+			return nil, fmt.Errorf("StartSaga %s: %w", id, ErrSagaExists)
+		}
+		// raced with a concurrent StartSaga of the same id, claim again if it failed
+		if existing := e.admission.find(logID); existing != nil {
+			e.admission.releaseSlot()
+			return existing, nil
+		}
+	}
+	var started *Saga
+	defer func() {
+		e.admission.finishStart(logID, started)
+	}()
+	s = &Saga{
 		id:      id,
-		context: ctx,
 		sec:     e,
-		logID:   LogPrefix + id,
-		store:   e.store,
+		logID:   logID,
+		store:   e.storeOf(logID),
+		state:   newState(),
+		sampled: e.sample(),
+
+		correlationID: CorrelationID(ctx),
+		sem:           e.concurrencyLimit(ctx),
+		tags:          Tags(ctx),
+		depth:         CompensationDepth(ctx),
 	}
-	s.startSaga()
-	return s
+	s.labels = e.labelsOf(s.tags)
+	s.priority = e.priorityOf(s.tags)
+	ctx = context.WithValue(ctx, sampledCtxKey{}, s.sampled)
+	if e.opts.idempotentStart {
+		last, err := s.store.LastLog(logID)
+		if err != nil {
+			return nil, errors.Annotatef(err, "StartSaga %s LastLog", id)
+		}
+		if last != "" {
+			return nil, fmt.Errorf("StartSaga %s: %w", id, ErrSagaExists)
+		}
+	}
+	s.context, s.span = s.startSpan(ctx, "saga "+id)
+	if err := s.startSaga(); err != nil {
+		s.span.End(err)
+		return nil, err
+	}
+	s.startHeartbeat()
+	s.count(statSagasStarted)
+	started = s
+	return s, nil
 }
@@ -0,0 +1,424 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSEC(t *testing.T, opts ...Option) *ExecutionCoordinator {
+	store, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	sec := NewSEC(store, LogPrefix, opts...)
+	return &sec
+}
+
+func TestAddSubTxDefDuplicate(t *testing.T) {
+	sec := newTestSEC(t)
+	assert.NoError(t, sec.AddSubTxDefE("A1", T1, C1))
+	err := sec.AddSubTxDefE("A1", T2, C2)
+	assert.True(t, errors.Is(err, ErrDuplicateSubTx))
+
+	// non-strict mode keeps the first definition
+	sec.AddSubTxDef("A1", T2, C2)
+	def := sec.MustFindSubTxDef("A1")
+	assert.Equal(t, "A1", def.subTxID)
+}
+
+func TestAddSubTxDefStrict(t *testing.T) {
+	sec := newTestSEC(t, WithStrictMode())
+	sec.AddSubTxDef("A1", T1, C1)
+	assert.Panics(t, func() {
+		sec.AddSubTxDef("A1", T2, C2)
+	})
+}
+
+func TestAddSubTxDefCompensateMismatch(t *testing.T) {
+	sec := newTestSEC(t)
+	acc := &account{}
+	err := sec.AddSubTxDefE("deduce", acc.deduce, func(ctx context.Context, name string) error { return nil })
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+	assert.EqualError(t, err, "subTxID deduce: invalid sub-transaction definition: compensate takes 1 arguments after context, action records 2")
+
+	err = sec.AddSubTxDefE("deduce", acc.deduce, func(ctx context.Context, name string, amount int64) error { return nil })
+	assert.EqualError(t, err, "subTxID deduce: invalid sub-transaction definition: compensate argument 2 has type int64, not assignable from action argument type int")
+
+	assert.Panics(t, func() {
+		sec.AddSubTxDef("deduce", acc.deduce, C1)
+	})
+	_, ok := sec.subTxDefinitions.findDefinition("deduce")
+	assert.False(t, ok)
+}
+
+func TestMaxInFlight(t *testing.T) {
+	sec := newTestSEC(t, WithMaxInFlight(1, 50*time.Millisecond))
+	s := sec.StartSaga(context.Background(), "inflight1")
+	assert.Equal(t, 1, sec.InFlight())
+
+	_, err := sec.StartSagaE(context.Background(), "inflight2")
+	assert.True(t, errors.Is(err, ErrTooManySagas))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.EndSaga()
+	}()
+	s2, err := sec.StartSagaE(context.Background(), "inflight2")
+	assert.NoError(t, err)
+	assert.NoError(t, s2.EndSaga())
+	assert.Equal(t, 0, sec.InFlight())
+}
+
+func TestIdempotentStart(t *testing.T) {
+	store, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	sec := NewSEC(store, LogPrefix, WithIdempotentStart(), WithMaxInFlight(1, 0))
+	s := sec.StartSaga(context.Background(), "idem1")
+	again, err := sec.StartSagaE(context.Background(), "idem1")
+	assert.NoError(t, err)
+	assert.True(t, s == again)
+	assert.Equal(t, 1, sec.InFlight())
+
+	// the log written by another coordinator
+	other := NewSEC(store, LogPrefix, WithIdempotentStart())
+	_, err = other.StartSagaE(context.Background(), "idem1")
+	assert.True(t, errors.Is(err, ErrSagaExists))
+	assert.Equal(t, 0, other.InFlight())
+
+	assert.NoError(t, s.EndSaga())
+	s2, err := other.StartSagaE(context.Background(), "idem1")
+	assert.NoError(t, err)
+	assert.False(t, s == s2)
+	assert.NoError(t, s2.EndSaga())
+
+	// concurrent starts get the same saga, only once it's started
+	sec = NewSEC(store, LogPrefix, WithIdempotentStart())
+	sagas := make([]*Saga, 5)
+	var wg sync.WaitGroup
+	for i := range sagas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := sec.StartSagaE(context.Background(), "idem2")
+			if assert.NoError(t, err) {
+				last, err := store.LastLog(s.logID)
+				assert.NoError(t, err)
+				assert.NotEmpty(t, last)
+			}
+			sagas[i] = s
+		}(i)
+	}
+	wg.Wait()
+	for _, s := range sagas {
+		assert.True(t, s == sagas[0])
+	}
+	assert.Equal(t, 1, sec.InFlight())
+	assert.NoError(t, sagas[0].EndSaga())
+}
+
+func TestStartSagaDuplicate(t *testing.T) {
+	sec := newTestSEC(t)
+	s := sec.StartSaga(context.Background(), "dup")
+	_, err := sec.StartSagaE(context.Background(), "dup")
+	assert.True(t, errors.Is(err, ErrSagaExists))
+	assert.Equal(t, 1, sec.InFlight())
+	// the rejected start leaves the running saga tracked
+	assert.True(t, sec.admission.find(s.logID) == s)
+
+	assert.NoError(t, s.EndSaga())
+	assert.Nil(t, sec.admission.find(s.logID))
+	s, err = sec.StartSagaE(context.Background(), "dup")
+	assert.NoError(t, err)
+	assert.NoError(t, s.EndSaga())
+}
+
+func TestVerifyDefinitions(t *testing.T) {
+	sec := newTestSEC(t)
+	acc := &account{balance: map[string]int{}}
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+	assert.NoError(t, sec.VerifyDefinitions())
+
+	// same type name registered by another type, e.g. proto1.Request and proto2.Request
+	type string2 string
+	sec.paramTypeRegister.nameToType["string"] = reflect.TypeOf(string2(""))
+	err := sec.VerifyDefinitions()
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+	assert.Contains(t, err.Error(), "resolves to")
+
+	delete(sec.paramTypeRegister.typeToName, reflect.TypeOf(0))
+	err = sec.VerifyDefinitions()
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+
+	sec = newTestSEC(t)
+	sec.AddSubTxDef("callback", func(ctx context.Context, f func()) error { return nil }, func(ctx context.Context, f func()) error { return nil })
+	assert.True(t, errors.Is(sec.VerifyDefinitions(), ErrInvalidSubTx))
+}
+
+func TestAddSubTxDefVersion(t *testing.T) {
+	var compensated []string
+	compensateV := func(version string) func(ctx context.Context, name string) error {
+		return func(ctx context.Context, name string) error {
+			compensated = append(compensated, version)
+			return nil
+		}
+	}
+	action := func(ctx context.Context, name string) error {
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDefVersion("reserve", 1, action, compensateV("v1")).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "versioned")
+	s.ExecSub("reserve", "foo")
+	// rolling deploy registers v2 while the saga is in flight
+	sec.AddSubTxDefVersion("reserve", 2, action, compensateV("v2"))
+	s2 := sec.StartSaga(context.Background(), "versioned2")
+	s2.ExecSub("reserve", "foo")
+
+	s.ExecSub("fail")
+	s2.ExecSub("fail")
+	assert.Equal(t, []string{"v1", "v2"}, compensated)
+	assert.Equal(t, 2, sec.MustFindSubTxDef("reserve").version)
+
+	err := sec.addSubTxDef("reserve", 2, action, compensateV("v2"))
+	assert.True(t, errors.Is(err, ErrDuplicateSubTx))
+	// registering an older version later doesn't replace the latest
+	sec.AddSubTxDef("reserve", action, compensateV("v0"))
+	assert.Equal(t, 2, sec.MustFindSubTxDef("reserve").version)
+	assert.NoError(t, sec.VerifyDefinitions())
+}
+
+func TestUpdateSubTxDef(t *testing.T) {
+	var mu sync.Mutex
+	var compensated []string
+	compensateV := func(version string) func(ctx context.Context, name string) error {
+		return func(ctx context.Context, name string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			compensated = append(compensated, version)
+			return nil
+		}
+	}
+	action := func(ctx context.Context, name string) error {
+		return nil
+	}
+	sec := newTestSEC(t)
+	version, err := sec.UpdateSubTxDef("reserve", action, compensateV("v0"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+	sec.AddSubTxDef("fail", failAction, failCompensate)
+
+	// in flight when the process crashes
+	s := sec.StartSaga(context.Background(), "reloaded")
+	s.ExecSub("reserve", "foo")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := sec.StartSaga(context.Background(), "concurrent"+strconv.Itoa(i))
+			s.ExecSub("reserve", "foo")
+			assert.NoError(t, s.EndSaga())
+		}(i)
+	}
+	version, err = sec.UpdateSubTxDef("reserve", action, compensateV("v1"))
+	wg.Wait()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	assert.Equal(t, 1, sec.MustFindSubTxDef("reserve").version)
+
+	s2 := sec.StartSaga(context.Background(), "reloaded2")
+	s2.ExecSub("reserve", "foo").ExecSub("fail")
+	assert.Equal(t, []string{"v1"}, compensated)
+	ok, err := sec.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"v1", "v0"}, compensated)
+
+	// an invalid definition keeps the current one
+	_, err = sec.UpdateSubTxDef("reserve", action, func(ctx context.Context) error { return nil })
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+	assert.Equal(t, 1, sec.MustFindSubTxDef("reserve").version)
+}
+
+func TestStepPlanCache(t *testing.T) {
+	var ran []string
+	actionV := func(version string) func(ctx context.Context, name string) error {
+		return func(ctx context.Context, name string) error {
+			ran = append(ran, version)
+			return nil
+		}
+	}
+	compensate := func(ctx context.Context, name string) error {
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("reserve", actionV("v0"), compensate)
+	for _, id := range []string{"plan0", "plan1"} {
+		assert.NoError(t, sec.StartSaga(context.Background(), id).ExecSub("reserve", "foo").EndSaga())
+	}
+	if assert.Len(t, sec.plans, 1) {
+		for key, plan := range sec.plans {
+			assert.Equal(t, "reserve", key.subTxID)
+			assert.Equal(t, []string{"string"}, plan.typeNames)
+		}
+	}
+
+	// a newer version drops cached plans, so sagas run it rather than the cached one
+	sec.AddSubTxDefVersion("reserve", 1, actionV("v1"), compensate)
+	assert.Empty(t, sec.plans)
+	assert.NoError(t, sec.StartSaga(context.Background(), "plan2").ExecSub("reserve", "foo").EndSaga())
+	assert.Equal(t, []string{"v0", "v0", "v1"}, ran)
+}
+
+func TestLogIDFunc(t *testing.T) {
+	sec := newTestSEC(t, WithLogIDFunc(func(id string) string {
+		return LogPrefix + "{tenant1}" + id
+	}))
+	s, err := sec.StartSagaE(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "saga{tenant1}1", s.logID)
+	logIDs, err := sec.store.LogIDs()
+	assert.NoError(t, err)
+	assert.Contains(t, logIDs, s.logID)
+	// recovery maps logID back to id by SagaStart log
+	assert.Equal(t, "1", sec.recoverSaga(s.logID, nil).id)
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, "2", newTestSEC(t).recoverSaga(LogPrefix+"2", nil).id)
+
+	sec = newTestSEC(t, WithLogIDFunc(func(id string) string {
+		return "other" + id
+	}))
+	_, err = sec.StartSagaE(context.Background(), "1")
+	assert.Error(t, err)
+	assert.Equal(t, 0, sec.InFlight())
+}
+
+func TestListSagasByTimeRange(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+
+	// a dead-lettered saga shares the prefix with dead-letter list
+	flaky := &flakyCompensate{failures: 10}
+	sec.AddSubTxDef("flaky", flaky.action, flaky.compensate)
+	dead := sec.StartSaga(context.Background(), "dead")
+	assert.Error(t, dead.ExecSub("flaky", "foo").ExecSub("deposit", "foo", 1).EndSaga())
+	time.Sleep(2 * time.Millisecond)
+	from := time.Now()
+	running := sec.StartSaga(context.Background(), "running")
+	running.ExecSub("deduce", "foo", 1)
+	to := time.Now()
+	later := sec.StartSaga(context.Background(), "later")
+
+	logIDs, err := sec.ListSagasByTimeRange(from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{running.logID}, logIDs)
+	logIDs, err = sec.ListSagasByTimeRange(from.Add(-time.Hour), time.Now())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{dead.logID, running.logID, later.logID}, logIDs)
+}
+
+func TestStorageSelector(t *testing.T) {
+	durable, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	ephemeral, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	selector := func(logID string) storage.Storage {
+		if strings.HasPrefix(logID, LogPrefix+"vip") {
+			return durable
+		}
+		return nil
+	}
+	acc := &account{balance: map[string]int{"foo": 100}}
+	flaky := &flakyCompensate{failures: 10}
+	sec := NewSEC(ephemeral, LogPrefix, WithStorageSelector(selector, durable))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("flaky", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	vip := sec.StartSaga(context.Background(), "vip")
+	vip.ExecSub("deduce", "foo", 10)
+	other := sec.StartSaga(context.Background(), "other")
+	other.ExecSub("deduce", "foo", 1)
+	logs, err := durable.Lookup(vip.logID)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 3)
+	logs, err = ephemeral.Lookup(vip.logID)
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+
+	logIDs, err := sec.ListSagasByTimeRange(time.Now().Add(-time.Hour), time.Now())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{vip.logID, other.logID}, logIDs)
+	replayed, err := sec.ReplayMany([]string{vip.logID, other.logID})
+	assert.NoError(t, err)
+	assert.Len(t, replayed, 2)
+
+	// dead-letter list stays in the storage given to NewSEC, recovery consults storage of the saga
+	assert.Error(t, vip.ExecSub("flaky", "foo").ExecSub("fail").EndSaga())
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{vip.logID}, failures)
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), vip.logID))
+	assert.Equal(t, 99, acc.balance["foo"])
+	logs, err = durable.Lookup(vip.logID)
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+	assert.NoError(t, other.EndSaga())
+}
+
+// flakyScanStore fails LogIDs the first failures calls, and LastLog of broken always.
+type flakyScanStore struct {
+	storage.Storage
+	failures int
+	broken   string
+}
+
+func (f *flakyScanStore) LogIDs() ([]string, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("connection reset")
+	}
+	return f.Storage.LogIDs()
+}
+
+func (f *flakyScanStore) LastLog(logID string) (string, error) {
+	if logID == f.broken {
+		return "", errors.New("connection reset")
+	}
+	return f.Storage.LastLog(logID)
+}
+
+func TestStartCoordinatorScanRetry(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	store := &flakyScanStore{Storage: mem}
+	sec := NewSEC(store, LogPrefix, WithScanRetry(RetryPolicy{MaxAttempts: 3}))
+	sec.StartSaga(context.Background(), "1")
+	sec.StartSaga(context.Background(), "2")
+
+	store.failures = 3
+	assert.Error(t, sec.StartCoordinator())
+
+	store.failures = 2
+	store.broken = LogPrefix + "1"
+	err = sec.StartCoordinator()
+	var scanErr *ScanError
+	if assert.True(t, errors.As(err, &scanErr)) {
+		assert.Len(t, scanErr.Failed, 1)
+		assert.Contains(t, scanErr.Failed, LogPrefix+"1")
+	}
+	assert.Equal(t, 0, store.failures)
+}
@@ -0,0 +1,184 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DanglingPolicy decides how RepairDangling resolves an ActionStart left without ActionEnd by a crash,
+// when it's unknown whether the action ran.
+type DanglingPolicy int
+
+const (
+	// DanglingManual requires human intervention, the saga is dead-lettered with high priority(see ListCompensateAlerts)
+	DanglingManual DanglingPolicy = iota
+	// DanglingCompensate assumes the action ran, so it's compensated, compensate must tolerate an action never ran.
+	// Compensation resumed by the watchdog, RetryCompensateFailure or EnterMaintenanceMode applies it too
+	DanglingCompensate
+	// DanglingRetry assumes the action didn't run and retries it to get a definite result, action must be idempotent
+	DanglingRetry
+)
+
+// OnDangling sets how RepairDangling resolves dangling ActionStart of the sub-transaction, default is DanglingManual.
+func OnDangling(policy DanglingPolicy) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.dangling = policy
+	}
+}
+
+// danglingActions returns ActionStart logs without ActionEnd, which are left by a crash during action.
+// ActionEnd is paired with its ActionStart by Started, or with the earliest open one of the sub-transaction
+// if it's written by older versions without Started, like compactLogs does.
+// ActionStart of a failed action is followed by SagaAbort, so it's not dangling.
+func danglingActions(logs []Log) []Log {
+	var open []Log
+	for _, log := range logs {
+		switch log.Type {
+		case ActionStart:
+			open = append(open, log)
+		case ActionEnd:
+			for i, start := range open {
+				if start.SubTxID == log.SubTxID && (log.Started == 0 || start.Time.UnixNano() == log.Started) {
+					open = append(open[:i], open[i+1:]...)
+					break
+				}
+			}
+		case SagaAbort, SagaEnd:
+			open = nil
+		}
+	}
+	return open
+}
+
+// RepairDangling resolves dangling ActionStart entries of the saga by policy of each sub-transaction(see OnDangling),
+// it's meant for sagas whose process crashed during an action. Since the remaining steps lived in the crashed caller,
+// the saga is rolled back once no dangling entries are left: actions assumed ran or retried successfully are compensated
+// with the others. It returns the number of dangling entries found, and ErrDanglingAction if any requires manual repair.
+// Policy is the one of the sub-transaction version that logged ActionStart. A saga still running in the coordinator
+// isn't repaired, it fails with ErrSagaRunning.
+func (e *ExecutionCoordinator) RepairDangling(ctx context.Context, logID string) (int, error) {
+	if e.admission.isLive(logID) {
+		return 0, fmt.Errorf("RepairDangling %s: %w", logID, ErrSagaRunning)
+	}
+	data, err := e.storeOf(logID).Lookup(logID)
+	if err != nil {
+		return 0, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	logs := unmarshalLogs(data)
+	dangling := danglingActions(logs)
+	if len(dangling) == 0 {
+		return 0, nil
+	}
+	s := e.recoverSaga(logID, logs)
+	s.correlationID = correlationIDOf(logs)
+	for _, start := range dangling {
+		if e.mustFindSubTxDefVersion(start.SubTxID, start.Version).dangling == DanglingManual {
+			s.alertCompensateFailure(start.SubTxID, ErrDanglingAction)
+			return len(dangling), fmt.Errorf("%s %s: %w", logID, start.SubTxID, ErrDanglingAction)
+		}
+	}
+	for _, start := range dangling {
+		if err := s.repairDangling(ctx, start); err != nil {
+			s.err = err
+		}
+	}
+	if s.err == nil {
+		s.err = fmt.Errorf("saga %s repaired after its process exited", logID)
+	}
+	s.Abort()
+	s.EndSaga()
+	if s.compensateFail {
+		return len(dangling), fmt.Errorf("%s: %w", logID, ErrCompensateFailed)
+	}
+	return len(dangling), nil
+}
+
+// repairDangling logs ActionEnd for dangling action assumed ran or retried successfully.
+func (s *Saga) repairDangling(ctx context.Context, start Log) error {
+	def := s.sec.mustFindSubTxDefVersion(start.SubTxID, start.Version)
+	if def.dangling == DanglingRetry {
+		values := UnmarshalParam(s.sec, start.Params)
+		if err := s.revealArgs(ctx, def, start.Params, values); err != nil {
+			return err
+		}
+		args := make([]interface{}, len(values))
+		for i, value := range values {
+			args[i] = value.Interface()
+		}
+		opts := ExecSubOptions{IdempotencyKey: start.IdempotencyKey}
+		if err := s.callAction(ctx, def, opts, args); err != nil {
+			// it's definite the action failed, nothing to compensate
+			return err
+		}
+	}
+	s.assumeRan(start, "RepairDangling")
+	return nil
+}
+
+// assumeRan logs ActionEnd for dangling action with args persisted by its ActionStart, so it's compensated.
+func (s *Saga) assumeRan(start Log, op string) Log {
+	end := assumedEnd(start)
+	s.mustAppendLog(&end, op)
+	return end
+}
+
+// assumedEnd returns ActionEnd log of action started by ActionStart log start, with args persisted by start.
+func assumedEnd(start Log) Log {
+	return Log{
+		Type:           ActionEnd,
+		SubTxID:        start.SubTxID,
+		Time:           time.Now(),
+		Params:         start.Params,
+		Started:        start.Time.UnixNano(),
+		IdempotencyKey: start.IdempotencyKey,
+		Version:        start.Version,
+	}
+}
+
+// deferActionEnd keeps ActionEnd of action started by ActionStart log start, which succeeded but whose ActionEnd
+// failed to be logged, for Abort to log it before SagaAbort, so the action is compensated like one assumed ran.
+// payloadLost is set if the ActionEnd failed since its compensation payload couldn't be serialized.
+func (s *Saga) deferActionEnd(start Log, group int, payloadLost bool) {
+	end := assumedEnd(start)
+	end.Group = group
+	end.PayloadLost = payloadLost
+	s.mu.Lock()
+	s.unlogged = append(s.unlogged, end)
+	s.mu.Unlock()
+}
+
+// logDeferredActionEnds logs ActionEnd kept by deferActionEnd and returns them. If logging fails again, it panics
+// like Abort does on storage failure, and the actions are left dangling for RepairDangling.
+func (s *Saga) logDeferredActionEnds() []Log {
+	s.mu.Lock()
+	unlogged := s.unlogged
+	s.unlogged = nil
+	s.mu.Unlock()
+	for i := range unlogged {
+		s.mustAppendLog(&unlogged[i], "Abort")
+	}
+	return unlogged
+}
+
+// compensateDangling makes resumed compensation cover dangling actions of sub-transactions declared by
+// OnDangling(DanglingCompensate): the action may have done its side effect before the crash lost its ActionEnd,
+// so ActionEnd is logged from args persisted by ActionStart and returned appended to logs.
+// Dangling actions of other policies are left to RepairDangling, as well as the ones whose ActionStart
+// was written by older versions without args.
+func (s *Saga) compensateDangling(logs []Log) []Log {
+	for _, start := range danglingActions(logs) {
+		def := s.sec.mustFindSubTxDefVersion(start.SubTxID, start.Version)
+		if def.dangling != DanglingCompensate {
+			continue
+		}
+		if len(start.Params) == 0 && def.action.Type().NumIn() > 1 {
+			s.sec.opts.logger.Printf("[WARNING]Dangling %s of %s has no args persisted, left to RepairDangling", start.SubTxID, s.logID)
+			continue
+		}
+		logs = append(logs, s.assumeRan(start, "compensateDangling"))
+	}
+	return logs
+}
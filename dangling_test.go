@@ -0,0 +1,215 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// crashDuringAction leaves saga with a completed deduce and a dangling charge like a crash during charge.
+func crashDuringAction(t *testing.T, sec *ExecutionCoordinator, id string) *Saga {
+	s := sec.StartSaga(context.Background(), id)
+	s.ExecSub("deduce", "foo", 10)
+	s.mustAppendLog(&Log{Type: ActionStart, SubTxID: "charge", Params: MarshalParam(sec, []interface{}{"foo", 20})}, "test")
+	// the crashed saga isn't running any more
+	sec.admission.release(s)
+	return s
+}
+
+func TestRepairDangling(t *testing.T) {
+	for _, c := range []struct {
+		policy        DanglingPolicy
+		chargeCalls   int
+		chargeRefunds int
+	}{
+		{policy: DanglingCompensate, chargeCalls: 0, chargeRefunds: 1},
+		{policy: DanglingRetry, chargeCalls: 1, chargeRefunds: 1},
+	} {
+		acc := &account{balance: map[string]int{"foo": 100}}
+		calls, refunds := 0, 0
+		sec := newTestSEC(t)
+		sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+			AddSubTxDef("charge", func(ctx context.Context, name string, amount int) error {
+				calls++
+				return nil
+			}, func(ctx context.Context, name string, amount int) error {
+				refunds++
+				return nil
+			}, OnDangling(c.policy))
+
+		s := crashDuringAction(t, sec, "dangling")
+		status, err := sec.Status(s.logID)
+		assert.NoError(t, err)
+		assert.Equal(t, SagaStatus{LogID: s.logID, Started: true, Completed: 1, Dangling: 1}, status)
+
+		n, err := sec.RepairDangling(context.Background(), s.logID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, c.chargeCalls, calls)
+		assert.Equal(t, c.chargeRefunds, refunds)
+		assert.Equal(t, 100, acc.balance["foo"])
+		logs, err := sec.store.Lookup(s.logID)
+		assert.NoError(t, err)
+		assert.Empty(t, logs)
+	}
+}
+
+func TestRepairDanglingManual(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("charge", acc.deduce, acc.deduceCompensate)
+
+	s := crashDuringAction(t, sec, "manual")
+	n, err := sec.RepairDangling(context.Background(), s.logID)
+	assert.Equal(t, 1, n)
+	assert.True(t, errors.Is(err, ErrDanglingAction))
+	alerts, err := sec.ListCompensateAlerts()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, alerts)
+	status, err := sec.Status(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, status.Dangling)
+
+	// failed action isn't dangling
+	s = sec.StartSaga(context.Background(), "failed")
+	sec.AddSubTxDef("fail", failAction, failCompensate)
+	s.ExecSub("fail")
+	status, err = sec.Status(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, status.Dangling)
+}
+
+func TestRepairDanglingRunning(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate, OnDangling(DanglingCompensate))
+
+	// action in progress of a running saga isn't dangling
+	s := sec.StartSaga(context.Background(), "running")
+	s.mustAppendLog(&Log{Type: ActionStart, SubTxID: "deduce", Params: MarshalParam(sec, []interface{}{"foo", 10})}, "test")
+	n, err := sec.RepairDangling(context.Background(), s.logID)
+	assert.Equal(t, 0, n)
+	assert.True(t, errors.Is(err, ErrSagaRunning))
+	logs, err := sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 2)
+}
+
+func TestRepairDanglingVersion(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	refunds := 0
+	refund := func(ctx context.Context, name string, amount int) error {
+		refunds++
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDefVersion("charge", 1, acc.deduce, refund, OnDangling(DanglingCompensate)).
+		AddSubTxDefVersion("charge", 2, acc.deduce, refund)
+
+	// policy of the version logged applies, not the latest one requiring manual repair
+	s := sec.StartSaga(context.Background(), "versioned")
+	s.ExecSub("deduce", "foo", 10)
+	s.mustAppendLog(&Log{Type: ActionStart, SubTxID: "charge", Version: 1, Params: MarshalParam(sec, []interface{}{"foo", 20})}, "test")
+	sec.admission.release(s)
+	n, err := sec.RepairDangling(context.Background(), s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, refunds)
+	assert.Equal(t, 100, acc.balance["foo"])
+}
+
+func TestDanglingActionsPairedByStart(t *testing.T) {
+	first := time.Unix(1, 0)
+	second := first.Add(time.Millisecond)
+	logs := []Log{
+		{Type: SagaStart},
+		{Type: ActionStart, SubTxID: "charge", Time: first},
+		{Type: ActionStart, SubTxID: "charge", Time: second},
+		// the second one ended first
+		{Type: ActionEnd, SubTxID: "charge", Started: second.UnixNano()},
+	}
+	assert.Equal(t, []Log{logs[1]}, danglingActions(logs))
+
+	// ActionEnd without Started is paired with the earliest
+	logs[3].Started = 0
+	assert.Equal(t, []Log{logs[2]}, danglingActions(logs))
+}
+
+func TestCompensateSagasAtStep(t *testing.T) {
+	store, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	acc := &account{balance: map[string]int{"foo": 100}}
+	refunds := 0
+	newSEC := func() *ExecutionCoordinator {
+		// compensations share acc
+		sec := NewSEC(store, LogPrefix, WithRecoveryConcurrency(1))
+		sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+			AddSubTxDef("charge", func(ctx context.Context, name string, amount int) error {
+				return nil
+			}, func(ctx context.Context, name string, amount int) error {
+				refunds++
+				return nil
+			}, OnDangling(DanglingCompensate))
+		return &sec
+	}
+	crashed := newSEC()
+	atCharge1 := crashDuringAction(t, crashed, "atCharge1")
+	atCharge2 := crashDuringAction(t, crashed, "atCharge2")
+	atDeduce := crashed.StartSaga(context.Background(), "atDeduce")
+	atDeduce.mustAppendLog(&Log{Type: ActionStart, SubTxID: "deduce", Params: MarshalParam(crashed, []interface{}{"foo", 1})}, "test")
+
+	sec := newSEC()
+	logIDs, err := sec.ListSagasAtStep("charge")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{atCharge1.logID, atCharge2.logID}, logIDs)
+
+	compensated, failed, err := sec.CompensateSagasAtStep(context.Background(), "charge")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{atCharge1.logID, atCharge2.logID}, compensated)
+	assert.Empty(t, failed)
+	assert.Equal(t, 2, refunds)
+	assert.Equal(t, 100, acc.balance["foo"])
+
+	logIDs, err = sec.ListSagasAtStep("charge")
+	assert.NoError(t, err)
+	assert.Empty(t, logIDs)
+	logIDs, err = sec.ListSagasAtStep("deduce")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{atDeduce.logID}, logIDs)
+}
+
+func TestResumeCompensationCoversDangling(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	refunds := 0
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("charge", func(ctx context.Context, name string, amount int) error {
+			return nil
+		}, func(ctx context.Context, name string, amount int) error {
+			refunds += amount
+			return nil
+		}, OnDangling(DanglingCompensate))
+
+	s := crashDuringAction(t, sec, "crashed")
+	ok, err := sec.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 20, refunds)
+	assert.Equal(t, 100, acc.balance["foo"])
+
+	// dangling action of other policies is left to RepairDangling
+	sec.AddSubTxDef("manual", acc.deduce, acc.deduceCompensate)
+	s = sec.StartSaga(context.Background(), "manual")
+	s.ExecSub("deduce", "foo", 10)
+	s.mustAppendLog(&Log{Type: ActionStart, SubTxID: "manual", Params: MarshalParam(sec, []interface{}{"foo", 20})}, "test")
+	ok, err = sec.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 100, acc.balance["foo"])
+}
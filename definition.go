@@ -2,7 +2,9 @@ package saga
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"time"
 )
 
 type subTxDefinitions map[string]subTxDefinition
@@ -11,17 +13,157 @@ type subTxDefinition struct {
 	subTxID    string
 	action     reflect.Value
 	compensate reflect.Value
+
+	manualCompensate bool
+	timeout          time.Duration
+	retry            RetryPolicy
+	batcher          *compensateBatcher
+	async            bool
+	detached         bool
+	// compensateRetries is the number of in-process compensate retries after the first attempt
+	compensateRetries int
+	// version is given by AddSubTxDefVersion, zero if unversioned
+	version int
+	// secretArgs are positions of args redacted from log, see SecretArgs
+	secretArgs    map[int]bool
+	restoreSecret RestoreSecret
+	dangling      DanglingPolicy
+	// partialCompensate undoes action returned error, see PartialCompensate
+	partialCompensate reflect.Value
+	// transformArgs transforms args before they're persisted, see TransformArgs
+	transformArgs       ArgTransformer
+	transformActionArgs bool
+	// compensateRef is the sub-transaction whose action compensates, see SubTxRef
+	compensateRef string
+	// compensatePayload makes compensate take payload set by action, see CompensateWithPayload
+	compensatePayload bool
+	// idempotentCompensate skips the CompensateStart marker, see IdempotentCompensate
+	idempotentCompensate bool
+	// recordCompensateResult persists return values of compensate, see RecordCompensateResult
+	recordCompensateResult bool
+	// verifier checks compensate reverted the action, see VerifyCompensate
+	verifier reflect.Value
+	// requireBoundResource fails compensation without resource bound by action, see RequireBoundResource
+	requireBoundResource bool
+}
+
+// subTxVersions keeps every registered version of sub-transaction definitions,
+// so saga pinned to an old version compensates with the compensate of that version.
+type subTxVersions map[string]map[int]subTxDefinition
+
+func (v subTxVersions) add(def subTxDefinition) {
+	versions, ok := v[def.subTxID]
+	if !ok {
+		versions = make(map[int]subTxDefinition)
+		v[def.subTxID] = versions
+	}
+	versions[def.version] = def
+}
+
+func (v subTxVersions) find(subTxID string, version int) (subTxDefinition, bool) {
+	def, ok := v[subTxID][version]
+	return def, ok
+}
+
+// SubTxOption configures a sub-transaction definition added by AddSubTxDef.
+type SubTxOption func(*subTxDefinition)
+
+// ManualCompensate marks compensate needs human intervention once it fails, e.g. manual refund.
+// A failed manual compensate isn't retried, the saga is dead-lettered with high priority
+// (see ListCompensateAlerts) and alert hook set by WithAlertHook is fired immediately.
+func ManualCompensate() SubTxOption {
+	return func(def *subTxDefinition) {
+		def.manualCompensate = true
+	}
+}
+
+// IdempotentCompensate declares compensate safe to run more than once, e.g. a refund keyed by order.
+//
+// Compensate of a sub-transaction without it logs CompensateStart before every invocation, if the process crashes
+// before CompensateEnd, the outcome is unknown and recovery won't run it again by itself: the saga is dead-lettered
+// with high priority like ManualCompensate, until RetryCompensateFailure re-runs it. Such compensate runs
+// at most once unattended, and a compensate returned error is still retried.
+// An idempotent compensate is re-run by recovery without the marker, i.e. at-least-once,
+// which saves an AppendLog per invocation.
+func IdempotentCompensate() SubTxOption {
+	return func(def *subTxDefinition) {
+		def.idempotentCompensate = true
+	}
 }
 
-func (s subTxDefinitions) addDefinition(subTxID string, action interface{}, compensate interface{}) subTxDefinitions {
+// defaultCompensateRetries makes compensate tried at most 10 times in-process.
+const defaultCompensateRetries = 9
+
+// CompensateRetries sets the number of in-process compensate retries after the first attempt, default is 9.
+// Zero means compensate runs exactly once: it's neither retried in-process nor scheduled by
+// WithCompensateRetrySchedule, the saga is dead-lettered on failure.
+func CompensateRetries(n int) SubTxOption {
+	return func(def *subTxDefinition) {
+		if n >= 0 {
+			def.compensateRetries = n
+		}
+	}
+}
+
+// ActionTimeout sets default timeout of each action attempt.
+func ActionTimeout(timeout time.Duration) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.timeout = timeout
+	}
+}
+
+// ActionRetry sets default retry policy of action, saga aborts only after all attempts failed.
+func ActionRetry(policy RetryPolicy) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.retry = policy
+	}
+}
+
+// SubTxRef references a registered sub-transaction by subTxID. Given to AddSubTxDef as compensate,
+// the action of the referenced sub-transaction compensates, e.g. an "undo" operation registered as its own sub-transaction.
+// The reference is resolved to the latest definition at abort time.
+type SubTxRef string
+
+// ArgTransformer transforms or validates args of a sub-transaction before they're persisted,
+// returning error aborts the saga before the action runs.
+type ArgTransformer func(args []interface{}) ([]interface{}, error)
+
+// TransformArgs scrubs or normalizes args by transform before they're persisted, e.g. to drop derived fields
+// or validate invariants. The transformed args are recorded in saga log and given to compensate,
+// so they must still match compensate params, while action runs with the original args.
+func TransformArgs(transform ArgTransformer) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.transformArgs = transform
+	}
+}
+
+// TransformActionArgs likes TransformArgs, but action runs with the transformed args as well.
+func TransformActionArgs(transform ArgTransformer) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.transformArgs = transform
+		def.transformActionArgs = true
+	}
+}
+
+func (s subTxDefinitions) addDefinition(subTxID string, action interface{}, compensate interface{}, opts ...SubTxOption) subTxDefinitions {
+	s[subTxID] = newSubTxDefinition(subTxID, action, compensate, opts...)
+	return s
+}
+
+func newSubTxDefinition(subTxID string, action interface{}, compensate interface{}, opts ...SubTxOption) subTxDefinition {
 	actionMethod := subTxMethod(action)
 	compensateMethod := subTxMethod(compensate)
-	s[subTxID] = subTxDefinition{
+	def := subTxDefinition{
 		subTxID:    subTxID,
 		action:     actionMethod,
 		compensate: compensateMethod,
+
+		compensateRetries: defaultCompensateRetries,
 	}
-	return s
+	for _, opt := range opts {
+		opt(&def)
+	}
+	return def
 }
 
 func (s subTxDefinitions) findDefinition(subTxID string) (subTxDefinition, bool) {
@@ -32,6 +174,70 @@ func (s subTxDefinitions) findDefinition(subTxID string) (subTxDefinition, bool)
 type paramTypeRegister struct {
 	nameToType map[string]reflect.Type
 	typeToName map[reflect.Type]string
+	providers  map[reflect.Type]func(ctx context.Context) interface{}
+}
+
+func (r *paramTypeRegister) addProvider(typ reflect.Type, provider func(ctx context.Context) interface{}) {
+	if r.providers == nil {
+		r.providers = make(map[reflect.Type]func(ctx context.Context) interface{})
+	}
+	r.nameToType[typ.String()] = typ
+	r.typeToName[typ] = typ.String()
+	r.providers[typ] = provider
+}
+
+// injectArgs fills arguments of action whose type has provider when args are fewer than action needs,
+// other arguments are taken from args in order.
+func (r *paramTypeRegister) injectArgs(ctx context.Context, action reflect.Value, args []interface{}) []interface{} {
+	actionType := action.Type()
+	missing := actionType.NumIn() - 1 - len(args)
+	if missing <= 0 || len(r.providers) == 0 {
+		return args
+	}
+	full := make([]interface{}, 0, actionType.NumIn()-1)
+	rest := args
+	for i := 1; i < actionType.NumIn(); i++ {
+		if provider, ok := r.providers[actionType.In(i)]; ok && missing > 0 {
+			full = append(full, provider(ctx))
+			missing--
+			continue
+		}
+		if len(rest) == 0 {
+			// can't be filled by providers, leave it to fail as is
+			return args
+		}
+		full = append(full, rest[0])
+		rest = rest[1:]
+	}
+	return full
+}
+
+// checkArgs reports ErrInvalidArgs if args can't be passed to action of def after its context param.
+func checkArgs(def subTxDefinition, args []interface{}) error {
+	actionType := def.action.Type()
+	expected := actionType.NumIn() - 1
+	if actionType.IsVariadic() {
+		if len(args) < expected-1 {
+			return fmt.Errorf("%w: %s expects at least %d args, got %d", ErrInvalidArgs, def.subTxID, expected-1, len(args))
+		}
+	} else if len(args) != expected {
+		return fmt.Errorf("%w: %s expects %d args, got %d", ErrInvalidArgs, def.subTxID, expected, len(args))
+	}
+	for i, arg := range args {
+		var paramType reflect.Type
+		if actionType.IsVariadic() && i >= expected-1 {
+			paramType = actionType.In(actionType.NumIn() - 1).Elem()
+		} else {
+			paramType = actionType.In(i + 1)
+		}
+		if arg == nil {
+			return fmt.Errorf("%w: %s arg %d is nil, expects %s", ErrInvalidArgs, def.subTxID, i, paramType)
+		}
+		if argType := reflect.TypeOf(arg); !argType.AssignableTo(paramType) {
+			return fmt.Errorf("%w: %s arg %d is %s, expects %s", ErrInvalidArgs, def.subTxID, i, argType, paramType)
+		}
+	}
+	return nil
 }
 
 func (r *paramTypeRegister) addParams(fc interface{}) {
@@ -61,14 +267,49 @@ func (r *paramTypeRegister) findType(typeName string) (reflect.Type, bool) {
 	return f, ok
 }
 
-func subTxMethod(obj interface{}) reflect.Value {
+// validateCompensate checks compensate accepts the arguments recorded for action,
+// since compensate is called with the action's arguments restored from saga log.
+func validateCompensate(subTxID string, action, compensate reflect.Value) error {
+	actionType, compensateType := action.Type(), compensate.Type()
+	if actionType.NumIn() != compensateType.NumIn() {
+		return fmt.Errorf("subTxID %s: %w: compensate takes %d arguments after context, action records %d",
+			subTxID, ErrInvalidSubTx, compensateType.NumIn()-1, actionType.NumIn()-1)
+	}
+	for i := 1; i < actionType.NumIn(); i++ {
+		if !actionType.In(i).AssignableTo(compensateType.In(i)) {
+			return fmt.Errorf("subTxID %s: %w: compensate argument %d has type %s, not assignable from action argument type %s",
+				subTxID, ErrInvalidSubTx, i, compensateType.In(i), actionType.In(i))
+		}
+	}
+	return nil
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// validateSubTxFunc checks obj is a func takes context.Context(or an interface it implements) as first argument,
+// role is "action" or "compensate" used in error message.
+func validateSubTxFunc(subTxID, role string, obj interface{}) (reflect.Value, error) {
 	funcValue := reflect.ValueOf(obj)
 	if funcValue.Kind() != reflect.Func {
-		panic("Regist object must be a func")
+		return reflect.Value{}, fmt.Errorf("subTxID %s: %w: %s must be a func, got %T", subTxID, ErrInvalidSubTx, role, obj)
+	}
+	funcType := funcValue.Type()
+	if funcType.NumIn() < 1 {
+		return reflect.Value{}, fmt.Errorf("subTxID %s: %w: %s first argument must be context.Context, got no argument",
+			subTxID, ErrInvalidSubTx, role)
+	}
+	if first := funcType.In(0); first != contextType &&
+		!(first.Kind() == reflect.Interface && contextType.Implements(first)) {
+		return reflect.Value{}, fmt.Errorf("subTxID %s: %w: %s first argument must be context.Context, got %s",
+			subTxID, ErrInvalidSubTx, role, first)
 	}
-	if funcValue.Type().NumIn() < 1 ||
-		funcValue.Type().In(0) != reflect.TypeOf((*context.Context)(nil)).Elem() {
-		panic("First argument must use context.Context.")
+	return funcValue, nil
+}
+
+func subTxMethod(obj interface{}) reflect.Value {
+	funcValue, err := validateSubTxFunc("", "registered func", obj)
+	if err != nil {
+		panic(err)
 	}
 	return funcValue
 }
@@ -2,6 +2,7 @@ package saga
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -40,7 +41,7 @@ func TestMissFunc(t *testing.T) {
 	func() {
 		defer func() {
 			if r := recover(); r != nil {
-				assert.Equal(t, "First argument must use SagaContext.", r)
+				assert.True(t, errors.Is(r.(error), ErrInvalidSubTx))
 				return
 			}
 			assert.Fail(t, "It must be panic when use E function")
@@ -48,3 +49,38 @@ func TestMissFunc(t *testing.T) {
 		subTxDefinitions{}.addDefinition("Test", T1, E)
 	}()
 }
+
+func F(name string, ctx context.Context) error {
+	return nil
+}
+
+func TestValidateSubTxFunc(t *testing.T) {
+	_, err := validateSubTxFunc("Test", "compensate", E)
+	assert.EqualError(t, err, "subTxID Test: invalid sub-transaction definition: compensate first argument must be context.Context, got no argument")
+	_, err = validateSubTxFunc("Test", "action", F)
+	assert.EqualError(t, err, "subTxID Test: invalid sub-transaction definition: action first argument must be context.Context, got string")
+	_, err = validateSubTxFunc("Test", "action", "F")
+	assert.EqualError(t, err, "subTxID Test: invalid sub-transaction definition: action must be a func, got string")
+	_, err = validateSubTxFunc("Test", "action", func(ctx interface{ Done() <-chan struct{} }) {})
+	assert.NoError(t, err)
+}
+
+func TestCompensateBySubTxRef(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	assert.NoError(t, sec.AddSubTxDefE("deposit", acc.deduceCompensate, acc.deduce))
+	assert.NoError(t, sec.AddSubTxDefE("withdraw", acc.deduce, SubTxRef("deposit")))
+	sec.AddSubTxDef("fail", failAction, failCompensate)
+
+	err := sec.AddSubTxDefE("unknown", acc.deduce, SubTxRef("missing"))
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+	err = sec.AddSubTxDefE("mismatch", acc.deduce, SubTxRef("fail"))
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+
+	s := sec.StartSaga(context.Background(), "ref")
+	s.ExecSub("withdraw", "foo", 10)
+	assert.Equal(t, 90, acc.balance["foo"])
+	s.ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 100, acc.balance["foo"])
+}
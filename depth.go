@@ -0,0 +1,80 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// WithMaxCompensationDepth dead-letters a saga instead of compensating it when its compensation would run
+// at depth beyond max. Compensates run at depth 1, a saga started with context of a compensate, e.g. a sub-saga
+// rolling back step A, is at depth of that compensate, and its own compensates run one level deeper,
+// so a misconfigured compensation re-entering itself through sub-sagas stops at max instead of running away.
+// The depth is carried by context given to StartSaga and persisted with SagaStart log for recovery.
+// Default is unlimited.
+func WithMaxCompensationDepth(max int) Option {
+	return func(o *options) {
+		o.maxCompensationDepth = max
+	}
+}
+
+type compensationDepthCtxKey struct{}
+
+// CompensationDepth returns depth of compensation ctx belongs to, 0 outside compensation.
+func CompensationDepth(ctx context.Context) int {
+	depth, _ := ctx.Value(compensationDepthCtxKey{}).(int)
+	return depth
+}
+
+func withCompensationDepth(ctx context.Context, depth int) context.Context {
+	return context.WithValue(ctx, compensationDepthCtxKey{}, depth)
+}
+
+// depthOf returns compensation depth persisted with SagaStart log.
+func depthOf(logs []Log) int {
+	for _, log := range logs {
+		if log.Type == SagaStart {
+			return log.Depth
+		}
+	}
+	return 0
+}
+
+// checkCompensationDepth dead-letters saga if its compensation would exceed WithMaxCompensationDepth.
+func (s *Saga) checkCompensationDepth() bool {
+	max := s.sec.opts.maxCompensationDepth
+	if max <= 0 || s.depth < max {
+		return true
+	}
+	s.compensateFail = true
+	err := fmt.Errorf("compensation depth %d exceeds %d: %w", s.depth+1, max, ErrCompensationLoop)
+	if derr := s.deadLetter("", err); derr != nil {
+		err = fmt.Errorf("%v: %w", derr, err)
+	}
+	s.mu.Lock()
+	s.err = &compensationLoopError{cause: s.err, err: err}
+	s.mu.Unlock()
+	return false
+}
+
+// compensationLoopError is the error of saga dead-lettered by WithMaxCompensationDepth,
+// it wraps both the error saga failed with and the one it wasn't compensated for.
+type compensationLoopError struct {
+	cause error
+	err   error
+}
+
+func (e *compensationLoopError) Error() string {
+	if e.cause == nil {
+		return e.err.Error()
+	}
+	return e.cause.Error() + ", not compensated: " + e.err.Error()
+}
+
+func (e *compensationLoopError) Unwrap() error {
+	return e.cause
+}
+
+func (e *compensationLoopError) Is(target error) bool {
+	return errors.Is(e.err, target)
+}
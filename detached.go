@@ -0,0 +1,92 @@
+package saga
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DetachedAction runs action of the sub-transaction in background, e.g. a fire-and-forget notification
+// which shouldn't block the critical path of saga. ExecSub logs ActionStart and returns without waiting,
+// the action logs ActionEnd once it succeeds.
+//
+// Semantics, since the action outlives ExecSub:
+//   - The action runs with values of saga context but isn't canceled with it, timeout and retry apply as usual.
+//   - ActionEnd is logged in completion order, so a detached action is compensated by its completion order
+//     rather than its ExecSub order.
+//   - A failed detached action doesn't abort saga, it's logged as warning and not compensated.
+//   - EndSaga waits for detached actions in progress, so saga log is complete before SagaEnd.
+//   - Abort cancels detached actions in progress and waits for them, the ones succeeded anyway are compensated.
+//   - A detached action in progress when the process crashes is left dangling, see RepairDangling.
+func DetachedAction() SubTxOption {
+	return func(def *subTxDefinition) {
+		def.detached = true
+	}
+}
+
+// detachedActions tracks detached actions of a saga in progress.
+type detachedActions struct {
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// valuesContext keeps values of parent context but is never canceled.
+type valuesContext struct {
+	context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valuesContext) Done() <-chan struct{}       { return nil }
+func (valuesContext) Err() error                  { return nil }
+
+// execDetached runs action in background, args are given to action and ActionEnd is paired with ActionStart log start.
+func (s *Saga) execDetached(ctx context.Context, subTxDef subTxDefinition, opts ExecSubOptions, start *Log, args []interface{}) {
+	d := &s.detached
+	d.once.Do(func() {
+		d.ctx, d.cancel = context.WithCancel(context.Background())
+	})
+	ctx, cancel := context.WithCancel(valuesContext{ctx})
+	stop := make(chan struct{})
+	d.wg.Add(1)
+	go func() {
+		// cancel the action when saga aborts
+		select {
+		case <-d.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	go func() {
+		defer d.wg.Done()
+		defer close(stop)
+		defer cancel()
+		s.count(statActions)
+		ctx, span := s.startSpan(ctx, "action "+subTxDef.subTxID)
+		scope := &valueScope{state: s.state, written: make(map[string]string)}
+		err := s.callAction(withValueScope(ctx, scope), subTxDef, opts, args)
+		span.End(err)
+		if err != nil {
+			s.sec.opts.logger.Printf("[WARNING]Detached action %s for %s failure: %v", subTxDef.subTxID, s.logID, err)
+			s.dropBound(scope)
+			return
+		}
+		if err := s.logActionEnd(subTxDef, opts, 0, start, scope, nil, false); err != nil {
+			s.sec.opts.logger.Printf("[WARNING]ActionEnd of detached %s for %s not logged, it won't be compensated: %v",
+				subTxDef.subTxID, s.logID, err)
+		}
+	}()
+}
+
+// waitDetached waits for detached actions in progress, they're canceled first if cancel is set.
+func (s *Saga) waitDetached(cancel bool) {
+	d := &s.detached
+	if cancel {
+		d.once.Do(func() {
+			d.ctx, d.cancel = context.WithCancel(context.Background())
+		})
+		d.cancel()
+	}
+	d.wg.Wait()
+}
@@ -0,0 +1,58 @@
+package saga
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DiagnosticsBundle is a self-contained snapshot of a saga for support tickets, see ExportDiagnostics.
+type DiagnosticsBundle struct {
+	LogID       string     `json:"logID"`
+	GeneratedAt time.Time  `json:"generatedAt"`
+	Status      SagaStatus `json:"status"`
+	// Timeline is the decoded saga log
+	Timeline []ReplayEntry `json:"timeline"`
+	// SubTxs are definitions of sub-transactions appearing in the saga log
+	SubTxs []SubTxConfig `json:"subTxs"`
+	// Config is the coordinator config without sub-transactions
+	Config CoordinatorConfig `json:"config"`
+}
+
+// Diagnose composes the diagnostics bundle of given saga by Status, Replay and ExportConfig.
+func (e *ExecutionCoordinator) Diagnose(logID string) (DiagnosticsBundle, error) {
+	bundle := DiagnosticsBundle{LogID: logID, GeneratedAt: time.Now()}
+	var err error
+	if bundle.Status, err = e.Status(logID); err != nil {
+		return bundle, errors.Annotatef(err, "Status %s failure", logID)
+	}
+	if bundle.Timeline, err = e.Replay(logID); err != nil {
+		return bundle, err
+	}
+	used := make(map[string]bool)
+	for _, entry := range bundle.Timeline {
+		if entry.SubTxID != "" {
+			used[entry.SubTxID] = true
+		}
+	}
+	bundle.Config = e.ExportConfig()
+	bundle.SubTxs = make([]SubTxConfig, 0, len(used))
+	for _, subTx := range bundle.Config.SubTxs {
+		if used[subTx.SubTxID] {
+			bundle.SubTxs = append(bundle.SubTxs, subTx)
+		}
+	}
+	bundle.Config.SubTxs = nil
+	return bundle, nil
+}
+
+// ExportDiagnostics returns the diagnostics bundle of given saga serialized to JSON,
+// e.g. to attach to a bug report. Secret args are kept redacted.
+func (e *ExecutionCoordinator) ExportDiagnostics(logID string) ([]byte, error) {
+	bundle, err := e.Diagnose(logID)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(bundle, "", "  ")
+}
@@ -1 +1,159 @@
 package saga
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kzh125/go-saga/storage"
+)
+
+// ErrInvalidArgs is returned when args given to ExecSub don't match action of the sub-transaction.
+var ErrInvalidArgs = errors.New("invalid sub-transaction args")
+
+// ErrDuplicateSubTx is returned when a subTxID is registered more than once.
+var ErrDuplicateSubTx = errors.New("duplicate sub-transaction definition")
+
+// ErrInvalidSubTx is returned when action or compensate of a sub-transaction definition is invalid.
+var ErrInvalidSubTx = errors.New("invalid sub-transaction definition")
+
+// ErrAbortTimeout is returned when compensation exceeds abort timeout set by WithAbortTimeout.
+var ErrAbortTimeout = errors.New("abort timeout")
+
+// ErrCompensateFailed is returned when a retried compensation still fails.
+var ErrCompensateFailed = errors.New("compensate failed")
+
+// ErrTooManySagas is returned by StartSaga when in-flight sagas reach the limit set by WithMaxInFlight.
+var ErrTooManySagas = errors.New("too many in-flight sagas")
+
+// ErrMaintenanceMode is returned by StartSaga and aborts running sagas after EnterMaintenanceMode.
+var ErrMaintenanceMode = errors.New("coordinator in maintenance mode")
+
+// ErrSagaExists is returned by StartSaga when the saga of the same id is running in the coordinator,
+// or with WithIdempotentStart, when log of the saga already exists in storage.
+var ErrSagaExists = errors.New("saga already exists")
+
+// ErrNotPaused is returned by Confirm when the saga isn't paused on the given sub-transaction.
+var ErrNotPaused = errors.New("saga not paused")
+
+// ErrCompensateUncertain is raised by recovery when compensate not declared by IdempotentCompensate
+// was interrupted, so whether it took effect is unknown.
+var ErrCompensateUncertain = errors.New("compensate outcome unknown")
+
+// ErrDanglingAction is returned by RepairDangling when a dangling action requires manual repair.
+var ErrDanglingAction = errors.New("dangling action requires manual repair")
+
+// ErrNoOutcomeStore is returned by Outcome and IsCompleted when WithOutcomeStore isn't set.
+var ErrNoOutcomeStore = errors.New("no outcome store")
+
+// ErrLogCorrupted is returned when saga log fails integrity verification, see WithLogChecksum.
+var ErrLogCorrupted = errors.New("saga log corrupted")
+
+// ErrSagaLocked is returned when compensation of a saga is being resumed by another coordinator, see storage.Locker.
+var ErrSagaLocked = errors.New("saga locked by another coordinator")
+
+// ErrSagaRunning is returned by RepairDangling when the saga is still running in the coordinator,
+// so its ActionStart without ActionEnd is an action in progress rather than dangling.
+var ErrSagaRunning = errors.New("saga running in the coordinator")
+
+// ErrPermanent marks a compensate error will never be resolved by retry, see Permanent.
+var ErrPermanent = errors.New("permanent error")
+
+// Permanent wraps err returned by compensate to short-circuit compensate retries,
+// the saga is dead-lettered immediately instead. errors.Is(Permanent(err), ErrPermanent) holds,
+// and errors.Unwrap returns err.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return "permanent: " + e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func (e *permanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+// PanicError is returned by action or compensate panicked, see WithRecoverActions.
+type PanicError struct {
+	// Value is the value panicked with
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// ErrCompensationLoop is the error of saga dead-lettered by WithMaxCompensationDepth.
+var ErrCompensationLoop = errors.New("compensation depth exceeded")
+
+// ErrVerifyFailed is returned when verifier registered by VerifyCompensate rejects a compensation.
+var ErrVerifyFailed = errors.New("compensation verification failed")
+
+// ErrBoundResourceLost is returned when compensate registered with RequireBoundResource has no resource bound by its action,
+// e.g. compensation resumed after restart.
+var ErrBoundResourceLost = errors.New("bound resource lost")
+
+// ErrPayloadLost is returned when compensate registered with CompensateWithPayload can't get the payload
+// set by its action, since it couldn't be serialized, see WithMarshalFailurePolicy.
+var ErrPayloadLost = errors.New("compensation payload lost")
+
+// MarshalError reports an arg of sub-transaction which can't be serialized into saga log,
+// the saga fails according to WithMarshalFailurePolicy.
+type MarshalError struct {
+	SubTxID string
+	// Index is the position of the arg, Type is its dynamic type
+	Index int
+	Type  string
+	Err   error
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("marshal arg %d of %s: type %s: %v", e.Index, e.SubTxID, e.Type, e.Err)
+}
+
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
+// errTypeNotRegistered is the cause of MarshalError for arg of type unknown to coordinator.
+var errTypeNotRegistered = errors.New("type not registered")
+
+// ScanError reports sagas StartCoordinator failed to scan, the others are scanned.
+type ScanError struct {
+	// Failed are errors by logID
+	Failed map[string]error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("scan %d sagas failure", len(e.Failed))
+}
+
+// StoreError reports a saga log storage failure during the named operation.
+type StoreError struct {
+	Op  string
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying storage error.
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the underlying storage error is retriable, see storage.IsTemporary.
+func (e *StoreError) Temporary() bool {
+	return storage.IsTemporary(e.Err)
+}
@@ -0,0 +1,228 @@
+package saga
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// Severity numbers of OpenTelemetry log data model
+const (
+	SeverityInfo = 9
+	SeverityWarn = 13
+)
+
+// LogRecord is a saga log entry converted to OpenTelemetry log data model.
+type LogRecord struct {
+	TimeUnixNano   int64
+	SeverityNumber int
+	SeverityText   string
+	// Body is the log type followed by subTxID if any, e.g. "ActionEnd deduce"
+	Body string
+	// Attributes are saga.* keyed fields of the entry, values are string, int64 or bool
+	Attributes map[string]interface{}
+}
+
+// LogExporter exports saga log records of a saga to observability backend, see ExportLogs.
+type LogExporter interface {
+	Export(ctx context.Context, logID string, records []LogRecord) error
+}
+
+// LogExporterFunc adapts ordinary function to LogExporter.
+type LogExporterFunc func(ctx context.Context, logID string, records []LogRecord) error
+
+// Export calls f(ctx, logID, records).
+func (f LogExporterFunc) Export(ctx context.Context, logID string, records []LogRecord) error {
+	return f(ctx, logID, records)
+}
+
+// ToLogRecords converts replayed entries of saga to log records in order,
+// entries reporting abort, timeout or retry are WARN, others are INFO.
+func ToLogRecords(logID string, entries []ReplayEntry) []LogRecord {
+	records := make([]LogRecord, 0, len(entries))
+	for _, entry := range entries {
+		record := LogRecord{
+			TimeUnixNano:   entry.Time.UnixNano(),
+			SeverityNumber: SeverityInfo,
+			SeverityText:   "INFO",
+			Body:           entry.Type.String(),
+			Attributes: map[string]interface{}{
+				"saga.log_id":   logID,
+				"saga.log_type": entry.Type.String(),
+			},
+		}
+		switch entry.Type {
+		case SagaAbort, AbortTimeout, CompensateRetry:
+			record.SeverityNumber, record.SeverityText = SeverityWarn, "WARN"
+		}
+		if entry.SubTxID != "" {
+			record.Body += " " + entry.SubTxID
+			record.Attributes["saga.sub_tx_id"] = entry.SubTxID
+		}
+		if entry.CorrelationID != "" {
+			record.Attributes["saga.correlation_id"] = entry.CorrelationID
+		}
+		if entry.IdempotencyKey != "" {
+			record.Attributes["saga.idempotency_key"] = entry.IdempotencyKey
+		}
+		if entry.Step > 0 {
+			record.Attributes["saga.step"] = int64(entry.Step)
+		}
+		if entry.Group > 0 {
+			record.Attributes["saga.group"] = int64(entry.Group)
+		}
+		if entry.Version > 0 {
+			record.Attributes["saga.version"] = int64(entry.Version)
+		}
+		if entry.Failed {
+			record.Attributes["saga.failed"] = true
+		}
+		if entry.Attempt > 0 {
+			record.Attributes["saga.attempt"] = int64(entry.Attempt)
+		}
+		if len(entry.Args) > 0 {
+			record.Attributes["saga.args"] = fmt.Sprint(entry.Args)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// ExportLogs replays persisted log of given saga and exports it by exporter, e.g. to push history
+// of a saga to observability backend for post-hoc analysis. It should be called before saga log is cleaned up,
+// or use ExportLogRecords with log kept by storage.Recorder.
+func (e *ExecutionCoordinator) ExportLogs(ctx context.Context, logID string, exporter LogExporter) error {
+	entries, err := e.Replay(logID)
+	if err != nil {
+		return err
+	}
+	return exporter.Export(ctx, logID, ToLogRecords(logID, entries))
+}
+
+// ExportLogRecords likes ExportLogs, but exports given saga log data.
+func (e *ExecutionCoordinator) ExportLogRecords(ctx context.Context, logID string, logs []string, exporter LogExporter) error {
+	entries, err := e.ReplayLogs(logs)
+	if err != nil {
+		return err
+	}
+	return exporter.Export(ctx, logID, ToLogRecords(logID, entries))
+}
+
+// OTLPExporter exports log records to OpenTelemetry collector by OTLP/HTTP with JSON encoding.
+type OTLPExporter struct {
+	// Endpoint is URL of collector logs endpoint, e.g. http://localhost:4318/v1/logs
+	Endpoint string
+	// ServiceName is set as service.name resource attribute
+	ServiceName string
+	// Headers are added to every request, e.g. authentication
+	Headers map[string]string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// NewOTLPExporter creates OTLPExporter posting to endpoint with service name.
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	return &OTLPExporter{Endpoint: endpoint, ServiceName: serviceName}
+}
+
+// Export posts records as one OTLP ExportLogsServiceRequest.
+func (x *OTLPExporter) Export(ctx context.Context, logID string, records []LogRecord) error {
+	body, err := json.Marshal(x.request(records))
+	if err != nil {
+		return errors.Annotate(err, "Marshal OTLP request failure")
+	}
+	req, err := http.NewRequest(http.MethodPost, x.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Annotate(err, "New OTLP request failure")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range x.Headers {
+		req.Header.Set(key, value)
+	}
+	client := x.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Annotatef(err, "Export %s failure", logID)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Export %s failure: %s %s", logID, resp.Status, msg)
+	}
+	return nil
+}
+
+type otlpValue map[string]interface{}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string          `json:"timeUnixNano"`
+	SeverityNumber int             `json:"severityNumber"`
+	SeverityText   string          `json:"severityText"`
+	Body           otlpValue       `json:"body"`
+	Attributes     []otlpAttribute `json:"attributes,omitempty"`
+}
+
+func (x *OTLPExporter) request(records []LogRecord) map[string]interface{} {
+	logRecords := make([]otlpLogRecord, 0, len(records))
+	for _, record := range records {
+		logRecords = append(logRecords, otlpLogRecord{
+			TimeUnixNano:   strconv.FormatInt(record.TimeUnixNano, 10),
+			SeverityNumber: record.SeverityNumber,
+			SeverityText:   record.SeverityText,
+			Body:           otlpValue{"stringValue": record.Body},
+			Attributes:     otlpAttributes(record.Attributes),
+		})
+	}
+	return map[string]interface{}{
+		"resourceLogs": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": x.ServiceName}),
+			},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope":      map[string]interface{}{"name": "github.com/kzh125/go-saga"},
+				"logRecords": logRecords,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes converts attributes to OTLP key values sorted by key.
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value otlpValue
+		switch v := attributes[key].(type) {
+		case int64:
+			// OTLP JSON encodes 64-bit integers as strings
+			value = otlpValue{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = otlpValue{"boolValue": v}
+		default:
+			value = otlpValue{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, otlpAttribute{Key: key, Value: value})
+	}
+	return kvs
+}
@@ -0,0 +1,61 @@
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportLogsOTLP(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	mem, _ := memory.NewMemStorage()
+	recorder := storage.NewRecorder(mem)
+	sec := NewSEC(recorder, LogPrefix)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+
+	s := sec.StartSaga(context.Background(), "export")
+	s.ExecSub("deduce", "foo", 30).ExecSub("deposit", "bar", 30)
+	assert.Error(t, s.EndSaga())
+
+	var body struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					SeverityText string
+					Body         struct{ StringValue string }
+					Attributes   []struct{ Key string }
+				}
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL+"/v1/logs", "orders")
+	exporter.Headers = map[string]string{"Authorization": "secret"}
+	assert.NoError(t, sec.ExportLogRecords(context.Background(), s.logID, recorder.Recorded(s.logID), exporter))
+	records := body.ResourceLogs[0].ScopeLogs[0].LogRecords
+	var bodies []string
+	for _, record := range records {
+		bodies = append(bodies, record.Body.StringValue)
+	}
+	assert.Equal(t, []string{"SagaStart", "ActionStart deduce", "ActionEnd deduce", "ActionStart deposit",
+		"SagaAbort", "CompensateStart deduce", "CompensateEnd deduce", "SagaEnd"}, bodies)
+	assert.Equal(t, "WARN", records[4].SeverityText)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	assert.Error(t, sec.ExportLogRecords(context.Background(), s.logID, recorder.Recorded(s.logID), exporter))
+}
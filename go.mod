@@ -4,11 +4,13 @@ go 1.14
 
 require (
 	github.com/Shopify/sarama v1.26.4
+	github.com/golang/mock v1.4.4
 	github.com/gomodule/redigo v1.8.2
 	github.com/juju/errors v0.0.0-20200330140219-3fe23663418f
 	github.com/juju/testing v0.0.0-20200706033705-4c23f9c453cd // indirect
 	github.com/lysu/kazoo-go v0.0.0-20160229162054-26744d16cdcf
 	github.com/samuel/go-zookeeper v0.0.0-20200724154423-2164a8ac840e // indirect
 	github.com/stretchr/testify v1.6.1
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20200707034311-ab3426394381 // indirect
 )
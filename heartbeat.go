@@ -0,0 +1,143 @@
+package saga
+
+import (
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// heartbeatKeyPrefix prefixes logID to key heartbeat timestamps of a running saga
+const heartbeatKeyPrefix = "sagaheartbeat_"
+
+// WithHeartbeat makes every saga append a heartbeat timestamp to storage every interval from StartSaga
+// until EndSaga, so a slow but alive saga can be told from a crashed one, see IsAlive.
+// A saga whose last heartbeat is older than timeout is treated as crashed, timeout defaults to 3 times interval.
+// The watchdog started by StartWatchdog compensates crashed sagas not running in this coordinator once,
+// further retries are up to the compensate retry schedule and dead-letter list as usual.
+func WithHeartbeat(interval, timeout time.Duration) Option {
+	return func(o *options) {
+		o.heartbeatInterval = interval
+		if timeout <= 0 {
+			timeout = 3 * interval
+		}
+		o.heartbeatTimeout = timeout
+	}
+}
+
+// heartbeat appends heartbeat timestamps of a saga until stopped.
+type heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHeartbeat beats once and keeps beating every interval in background, it's a no-op without WithHeartbeat.
+func (s *Saga) startHeartbeat() {
+	interval := s.sec.opts.heartbeatInterval
+	if interval <= 0 {
+		return
+	}
+	s.beat()
+	hb := &heartbeat{stop: make(chan struct{}), done: make(chan struct{})}
+	s.heartbeat = hb
+	go func() {
+		defer close(hb.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hb.stop:
+				return
+			case <-ticker.C:
+				s.beat()
+			}
+		}
+	}()
+}
+
+// beat appends a heartbeat, failure is only logged since the next beat may succeed.
+func (s *Saga) beat() {
+	key := heartbeatKeyPrefix + s.logID
+	if err := s.store.AppendLog(key, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		s.sec.opts.logger.Printf("[WARNING]Heartbeat %s failure: %v", s.logID, err)
+	}
+}
+
+// stopHeartbeat stops heartbeat and removes heartbeat timestamps of the saga.
+func (s *Saga) stopHeartbeat() {
+	if s.heartbeat == nil {
+		return
+	}
+	close(s.heartbeat.stop)
+	<-s.heartbeat.done
+	s.heartbeat = nil
+	if err := s.store.Cleanup(heartbeatKeyPrefix + s.logID); err != nil {
+		s.sec.opts.logger.Printf("[WARNING]Cleanup heartbeat %s failure: %v", s.logID, err)
+	}
+}
+
+// lastHeartbeat returns time of the last heartbeat of saga, ok is false if the saga has no heartbeat.
+func (e *ExecutionCoordinator) lastHeartbeat(logID string) (beat time.Time, ok bool, err error) {
+	last, err := e.storeOf(logID).LastLog(heartbeatKeyPrefix + logID)
+	if err != nil {
+		return time.Time{}, false, errors.Annotatef(err, "LastLog heartbeat %s failure", logID)
+	}
+	if last == "" {
+		return time.Time{}, false, nil
+	}
+	beat, err = time.Parse(time.RFC3339Nano, last)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("heartbeat %s: %v", logID, err)
+	}
+	return beat, true, nil
+}
+
+// IsAlive reports whether saga of logID has a heartbeat within the timeout set by WithHeartbeat,
+// i.e. it's still running on some node. A saga without heartbeat, e.g. ended or started without WithHeartbeat,
+// isn't alive.
+func (e *ExecutionCoordinator) IsAlive(logID string) (bool, error) {
+	beat, ok, err := e.lastHeartbeat(logID)
+	if err != nil || !ok {
+		return false, err
+	}
+	return time.Since(beat) <= e.opts.heartbeatTimeout, nil
+}
+
+// recoverCrashedSagas compensates sagas neither ended nor running in this coordinator whose heartbeat is stale.
+// Their heartbeat is removed after compensation, so they're not picked again.
+func (e *ExecutionCoordinator) recoverCrashedSagas() error {
+	logIDs, err := e.logIDs()
+	if err != nil {
+		return err
+	}
+	for _, logID := range logIDs {
+		if e.admission.isLive(logID) {
+			continue
+		}
+		beat, ok, err := e.lastHeartbeat(logID)
+		if err != nil {
+			return err
+		}
+		if !ok || time.Since(beat) <= e.opts.heartbeatTimeout {
+			continue
+		}
+		ended, ok, err := e.sagaEnded(logID)
+		if err != nil {
+			return err
+		}
+		if ok && !ended {
+			e.opts.logger.Printf("[WARNING]Saga %s heartbeat stale since %s, compensating", logID, beat)
+			if _, err := e.resumeCompensation(logID); stderrors.Is(err, ErrSagaLocked) {
+				// another coordinator is recovering it
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		if err := e.storeOf(logID).Cleanup(heartbeatKeyPrefix + logID); err != nil {
+			return errors.Annotatef(err, "Cleanup heartbeat %s failure", logID)
+		}
+	}
+	return nil
+}
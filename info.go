@@ -0,0 +1,71 @@
+package saga
+
+import (
+	"context"
+)
+
+// SagaInfo describes the saga which a compensate runs for, see FromContext, or an action runs for, see WithActionContext.
+type SagaInfo struct {
+	ID    string
+	LogID string
+	// SubTxID is the sub-transaction whose action or compensate runs
+	SubTxID string
+	// Steps are sub-transactions completed by the saga in execution order, including compensated ones,
+	// they're only known to compensate
+	Steps []CompletedStep
+}
+
+// CompletedStep is a sub-transaction whose action has completed.
+type CompletedStep struct {
+	SubTxID        string
+	IdempotencyKey string
+}
+
+type sagaInfoCtxKey struct{}
+
+// FromContext returns info of the saga from compensate context, so a compensate can make holistic decisions,
+// e.g. cancel everything under an order, without changing its signature.
+func FromContext(ctx context.Context) (SagaInfo, bool) {
+	info, ok := ctx.Value(sagaInfoCtxKey{}).(SagaInfo)
+	return info, ok
+}
+
+func withSagaInfo(ctx context.Context, s *Saga, subTxID string) context.Context {
+	return context.WithValue(ctx, sagaInfoCtxKey{}, s.info(subTxID))
+}
+
+func (s *Saga) info(subTxID string) SagaInfo {
+	return SagaInfo{
+		ID:      s.id,
+		LogID:   s.logID,
+		SubTxID: subTxID,
+		Steps:   s.steps,
+	}
+}
+
+// WithActionContext sets decorator applied to context of every action before it's called,
+// e.g. to attach saga id and helpers consistently. Default passes context given to ExecSub as is.
+func WithActionContext(decorate func(ctx context.Context, info SagaInfo) context.Context) Option {
+	return func(o *options) {
+		o.actionContext = decorate
+	}
+}
+
+// decorateActionContext applies decorator set by WithActionContext.
+func (s *Saga) decorateActionContext(ctx context.Context, subTxID string) context.Context {
+	if decorate := s.sec.opts.actionContext; decorate != nil {
+		return decorate(ctx, s.info(subTxID))
+	}
+	return ctx
+}
+
+// completedSteps returns steps of ActionEnd logs in order.
+func completedSteps(logs []Log) []CompletedStep {
+	steps := make([]CompletedStep, 0, len(logs))
+	for _, log := range logs {
+		if log.Type == ActionEnd {
+			steps = append(steps, CompletedStep{SubTxID: log.SubTxID, IdempotencyKey: log.IdempotencyKey})
+		}
+	}
+	return steps
+}
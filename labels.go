@@ -0,0 +1,168 @@
+package saga
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type tagsCtxKey struct{}
+
+// WithTags returns ctx carrying tags of business dimensions, e.g. tenant, region and saga type.
+// StartSaga extracts them from ctx and persists them with SagaStart log, tags allowed by WithLabelAllowlist
+// become labels of the saga: attributes of its spans(see LabeledSpan) and dimensions of LabeledStats.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, tagsCtxKey{}, tags)
+}
+
+// Tags returns tags set by WithTags.
+func Tags(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsCtxKey{}).(map[string]string)
+	return tags
+}
+
+// WithLabelAllowlist sets tag keys which become labels of saga, other tags are only persisted.
+// Every distinct combination of label values gets its own LabeledStats, so only allow keys of bounded values.
+// Default allows none.
+func WithLabelAllowlist(keys ...string) Option {
+	return func(o *options) {
+		o.labelAllowlist = keys
+	}
+}
+
+// LabeledSpan is implemented by Span accepting attributes, labels of saga are set on every span of it.
+type LabeledSpan interface {
+	Span
+	SetAttributes(attrs map[string]string)
+}
+
+// LabeledStats are Stats of sagas sharing labels.
+type LabeledStats struct {
+	Labels map[string]string
+	Stats
+}
+
+// labelSet is labels shared by sagas and their counters.
+type labelSet struct {
+	labels map[string]string
+	stats  Stats
+}
+
+// labelRegistry holds label sets seen by coordinator by their canonical key.
+type labelRegistry struct {
+	mu   sync.Mutex
+	sets map[string]*labelSet
+}
+
+// labelsOf returns label set of sagas tagged with tags, nil if no tag is allowed as label.
+func (e *ExecutionCoordinator) labelsOf(tags map[string]string) *labelSet {
+	labels := make(map[string]string)
+	keys := make([]string, 0, len(e.opts.labelAllowlist))
+	for _, key := range e.opts.labelAllowlist {
+		if value, ok := tags[key]; ok {
+			labels[key] = value
+			keys = append(keys, key)
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(labels[key])
+		b.WriteByte(0)
+	}
+	r := e.labels
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set, ok := r.sets[b.String()]
+	if !ok {
+		set = &labelSet{labels: labels}
+		r.sets[b.String()] = set
+	}
+	return set
+}
+
+// LabeledStats returns snapshots of counters of sagas by their labels, see WithLabelAllowlist.
+func (e *ExecutionCoordinator) LabeledStats() []LabeledStats {
+	r := e.labels
+	r.mu.Lock()
+	keys := make([]string, 0, len(r.sets))
+	for key := range r.sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sets := make([]*labelSet, 0, len(keys))
+	for _, key := range keys {
+		sets = append(sets, r.sets[key])
+	}
+	r.mu.Unlock()
+	stats := make([]LabeledStats, 0, len(sets))
+	for _, set := range sets {
+		labels := make(map[string]string, len(set.labels))
+		for key, value := range set.labels {
+			labels[key] = value
+		}
+		stats = append(stats, LabeledStats{Labels: labels, Stats: set.stats.snapshot()})
+	}
+	return stats
+}
+
+// statCounter names a counter of Stats.
+type statCounter int
+
+const (
+	statSagasStarted statCounter = iota
+	statSagasEnded
+	statSagasAborted
+	statActions
+	statCompensations
+)
+
+func (st *Stats) counter(c statCounter) *int64 {
+	switch c {
+	case statSagasStarted:
+		return &st.SagasStarted
+	case statSagasEnded:
+		return &st.SagasEnded
+	case statSagasAborted:
+		return &st.SagasAborted
+	case statActions:
+		return &st.Actions
+	default:
+		return &st.Compensations
+	}
+}
+
+// count increases counter c of coordinator and the one of saga labels.
+func (s *Saga) count(c statCounter) {
+	atomic.AddInt64(s.sec.stats.counter(c), 1)
+	if s.labels != nil {
+		atomic.AddInt64(s.labels.stats.counter(c), 1)
+	}
+}
+
+// labelSpan sets labels of saga on span if it accepts attributes.
+func (s *Saga) labelSpan(span Span) {
+	if s.labels == nil {
+		return
+	}
+	if labeled, ok := span.(LabeledSpan); ok {
+		labeled.SetAttributes(s.labels.labels)
+	}
+}
+
+// tagsOf returns tags persisted with SagaStart log, they are Values of the entry but not saga state.
+func tagsOf(logs []Log) map[string]string {
+	for _, log := range logs {
+		if log.Type == SagaStart {
+			return log.Values
+		}
+	}
+	return nil
+}
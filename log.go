@@ -1,30 +1,169 @@
 package saga
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
 	"time"
 )
 
-// LogType present type flag for Log
-type LogType int
+// LogType present type flag for Log.
+// It's an extensible string based enum: built-in types are below, custom types are added by RegisterLogType.
+// It's persisted as its name, while entries persisted by older versions as numeric code are still decoded.
+// A type unknown to the decoder is kept as is, it's informational and skipped by recovery logic.
+type LogType string
 
 const (
-	// SagaStart flag saga stared log
-	SagaStart LogType = iota + 1
+	// SagaStart flag saga stared log, Values are tags set by WithTags
+	SagaStart LogType = "SagaStart"
 	// SagaEnd flag saga ended log
-	SagaEnd
+	SagaEnd LogType = "SagaEnd"
 	// SagaAbort flag saga aborted
-	SagaAbort
+	SagaAbort LogType = "SagaAbort"
 	// ActionStart flag action start log
-	ActionStart
+	ActionStart LogType = "ActionStart"
 	// ActionEnd flag action end log
-	ActionEnd
+	ActionEnd LogType = "ActionEnd"
 	// CompensateStart flag compensate start log
-	CompensateStart
+	CompensateStart LogType = "CompensateStart"
 	// CompensateEnd flag compensate end log
-	CompensateEnd
+	CompensateEnd LogType = "CompensateEnd"
+	// CompensateRetry flag compensate failed and scheduled to retry at NextRetry
+	CompensateRetry LogType = "CompensateRetry"
+	// AbortTimeout flag compensation stopped by abort timeout, SubTxID is the first un-compensated one
+	AbortTimeout LogType = "AbortTimeout"
+	// ActionSkipped flag action skipped by ExecSubIf
+	ActionSkipped LogType = "ActionSkipped"
+	// ActionPaused flag saga paused until the async action is confirmed, see AsyncAction
+	ActionPaused LogType = "ActionPaused"
+	// ActionResumed flag async action confirmed and saga resumed
+	ActionResumed LogType = "ActionResumed"
+	// GroupStart flag start of a group of sub-transactions executed concurrently by ExecSubConcurrent
+	GroupStart LogType = "GroupStart"
+	// GroupEnd flag all members of the group are done
+	GroupEnd LogType = "GroupEnd"
+	// SagaPaused flag forward execution paused by Pause
+	SagaPaused LogType = "SagaPaused"
+	// SagaResumed flag forward execution resumed by Resume
+	SagaResumed LogType = "SagaResumed"
+	// CompensationSkipped flag compensation of aborted saga declined by WithShouldCompensate hook,
+	// Values["error"] is the error aborted the saga
+	CompensationSkipped LogType = "CompensationSkipped"
+	// CompensateFailed flag compensate started by CompensateStart returned error, or its interrupted outcome
+	// was escalated by recovery, Values["error"] is the error
+	CompensateFailed LogType = "CompensateFailed"
+	// CompensateVerified and CompensateVerifyFailed flag verifier registered by VerifyCompensate accepted
+	// and rejected compensation, Values["error"] is the error of rejection
+	CompensateVerified     LogType = "CompensateVerified"
+	CompensateVerifyFailed LogType = "CompensateVerifyFailed"
+	// ResourceEnrolled, ResourceReleased and ResourceDeregistered flag saga enrolled in a shared resource,
+	// released its reference by compensation and left it without compensation, see Enroll.
+	// Values["resource"] and Values["id"] are name and id of the resource
+	ResourceEnrolled     LogType = "ResourceEnrolled"
+	ResourceReleased     LogType = "ResourceReleased"
+	ResourceDeregistered LogType = "ResourceDeregistered"
+	// CommitPending flag intent of callback queued by OnCommit, Values["callback"] is its name
+	CommitPending LogType = "CommitPending"
+	// CommitDone flag callback queued by OnCommit succeeded, Values["callback"] is its name
+	CommitDone LogType = "CommitDone"
+	// LogCompacted marks the end of the head of saga log rewritten by compaction, see CompactLog.
+	// Values["removed"] is the number of entries removed by compactions so far
+	LogCompacted LogType = "LogCompacted"
 )
 
+// legacyLogTypes are built-in types indexed by numeric code - 1, which older versions persisted
+var legacyLogTypes = []LogType{
+	SagaStart, SagaEnd, SagaAbort, ActionStart, ActionEnd, CompensateStart, CompensateEnd, CompensateRetry,
+	AbortTimeout, ActionSkipped, ActionPaused, ActionResumed, GroupStart, GroupEnd, SagaPaused, SagaResumed,
+}
+
+// logTypes registers known types, built-in types are true
+var logTypes = struct {
+	sync.RWMutex
+	registered map[LogType]bool
+}{registered: make(map[LogType]bool)}
+
+func init() {
+	for _, t := range legacyLogTypes {
+		logTypes.registered[t] = true
+	}
+	for _, t := range []LogType{CompensationSkipped, CompensateFailed, CommitPending, CommitDone,
+		ResourceEnrolled, ResourceReleased, ResourceDeregistered, CompensateVerified, CompensateVerifyFailed, LogCompacted} {
+		logTypes.registered[t] = true
+	}
+}
+
+// RegisterLogType registers a custom log type, e.g. a marker appended by Mark.
+// It returns error if name is empty or already registered.
+func RegisterLogType(name string) (LogType, error) {
+	t := LogType(name)
+	if name == "" {
+		return "", errors.New("log type name is empty")
+	}
+	logTypes.Lock()
+	defer logTypes.Unlock()
+	if _, ok := logTypes.registered[t]; ok {
+		return "", fmt.Errorf("log type %s already registered", name)
+	}
+	logTypes.registered[t] = false
+	return t, nil
+}
+
+// Registered reports whether t is built-in or registered by RegisterLogType.
+func (t LogType) Registered() bool {
+	logTypes.RLock()
+	defer logTypes.RUnlock()
+	_, ok := logTypes.registered[t]
+	return ok
+}
+
+// builtin reports whether t is defined by this package.
+func (t LogType) builtin() bool {
+	logTypes.RLock()
+	defer logTypes.RUnlock()
+	return logTypes.registered[t]
+}
+
+func (t LogType) String() string {
+	return string(t)
+}
+
+// UnmarshalJSON decodes type persisted as name, or as numeric code by older versions.
+// An unknown code is decoded as "LogType(code)".
+func (t *LogType) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		*t = LogType(name)
+		return nil
+	}
+	var code int
+	if err := json.Unmarshal(data, &code); err != nil {
+		return fmt.Errorf("invalid log type %s", data)
+	}
+	if code >= 1 && code <= len(legacyLogTypes) {
+		*t = legacyLogTypes[code-1]
+		return nil
+	}
+	*t = LogType("LogType(" + strconv.Itoa(code) + ")")
+	return nil
+}
+
+// legacyCode returns numeric code older versions persisted t as, ok is false for types not known by them.
+func (t LogType) legacyCode() (int, bool) {
+	for i, legacy := range legacyLogTypes {
+		if legacy == t {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
 // Log presents Saga Log.
 // Saga Log used to log execute status for saga,
 // and SEC use it to compensate and retry.
@@ -33,6 +172,41 @@ type Log struct {
 	SubTxID string      `json:"subTxID,omitempty"`
 	Time    time.Time   `json:"time,omitempty"`
 	Params  []ParamData `json:"params,omitempty"`
+	// CorrelationID is given by WithCorrelationID to StartSaga, it's stamped into every log entry of the saga
+	CorrelationID string `json:"correlationID,omitempty"`
+	// IdempotencyKey is given by ExecSubOptions for ActionStart and ActionEnd log
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Succeeded are indexes of items succeeded, only used by ActionEnd log of action returned PartialError
+	Succeeded []int `json:"succeeded,omitempty"`
+	// Failed flags ActionEnd log of action returned error, which is compensated by PartialCompensate
+	Failed bool `json:"failed,omitempty"`
+	// Group is 1-based sequence of concurrent group in saga, only used by GroupStart, GroupEnd and ActionEnd log of group member
+	Group int `json:"group,omitempty"`
+	// Step is 1-based position of the ActionEnd log compensated, only used by CompensateStart and CompensateEnd log
+	Step int `json:"step,omitempty"`
+	// Version is the version of sub-transaction definition, only used by ActionStart and ActionEnd log
+	Version int `json:"version,omitempty"`
+	// Result are return values of compensate, only used by CompensateEnd log with RecordCompensateResult
+	Result []ParamData `json:"result,omitempty"`
+	// Depth is compensation depth of context saga started with, only used by SagaStart log
+	Depth int `json:"depth,omitempty"`
+	// SagaID is id given to StartSaga, only used by SagaStart log of saga whose logID is built by WithLogIDFunc
+	SagaID string `json:"sagaID,omitempty"`
+	// Started is time in nanoseconds of the paired ActionStart log, which holds params if ActionEnd has none
+	// (see WithArgsOnActionStart), only used by ActionEnd log
+	Started int64 `json:"started,omitempty"`
+	// Values are set by action through SetValue, only used by ActionEnd log
+	Values map[string]string `json:"values,omitempty"`
+	// Payload is set by action through SetCompensationPayload, only used by ActionEnd log
+	Payload *ParamData `json:"payload,omitempty"`
+	// PayloadLost tells the payload set by action couldn't be serialized, only used by ActionEnd log
+	PayloadLost bool `json:"payloadLost,omitempty"`
+	// Seq and Checksum chain entries appended by saga, only used with WithLogChecksum
+	Seq      int    `json:"seq,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Attempt and NextRetry are only used by CompensateRetry log
+	Attempt   int       `json:"attempt,omitempty"`
+	NextRetry time.Time `json:"nextRetry,omitempty"`
 }
 
 func (l *Log) mustMarshal() string {
@@ -45,12 +219,30 @@ func mustUnmarshalLog(data string) Log {
 	return log
 }
 
+// bufferPool reuses encode buffers, so marshaling only allocates for the returned string
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 func mustMarshal(value interface{}) string {
-	s, err := json.Marshal(value)
+	data, err := marshal(value)
 	if err != nil {
 		panic("Marshal Failure")
 	}
-	return string(s)
+	return data
+}
+
+func marshal(value interface{}) (string, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(buf)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(value); err != nil {
+		return "", err
+	}
+	// trim the newline Encode appends
+	return string(buf.Bytes()[:buf.Len()-1]), nil
 }
 
 func mustUnmarshal(data []byte, v interface{}) {
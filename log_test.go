@@ -1,8 +1,10 @@
 package saga
 
 import (
-	"github.com/stretchr/testify/assert"
+	"context"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMarshalLog(t *testing.T) {
@@ -15,3 +17,46 @@ func TestMarshalLog(t *testing.T) {
 	l2 := mustUnmarshalLog(sl)
 	assert.Equal(t, ActionStart, l2.Type)
 }
+
+func TestUnmarshalLegacyLogType(t *testing.T) {
+	assert.Equal(t, ActionEnd, mustUnmarshalLog(`{"type":5,"subTxID":"1"}`).Type)
+	assert.Equal(t, LogType("LogType(99)"), mustUnmarshalLog(`{"type":99}`).Type)
+	assert.Contains(t, (&Log{Type: ActionEnd, SubTxID: "1"}).mustMarshal(), `{"type":"ActionEnd","subTxID":"1",`)
+
+	// a type from a newer version is kept
+	log := mustUnmarshalLog(`{"type":"FutureMarker"}`)
+	assert.Equal(t, LogType("FutureMarker"), log.Type)
+	assert.False(t, log.Type.Registered())
+}
+
+func TestMarkCustomLogType(t *testing.T) {
+	checkpoint, err := RegisterLogType("TestCheckpoint")
+	assert.NoError(t, err)
+	// the registry is global, unregister so the test can run again
+	t.Cleanup(func() {
+		logTypes.Lock()
+		defer logTypes.Unlock()
+		delete(logTypes.registered, checkpoint)
+	})
+	_, err = RegisterLogType("TestCheckpoint")
+	assert.Error(t, err)
+	_, err = RegisterLogType("SagaStart")
+	assert.Error(t, err)
+
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+	s := sec.StartSaga(context.Background(), "mark")
+	s.ExecSub("deduce", "foo", 10)
+	assert.NoError(t, s.Mark(checkpoint, map[string]string{"at": "deduce"}))
+	assert.Error(t, s.Mark(ActionEnd, nil))
+	assert.Error(t, s.Mark("Unregistered", nil))
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, checkpoint, entries[len(entries)-1].Type)
+
+	s.ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 100, acc.balance["foo"])
+}
@@ -0,0 +1,121 @@
+package saga
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+)
+
+// MaintenanceProgress reports progress of EnterMaintenanceMode.
+type MaintenanceProgress struct {
+	// InFlight is the number of sagas running in this coordinator, they abort by themselves
+	// on their next ExecSub or EndSaga
+	InFlight int
+	// Total is the number of stored non-terminal sagas to compensate
+	Total int
+	// Compensated and Failed are logIDs of stored sagas compensated so far and the ones failed to
+	Compensated []string
+	Failed      []string
+}
+
+// EnterMaintenanceMode stops the coordinator from doing new work and rolls back work in progress:
+// StartSaga fails with ErrMaintenanceMode from now on, sagas running in this coordinator abort and compensate
+// on their next ExecSub or EndSaga, and stored sagas neither ended nor running here are compensated with
+// bounded concurrency(see WithRecoveryConcurrency), e.g. sagas left by crashed processes.
+//
+// Stored sagas are compensated regardless of their owner, so other coordinators sharing the storage
+// should be stopped or in maintenance mode too, unless storage implements storage.Locker.
+// progress is called, if not nil, after every stored saga is handled. The returned progress is final,
+// err is only returned when sagas can't be listed or ctx is done.
+func (e *ExecutionCoordinator) EnterMaintenanceMode(ctx context.Context, progress func(MaintenanceProgress)) (MaintenanceProgress, error) {
+	atomic.StoreInt32(&e.admission.maintenance, 1)
+	report := MaintenanceProgress{InFlight: e.InFlight()}
+	logIDs, err := e.logIDs()
+	if err != nil {
+		return report, err
+	}
+	var pending []string
+	for _, logID := range logIDs {
+		if e.admission.isLive(logID) {
+			continue
+		}
+		ended, ok, err := e.sagaEnded(logID)
+		if err != nil {
+			return report, err
+		}
+		if ok && !ended {
+			pending = append(pending, logID)
+		}
+	}
+	report.Total = len(pending)
+	if progress != nil {
+		progress(report)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, e.opts.recoveryConcurrency)
+	for _, logID := range pending {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(logID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ok, err := e.resumeCompensation(logID)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || !ok {
+				e.opts.logger.Printf("[WARNING]Maintenance compensate %s failure: %v", logID, err)
+				report.Failed = append(report.Failed, logID)
+			} else {
+				report.Compensated = append(report.Compensated, logID)
+			}
+			if progress != nil {
+				progress(report)
+			}
+		}(logID)
+	}
+	wg.Wait()
+	return report, ctx.Err()
+}
+
+// ExitMaintenanceMode lets StartSaga start sagas again.
+func (e *ExecutionCoordinator) ExitMaintenanceMode() {
+	atomic.StoreInt32(&e.admission.maintenance, 0)
+}
+
+// InMaintenanceMode reports whether the coordinator is in maintenance mode.
+func (e *ExecutionCoordinator) InMaintenanceMode() bool {
+	return e.admission.inMaintenance()
+}
+
+// sagaEnded reports whether saga log has SagaEnd, ok is false if logID doesn't hold saga log.
+func (e *ExecutionCoordinator) sagaEnded(logID string) (ended, ok bool, err error) {
+	if _, ok, err = e.startTime(logID); err != nil || !ok {
+		return false, ok, err
+	}
+	it, err := e.storeOf(logID).LookupStream(logID)
+	if err != nil {
+		return false, false, errors.Annotatef(err, "LookupStream %s failure", logID)
+	}
+	defer it.Close()
+	for it.Next() {
+		if mustUnmarshalLog(it.Value()).Type == SagaEnd {
+			ended = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		return false, false, errors.Annotatef(err, "LookupStream %s failure", logID)
+	}
+	return ended, true, nil
+}
@@ -0,0 +1,324 @@
+package saga
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/kzh125/go-saga/storage"
+)
+
+// options holds the optional settings of an ExecutionCoordinator.
+type options struct {
+	logger            *log.Logger
+	strict            bool
+	compensateBackoff Backoff
+
+	compensateRetrySchedule []time.Duration
+	compensateRetryBackoff  Backoff
+	compensateRetryMax      int
+	abortTimeout            time.Duration
+	recoveryConcurrency     int
+	defaultActionTimeout    time.Duration
+	maxInFlight             int
+	maxInFlightWait         time.Duration
+	maxConcurrency          int
+	concurrentFailFast      bool
+	logChecksum             bool
+
+	logIDFunc func(id string) string
+
+	asyncCleanup      int
+	pausePollInterval time.Duration
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	outcomeStore      storage.Storage
+	cleanupPolicy     CleanupPolicy
+	archiveStore      storage.Storage
+
+	storeRetry RetryPolicy
+	scanRetry  RetryPolicy
+
+	storageSelector func(logID string) storage.Storage
+	backends        []storage.Storage
+
+	tracer          Tracer
+	traceSampleRate float64
+
+	publisher        LogPublisher
+	publishErrorHook func(logID string, log Log, err error)
+
+	onStart func(ctx context.Context) (context.Context, error)
+	onEnd   func(ctx context.Context, err error)
+
+	compensateContext []ContextCopier
+	shouldCompensate  func(err error, completed []string) bool
+	onBeforeAbort     func(ctx context.Context, logID string) context.Context
+	onAfterAbort      func(ctx context.Context, logID string, result error)
+
+	alertHook func(logID, subTxID string, err error)
+
+	commitRecovery     map[string]func(ctx context.Context, logID string) error
+	commitAfterCleanup bool
+
+	resultInterpreter ResultInterpreter
+	actionContext     func(ctx context.Context, info SagaInfo) context.Context
+	// propagatePanics is set by WithRecoverActions(false)
+	propagatePanics bool
+	argsOnStart     bool
+	labelAllowlist  []string
+
+	maxCompensationDepth int
+	compensateLimits     map[string]*tokenBucket
+	priorityTag          string
+	idempotentStart      bool
+	marshalFailurePolicy MarshalFailurePolicy
+	compactThreshold     int
+	compactKeep          int
+}
+
+// Option configures an ExecutionCoordinator created by NewSEC.
+type Option func(*options)
+
+// WithLogger sets the logger used to report warnings, such as duplicate sub-transaction registration.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithStrictMode makes AddSubTxDef panic on duplicate subTxID registration,
+// so misconfiguration is caught at startup before any traffic arrives.
+func WithStrictMode() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// WithCompensateBackoff sets backoff between compensate retries, e.g.
+//
+//	WithCompensateBackoff(Backoff{Base: 100 * time.Millisecond, Max: 5 * time.Second, Jitter: FullJitter})
+//
+// Default retries immediately.
+func WithCompensateBackoff(b Backoff) Option {
+	return func(o *options) {
+		o.compensateBackoff = b
+	}
+}
+
+// WithCompensateRetrySchedule sets delays of later retries once in-process compensate attempts are exhausted, e.g.
+//
+//	WithCompensateRetrySchedule(time.Minute, 5*time.Minute, 30*time.Minute)
+//
+// The next retry time is persisted in saga log and the watchdog started by StartWatchdog resumes compensation when due.
+// The saga is dead-lettered when schedule is used up. Default dead-letters immediately.
+func WithCompensateRetrySchedule(delays ...time.Duration) Option {
+	return func(o *options) {
+		o.compensateRetrySchedule = delays
+	}
+}
+
+// WithCompensateRetryBackoff schedules at most maxRetries later retries like WithCompensateRetrySchedule,
+// with delays growing by b instead of a fixed list. The attempt number and next retry time are persisted
+// in saga log, so delay of the next attempt is computed from the persisted attempt and previous delay,
+// a restart neither resets the backoff nor forgets the scheduled time. It overrides WithCompensateRetrySchedule.
+func WithCompensateRetryBackoff(b Backoff, maxRetries int) Option {
+	return func(o *options) {
+		o.compensateRetryBackoff = b
+		o.compensateRetryMax = maxRetries
+	}
+}
+
+// WithOnStart sets hook invoked by StartSaga before saga starts, e.g. to open a tracing scope spans whole saga.
+// The returned context is used as saga context, returning error fails StartSaga.
+func WithOnStart(hook func(ctx context.Context) (context.Context, error)) Option {
+	return func(o *options) {
+		o.onStart = hook
+	}
+}
+
+// WithOnEnd sets hook invoked by EndSaga with saga context and saga result, even when the saga aborted.
+// It's the place to clean up what WithOnStart hook set up.
+func WithOnEnd(hook func(ctx context.Context, err error)) Option {
+	return func(o *options) {
+		o.onEnd = hook
+	}
+}
+
+// WithShouldCompensate sets hook consulted by Abort to decide whether to compensate at all, default is always.
+// err is the error aborted the saga, nil for explicit Abort, completed are subTxIDs of the steps to compensate
+// in execution order. Returning false leaves them as is, e.g. a business rule keeps partial state on a terminal error,
+// the decision is recorded by CompensationSkipped log and honored by recovery.
+func WithShouldCompensate(hook func(err error, completed []string) bool) Option {
+	return func(o *options) {
+		o.shouldCompensate = hook
+	}
+}
+
+// WithOnBeforeAbort sets hook invoked once before compensation of an aborted saga begins, including compensation
+// resumed by recovery, watchdog or RetryCompensateFailure, e.g. to acquire a lock or open a transaction shared by
+// all compensations. The returned context is the parent of every compensate context of this abort.
+func WithOnBeforeAbort(hook func(ctx context.Context, logID string) context.Context) Option {
+	return func(o *options) {
+		o.onBeforeAbort = hook
+	}
+}
+
+// WithOnAfterAbort sets hook invoked once after compensation of an aborted saga, with the context returned by
+// WithOnBeforeAbort hook. result is nil if all sub-transactions are compensated, otherwise it wraps ErrCompensateFailed.
+// It's the place to tear down what WithOnBeforeAbort hook set up.
+func WithOnAfterAbort(hook func(ctx context.Context, logID string, result error)) Option {
+	return func(o *options) {
+		o.onAfterAbort = hook
+	}
+}
+
+// WithResultInterpreter overrides how return values of actions and compensates are interpreted, e.g. for funcs
+// returning (T, error) or a sentinel status instead of error. Default is DefaultResultInterpreter.
+// A failure reported with nil err is turned into a generic error naming the sub-transaction.
+func WithResultInterpreter(interpreter ResultInterpreter) Option {
+	return func(o *options) {
+		o.resultInterpreter = interpreter
+	}
+}
+
+// WithRecoverActions decides whether a panic in action or compensate is recovered into a *PanicError,
+// which aborts the saga or fails the compensate like any error, or propagates to crash the process,
+// e.g. to fail fast in development. Default recovers.
+func WithRecoverActions(recover bool) Option {
+	return func(o *options) {
+		o.propagatePanics = !recover
+	}
+}
+
+// WithAlertHook sets hook fired when a compensate marked by ManualCompensate failed,
+// e.g. to page someone for manual intervention.
+func WithAlertHook(hook func(logID, subTxID string, err error)) Option {
+	return func(o *options) {
+		o.alertHook = hook
+	}
+}
+
+// WithAbortTimeout bounds the whole compensation of an Abort. Once exceeded, compensation stops,
+// the saga is dead-lettered with the un-compensated sub-transactions recorded in its log,
+// so callers aren't blocked indefinitely. Default is unbounded.
+func WithAbortTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.abortTimeout = timeout
+	}
+}
+
+// WithStoreRetry retries saga log appends failed with a temporary storage error(see storage.IsTemporary),
+// e.g. a momentary redis failover, instead of failing the saga. Fatal storage errors are never retried.
+// Once retries are used up, ExecSub aborts the saga with a *StoreError. Default doesn't retry.
+func WithStoreRetry(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.storeRetry = policy
+	}
+}
+
+// WithScanRetry retries failed storage calls of the StartCoordinator scan by policy, e.g. a momentary redis failover,
+// so a blip doesn't abandon the scan. The scan only reads, so any error is retried. Default doesn't retry.
+func WithScanRetry(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.scanRetry = policy
+	}
+}
+
+// WithAsyncCleanup makes EndSaga return right after logging SagaEnd, and clean up saga log
+// in a background worker with a queue of size, EndSaga blocks while the queue is full.
+// A failed cleanup is retried with backoff, and logged if it still fails.
+// Call Shutdown to drain the queue before exit.
+func WithAsyncCleanup(size int) Option {
+	return func(o *options) {
+		o.asyncCleanup = size
+	}
+}
+
+// WithRecoveryConcurrency sets max number of sagas RetryAllCompensateFailures retries concurrently, default to 4.
+func WithRecoveryConcurrency(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.recoveryConcurrency = n
+		}
+	}
+}
+
+// WithDefaultActionTimeout bounds each action attempt of sub-transactions which have no timeout
+// set by ActionTimeout or ExecSubOptions. If saga context has an earlier deadline, the earlier one wins.
+func WithDefaultActionTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.defaultActionTimeout = timeout
+	}
+}
+
+// WithMaxInFlight bounds the number of sagas started but not ended by EndSaga.
+// Once the limit is reached StartSaga waits at most wait for a saga to end, then fails with ErrTooManySagas,
+// a zero wait fails immediately. Default is unbounded.
+func WithMaxInFlight(n int, wait time.Duration) Option {
+	return func(o *options) {
+		o.maxInFlight = n
+		o.maxInFlightWait = wait
+	}
+}
+
+// WithIdempotentStart makes StartSaga idempotent by saga id, e.g. for requests redelivered by a queue.
+// A repeated StartSaga of a saga running in this coordinator returns the running saga once it's started,
+// instead of failing with ErrSagaExists, and one of a saga whose log exists in storage,
+// e.g. started by another coordinator, fails with ErrSagaExists.
+// It costs StartSaga a storage lookup.
+func WithIdempotentStart() Option {
+	return func(o *options) {
+		o.idempotentStart = true
+	}
+}
+
+// WithMaxConcurrency limits each saga to at most n lists of ExecSubConcurrent(or items of ExecSubParallel) running simultaneously,
+// the budget is shared by all ExecSubConcurrent calls of the saga, so a saga fanning out repeatedly
+// or from many goroutines doesn't spike goroutines. A list waits for a free slot before it starts.
+// It can be overridden per saga by WithConcurrency. Default is unlimited.
+func WithMaxConcurrency(n int) Option {
+	return func(o *options) {
+		o.maxConcurrency = n
+	}
+}
+
+// WithConcurrentFailFast makes the first failure in ExecSubConcurrent cancel context shared by the actions
+// of the group in progress, so they abort promptly instead of running to completion before the saga aborts.
+// It's only effective for actions honoring context cancellation.
+func WithConcurrentFailFast() Option {
+	return func(o *options) {
+		o.concurrentFailFast = true
+	}
+}
+
+// WithLogIDFunc sets how StartSaga builds logID from saga id, default is LogPrefix + id.
+// Built logID must start with logPrefix given to NewSEC, so LogIDs of storage and recovery still recognize it,
+// e.g. include date for TTL, tenant for isolation, or a hash tag so logs of a tenant share a Redis cluster slot:
+//
+//	WithLogIDFunc(func(id string) string { return "saga{" + tenantOf(id) + "}" + id })
+func WithLogIDFunc(fn func(id string) string) Option {
+	return func(o *options) {
+		o.logIDFunc = fn
+	}
+}
+
+// WithTracer traces sagas with spans of the saga, its actions and compensates.
+// Only a fraction sampleRate(0 to 1) of sagas are traced, the decision is made once by StartSaga,
+// so a sampled saga is fully traced end-to-end. Stats are updated regardless.
+func WithTracer(tracer Tracer, sampleRate float64) Option {
+	return func(o *options) {
+		o.tracer = tracer
+		o.traceSampleRate = sampleRate
+	}
+}
+
+// WithLogPublisher publishes every saga log entry after it's appended to storage.
+// Publication is best-effort and never breaks the saga: failures are passed to onError,
+// or logged if onError is nil.
+func WithLogPublisher(publisher LogPublisher, onError func(logID string, log Log, err error)) Option {
+	return func(o *options) {
+		o.publisher = publisher
+		o.publishErrorHook = onError
+	}
+}
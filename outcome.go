@@ -0,0 +1,97 @@
+package saga
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// outcomeKeyPrefix prefixes logID to key outcome record in outcome store
+const outcomeKeyPrefix = "outcome_"
+
+const (
+	// OutcomeCompleted is outcome of saga whose sub-transactions all succeeded
+	OutcomeCompleted = "completed"
+	// OutcomeCompensated is outcome of aborted saga whose sub-transactions are all compensated
+	OutcomeCompensated = "compensated"
+	// OutcomeCompensationSkipped is outcome of aborted saga whose compensation is declined, see WithShouldCompensate
+	OutcomeCompensationSkipped = "compensation_skipped"
+)
+
+// SagaOutcome is the terminal record of a saga retained after its log is cleaned up, see WithOutcomeStore.
+type SagaOutcome struct {
+	ID      string    `json:"id"`
+	LogID   string    `json:"logID"`
+	Outcome string    `json:"outcome"`
+	Time    time.Time `json:"time"`
+}
+
+// WithOutcomeStore retains a small outcome record of every saga in store right before its log is cleaned up,
+// so callers can tell a completed saga from one never started, e.g. to reject re-running a saga id, see IsCompleted.
+// store should be a storage retained longer than saga log, records are never cleaned up by coordinator.
+func WithOutcomeStore(store storage.Storage) Option {
+	return func(o *options) {
+		o.outcomeStore = store
+	}
+}
+
+// newOutcome returns terminal outcome of saga.
+func (s *Saga) newOutcome(outcome string) SagaOutcome {
+	return SagaOutcome{ID: s.id, LogID: s.logID, Outcome: outcome, Time: time.Now()}
+}
+
+// recordOutcome writes outcome record of saga if outcome store is set.
+func (s *Saga) recordOutcome(outcome SagaOutcome) error {
+	store := s.sec.opts.outcomeStore
+	if store == nil {
+		return nil
+	}
+	data, err := json.Marshal(outcome)
+	if err != nil {
+		return err
+	}
+	return store.AppendLog(outcomeKeyPrefix+s.logID, string(data))
+}
+
+// Outcome returns outcome record of saga with given id, nil if saga has no outcome recorded, e.g. it's still running.
+// It requires WithOutcomeStore.
+func (e *ExecutionCoordinator) Outcome(id string) (*SagaOutcome, error) {
+	store := e.opts.outcomeStore
+	if store == nil {
+		return nil, fmt.Errorf("Outcome %s: %w", id, ErrNoOutcomeStore)
+	}
+	key := outcomeKeyPrefix + e.logIDOf(id)
+	data, err := store.LastLog(key)
+	if err != nil {
+		return nil, errors.Annotatef(err, "LastLog %s failure", key)
+	}
+	if data == "" {
+		return nil, nil
+	}
+	var outcome SagaOutcome
+	if err := json.Unmarshal([]byte(data), &outcome); err != nil {
+		return nil, errors.Annotatef(err, "Unmarshal outcome %s failure", key)
+	}
+	return &outcome, nil
+}
+
+// IsCompleted reports whether saga with given id has completed with all sub-transactions succeeded.
+// It requires WithOutcomeStore.
+func (e *ExecutionCoordinator) IsCompleted(id string) (bool, error) {
+	outcome, err := e.Outcome(id)
+	if err != nil {
+		return false, err
+	}
+	return outcome != nil && outcome.Outcome == OutcomeCompleted, nil
+}
+
+// logIDOf returns logID of saga with given id.
+func (e *ExecutionCoordinator) logIDOf(id string) string {
+	if e.opts.logIDFunc != nil {
+		return e.opts.logIDFunc(id)
+	}
+	return LogPrefix + id
+}
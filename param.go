@@ -1,6 +1,7 @@
 package saga
 
 import (
+	"fmt"
 	"reflect"
 )
 
@@ -9,28 +10,81 @@ import (
 type ParamData struct {
 	ParamType string `json:"paramType,omitempty"`
 	Data      string `json:"data,omitempty"`
+	// Secret refers to the in-memory value of an argument redacted by SecretArgs
+	Secret string `json:"secret,omitempty"`
 }
 
 // MarshalParam convert args into ParamData.
-// This method will lookup typeName in given SEC.
+// This method will lookup typeName in given SEC, it panics with *MarshalError if an arg can't be serialized.
 func MarshalParam(sec *ExecutionCoordinator, args []interface{}) []ParamData {
-	p := make([]ParamData, 0, len(args))
-	for _, arg := range args {
-		typ := sec.MustFindParamName(reflect.ValueOf(arg).Type())
-		p = append(p, ParamData{
-			ParamType: typ,
-			Data:      mustMarshal(arg),
-		})
+	p, err := marshalParams(sec, "", args)
+	if err != nil {
+		panic(err)
 	}
 	return p
 }
 
+// marshalParams converts args of sub-transaction subTxID into ParamData,
+// it returns *MarshalError for the first arg whose type isn't registered or can't be encoded.
+func marshalParams(sec *ExecutionCoordinator, subTxID string, args []interface{}) ([]ParamData, error) {
+	p := make([]ParamData, 0, len(args))
+	// lookup under a single read lock instead of locking per argument
+	sec.mu.RLock()
+	defer sec.mu.RUnlock()
+	for i, arg := range args {
+		typ, ok := sec.paramTypeRegister.findTypeName(reflect.TypeOf(arg))
+		if !ok {
+			return nil, &MarshalError{SubTxID: subTxID, Index: i, Type: fmt.Sprintf("%T", arg), Err: errTypeNotRegistered}
+		}
+		param, err := encodeParam(subTxID, i, typ, arg)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, param)
+	}
+	return p, nil
+}
+
+// marshalNamedParams likes marshalParams, but type names of args are already resolved, e.g. by stepPlan.
+func marshalNamedParams(subTxID string, typeNames []string, args []interface{}) ([]ParamData, error) {
+	p := make([]ParamData, 0, len(args))
+	for i, arg := range args {
+		param, err := encodeParam(subTxID, i, typeNames[i], arg)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, param)
+	}
+	return p, nil
+}
+
+func encodeParam(subTxID string, i int, typ string, arg interface{}) (ParamData, error) {
+	data, err := marshal(arg)
+	if err != nil {
+		return ParamData{}, &MarshalError{SubTxID: subTxID, Index: i, Type: fmt.Sprintf("%T", arg), Err: err}
+	}
+	return ParamData{
+		ParamType: typ,
+		Data:      data,
+	}, nil
+}
+
 // UnmarshalParam convert ParamData back to parameter values to function call usage.
 // This method will lookup reflect.Type in given SEC.
 func UnmarshalParam(sec *ExecutionCoordinator, paramData []ParamData) []reflect.Value {
-	var values []reflect.Value
+	values := make([]reflect.Value, 0, len(paramData))
+	sec.mu.RLock()
+	defer sec.mu.RUnlock()
 	for _, param := range paramData {
-		ptyp := sec.MustFindParamType(param.ParamType)
+		ptyp, ok := sec.paramTypeRegister.findType(param.ParamType)
+		if !ok {
+			panic("Find Param Type Panic: " + param.ParamType)
+		}
+		// redacted secret can't be decoded, it's revealed by compensate
+		if param.Secret != "" {
+			values = append(values, reflect.Zero(ptyp))
+			continue
+		}
 		obj := reflect.New(ptyp).Interface()
 		mustUnmarshal([]byte(param.Data), obj)
 		objV := reflect.ValueOf(obj)
@@ -41,3 +95,34 @@ func UnmarshalParam(sec *ExecutionCoordinator, paramData []ParamData) []reflect.
 	}
 	return values
 }
+
+// MarshalFailurePolicy decides how saga fails when args of a sub-transaction can't be serialized, see MarshalError.
+type MarshalFailurePolicy int
+
+const (
+	// MarshalFailCompensate aborts the saga and compensates steps done, like a failed action. It's the default.
+	MarshalFailCompensate MarshalFailurePolicy = iota
+	// MarshalFailNoCompensate aborts the saga without compensation, CompensationSkipped is logged and steps done
+	// are kept as they are, e.g. to repair args and finish the saga by hand.
+	MarshalFailNoCompensate
+)
+
+// WithMarshalFailurePolicy sets how saga fails on MarshalError. Args are serialized into ActionStart log
+// before the action runs, so the failing action is never run, while a compensation payload(see CompensateWithPayload)
+// is serialized after: its action ran, so it's logged done without the payload, and compensating it fails
+// with ErrPayloadLost, which dead-letters the saga and keeps its log for manual repair.
+func WithMarshalFailurePolicy(policy MarshalFailurePolicy) Option {
+	return func(o *options) {
+		o.marshalFailurePolicy = policy
+	}
+}
+
+// failMarshal fails saga with MarshalError err according to WithMarshalFailurePolicy.
+func (s *Saga) failMarshal(group int, err error) {
+	if s.sec.opts.marshalFailurePolicy == MarshalFailNoCompensate {
+		s.mu.Lock()
+		s.skipCompensation = true
+		s.mu.Unlock()
+	}
+	s.fail(group, err)
+}
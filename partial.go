@@ -0,0 +1,63 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// PartialError is returned by action processing many items which succeeded on some items only.
+// The saga aborts like on any error, but the action is still compensated: Succeeded is persisted
+// with its ActionEnd log and given to compensate by SucceededItems, so only these items are rolled back.
+// Action returning PartialError isn't retried.
+type PartialError struct {
+	// Succeeded are indexes of the items succeeded
+	Succeeded []int
+	Err       error
+}
+
+// Partial returns PartialError of action succeeded on items at indexes succeeded, and failed by err on others.
+func Partial(succeeded []int, err error) error {
+	return &PartialError{Succeeded: succeeded, Err: err}
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("partial success of %d items: %v", len(e.Succeeded), e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// PartialCompensate registers compensate of action failed midway, i.e. action returned error.
+// By default a failed action isn't compensated, since it's expected to fail without side effect
+// (PartialError aside), and compensate only undoes fully succeeded action when the saga aborts later.
+// With PartialCompensate, a failed action is recorded and partialCompensate is called with its arguments
+// when the saga aborts, e.g. to clean up what the action left behind before it failed.
+// partialCompensate must accept the same arguments as compensate, SucceededItems works for it as well
+// if the action returned PartialError.
+func PartialCompensate(partialCompensate interface{}) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.partialCompensate = reflect.ValueOf(partialCompensate)
+	}
+}
+
+// validatePartialCompensate checks partial compensate accepts the arguments recorded for action.
+func validatePartialCompensate(def subTxDefinition) error {
+	if !def.partialCompensate.IsValid() {
+		return nil
+	}
+	if _, err := validateSubTxFunc(def.subTxID, "partial compensate", def.partialCompensate.Interface()); err != nil {
+		return err
+	}
+	return validateCompensate(def.subTxID, def.action, def.partialCompensate)
+}
+
+type succeededCtxKey struct{}
+
+// SucceededItems returns indexes of items succeeded from compensate context,
+// ok is false if action succeeded on all items, i.e. it didn't return PartialError.
+func SucceededItems(ctx context.Context) (succeeded []int, ok bool) {
+	succeeded, ok = ctx.Value(succeededCtxKey{}).([]int)
+	return succeeded, ok
+}
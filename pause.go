@@ -0,0 +1,91 @@
+package saga
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// pausedKeyPrefix prefixes logID to key pause marker of a paused saga
+const pausedKeyPrefix = "sagapaused_"
+
+// WithPausePolling makes ExecSub check pause marker set by Pause before every action,
+// and poll it every interval while the saga is paused. It costs a storage round-trip per action,
+// so Pause has no effect on coordinator without this option.
+func WithPausePolling(interval time.Duration) Option {
+	return func(o *options) {
+		o.pausePollInterval = interval
+	}
+}
+
+// Pause pauses forward execution of a running saga, e.g. during a downstream maintenance window.
+// The pause marker is persisted, so it survives restarts until Resume. The action in progress finishes,
+// the next ExecSub blocks until the saga is resumed or saga context is done, in which case the saga aborts.
+// Time paused isn't counted into action timeout, but saga context deadline still applies.
+// Pause never blocks compensation: Abort, watchdog and RetryCompensateFailure compensate paused sagas as usual.
+// It requires WithPausePolling on the coordinator running the saga.
+func (e *ExecutionCoordinator) Pause(logID string) error {
+	last, err := e.storeOf(logID).LastLog(logID)
+	if err != nil {
+		return errors.Annotatef(err, "LastLog %s failure", logID)
+	}
+	if last == "" {
+		return fmt.Errorf("Pause %s: saga log not found", logID)
+	}
+	log := &Log{Type: SagaPaused, Time: time.Now()}
+	if err := e.storeOf(logID).AppendLog(logID, log.mustMarshal()); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", logID)
+	}
+	if err := e.storeOf(logID).AppendLog(pausedKeyPrefix+logID, log.Time.Format(time.RFC3339Nano)); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", pausedKeyPrefix+logID)
+	}
+	return nil
+}
+
+// Resume resumes forward execution of a saga paused by Pause, it returns ErrNotPaused if the saga isn't paused.
+func (e *ExecutionCoordinator) Resume(logID string) error {
+	paused, err := e.isPaused(logID)
+	if err != nil {
+		return err
+	}
+	if !paused {
+		return fmt.Errorf("Resume %s: %w", logID, ErrNotPaused)
+	}
+	log := &Log{Type: SagaResumed, Time: time.Now()}
+	if err := e.storeOf(logID).AppendLog(logID, log.mustMarshal()); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", logID)
+	}
+	if err := e.storeOf(logID).Cleanup(pausedKeyPrefix + logID); err != nil {
+		return errors.Annotatef(err, "Cleanup %s failure", pausedKeyPrefix+logID)
+	}
+	return nil
+}
+
+func (e *ExecutionCoordinator) isPaused(logID string) (bool, error) {
+	marker, err := e.storeOf(logID).LastLog(pausedKeyPrefix + logID)
+	if err != nil {
+		return false, errors.Annotatef(err, "LastLog %s failure", pausedKeyPrefix+logID)
+	}
+	return marker != "", nil
+}
+
+// waitResumed blocks while the saga is paused, it returns error if saga context is done or pause marker can't be read.
+func (s *Saga) waitResumed() error {
+	interval := s.sec.opts.pausePollInterval
+	if interval <= 0 {
+		return nil
+	}
+	for {
+		paused, err := s.sec.isPaused(s.logID)
+		if err != nil {
+			return &StoreError{Op: "waitResumed", Err: err}
+		}
+		if !paused {
+			return nil
+		}
+		if err := sleepContext(s.context, interval); err != nil {
+			return fmt.Errorf("paused: %w", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// CompensateWithPayload makes compensate receive the compensation payload set by action through
+// SetCompensationPayload instead of the action args, e.g. ID of the resource created by action.
+// compensate must take exactly one argument after context, the payload, whose type is registered like other params.
+// Compensation is skipped if the action succeeded without setting payload, there's nothing to undo then.
+func CompensateWithPayload() SubTxOption {
+	return func(def *subTxDefinition) {
+		def.compensatePayload = true
+	}
+}
+
+// SetCompensationPayload sets compensation payload from action context of sub-transaction registered with
+// CompensateWithPayload. payload is persisted with the action's ActionEnd log separately from action args,
+// and given to compensate when the saga aborts. It does nothing if ctx isn't given by a saga.
+func SetCompensationPayload(ctx context.Context, payload interface{}) {
+	scope, ok := ctx.Value(valuesCtxKey{}).(*valueScope)
+	if !ok || scope.written == nil {
+		return
+	}
+	scope.mu.Lock()
+	scope.payload = payload
+	scope.mu.Unlock()
+}
+
+// validateCompensatePayload checks compensate takes the payload only.
+func validateCompensatePayload(def subTxDefinition) error {
+	if n := def.compensate.Type().NumIn() - 1; n != 1 {
+		return fmt.Errorf("subTxID %s: %w: compensate with payload takes %d arguments after context, expected 1",
+			def.subTxID, ErrInvalidSubTx, n)
+	}
+	return nil
+}
+
+// marshalPayload marshals payload of action for ActionEnd log, it returns nil if action set no payload.
+func (s *Saga) marshalPayload(def subTxDefinition, scope *valueScope) (*ParamData, error) {
+	scope.mu.Lock()
+	payload := scope.payload
+	scope.mu.Unlock()
+	if !def.compensatePayload || payload == nil {
+		return nil, nil
+	}
+	if want := def.compensate.Type().In(1); !reflect.TypeOf(payload).AssignableTo(want) {
+		return nil, fmt.Errorf("compensation payload of %s: %w: %T isn't assignable to %s", def.subTxID, ErrInvalidSubTx, payload, want)
+	}
+	params, err := marshalParams(s.sec, def.subTxID, []interface{}{payload})
+	if err != nil {
+		return nil, err
+	}
+	return &params[0], nil
+}
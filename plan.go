@@ -0,0 +1,42 @@
+package saga
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// CompensationStep is a compensate that Abort would perform.
+type CompensationStep struct {
+	SubTxID string        `json:"subTxID"`
+	Args    []interface{} `json:"args,omitempty"`
+	// Manual reports compensate is marked by ManualCompensate
+	Manual bool `json:"manual,omitempty"`
+}
+
+// PlanCompensation previews compensations a real Abort(or resumed compensation) of given saga would perform,
+// in execution order with decoded arguments, without calling any compensate. It's read-only.
+func (e *ExecutionCoordinator) PlanCompensation(logID string) (steps []CompensationStep, err error) {
+	logs, err := e.storeOf(logID).Lookup(logID)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			steps, err = nil, fmt.Errorf("PlanCompensation %s failure: %v", logID, r)
+		}
+	}()
+	actionEnds, _ := pendingCompensations(unmarshalLogs(logs))
+	steps = make([]CompensationStep, 0, len(actionEnds))
+	for i := len(actionEnds) - 1; i >= 0; i-- {
+		step := CompensationStep{
+			SubTxID: actionEnds[i].SubTxID,
+			Manual:  e.mustFindSubTxDefVersion(actionEnds[i].SubTxID, actionEnds[i].Version).manualCompensate,
+		}
+		for _, arg := range UnmarshalParam(e, actionEnds[i].Params) {
+			step.Args = append(step.Args, arg.Interface())
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
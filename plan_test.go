@@ -0,0 +1,26 @@
+package saga
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanCompensation(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("refund", acc.deduce, acc.deduceCompensate, ManualCompensate())
+
+	s := sec.StartSaga(context.Background(), "plan")
+	s.ExecSub("deduce", "foo", 10).ExecSub("refund", "foo", 20)
+	steps, err := sec.PlanCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, []CompensationStep{
+		{SubTxID: "refund", Args: []interface{}{"foo", 20}, Manual: true},
+		{SubTxID: "deduce", Args: []interface{}{"foo", 10}},
+	}, steps)
+	// read-only
+	assert.Equal(t, 70, acc.balance["foo"])
+}
@@ -0,0 +1,30 @@
+package saga
+
+// LogPublisher publishes saga log entries to external event bus(NATS, Kafka, etc.),
+// so other services can react to saga progress in real time.
+type LogPublisher interface {
+	// Publish publishes log entry appended under logID
+	Publish(logID string, log Log) error
+}
+
+// LogPublisherFunc adapts ordinary function to LogPublisher.
+type LogPublisherFunc func(logID string, log Log) error
+
+// Publish calls f(logID, log).
+func (f LogPublisherFunc) Publish(logID string, log Log) error {
+	return f(logID, log)
+}
+
+// publish publishes log entry after it's appended, best-effort.
+func (e *ExecutionCoordinator) publish(logID string, log Log) {
+	if e.opts.publisher == nil {
+		return
+	}
+	if err := e.opts.publisher.Publish(logID, log); err != nil {
+		if e.opts.publishErrorHook != nil {
+			e.opts.publishErrorHook(logID, log, err)
+			return
+		}
+		e.opts.logger.Printf("[WARNING]Publish log of %s failure: %v", logID, err)
+	}
+}
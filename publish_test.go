@@ -0,0 +1,32 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogPublisher(t *testing.T) {
+	var published []LogType
+	var publishErrs int
+	publisher := LogPublisherFunc(func(logID string, log Log) error {
+		published = append(published, log.Type)
+		if log.Type == ActionStart {
+			return errors.New("bus unavailable")
+		}
+		return nil
+	})
+	sec := newTestSEC(t, WithLogPublisher(publisher, func(logID string, log Log, err error) {
+		publishErrs++
+	}))
+	acc := &account{balance: map[string]int{}}
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+
+	s := sec.StartSaga(context.Background(), "publish")
+	s.ExecSub("deduce", "foo", 1)
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, []LogType{SagaStart, ActionStart, ActionEnd, SagaEnd}, published)
+	assert.Equal(t, 1, publishErrs)
+}
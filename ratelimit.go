@@ -0,0 +1,187 @@
+package saga
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WithCompensateRateLimit bounds compensates of subTxID to rate per second with bursts of burst,
+// e.g. so a mass abort doesn't overwhelm a fragile downstream. The token bucket is shared by all sagas
+// of the coordinator, every compensate attempt waits for a token, and gives up when abort timeout
+// (see WithAbortTimeout) would be exceeded while waiting. Waiting compensates get tokens by priority
+// of their sagas(see WithPriorityTag), then in arrival order. rate must be positive. Default is unlimited.
+func WithCompensateRateLimit(subTxID string, rate float64, burst int) Option {
+	return func(o *options) {
+		if o.compensateLimits == nil {
+			o.compensateLimits = make(map[string]*tokenBucket)
+		}
+		o.compensateLimits[subTxID] = newTokenBucket(rate, burst)
+	}
+}
+
+// WithPriorityTag sets the tag(see WithTags) holding priority of saga as an integer, compensates of sagas
+// with higher priority get tokens of WithCompensateRateLimit first when tokens are scarce,
+// e.g. so payments are compensated first during a throttled mass rollback. Missing or malformed priority is 0.
+func WithPriorityTag(key string) Option {
+	return func(o *options) {
+		o.priorityTag = key
+	}
+}
+
+// priorityOf returns priority of saga tagged with tags, see WithPriorityTag.
+func (e *ExecutionCoordinator) priorityOf(tags map[string]string) int {
+	if e.opts.priorityTag == "" {
+		return 0
+	}
+	priority, _ := strconv.Atoi(tags[e.opts.priorityTag])
+	return priority
+}
+
+// tokenBucket is a token bucket rate limiter, tokens are handed to waiters by priority.
+type tokenBucket struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	waiters tokenWaiters
+	seq     int64
+	// armed is set while a dispatch is scheduled
+	armed bool
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// tokenWaiter waits for a token, ready is closed once granted.
+type tokenWaiter struct {
+	priority int
+	seq      int64
+	index    int
+	granted  bool
+	ready    chan struct{}
+}
+
+// tokenWaiters is a heap of waiters, higher priority first, then earlier arrival.
+type tokenWaiters []*tokenWaiter
+
+func (w tokenWaiters) Len() int { return len(w) }
+
+func (w tokenWaiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority > w[j].priority
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w tokenWaiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *tokenWaiters) Push(x interface{}) {
+	waiter := x.(*tokenWaiter)
+	waiter.index = len(*w)
+	*w = append(*w, waiter)
+}
+
+func (w *tokenWaiters) Pop() interface{} {
+	old := *w
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	*w = old[:len(old)-1]
+	return waiter
+}
+
+// refill adds tokens accumulated since last refill, must be called with mu held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait takes a token, waiting until it's handed to the waiter of priority or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, priority int) error {
+	b.mu.Lock()
+	b.refill()
+	if len(b.waiters) == 0 && b.tokens >= 1 {
+		b.tokens--
+		b.mu.Unlock()
+		return nil
+	}
+	b.seq++
+	waiter := &tokenWaiter{priority: priority, seq: b.seq, ready: make(chan struct{})}
+	heap.Push(&b.waiters, waiter)
+	b.schedule()
+	b.mu.Unlock()
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if waiter.granted {
+		return nil
+	}
+	heap.Remove(&b.waiters, waiter.index)
+	return ctx.Err()
+}
+
+// schedule arms dispatch for the time the next token is available, must be called with mu held.
+func (b *tokenBucket) schedule() {
+	if b.armed || len(b.waiters) == 0 {
+		return
+	}
+	b.armed = true
+	delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	time.AfterFunc(delay, b.dispatch)
+}
+
+// dispatch hands available tokens to waiters by priority.
+func (b *tokenBucket) dispatch() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.armed = false
+	b.refill()
+	for len(b.waiters) > 0 && b.tokens >= 1 {
+		waiter := heap.Pop(&b.waiters).(*tokenWaiter)
+		b.tokens--
+		waiter.granted = true
+		close(waiter.ready)
+	}
+	b.schedule()
+}
+
+// waitCompensateToken waits for a token of rate limit of subTxID set by WithCompensateRateLimit.
+func (s *Saga) waitCompensateToken(subTxID string) error {
+	limit, ok := s.sec.opts.compensateLimits[subTxID]
+	if !ok {
+		return nil
+	}
+	ctx := s.compensateCtx
+	if !s.compensateDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, s.compensateDeadline)
+		defer cancel()
+	}
+	if err := limit.wait(ctx, s.priority); err != nil {
+		if err == context.DeadlineExceeded && !s.compensateDeadline.IsZero() {
+			return fmt.Errorf("compensate %s rate limited: %w", subTxID, ErrAbortTimeout)
+		}
+		return fmt.Errorf("compensate %s rate limited: %w", subTxID, err)
+	}
+	return nil
+}
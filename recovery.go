@@ -0,0 +1,460 @@
+package saga
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// ListCompensateFailures returns logIDs of sagas whose compensation gave up(dead-lettered).
+func (e *ExecutionCoordinator) ListCompensateFailures() ([]string, error) {
+	logIDs, err := e.store.Lookup(compensateFailuresLogID)
+	if err != nil {
+		return nil, errors.Annotate(err, "Lookup compensate failures failure")
+	}
+	return uniqueLogIDs(logIDs), nil
+}
+
+// ListCompensateAlerts returns logIDs of dead-lettered sagas whose ManualCompensate failed,
+// they need human intervention and should be handled before other compensate failures.
+func (e *ExecutionCoordinator) ListCompensateAlerts() ([]string, error) {
+	logIDs, err := e.store.Lookup(compensateAlertsLogID)
+	if err != nil {
+		return nil, errors.Annotate(err, "Lookup compensate alerts failure")
+	}
+	return uniqueLogIDs(logIDs), nil
+}
+
+// RetryCompensateFailure resumes compensation of a dead-lettered saga,
+// only the sub-transactions not yet compensated will be compensated.
+// It removes logID from dead-letter list on success, returns ErrCompensateFailed if compensation failed again.
+func (e *ExecutionCoordinator) RetryCompensateFailure(ctx context.Context, logID string) error {
+	if err := e.retryCompensateFailure(ctx, logID); err != nil {
+		return err
+	}
+	return e.removeCompensateFailures(logID)
+}
+
+// RetryAllCompensateFailures retries all dead-lettered sagas with bounded concurrency(see WithRecoveryConcurrency),
+// it's a one-shot "drain the dead-letter list" operation after a downstream recovers.
+// It returns logIDs retried successfully and the ones failed again, err is only returned
+// when dead-letter list can't be read or updated, or ctx is done.
+func (e *ExecutionCoordinator) RetryAllCompensateFailures(ctx context.Context) (succeeded, failed []string, err error) {
+	logIDs, err := e.ListCompensateFailures()
+	if err != nil {
+		return nil, nil, err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, e.opts.recoveryConcurrency)
+	for _, logID := range logIDs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(logID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			retryErr := e.retryCompensateFailure(ctx, logID)
+			mu.Lock()
+			defer mu.Unlock()
+			if retryErr != nil {
+				e.opts.logger.Printf("[WARNING]Retry compensate failure %s: %v", logID, retryErr)
+				failed = append(failed, logID)
+				return
+			}
+			succeeded = append(succeeded, logID)
+		}(logID)
+	}
+	wg.Wait()
+	if err := e.removeCompensateFailures(succeeded...); err != nil {
+		return succeeded, failed, err
+	}
+	return succeeded, failed, ctx.Err()
+}
+
+func (e *ExecutionCoordinator) retryCompensateFailure(ctx context.Context, logID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ok, err := e.resumeCompensation(logID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w", logID, ErrCompensateFailed)
+	}
+	return nil
+}
+
+func (e *ExecutionCoordinator) removeCompensateFailures(logIDs ...string) error {
+	if len(logIDs) == 0 {
+		return nil
+	}
+	if err := e.removeLogID(compensateAlertsLogID, logIDs...); err != nil {
+		return err
+	}
+	return e.removeLogID(compensateFailuresLogID, logIDs...)
+}
+
+// StartWatchdog starts a goroutine which checks sagas scheduled by compensate retry schedule every interval,
+// and resumes their compensation when due. With WithHeartbeat, it also compensates sagas with stale heartbeat.
+// The goroutine stops when ctx is done.
+func (e *ExecutionCoordinator) StartWatchdog(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := e.retryDueCompensations(); err != nil {
+					e.opts.logger.Printf("[WARNING]Watchdog retry compensations failure: %v", err)
+				}
+				if e.opts.heartbeatInterval > 0 {
+					if err := e.recoverCrashedSagas(); err != nil {
+						e.opts.logger.Printf("[WARNING]Watchdog recover crashed sagas failure: %v", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (e *ExecutionCoordinator) retryDueCompensations() error {
+	logIDs, err := e.store.Lookup(compensateRetriesLogID)
+	if err != nil {
+		return errors.Annotate(err, "Lookup compensate retries failure")
+	}
+	for _, logID := range uniqueLogIDs(logIDs) {
+		next, scheduled, err := e.nextCompensateRetry(logID)
+		if err != nil {
+			return err
+		}
+		if scheduled && time.Now().Before(next) {
+			continue
+		}
+		if scheduled {
+			if _, err := e.resumeCompensation(logID); stderrors.Is(err, ErrSagaLocked) {
+				// another coordinator is resuming it
+				continue
+			} else if err != nil {
+				return err
+			}
+			// failed again, a new retry has been scheduled
+			if _, scheduled, err = e.nextCompensateRetry(logID); err != nil || scheduled {
+				continue
+			}
+		}
+		if err := e.removeLogID(compensateRetriesLogID, logID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextCompensateRetry returns next retry time if saga has a pending compensate retry.
+func (e *ExecutionCoordinator) nextCompensateRetry(logID string) (time.Time, bool, error) {
+	logs, err := e.storeOf(logID).Lookup(logID)
+	if err != nil {
+		return time.Time{}, false, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	// a retry is pending if no compensation started after the last CompensateRetry log
+	var pending *Log
+	for _, logData := range logs {
+		log := mustUnmarshalLog(logData)
+		switch log.Type {
+		case CompensateRetry:
+			pending = &log
+		case CompensateStart, CompensateEnd, CompensateFailed:
+			pending = nil
+		}
+	}
+	if pending == nil {
+		return time.Time{}, false, nil
+	}
+	return pending.NextRetry, true, nil
+}
+
+// resumeCompensation compensates the sub-transactions in saga log which haven't been compensated,
+// and cleans up saga log on success.
+// With storage implementing storage.Locker, it returns ErrSagaLocked if the saga is locked by another coordinator.
+func (e *ExecutionCoordinator) resumeCompensation(logID string) (bool, error) {
+	store := e.storeOf(logID)
+	if locker, ok := store.(storage.Locker); ok {
+		unlock, locked, err := locker.TryLockSaga(logID)
+		if err != nil {
+			return false, errors.Annotatef(err, "TryLockSaga %s failure", logID)
+		}
+		if !locked {
+			return false, fmt.Errorf("%s: %w", logID, ErrSagaLocked)
+		}
+		defer func() {
+			if err := unlock(); err != nil {
+				e.opts.logger.Printf("[WARNING]Unlock saga %s failure: %v", logID, err)
+			}
+		}()
+	}
+	logs, err := store.Lookup(logID)
+	if err != nil {
+		return false, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	all := unmarshalLogs(logs)
+	if e.opts.logChecksum {
+		if err := verifyChain(all); err != nil {
+			return false, fmt.Errorf("%s: %w: %v", logID, ErrLogCorrupted, err)
+		}
+	}
+	s := e.recoverSaga(logID, all)
+	s.correlationID = correlationIDOf(all)
+	s.labels = e.labelsOf(tagsOf(all))
+	s.priority = e.priorityOf(tagsOf(all))
+	s.depth = depthOf(all)
+	for _, log := range all {
+		s.state.restore(log)
+	}
+	s.steps = completedSteps(all)
+	s.prevRetryDelay = lastRetryDelay(all)
+	if uncertain := e.uncertainCompensations(all); len(uncertain) > 0 {
+		s.escalateUncertain(uncertain)
+		return false, nil
+	}
+	actionEnds, retries := pendingCompensations(s.compensateDangling(all))
+	if !s.compensateAll(actionEnds, retries) {
+		return false, nil
+	}
+	outcome := s.newOutcome(OutcomeCompensated)
+	if err := s.recordOutcome(outcome); err != nil {
+		return true, errors.Annotatef(err, "Record outcome %s failure", logID)
+	}
+	switch e.cleanupAction(outcome) {
+	case CleanupRetain:
+		return true, nil
+	case CleanupArchive:
+		if err := e.archive(logID); err != nil {
+			return true, errors.Annotatef(err, "Archive %s failure", logID)
+		}
+	}
+	if err := store.Cleanup(logID); err != nil {
+		return true, errors.Annotatef(err, "Cleanup %s failure", logID)
+	}
+	return true, nil
+}
+
+// pendingCompensations returns ActionEnd logs haven't been compensated in append order,
+// and the number of scheduled compensate retries already made.
+// Returned ActionEnd logs have Step set, which pairs them with their CompensateStart/End logs.
+func pendingCompensations(logs []Log) ([]Log, int) {
+	var actionEnds []Log
+	compensated := make(map[int]bool)
+	unpaired, retries := 0, 0
+	params := make(startParams)
+	for _, log := range logs {
+		params.restore(&log)
+		switch log.Type {
+		case ActionEnd:
+			log.Step = len(actionEnds) + 1
+			actionEnds = append(actionEnds, log)
+		case CompensateEnd:
+			if log.Step > 0 {
+				compensated[log.Step] = true
+			} else {
+				unpaired++
+			}
+		case CompensateRetry:
+			retries++
+		case CompensationSkipped:
+			// compensation was declined, nothing is pending
+			return nil, retries
+		}
+	}
+	pending := make([]Log, 0, len(actionEnds))
+	for _, log := range actionEnds {
+		if !compensated[log.Step] {
+			pending = append(pending, log)
+		}
+	}
+	// CompensateEnd written before Step was recorded can't be paired,
+	// sub-transactions are compensated in reverse order, so the compensated ones are always the last
+	if unpaired > len(pending) {
+		unpaired = len(pending)
+	}
+	return pending[:len(pending)-unpaired], retries
+}
+
+// uncertainCompensations returns CompensateStart logs followed by neither CompensateEnd nor CompensateFailed,
+// i.e. compensates interrupted by crash, unless the sub-transaction is now declared by IdempotentCompensate.
+func (e *ExecutionCoordinator) uncertainCompensations(logs []Log) []Log {
+	started := make(map[int]Log)
+	seen := make(map[int]bool)
+	var steps []int
+	var actionEnds []Log
+	for _, log := range logs {
+		if log.Type == ActionEnd {
+			actionEnds = append(actionEnds, log)
+		}
+		if log.Step == 0 {
+			continue
+		}
+		switch log.Type {
+		case CompensateStart:
+			if !seen[log.Step] {
+				seen[log.Step] = true
+				steps = append(steps, log.Step)
+			}
+			started[log.Step] = log
+		case CompensateEnd, CompensateFailed:
+			delete(started, log.Step)
+		}
+	}
+	var uncertain []Log
+	for _, step := range steps {
+		log, ok := started[step]
+		if !ok || step > len(actionEnds) {
+			continue
+		}
+		end := actionEnds[step-1]
+		if !e.mustFindSubTxDefVersion(end.SubTxID, end.Version).idempotentCompensate {
+			uncertain = append(uncertain, log)
+		}
+	}
+	return uncertain
+}
+
+// escalateUncertain resolves interrupted compensates as failed and dead-letters the saga with high priority,
+// so they're only re-run by RetryCompensateFailure.
+func (s *Saga) escalateUncertain(uncertain []Log) {
+	for _, log := range uncertain {
+		s.failCompensate(log, ErrCompensateUncertain)
+	}
+	s.compensateFail = true
+	s.alertCompensateFailure(uncertain[0].SubTxID, fmt.Errorf("compensate %s: %w", uncertain[0].SubTxID, ErrCompensateUncertain))
+}
+
+// unmarshalLogs decodes saga log entries.
+func unmarshalLogs(logs []string) []Log {
+	decoded := make([]Log, 0, len(logs))
+	for _, logData := range logs {
+		decoded = append(decoded, mustUnmarshalLog(logData))
+	}
+	return decoded
+}
+
+// recoverSaga rebuilds Saga for given logID to continue its compensation, logs are its saga log if already read.
+func (e *ExecutionCoordinator) recoverSaga(logID string, logs []Log) *Saga {
+	return &Saga{
+		id:      e.sagaIDOf(logID, logs),
+		logID:   logID,
+		context: context.Background(),
+		sec:     e,
+		store:   e.storeOf(logID),
+		state:   newState(),
+		span:    nopSpan{},
+		// recovered saga never took an in-flight slot
+		ended: 1,
+	}
+}
+
+// sagaIDOf returns id StartSaga built logID from, see logIDOf. Since logID built by WithLogIDFunc can't be mapped back,
+// id is read from SagaStart log, whose first entry is streamed unless logs are given. Logs written before SagaStart
+// carried id fall back to logID without the coordinator's prefix.
+func (e *ExecutionCoordinator) sagaIDOf(logID string, logs []Log) string {
+	if e.opts.logIDFunc == nil {
+		return strings.TrimPrefix(logID, LogPrefix)
+	}
+	if logs == nil {
+		if it, err := e.storeOf(logID).LookupStream(logID); err == nil {
+			if it.Next() {
+				logs = []Log{mustUnmarshalLog(it.Value())}
+			}
+			it.Close()
+		}
+	}
+	for _, log := range logs {
+		if log.Type == SagaStart && log.SagaID != "" {
+			return log.SagaID
+		}
+	}
+	return strings.TrimPrefix(logID, e.logPrefix)
+}
+
+// removeLogID removes logIDs from list stored under given key.
+func (e *ExecutionCoordinator) removeLogID(key string, logIDs ...string) error {
+	_, err := e.rewriteList(key, logIDs...)
+	return err
+}
+
+// appendList appends logID to list stored under given key. Unless storage implements storage.Remover,
+// it's serialized with rewriteList of this coordinator, which can't protect the list from other processes.
+func (e *ExecutionCoordinator) appendList(key, logID string) error {
+	if _, ok := e.store.(storage.Remover); !ok {
+		e.listMu.Lock()
+		defer e.listMu.Unlock()
+	}
+	if err := e.store.AppendLog(key, logID); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", key)
+	}
+	return nil
+}
+
+// rewriteList removes logIDs from list stored under given key, and returns the number of logIDs left.
+// Removal is atomic if storage implements storage.Remover, otherwise the list is looked up and rewritten
+// without logIDs, which loses logIDs appended meanwhile by other processes, e.g. coordinator replicas.
+func (e *ExecutionCoordinator) rewriteList(key string, logIDs ...string) (int, error) {
+	if remover, ok := e.store.(storage.Remover); ok {
+		left, err := remover.RemoveEntries(key, logIDs...)
+		if err != nil {
+			return 0, errors.Annotatef(err, "RemoveEntries %s failure", key)
+		}
+		return left, nil
+	}
+	e.listMu.Lock()
+	defer e.listMu.Unlock()
+	removed := make(map[string]bool, len(logIDs))
+	for _, logID := range logIDs {
+		removed[logID] = true
+	}
+	stored, err := e.store.Lookup(key)
+	if err != nil {
+		return 0, errors.Annotatef(err, "Lookup %s failure", key)
+	}
+	if err := e.store.Cleanup(key); err != nil {
+		return 0, errors.Annotatef(err, "Cleanup %s failure", key)
+	}
+	left := 0
+	for _, id := range uniqueLogIDs(stored) {
+		if removed[id] {
+			continue
+		}
+		if err := e.store.AppendLog(key, id); err != nil {
+			return 0, errors.Annotatef(err, "AppendLog %s failure", key)
+		}
+		left++
+	}
+	return left, nil
+}
+
+func uniqueLogIDs(logIDs []string) []string {
+	seen := make(map[string]bool, len(logIDs))
+	unique := make([]string, 0, len(logIDs))
+	for _, logID := range logIDs {
+		if !seen[logID] {
+			seen[logID] = true
+			unique = append(unique, logID)
+		}
+	}
+	return unique
+}
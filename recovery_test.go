@@ -0,0 +1,999 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyCompensate fails the first failures calls.
+type flakyCompensate struct {
+	failures int32
+	calls    int32
+}
+
+func (f *flakyCompensate) action(ctx context.Context, name string) error {
+	return nil
+}
+
+func (f *flakyCompensate) compensate(ctx context.Context, name string) error {
+	if atomic.AddInt32(&f.calls, 1) <= f.failures {
+		return errors.New("downstream unavailable")
+	}
+	return nil
+}
+
+func failAction(ctx context.Context) error {
+	return errors.New("action failure")
+}
+
+func failCompensate(ctx context.Context) error {
+	return nil
+}
+
+func TestCompensateRetrySchedule(t *testing.T) {
+	flaky := &flakyCompensate{failures: 15}
+	sec := newTestSEC(t, WithCompensateRetrySchedule(10*time.Millisecond, 10*time.Millisecond))
+	sec.AddSubTxDef("flaky", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "retry")
+	s.ExecSub("flaky", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Empty(t, failures)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sec.StartWatchdog(ctx, 5*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		logs, _ := sec.store.Lookup(s.logID)
+		return len(logs) == 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(16), atomic.LoadInt32(&flaky.calls))
+}
+
+func TestCompensateRetryBackoff(t *testing.T) {
+	flaky := &flakyCompensate{failures: 100}
+	store, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	newSEC := func() *ExecutionCoordinator {
+		sec := NewSEC(store, LogPrefix, WithCompensateRetryBackoff(Backoff{Base: time.Minute}, 2))
+		sec.AddSubTxDef("flaky", flaky.action, flaky.compensate).
+			AddSubTxDef("fail", failAction, failCompensate)
+		return &sec
+	}
+	lastRetry := func(logID string) Log {
+		logs, err := store.Lookup(logID)
+		assert.NoError(t, err)
+		var retry Log
+		for _, log := range unmarshalLogs(logs) {
+			if log.Type == CompensateRetry {
+				retry = log
+			}
+		}
+		return retry
+	}
+
+	sec := newSEC()
+	s := sec.StartSaga(context.Background(), "backoff")
+	s.ExecSub("flaky", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	retry := lastRetry(s.logID)
+	assert.Equal(t, CompensateRetry, retry.Type)
+	assert.Equal(t, 1, retry.Attempt)
+	assert.Equal(t, time.Minute, retry.NextRetry.Sub(retry.Time))
+
+	// backoff continues from the persisted attempt after restart
+	restarted := newSEC()
+	ok, err := restarted.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	retry = lastRetry(s.logID)
+	assert.Equal(t, 2, retry.Attempt)
+	assert.Equal(t, 2*time.Minute, retry.NextRetry.Sub(retry.Time))
+
+	ok, err = newSEC().resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	failures, err := restarted.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+}
+
+func TestRetryCompensateFailure(t *testing.T) {
+	flaky := &flakyCompensate{failures: 10}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("flaky", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "dead")
+	s.ExecSub("flaky", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	failures, err = sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Empty(t, failures)
+	assert.Equal(t, int32(11), atomic.LoadInt32(&flaky.calls))
+}
+
+func TestManualCompensate(t *testing.T) {
+	flaky := &flakyCompensate{failures: 1}
+	var alerted []string
+	sec := newTestSEC(t,
+		WithCompensateRetrySchedule(time.Minute),
+		WithAlertHook(func(logID, subTxID string, err error) {
+			alerted = append(alerted, subTxID)
+		}))
+	sec.AddSubTxDef("refund", flaky.action, flaky.compensate, ManualCompensate()).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "manual")
+	s.ExecSub("refund", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&flaky.calls))
+	assert.Equal(t, []string{"refund"}, alerted)
+
+	alerts, err := sec.ListCompensateAlerts()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, alerts)
+
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	alerts, err = sec.ListCompensateAlerts()
+	assert.NoError(t, err)
+	assert.Empty(t, alerts)
+}
+
+func TestAbortTimeout(t *testing.T) {
+	flaky := &flakyCompensate{failures: 100}
+	sec := newTestSEC(t,
+		WithAbortTimeout(50*time.Millisecond),
+		WithCompensateBackoff(Backoff{Base: 20 * time.Millisecond}))
+	sec.AddSubTxDef("first", flaky.action, flaky.compensate).
+		AddSubTxDef("second", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "timeout")
+	start := time.Now()
+	s.ExecSub("first", "foo").ExecSub("second", "bar").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.True(t, time.Since(start) < time.Second)
+
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	var timeout *ReplayEntry
+	for i := range entries {
+		if entries[i].Type == AbortTimeout {
+			timeout = &entries[i]
+		}
+	}
+	if assert.NotNil(t, timeout) {
+		assert.Equal(t, "second", timeout.SubTxID)
+	}
+}
+
+func TestRetryAllCompensateFailures(t *testing.T) {
+	recovered := &flakyCompensate{failures: 10}
+	broken := &flakyCompensate{failures: 1000}
+	sec := newTestSEC(t, WithRecoveryConcurrency(2))
+	sec.AddSubTxDef("recovered", recovered.action, recovered.compensate).
+		AddSubTxDef("broken", broken.action, broken.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s1 := sec.StartSaga(context.Background(), "1")
+	s1.ExecSub("recovered", "foo").ExecSub("fail")
+	s1.EndSaga()
+	s2 := sec.StartSaga(context.Background(), "2")
+	s2.ExecSub("broken", "foo").ExecSub("fail")
+	s2.EndSaga()
+
+	succeeded, failed, err := sec.RetryAllCompensateFailures(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s1.logID}, succeeded)
+	assert.Equal(t, []string{s2.logID}, failed)
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s2.logID}, failures)
+}
+
+func TestPermanentCompensateError(t *testing.T) {
+	calls := 0
+	compensate := func(ctx context.Context, name string) error {
+		calls++
+		return Permanent(errors.New("order archived"))
+	}
+	flaky := &flakyCompensate{}
+	sec := newTestSEC(t, WithCompensateRetrySchedule(time.Minute))
+	sec.AddSubTxDef("cancel", flaky.action, compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "permanent")
+	s.ExecSub("cancel", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 1, calls)
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+
+	err = Permanent(errors.New("cause"))
+	assert.True(t, errors.Is(err, ErrPermanent))
+	assert.EqualError(t, errors.Unwrap(err), "cause")
+}
+
+func TestCompensateRetries(t *testing.T) {
+	once := &flakyCompensate{failures: 1}
+	twice := &flakyCompensate{failures: 1}
+	sec := newTestSEC(t, WithCompensateRetrySchedule(time.Minute))
+	sec.AddSubTxDef("once", once.action, once.compensate, CompensateRetries(0)).
+		AddSubTxDef("twice", twice.action, twice.compensate, CompensateRetries(1)).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "retries")
+	s.ExecSub("once", "foo").ExecSub("twice", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&twice.calls))
+	// not retried in-process nor scheduled
+	assert.Equal(t, int32(1), atomic.LoadInt32(&once.calls))
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+}
+
+func TestResumePartialCompensation(t *testing.T) {
+	calls := map[string]int{}
+	broken := true
+	compensate := func(ctx context.Context, name string) error {
+		if name == "second" && broken {
+			return Permanent(errors.New("downstream broken"))
+		}
+		calls[name]++
+		return nil
+	}
+	action := func(ctx context.Context, name string) error {
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("step", action, compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "partial")
+	s.ExecSub("step", "first").ExecSub("step", "second").ExecSub("step", "third").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, map[string]int{"third": 1}, calls)
+
+	broken = false
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	// third isn't compensated again
+	assert.Equal(t, map[string]int{"first": 1, "second": 1, "third": 1}, calls)
+}
+
+func TestPendingCompensations(t *testing.T) {
+	logs := []Log{
+		{Type: ActionEnd, SubTxID: "A"},
+		{Type: ActionEnd, SubTxID: "A"},
+		{Type: ActionEnd, SubTxID: "B"},
+		{Type: CompensateStart, SubTxID: "B", Step: 3},
+		{Type: CompensateEnd, SubTxID: "B", Step: 3},
+		{Type: CompensateRetry, SubTxID: "A"},
+	}
+	pending, retries := pendingCompensations(logs)
+	assert.Equal(t, 1, retries)
+	assert.Equal(t, []Log{{Type: ActionEnd, SubTxID: "A", Step: 1}, {Type: ActionEnd, SubTxID: "A", Step: 2}}, pending)
+
+	// CompensateEnd without Step written by older version
+	logs = append(logs, Log{Type: CompensateEnd, SubTxID: "A"})
+	pending, _ = pendingCompensations(logs)
+	assert.Equal(t, []Log{{Type: ActionEnd, SubTxID: "A", Step: 1}}, pending)
+}
+
+type lockKey struct{}
+
+func TestAbortHooks(t *testing.T) {
+	var before, after int32
+	var results []error
+	flaky := &flakyCompensate{failures: 10}
+	sec := newTestSEC(t,
+		WithOnBeforeAbort(func(ctx context.Context, logID string) context.Context {
+			atomic.AddInt32(&before, 1)
+			return context.WithValue(ctx, lockKey{}, "lock:"+logID)
+		}),
+		WithOnAfterAbort(func(ctx context.Context, logID string, result error) {
+			atomic.AddInt32(&after, 1)
+			assert.Equal(t, "lock:"+logID, ctx.Value(lockKey{}))
+			results = append(results, result)
+		}))
+	var s *Saga
+	sec.AddSubTxDef("flaky", flaky.action, func(ctx context.Context, name string) error {
+		assert.Equal(t, "lock:"+s.logID, ctx.Value(lockKey{}))
+		// re-entrant abort doesn't run hooks again
+		if atomic.LoadInt32(&flaky.calls) == 0 {
+			s.Abort()
+		}
+		return flaky.compensate(ctx, name)
+	}).AddSubTxDef("fail", failAction, failCompensate)
+
+	s = sec.StartSaga(context.Background(), "hooks")
+	s.ExecSub("flaky", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, int32(1), before)
+	assert.Equal(t, int32(1), after)
+
+	// resumed abort runs hooks once more
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	assert.Equal(t, int32(2), before)
+	assert.Equal(t, int32(2), after)
+	if assert.Len(t, results, 2) {
+		assert.True(t, errors.Is(results[0], ErrCompensateFailed))
+		assert.NoError(t, results[1])
+	}
+}
+
+// lockingStore locks sagas in process, like storage.Locker shared by coordinator replicas.
+type lockingStore struct {
+	storage.Storage
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (l *lockingStore) TryLockSaga(logID string) (func() error, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked[logID] {
+		return nil, false, nil
+	}
+	l.locked[logID] = true
+	return func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.locked, logID)
+		return nil
+	}, true, nil
+}
+
+func TestRecoveryLock(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	store := &lockingStore{Storage: mem, locked: make(map[string]bool)}
+	flaky := &flakyCompensate{failures: 10}
+	sec := NewSEC(store, LogPrefix)
+	sec.AddSubTxDef("flaky", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "locked")
+	s.ExecSub("flaky", "foo").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+
+	// another replica holds the lock
+	unlock, ok, err := store.TryLockSaga(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	err = sec.RetryCompensateFailure(context.Background(), s.logID)
+	assert.True(t, errors.Is(err, ErrSagaLocked))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&flaky.calls))
+
+	assert.NoError(t, unlock())
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	assert.Empty(t, store.locked)
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	store, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	acc := &account{balance: map[string]int{"foo": 100}}
+	crashed := NewSEC(store, LogPrefix)
+	crashed.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+	crashed.StartSaga(context.Background(), "crashed").ExecSub("deduce", "foo", 10)
+	ended := crashed.StartSaga(context.Background(), "ended")
+	ended.ExecSub("deduce", "foo", 1)
+	assert.NoError(t, ended.EndSaga())
+
+	sec := NewSEC(store, LogPrefix)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+	live := sec.StartSaga(context.Background(), "live")
+	live.ExecSub("deduce", "foo", 20)
+	assert.Equal(t, 69, acc.balance["foo"])
+
+	var calls int
+	report, err := sec.EnterMaintenanceMode(context.Background(), func(MaintenanceProgress) { calls++ })
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, report.InFlight)
+	assert.Equal(t, 1, report.Total)
+	assert.Equal(t, []string{LogPrefix + "crashed"}, report.Compensated)
+	assert.Empty(t, report.Failed)
+	assert.Equal(t, 79, acc.balance["foo"])
+	assert.True(t, sec.InMaintenanceMode())
+
+	_, err = sec.StartSagaE(context.Background(), "new")
+	assert.True(t, errors.Is(err, ErrMaintenanceMode))
+
+	live.ExecSub("deduce", "foo", 5)
+	assert.True(t, errors.Is(live.EndSaga(), ErrMaintenanceMode))
+	assert.Equal(t, 99, acc.balance["foo"])
+
+	sec.ExitMaintenanceMode()
+	s, err := sec.StartSagaE(context.Background(), "new")
+	assert.NoError(t, err)
+	assert.NoError(t, s.EndSaga())
+}
+
+func TestHeartbeat(t *testing.T) {
+	store, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	acc := &account{balance: map[string]int{"foo": 100}}
+	other := &account{balance: map[string]int{"foo": 100}}
+	slow := func(ctx context.Context, name string, amount int) error {
+		time.Sleep(50 * time.Millisecond)
+		return other.deduce(ctx, name, amount)
+	}
+	crashedSEC := NewSEC(store, LogPrefix, WithHeartbeat(10*time.Millisecond, 30*time.Millisecond))
+	crashedSEC.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+	crashed := crashedSEC.StartSaga(context.Background(), "crashed")
+	crashed.ExecSub("deduce", "foo", 10)
+	// the process dies, heartbeat stops without EndSaga
+	close(crashed.heartbeat.stop)
+	<-crashed.heartbeat.done
+
+	sec := NewSEC(store, LogPrefix, WithHeartbeat(10*time.Millisecond, 30*time.Millisecond))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("slow", slow, other.deduceCompensate)
+	live := sec.StartSaga(context.Background(), "live")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		live.ExecSub("slow", "foo", 1)
+	}()
+	time.Sleep(40 * time.Millisecond)
+	alive, err := sec.IsAlive(live.logID)
+	assert.NoError(t, err)
+	assert.True(t, alive)
+	alive, err = sec.IsAlive(crashed.logID)
+	assert.NoError(t, err)
+	assert.False(t, alive)
+
+	assert.NoError(t, sec.recoverCrashedSagas())
+	<-done
+	assert.Equal(t, 100, acc.balance["foo"])
+	assert.Equal(t, 99, other.balance["foo"])
+	logs, err := store.Lookup(crashed.logID)
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+	assert.NoError(t, live.EndSaga())
+	alive, err = sec.IsAlive(live.logID)
+	assert.NoError(t, err)
+	assert.False(t, alive)
+}
+
+func TestShouldCompensate(t *testing.T) {
+	errKeep := errors.New("keep partial state")
+	acc := &account{balance: map[string]int{"foo": 100}}
+	var completed []string
+	outcomes, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	sec := newTestSEC(t, WithOutcomeStore(outcomes), WithShouldCompensate(func(err error, subTxIDs []string) bool {
+		completed = subTxIDs
+		return !errors.Is(err, errKeep)
+	}))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("keep", func(ctx context.Context) error { return errKeep }, failCompensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "keep")
+	s.ExecSub("deduce", "foo", 10).ExecSub("deduce", "foo", 1).ExecSub("keep")
+	assert.Equal(t, []string{"deduce", "deduce"}, completed)
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	last := entries[len(entries)-1]
+	assert.Equal(t, CompensationSkipped, last.Type)
+	assert.Equal(t, errKeep.Error(), last.Values["error"])
+	assert.True(t, errors.Is(s.EndSaga(), errKeep))
+	assert.Equal(t, 89, acc.balance["foo"])
+	outcome, err := sec.Outcome("keep")
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeCompensationSkipped, outcome.Outcome)
+	// recovery honors the decision
+	actionEnds, _ := pendingCompensations([]Log{{Type: ActionEnd}, {Type: SagaAbort}, {Type: CompensationSkipped}})
+	assert.Empty(t, actionEnds)
+
+	s = sec.StartSaga(context.Background(), "compensate")
+	s.ExecSub("deduce", "foo", 9).ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 89, acc.balance["foo"])
+}
+
+func TestOnCommit(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	var sent []string
+	emailDown := true
+	sendEmail := func(ctx context.Context, logID string) error {
+		if emailDown {
+			return errors.New("email service down")
+		}
+		sent = append(sent, logID)
+		return nil
+	}
+	sec := newTestSEC(t, WithCommitRecovery("email", sendEmail))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "abort")
+	s.OnCommit("event", func(ctx context.Context) error {
+		t.Error("callback of aborted saga runs")
+		return nil
+	})
+	s.ExecSub("deduce", "foo", 10).ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 100, acc.balance["foo"])
+
+	s = sec.StartSaga(context.Background(), "commit")
+	var published []string
+	s.OnCommit("event", func(ctx context.Context) error {
+		published = append(published, "deduced")
+		return nil
+	})
+	s.OnCommit("email", func(ctx context.Context) error {
+		return sendEmail(ctx, s.logID)
+	})
+	s.ExecSub("deduce", "foo", 10)
+	assert.Empty(t, published)
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, []string{"deduced"}, published)
+	assert.Empty(t, sent)
+	// log is kept for the failed callback
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, CommitDone, entries[len(entries)-1].Type)
+	logs, err := sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"email"}, pendingCommits(unmarshalLogs(logs)))
+
+	emailDown = false
+	recovered, failed, err := sec.RecoverCommits(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, recovered)
+	assert.Empty(t, failed)
+	assert.Equal(t, []string{s.logID}, sent)
+	assert.Equal(t, []string{"deduced"}, published)
+	logs, err = sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+}
+
+func TestIdempotentCompensate(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("refund", acc.deduce, acc.deduceCompensate, IdempotentCompensate()).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	// idempotent compensate isn't marked
+	s := sec.StartSaga(context.Background(), "idempotent")
+	s.ExecSub("refund", "foo", 10).ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 100, acc.balance["foo"])
+
+	// crashed during non-idempotent compensate
+	crashed := func(subTxID string) *Saga {
+		s := sec.StartSaga(context.Background(), "crashed"+subTxID)
+		s.ExecSub(subTxID, "foo", 10)
+		for _, log := range []*Log{{Type: SagaAbort}, {Type: CompensateStart, SubTxID: subTxID, Step: 1}} {
+			assert.NoError(t, s.appendLog(log))
+		}
+		return s
+	}
+	s = crashed("deduce")
+	ok, err := sec.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 90, acc.balance["foo"])
+	alerts, err := sec.ListCompensateAlerts()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, alerts)
+	// escalated, it's only re-run on demand
+	logs, err := sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.Empty(t, sec.uncertainCompensations(unmarshalLogs(logs)))
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	assert.Equal(t, 100, acc.balance["foo"])
+
+	// idempotent compensate is re-run
+	s = crashed("refund")
+	ok, err = sec.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 100, acc.balance["foo"])
+}
+
+func TestSharedResource(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	var released []string
+	releaseDown := true
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("fail", failAction, failCompensate).
+		AddSharedResource("slot", func(ctx context.Context, resourceID string) error {
+			if releaseDown {
+				return errors.New("warehouse down")
+			}
+			released = append(released, resourceID)
+			return nil
+		})
+
+	s := sec.StartSaga(context.Background(), "unregistered")
+	assert.Error(t, s.Enroll("truck", "t1"))
+	assert.NoError(t, s.EndSaga())
+
+	sagas := make([]*Saga, 3)
+	for i := range sagas {
+		sagas[i] = sec.StartSaga(context.Background(), "batch"+strconv.Itoa(i))
+		assert.NoError(t, sagas[i].Enroll("slot", "s1"))
+		sagas[i].ExecSub("deduce", "foo", 10)
+	}
+	refs, err := sec.ResourceRefs("slot", "s1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, refs)
+
+	// the deregistered saga leaves without releasing
+	assert.NoError(t, sagas[0].Deregister("slot", "s1"))
+	assert.NoError(t, sagas[0].EndSaga())
+	sagas[1].ExecSub("fail")
+	assert.Error(t, sagas[1].EndSaga())
+	assert.Empty(t, released)
+
+	// the last saga releases, failure dead-letters it
+	sagas[2].ExecSub("fail")
+	assert.Error(t, sagas[2].EndSaga())
+	assert.Empty(t, released)
+	refs, err = sec.ResourceRefs("slot", "s1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, refs)
+
+	releaseDown = false
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), sagas[2].logID))
+	assert.Equal(t, []string{"s1"}, released)
+	assert.Equal(t, 90, acc.balance["foo"])
+	refs, err = sec.ResourceRefs("slot", "s1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, refs)
+
+	// lost references are rebuilt from saga log
+	s = sec.StartSaga(context.Background(), "lost")
+	assert.NoError(t, s.Enroll("slot", "s2"))
+	assert.NoError(t, sec.store.Cleanup(resourceKey("slot", "s2")))
+	assert.NoError(t, sec.RebuildResourceRefs())
+	refs, err = sec.ResourceRefs("slot", "s2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, refs)
+}
+
+func TestMaxCompensationDepth(t *testing.T) {
+	sec := newTestSEC(t, WithMaxCompensationDepth(3))
+	var depths []int
+	var sagaErrs []error
+	sec.AddSubTxDef("reserve", func(ctx context.Context) error {
+		return nil
+	}, func(ctx context.Context) error {
+		// misconfigured compensate re-entering itself through a sub-saga
+		depth := CompensationDepth(ctx)
+		depths = append(depths, depth)
+		sub := sec.StartSaga(ctx, "sub"+strconv.Itoa(depth))
+		sagaErrs = append(sagaErrs, sub.ExecSub("reserve").ExecSub("fail").EndSaga())
+		return nil
+	}).AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "loop")
+	assert.Error(t, s.ExecSub("reserve").ExecSub("fail").EndSaga())
+	assert.Equal(t, []int{1, 2, 3}, depths)
+	assert.True(t, errors.Is(sagaErrs[0], ErrCompensationLoop))
+	// the error the sub-saga failed with is kept
+	assert.Contains(t, sagaErrs[0].Error(), "action failure")
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{LogPrefix + "sub3"}, failures)
+}
+
+func TestVerifyCompensate(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	lostRefunds := 1
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, func(ctx context.Context, name string, amount int) error {
+		// the refund reports success without effect at first
+		if lostRefunds > 0 {
+			lostRefunds--
+			return nil
+		}
+		return acc.deduceCompensate(ctx, name, amount)
+	}, VerifyCompensate(func(ctx context.Context, name string, amount int) error {
+		if acc.balance[name] != 100 {
+			return errors.New("balance not restored")
+		}
+		return nil
+	}), CompensateRetries(1)).AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "verified")
+	s.ExecSub("deduce", "foo", 10).ExecSub("fail")
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	var outcomes []LogType
+	for _, entry := range entries {
+		if entry.Type == CompensateVerified || entry.Type == CompensateVerifyFailed {
+			outcomes = append(outcomes, entry.Type)
+		}
+	}
+	assert.Equal(t, []LogType{CompensateVerifyFailed, CompensateVerified}, outcomes)
+	assert.Equal(t, 100, acc.balance["foo"])
+	assert.Error(t, s.EndSaga())
+
+	// rejected by every attempt
+	lostRefunds = 2
+	s = sec.StartSaga(context.Background(), "rejected")
+	s.ExecSub("deduce", "foo", 10).ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 90, acc.balance["foo"])
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+
+	assert.Error(t, sec.AddSubTxDefE("mismatch", acc.deduce, acc.deduceCompensate,
+		VerifyCompensate(func(ctx context.Context, name string) error { return nil })))
+}
+
+func TestBoundResource(t *testing.T) {
+	released := map[string]int{}
+	var compensatedOn []interface{}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("session", func(ctx context.Context, conn string) error {
+		if conn != "" {
+			BindResource(ctx, conn, func() error {
+				released[conn]++
+				return nil
+			})
+		}
+		return nil
+	}, func(ctx context.Context, conn string) error {
+		resource, _ := BoundResource(ctx)
+		compensatedOn = append(compensatedOn, resource)
+		return nil
+	}, RequireBoundResource()).AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "aborted")
+	s.ExecSub("session", "conn1").ExecSub("fail")
+	assert.Equal(t, []interface{}{"conn1"}, compensatedOn)
+	assert.Equal(t, 1, released["conn1"])
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 1, released["conn1"])
+
+	s = sec.StartSaga(context.Background(), "committed")
+	s.ExecSub("session", "conn2")
+	assert.Equal(t, 0, released["conn2"])
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, 1, released["conn2"])
+
+	// nothing bound, e.g. lost by restart
+	s = sec.StartSaga(context.Background(), "lost")
+	s.ExecSub("session", "").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Len(t, compensatedOn, 1)
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+}
+
+func TestLogCompaction(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 1000}}
+	sec := newTestSEC(t, WithArgsOnActionStart(), WithLogCompaction(8, 2))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+
+	s := sec.StartSaga(context.Background(), "compacted")
+	var expected []Step
+	for i := 1; i <= 10; i++ {
+		s.ExecSub("deduce", "foo", i)
+		expected = append(expected, Step{Type: ActionEnd, SubTxID: "deduce", Args: []interface{}{"foo", i}})
+	}
+	assert.Equal(t, 945, acc.balance["foo"])
+	data, err := sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	logs := unmarshalLogs(data)
+	assert.Less(t, len(logs), 21)
+	assert.Equal(t, SagaStart, logs[0].Type)
+	types := make(map[LogType]int)
+	for _, log := range logs {
+		types[log.Type]++
+	}
+	assert.Equal(t, 10, types[ActionEnd])
+	assert.Equal(t, 1, types[LogCompacted])
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.NoError(t, VerifySteps(expected, StepsOf(entries)))
+
+	removed, err := sec.CompactLog(s.logID, 0)
+	assert.NoError(t, err)
+	assert.NotZero(t, removed)
+	data, err = sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.Len(t, data, 12)
+	last := unmarshalLogs(data)[len(data)-1]
+	assert.Equal(t, LogCompacted, last.Type)
+	assert.Equal(t, "10", last.Values["removed"])
+
+	// compensation resumed from the compacted log
+	ok, err := sec.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1000, acc.balance["foo"])
+}
+
+func TestCompactLogsPairsByStarted(t *testing.T) {
+	t1, t2 := time.Unix(1, 0), time.Unix(2, 0)
+	p1, p2 := []ParamData{{ParamType: "int", Data: "1"}}, []ParamData{{ParamType: "int", Data: "2"}}
+	logs := []Log{
+		{Type: ActionStart, SubTxID: "deduce", Time: t1, Params: p1},
+		{Type: ActionStart, SubTxID: "deduce", Time: t2, Params: p2},
+		// concurrent steps of the same sub-transaction end out of order
+		{Type: ActionEnd, SubTxID: "deduce", Time: time.Unix(3, 0), Started: t2.UnixNano()},
+		{Type: ActionEnd, SubTxID: "deduce", Time: time.Unix(4, 0), Started: t1.UnixNano()},
+	}
+	checkpoint, removed, total := compactLogs(logs, 3)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 1, total)
+	if assert.Len(t, checkpoint, 2) {
+		// the start of the step not compacted is kept for its end
+		assert.Equal(t, t1, checkpoint[0].Time)
+		assert.Equal(t, p2, checkpoint[1].Params)
+	}
+}
+
+func TestCompensateRateLimit(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t, WithCompensateRateLimit("deduce", 20, 1), WithAbortTimeout(time.Second))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		s := sec.StartSaga(context.Background(), "limited"+strconv.Itoa(i))
+		assert.Error(t, s.ExecSub("deduce", "foo", 10).ExecSub("fail").EndSaga())
+	}
+	// the first token is available at once
+	assert.True(t, time.Since(start) >= 4*50*time.Millisecond, "compensated in %v", time.Since(start))
+	assert.Equal(t, 100, acc.balance["foo"])
+
+	// waiting for a token is bounded by abort timeout
+	sec = newTestSEC(t, WithCompensateRateLimit("deduce", 0.1, 1), WithAbortTimeout(50*time.Millisecond))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+	for i := 0; i < 2; i++ {
+		s := sec.StartSaga(context.Background(), "timeout"+strconv.Itoa(i))
+		assert.Error(t, s.ExecSub("deduce", "foo", 10).ExecSub("fail").EndSaga())
+	}
+	assert.Equal(t, 90, acc.balance["foo"])
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{LogPrefix + "timeout1"}, failures)
+}
+
+func TestCompensatePriority(t *testing.T) {
+	var mu sync.Mutex
+	var compensated []string
+	sec := newTestSEC(t, WithCompensateRateLimit("reserve", 10, 1), WithPriorityTag("priority"))
+	sec.AddSubTxDef("reserve", func(ctx context.Context, name string) error {
+		return nil
+	}, func(ctx context.Context, name string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		compensated = append(compensated, name)
+		return nil
+	}).AddSubTxDef("fail", failAction, failCompensate)
+	abort := func(name, priority string) {
+		ctx := WithTags(context.Background(), map[string]string{"priority": priority})
+		sec.StartSaga(ctx, name).ExecSub("reserve", name).ExecSub("fail").EndSaga()
+	}
+
+	// takes the only token
+	abort("first", "0")
+	var wg sync.WaitGroup
+	for _, c := range []struct{ name, priority string }{{"low", "1"}, {"normal", ""}, {"high", "9"}} {
+		wg.Add(1)
+		go func(name, priority string) {
+			defer wg.Done()
+			abort(name, priority)
+		}(c.name, c.priority)
+		// queue in order
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"first", "high", "low", "normal"}, compensated)
+}
+
+// plainStore hides optional interfaces of storage, e.g. storage.Remover.
+type plainStore struct {
+	storage.Storage
+}
+
+func TestDeadLetterListConcurrentRemove(t *testing.T) {
+	const n = 50
+	for name, atomicRemove := range map[string]bool{"remover": true, "rewrite": false} {
+		t.Run(name, func(t *testing.T) {
+			store, err := memory.NewMemStorage()
+			assert.NoError(t, err)
+			retrier, replica := NewSEC(store, LogPrefix), NewSEC(store, LogPrefix)
+			deadLetterer := &replica
+			if !atomicRemove {
+				// a rewritten list is only protected from appends of the same coordinator
+				retrier = NewSEC(plainStore{store}, LogPrefix)
+				deadLetterer = &retrier
+			}
+			var old []string
+			for i := 0; i < n; i++ {
+				old = append(old, "old"+strconv.Itoa(i))
+				assert.NoError(t, retrier.appendList(compensateFailuresLogID, old[i]))
+			}
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for _, logID := range old {
+					assert.NoError(t, retrier.removeLogID(compensateFailuresLogID, logID))
+				}
+			}()
+			var added []string
+			go func() {
+				defer wg.Done()
+				for i := 0; i < n; i++ {
+					added = append(added, "new"+strconv.Itoa(i))
+					assert.NoError(t, deadLetterer.appendList(compensateFailuresLogID, added[i]))
+				}
+			}()
+			wg.Wait()
+			failures, err := retrier.ListCompensateFailures()
+			assert.NoError(t, err)
+			assert.Equal(t, added, failures)
+		})
+	}
+}
+
+func TestSharedResourceKeepsState(t *testing.T) {
+	var compensated string
+	compensateDown := true
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("order", func(ctx context.Context) error {
+		SetValue(ctx, "id", "o1")
+		return nil
+	}, func(ctx context.Context) error {
+		if compensateDown {
+			return errors.New("order service down")
+		}
+		GetValue(ctx, "id", &compensated)
+		return nil
+	}).AddSubTxDef("fail", failAction, failCompensate).
+		AddSharedResource("slot", func(ctx context.Context, resourceID string) error {
+			return nil
+		})
+
+	s := sec.StartSaga(context.Background(), "state")
+	s.ExecSub("order")
+	// resource log is written after the action, its id mustn't shadow the one set by action
+	assert.NoError(t, s.Enroll("slot", "s1"))
+	s.ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+
+	compensateDown = false
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	assert.Equal(t, "o1", compensated)
+}
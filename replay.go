@@ -0,0 +1,122 @@
+package saga
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// ReplayEntry is a saga log entry with its params decoded.
+type ReplayEntry struct {
+	Log
+	// Args are decoded Log.Params
+	Args []interface{} `json:"args,omitempty"`
+	// Results are decoded Log.Result, see RecordCompensateResult
+	Results []interface{} `json:"results,omitempty"`
+}
+
+// Step is a sub-transaction action or compensate executed by saga, it's used to verify saga behavior.
+type Step struct {
+	Type    LogType
+	SubTxID string
+	Args    []interface{}
+}
+
+func (s Step) String() string {
+	return fmt.Sprintf("{%s %s %v}", s.Type, s.SubTxID, s.Args)
+}
+
+// Replay decodes persisted log of given saga into entries in order.
+func (e *ExecutionCoordinator) Replay(logID string) ([]ReplayEntry, error) {
+	logs, err := e.storeOf(logID).Lookup(logID)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	return e.ReplayLogs(logs)
+}
+
+// ReplayMany decodes persisted logs of given sagas in one storage batch, e.g. to load a page of dashboard.
+func (e *ExecutionCoordinator) ReplayMany(logIDs []string) (map[string][]ReplayEntry, error) {
+	// one batch per storage, see WithStorageSelector
+	batches := make(map[storage.Storage][]string)
+	for _, logID := range logIDs {
+		store := e.storeOf(logID)
+		batches[store] = append(batches[store], logID)
+	}
+	logs := make(map[string][]string, len(logIDs))
+	for store, batch := range batches {
+		found, err := store.LookupMany(batch)
+		if err != nil {
+			return nil, errors.Annotate(err, "LookupMany failure")
+		}
+		for logID, data := range found {
+			logs[logID] = data
+		}
+	}
+	entries := make(map[string][]ReplayEntry, len(logs))
+	for logID, data := range logs {
+		var err error
+		if entries[logID], err = e.ReplayLogs(data); err != nil {
+			return nil, errors.Annotatef(err, "Replay %s", logID)
+		}
+	}
+	return entries, nil
+}
+
+// ReplayLogs decodes given saga log data into entries in order,
+// e.g. the log recorded by storage.Recorder, which is kept after saga cleaned up.
+func (e *ExecutionCoordinator) ReplayLogs(logs []string) (entries []ReplayEntry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			entries, err = nil, fmt.Errorf("Replay failure: %v", r)
+		}
+	}()
+	entries = make([]ReplayEntry, 0, len(logs))
+	params := make(startParams)
+	for _, logData := range logs {
+		log := mustUnmarshalLog(logData)
+		params.restore(&log)
+		entry := ReplayEntry{Log: log}
+		for _, arg := range UnmarshalParam(e, log.Params) {
+			entry.Args = append(entry.Args, arg.Interface())
+		}
+		for _, result := range UnmarshalParam(e, log.Result) {
+			entry.Results = append(entry.Results, result.Interface())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// StepsOf returns actions and compensates completed in given entries, in order.
+func StepsOf(entries []ReplayEntry) []Step {
+	var steps []Step
+	for _, entry := range entries {
+		if entry.Type == ActionEnd || entry.Type == CompensateEnd {
+			steps = append(steps, Step{Type: entry.Type, SubTxID: entry.SubTxID, Args: entry.Args})
+		}
+	}
+	return steps
+}
+
+// VerifySteps compares steps of a saga run against expected ones,
+// returns error describing the first divergence of order, subTxID or args.
+func VerifySteps(expected, actual []Step) error {
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		exp, act := expected[i], actual[i]
+		if exp.Type != act.Type || exp.SubTxID != act.SubTxID {
+			return fmt.Errorf("step %d: expected %v, got %v", i, exp, act)
+		}
+		if len(exp.Args) != 0 || len(act.Args) != 0 {
+			if !reflect.DeepEqual(exp.Args, act.Args) {
+				return fmt.Errorf("step %d %s: expected args %v, got %v", i, exp.SubTxID, exp.Args, act.Args)
+			}
+		}
+	}
+	if len(expected) != len(actual) {
+		return fmt.Errorf("expected %d steps, got %d: %v", len(expected), len(actual), actual)
+	}
+	return nil
+}
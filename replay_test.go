@@ -0,0 +1,119 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayVerifySteps(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	mem, _ := memory.NewMemStorage()
+	recorder := storage.NewRecorder(mem)
+	sec := NewSEC(recorder, LogPrefix)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+
+	s := sec.StartSaga(context.Background(), "replay")
+	s.ExecSub("deduce", "foo", 30).ExecSub("deposit", "bar", 30)
+	assert.Error(t, s.EndSaga())
+
+	entries, err := sec.ReplayLogs(recorder.Recorded(s.logID))
+	assert.NoError(t, err)
+	assert.Equal(t, SagaStart, entries[0].Type)
+	steps := StepsOf(entries)
+	assert.NoError(t, VerifySteps([]Step{
+		{Type: ActionEnd, SubTxID: "deduce", Args: []interface{}{"foo", 30}},
+		{Type: CompensateEnd, SubTxID: "deduce"},
+	}, steps))
+
+	err = VerifySteps([]Step{
+		{Type: ActionEnd, SubTxID: "deduce", Args: []interface{}{"foo", 20}},
+		{Type: CompensateEnd, SubTxID: "deduce"},
+	}, steps)
+	assert.EqualError(t, err, "step 0 deduce: expected args [foo 20], got [foo 30]")
+	assert.Error(t, VerifySteps(steps[:1], steps))
+}
+
+func TestReplayMany(t *testing.T) {
+	flaky := &flakyCompensate{failures: 100}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("flaky", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+	s1 := sec.StartSaga(context.Background(), "1")
+	s1.ExecSub("flaky", "foo")
+	s2 := sec.StartSaga(context.Background(), "2")
+
+	entries, err := sec.ReplayMany([]string{s1.logID, s2.logID})
+	assert.NoError(t, err)
+	assert.Len(t, entries[s1.logID], 3)
+	assert.Equal(t, []interface{}{"foo"}, entries[s1.logID][2].Args)
+	assert.Len(t, entries[s2.logID], 1)
+}
+
+func TestRecordCompensateResult(t *testing.T) {
+	mem, _ := memory.NewMemStorage()
+	recorder := storage.NewRecorder(mem)
+	sec := NewSEC(recorder, LogPrefix)
+	refundDown := true
+	sec.AddSubTxDef("charge", func(ctx context.Context, name string, amount int) error {
+		return nil
+	}, func(ctx context.Context, name string, amount int) (string, error) {
+		if refundDown {
+			refundDown = false
+			return "", errors.New("refund service down")
+		}
+		return "refund-" + name, nil
+	}, RecordCompensateResult()).AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "refund")
+	s.ExecSub("charge", "foo", 30).ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+
+	entries, err := sec.ReplayLogs(recorder.Recorded(s.logID))
+	assert.NoError(t, err)
+	var results [][]interface{}
+	for _, entry := range entries {
+		if entry.Type == CompensateEnd {
+			results = append(results, entry.Results)
+		}
+	}
+	// the trailing error fails the first attempt
+	assert.Equal(t, [][]interface{}{{"refund-foo"}}, results)
+}
+
+func TestSimulateCompensate(t *testing.T) {
+	type shipment struct {
+		ID    string
+		Items map[string]int
+		// unexported fields don't survive the saga log
+		carrier string
+	}
+	var got *shipment
+	failures := 1
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("ship", func(ctx context.Context, s *shipment) error {
+		return nil
+	}, func(ctx context.Context, s *shipment) error {
+		got = s
+		if failures > 0 {
+			failures--
+			return errors.New("carrier unavailable")
+		}
+		return nil
+	}, CompensateRetries(1))
+
+	sample := &shipment{ID: "s1", Items: map[string]int{"apple": 2}, carrier: "ups"}
+	assert.NoError(t, sec.SimulateCompensate(context.Background(), "ship", sample))
+	assert.False(t, got == sample)
+	assert.Equal(t, &shipment{ID: "s1", Items: map[string]int{"apple": 2}}, got)
+
+	failures = 2
+	assert.Error(t, sec.SimulateCompensate(context.Background(), "ship", sample))
+	assert.Error(t, sec.SimulateCompensate(context.Background(), "ship", "s1"))
+	assert.Error(t, sec.SimulateCompensate(context.Background(), "unknown"))
+}
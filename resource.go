@@ -0,0 +1,204 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// resourceKeyPrefix prefixes name and id of a shared resource to key the list of sagas holding it
+const resourceKeyPrefix = "sagaresource_"
+
+func resourceKey(name, resourceID string) string {
+	return resourceKeyPrefix + name + "_" + resourceID
+}
+
+// resourceRef is a shared resource enrolled by saga.
+type resourceRef struct {
+	name string
+	id   string
+}
+
+// AddSharedResource registers a kind of resource shared by multiple sagas, e.g. a warehouse slot or
+// a batch payment. Sagas Enroll in a resource by its id, and release is called once when the last saga
+// holding the resource compensates, instead of once per saga. References are persisted in storage,
+// so they survive restarts, see RebuildResourceRefs.
+func (e *ExecutionCoordinator) AddSharedResource(name string, release func(ctx context.Context, resourceID string) error) *ExecutionCoordinator {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sharedResources[name] = release
+	return e
+}
+
+func (e *ExecutionCoordinator) findSharedResource(name string) (func(ctx context.Context, resourceID string) error, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	release, ok := e.sharedResources[name]
+	return release, ok
+}
+
+// Enroll makes saga hold shared resource registered by AddSharedResource under name. Once the saga compensates,
+// it drops its reference, and the resource is released if no other saga holds it. A committed saga keeps
+// holding the resource until Deregister.
+func (s *Saga) Enroll(name, resourceID string) error {
+	if _, ok := s.sec.findSharedResource(name); !ok {
+		return fmt.Errorf("Enroll: shared resource %s not registered", name)
+	}
+	log := &Log{Type: ResourceEnrolled, Time: time.Now(), Values: map[string]string{"resource": name, "id": resourceID}}
+	if err := s.appendLog(log); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", s.logID)
+	}
+	return s.sec.appendList(resourceKey(name, resourceID), s.logID)
+}
+
+// Deregister drops reference of saga to shared resource without releasing it, even if it's the last one,
+// e.g. the resource is handed over to its consumer.
+func (s *Saga) Deregister(name, resourceID string) error {
+	log := &Log{Type: ResourceDeregistered, Time: time.Now(), Values: map[string]string{"resource": name, "id": resourceID}}
+	if err := s.appendLog(log); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", s.logID)
+	}
+	return s.sec.removeLogID(resourceKey(name, resourceID), s.logID)
+}
+
+// heldResources returns shared resources enrolled in saga log and neither released nor deregistered, in order.
+func heldResources(logs []Log) []resourceRef {
+	var held []resourceRef
+	for _, log := range logs {
+		ref := resourceRef{name: log.Values["resource"], id: log.Values["id"]}
+		switch log.Type {
+		case ResourceEnrolled:
+			held = append(held, ref)
+		case ResourceReleased, ResourceDeregistered:
+			for i := range held {
+				if held[i] == ref {
+					held = append(held[:i], held[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return held
+}
+
+// releaseResources drops references of a compensated saga to shared resources, and releases the ones it held last.
+// It reports false if any release failed, in which case the saga is dead-lettered, and RetryCompensateFailure
+// releases it again.
+func (s *Saga) releaseResources() bool {
+	s.sec.mu.RLock()
+	shared := len(s.sec.sharedResources)
+	s.sec.mu.RUnlock()
+	if shared == 0 {
+		return true
+	}
+	logs, err := s.store.Lookup(s.logID)
+	if err != nil {
+		panic(fmt.Errorf("releaseResources Lookup: %v", err))
+	}
+	for _, ref := range heldResources(unmarshalLogs(logs)) {
+		if err := s.releaseResource(ref); err != nil {
+			s.compensateFail = true
+			s.deadLetter(ref.name, err)
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Saga) releaseResource(ref resourceRef) error {
+	release, ok := s.sec.findSharedResource(ref.name)
+	if !ok {
+		return fmt.Errorf("shared resource %s not registered", ref.name)
+	}
+	key := resourceKey(ref.name, ref.id)
+	left, err := s.sec.rewriteList(key, s.logID)
+	if err != nil {
+		return err
+	}
+	if left == 0 {
+		if err := release(s.compensateCtx, ref.id); err != nil {
+			// keep the reference so that the retry releases it again
+			if err := s.sec.appendList(key, s.logID); err != nil {
+				s.sec.opts.logger.Printf("[WARNING]Restore reference of %s to %s failure: %v", s.logID, key, err)
+			}
+			return errors.Annotatef(err, "release %s %s", ref.name, ref.id)
+		}
+	}
+	log := &Log{Type: ResourceReleased, Time: time.Now(), Values: map[string]string{"resource": ref.name, "id": ref.id}}
+	return s.appendLog(log)
+}
+
+// ResourceRefs returns the number of sagas holding given shared resource.
+func (e *ExecutionCoordinator) ResourceRefs(name, resourceID string) (int, error) {
+	key := resourceKey(name, resourceID)
+	logIDs, err := e.store.Lookup(key)
+	if err != nil {
+		return 0, errors.Annotatef(err, "Lookup %s failure", key)
+	}
+	return len(uniqueLogIDs(logIDs)), nil
+}
+
+// RebuildResourceRefs reconciles references to shared resources with saga logs, e.g. after the process crashed
+// between logging ResourceEnrolled and recording the reference. Sagas holding a resource by their log are added,
+// and the ones released or deregistered are removed. References of sagas whose log is cleaned up are kept,
+// since committed sagas hold their resources.
+func (e *ExecutionCoordinator) RebuildResourceRefs() error {
+	logIDs, err := e.logIDs()
+	if err != nil {
+		return err
+	}
+	for _, logID := range logIDs {
+		if _, ok, err := e.startTime(logID); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		data, err := e.storeOf(logID).Lookup(logID)
+		if err != nil {
+			return errors.Annotatef(err, "Lookup %s failure", logID)
+		}
+		logs := unmarshalLogs(data)
+		held := make(map[resourceRef]bool)
+		for _, log := range logs {
+			if log.Type == ResourceEnrolled {
+				held[resourceRef{name: log.Values["resource"], id: log.Values["id"]}] = false
+			}
+		}
+		for _, ref := range heldResources(logs) {
+			held[ref] = true
+		}
+		for ref, holding := range held {
+			key := resourceKey(ref.name, ref.id)
+			if holding {
+				err = e.addRef(key, logID)
+			} else {
+				err = e.removeLogID(key, logID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addRef appends logID to list stored under key unless it's there.
+func (e *ExecutionCoordinator) addRef(key, logID string) error {
+	e.listMu.Lock()
+	defer e.listMu.Unlock()
+	stored, err := e.store.Lookup(key)
+	if err != nil {
+		return errors.Annotatef(err, "Lookup %s failure", key)
+	}
+	for _, id := range stored {
+		if id == logID {
+			return nil
+		}
+	}
+	if err := e.store.AppendLog(key, logID); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", key)
+	}
+	return nil
+}
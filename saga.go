@@ -8,9 +8,12 @@
 package saga
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
@@ -20,6 +23,15 @@ import (
 
 const LogPrefix = "saga"
 
+const (
+	// compensateFailuresLogID is dead-letter list of logIDs whose compensation gave up
+	compensateFailuresLogID = "sagacompensate_failures"
+	// compensateRetriesLogID is list of logIDs whose compensation is scheduled to retry later
+	compensateRetriesLogID = "sagacompensate_retries"
+	// compensateAlertsLogID is high-priority dead-letter list of logIDs whose manual compensate failed
+	compensateAlertsLogID = "sagacompensate_alerts"
+)
+
 // Saga presents current execute transaction.
 // A Saga constituted by small sub-transactions.
 type Saga struct {
@@ -29,9 +41,117 @@ type Saga struct {
 	sec            *ExecutionCoordinator
 	store          storage.Storage
 	compensateFail bool
-	mu             sync.Mutex // protects following fields
-	err            error
-	abort          bool
+	// compensateDeadline is deadline of whole compensation, zero means unbounded
+	compensateDeadline time.Time
+	state              *State
+	// secrets are args redacted from log by SecretArgs, keyed by ParamData.Secret
+	secrets       map[string]interface{}
+	correlationID string
+	// tags are set by WithTags, labels are the ones allowed by WithLabelAllowlist, nil if none
+	tags   map[string]string
+	labels *labelSet
+	// depth is compensation depth of context saga started with, see WithMaxCompensationDepth
+	depth int
+	// priority is given by tag of WithPriorityTag
+	priority int
+	// sampled is decided by StartSaga, span is the saga span if sampled
+	sampled bool
+	span    Span
+	// steps are completed sub-transactions, set before compensation
+	steps []CompletedStep
+	mu    sync.Mutex // protects following fields
+	err   error
+	abort bool
+	// skipCompensation declines compensation of the abort, see MarshalFailNoCompensate
+	skipCompensation bool
+	// unlogged are ActionEnd logs of actions succeeded but failed to be logged, Abort logs them to compensate
+	unlogged []Log
+	// groups is the number of groups started by ExecSubConcurrent
+	groups int
+	// chain is the checksum chain of saga log, see WithLogChecksum
+	chain logChain
+	// sem bounds lists of ExecSubConcurrent running simultaneously, nil if unlimited, see WithConcurrency
+	sem chan struct{}
+	// compensating guards compensateAll against re-entrance, compensateCtx is the parent of compensate contexts
+	compensating  int32
+	compensateCtx context.Context
+	ended         int32
+	// heartbeat is nil unless WithHeartbeat is set
+	heartbeat *heartbeat
+	detached  detachedActions
+	// compensationSkipped is set if WithShouldCompensate hook or MarshalFailNoCompensate declined compensation
+	compensationSkipped bool
+	// prevRetryDelay is delay of the last scheduled compensate retry, restored from log by recovery
+	prevRetryDelay time.Duration
+	// commits are callbacks queued by OnCommit
+	commits []commitCallback
+	// appended counts entries appended by saga, compacting guards its compaction, see WithLogCompaction
+	appended   int32
+	compacting int32
+}
+
+// paramsPool reuses reflect.Value slices used to call sub-transaction action
+var paramsPool = sync.Pool{
+	New: func() interface{} {
+		params := make([]reflect.Value, 0, 8)
+		return &params
+	},
+}
+
+// ExecSubOptions overrides sub-transaction defaults for a single ExecSubWithOptions call.
+// Zero value fields keep the defaults.
+type ExecSubOptions struct {
+	// Timeout bounds each action attempt
+	Timeout time.Duration
+	// Retry retries failed action before aborting saga
+	Retry *RetryPolicy
+	// IdempotencyKey is persisted into saga log and passed to action via context, see IdempotencyKey
+	IdempotencyKey string
+}
+
+type correlationIDCtxKey struct{}
+
+// WithCorrelationID returns ctx carrying correlation ID, e.g. ID of the originating request.
+// StartSaga extracts it from ctx and stamps it into every log entry of the saga,
+// so log aggregation can tie saga entries to the request across services.
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, correlationIDCtxKey{}, correlationID)
+}
+
+// CorrelationID returns correlation ID set by WithCorrelationID.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDCtxKey{}).(string)
+	return id
+}
+
+type concurrencyCtxKey struct{}
+
+// WithConcurrency returns ctx limiting the saga started by StartSaga with it to at most n lists of
+// ExecSubConcurrent running simultaneously, shared by all ExecSubConcurrent calls of the saga.
+// It overrides the default set by WithMaxConcurrency, n <= 0 means unlimited.
+func WithConcurrency(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, concurrencyCtxKey{}, n)
+}
+
+// concurrencyLimit returns semaphore of saga started with ctx, nil if unlimited.
+func (e *ExecutionCoordinator) concurrencyLimit(ctx context.Context) chan struct{} {
+	n := e.opts.maxConcurrency
+	if limit, ok := ctx.Value(concurrencyCtxKey{}).(int); ok {
+		n = limit
+	}
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+type idempotencyKeyCtxKey struct{}
+
+// IdempotencyKey returns idempotency key given by ExecSubOptions from action context.
+// The key stays the same across action retries, so downstream can de-duplicate them.
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyCtxKey{}).(string)
+	return key
 }
 
 // ExecSubParams is params for ExecSub
@@ -40,89 +160,504 @@ type ExecSubParams struct {
 	Args    []interface{}
 }
 
-func (s *Saga) startSaga() {
+// appendLog appends log into saga log storage, and publishes it if publisher is set.
+func (s *Saga) appendLog(log *Log) error {
+	log.CorrelationID = s.correlationID
+	if s.sec.opts.logChecksum {
+		// entries must be appended in the order they are chained
+		s.chain.mu.Lock()
+		defer s.chain.mu.Unlock()
+		if err := s.chain.seal(s.store, s.logID, log); err != nil {
+			return err
+		}
+	}
+	data := log.mustMarshal()
+	policy := s.sec.opts.storeRetry
+	var delay time.Duration
+	for i := 1; ; i++ {
+		err := s.store.AppendLog(s.logID, data)
+		if err == nil {
+			break
+		}
+		if i >= policy.attempts() || !storage.IsTemporary(err) {
+			return err
+		}
+		delay = policy.Backoff.Delay(i, delay)
+		time.Sleep(delay)
+	}
+	if s.sec.opts.logChecksum {
+		s.chain.advance(log)
+	}
+	s.sec.publish(s.logID, *log)
+	s.compactIfDue()
+	return nil
+}
+
+func (s *Saga) startSaga() error {
 	log := &Log{
-		Type: SagaStart,
-		Time: time.Now(),
+		Type:   SagaStart,
+		Time:   time.Now(),
+		Values: s.tags,
+		Depth:  s.depth,
+	}
+	if s.sec.opts.logIDFunc != nil {
+		log.SagaID = s.id
 	}
-	err := s.store.AppendLog(s.logID, log.mustMarshal())
+	err := s.appendLog(log)
 	if err != nil {
-		panic(fmt.Errorf("startSaga AppendLog: %v", err))
+		return &StoreError{Op: "startSaga AppendLog", Err: err}
 	}
+	return nil
 }
 
 // ExecSub executes a sub-transaction for given subTxID(which define in SEC initialize) and arguments.
 // it returns current Saga.
 func (s *Saga) ExecSub(subTxID string, args ...interface{}) *Saga {
+	return s.ExecSubWithOptions(subTxID, ExecSubOptions{}, args...)
+}
+
+// ExecSubIf executes the sub-transaction only if cond holds, cond can inspect saga state
+// kept by prior steps. Otherwise the sub-transaction is skipped without aborting saga,
+// and an ActionSkipped log is recorded so recovery knows it was skipped intentionally.
+// it returns current Saga.
+func (s *Saga) ExecSubIf(cond func(*Saga) bool, subTxID string, args ...interface{}) *Saga {
 	s.mu.Lock()
 	abort := s.abort
 	s.mu.Unlock()
 	if abort {
 		return s
 	}
-	subTxDef := s.sec.MustFindSubTxDef(subTxID)
+	if cond(s) {
+		return s.ExecSub(subTxID, args...)
+	}
 	log := &Log{
-		Type:    ActionStart,
+		Type:    ActionSkipped,
 		SubTxID: subTxID,
 		Time:    time.Now(),
 	}
-	err := s.store.AppendLog(s.logID, log.mustMarshal())
+	err := s.appendLog(log)
 	if err != nil {
-		panic(fmt.Errorf("ExecSub AppendLog: %v", err))
+		panic(fmt.Errorf("ExecSubIf AppendLog: %v", err))
 	}
+	return s
+}
 
-	params := make([]reflect.Value, 0, len(args)+1)
-	params = append(params, reflect.ValueOf(s.context))
-	for _, arg := range args {
-		params = append(params, reflect.ValueOf(arg))
+// Mark appends a custom entry of typ registered by RegisterLogType to saga log, e.g. a marker of integration,
+// values are recorded as Values of the entry. Recovery logic skips custom entries.
+func (s *Saga) Mark(typ LogType, values map[string]string) error {
+	if !typ.Registered() || typ.builtin() {
+		return fmt.Errorf("Mark %s: not a registered custom log type", typ)
+	}
+	return s.appendLog(&Log{Type: typ, Time: time.Now(), Values: values})
+}
+
+// State returns key/value store of the saga.
+func (s *Saga) State() *State {
+	return s.state
+}
+
+// LogID returns logID the saga log is stored under, e.g. to verify it by sagatest.
+func (s *Saga) LogID() string {
+	return s.logID
+}
+
+// Err returns error caused saga abort, or nil if not aborted.
+func (s *Saga) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// ExecSubWithOptions likes ExecSub, but opts overrides the sub-transaction defaults for this call.
+// it returns current Saga.
+func (s *Saga) ExecSubWithOptions(subTxID string, opts ExecSubOptions, args ...interface{}) *Saga {
+	s.execSub(s.context, subTxID, opts, 0, args)
+	return s
+}
+
+// execSub executes sub-transaction as member of concurrent group if group > 0, it returns false if saga fails.
+// A failed group member doesn't abort saga, ExecSubConcurrent aborts once the whole group is done.
+// ctx is the parent of action context, it's s.context unless the group is fail-fast.
+func (s *Saga) execSub(ctx context.Context, subTxID string, opts ExecSubOptions, group int, args []interface{}) bool {
+	s.mu.Lock()
+	failed := s.abort || (group > 0 && s.err != nil)
+	s.mu.Unlock()
+	if failed {
+		return false
+	}
+	if s.sec.admission.inMaintenance() {
+		s.fail(group, fmt.Errorf("ExecSub %s: %w", subTxID, ErrMaintenanceMode))
+		return false
+	}
+	if err := s.waitResumed(); err != nil {
+		s.fail(group, err)
+		return false
+	}
+	plan := s.sec.mustFindStepPlan(subTxID, args)
+	subTxDef := plan.def
+	// persisted are args recorded for compensate, which may be transformed by TransformArgs
+	persisted := args
+	if plan.typeNames == nil {
+		s.sec.mu.RLock()
+		args = s.sec.paramTypeRegister.injectArgs(ctx, subTxDef.action, args)
+		s.sec.mu.RUnlock()
+		persisted = args
+		if subTxDef.transformArgs != nil {
+			var err error
+			if persisted, err = subTxDef.transformArgs(args); err != nil {
+				s.fail(group, fmt.Errorf("transform args of %s: %w", subTxID, err))
+				return false
+			}
+			if subTxDef.transformActionArgs {
+				args = persisted
+			}
+		}
+		// reflect.Value.Call panics on mismatched args, check before anything is logged
+		if err := checkArgs(subTxDef, args); err != nil {
+			s.fail(group, err)
+			return false
+		}
+	}
+	// params are recorded so a dangling action left by crash can be repaired, see RepairDangling
+	log := &Log{
+		Type:           ActionStart,
+		SubTxID:        subTxID,
+		Time:           time.Now(),
+		IdempotencyKey: opts.IdempotencyKey,
+		Version:        subTxDef.version,
+	}
+	var params []ParamData
+	var err error
+	if plan.typeNames != nil {
+		params, err = marshalNamedParams(subTxID, plan.typeNames, persisted)
+	} else {
+		params, err = marshalParams(s.sec, subTxID, persisted)
+	}
+	if err != nil {
+		s.failMarshal(group, err)
+		return false
+	}
+	log.Params = s.redactParams(subTxDef, persisted, params)
+	// the action hasn't run, aborting is safe once retries of append are used up(see WithStoreRetry)
+	err = s.appendLog(log)
+	if err != nil {
+		s.fail(group, &StoreError{Op: "ExecSub AppendLog", Err: err})
+		return false
 	}
-	result := subTxDef.action.Call(params)
-	if isReturnError(result) {
-		s.mu.Lock()
-		s.err, _ = result[0].Interface().(error)
-		s.mu.Unlock()
+	if subTxDef.detached {
+		s.execDetached(ctx, subTxDef, opts, log, args)
+		return true
+	}
+
+	var confirmed chan error
+	if subTxDef.async {
+		// register before submitting, confirmation may arrive before action returns
+		confirmed = s.sec.confirms.register(confirmKey(s.logID, subTxID))
+	}
+	s.count(statActions)
+	ctx, span := s.startSpan(ctx, "action "+subTxID)
+	scope := &valueScope{state: s.state, written: make(map[string]string)}
+	err = s.callAction(withValueScope(ctx, scope), subTxDef, opts, args)
+	span.End(err)
+	if err != nil {
+		if subTxDef.async {
+			s.sec.confirms.remove(confirmKey(s.logID, subTxID))
+		}
+		// failed action with partial compensate, or succeeded items of partial success are compensated by Abort
+		var partial *PartialError
+		var succeeded []int
+		if errors.As(err, &partial) {
+			succeeded = partial.Succeeded
+		}
+		var logErr error
+		if subTxDef.partialCompensate.IsValid() {
+			logErr = s.logActionEnd(subTxDef, opts, group, log, scope, succeeded, true)
+		} else if len(succeeded) > 0 {
+			logErr = s.logActionEnd(subTxDef, opts, group, log, scope, succeeded, false)
+		} else {
+			s.dropBound(scope)
+		}
+		if logErr != nil {
+			s.sec.opts.logger.Printf("[WARNING]ActionEnd of failed %s for %s not logged, it won't be compensated: %v",
+				subTxID, s.logID, logErr)
+		}
+		s.fail(group, err)
+		return false
+	}
+
+	if err := s.logActionEnd(subTxDef, opts, group, log, scope, nil, false); err != nil {
+		// the action ran, Abort logs its end again to compensate it, or leaves it dangling for RepairDangling
+		var marshalErr *MarshalError
+		if errors.As(err, &marshalErr) {
+			s.deferActionEnd(*log, group, true)
+			s.failMarshal(group, err)
+		} else {
+			s.deferActionEnd(*log, group, false)
+			s.fail(group, &StoreError{Op: "ExecSub AppendLog", Err: err})
+		}
+		return false
+	}
+	if subTxDef.async {
+		s.awaitConfirm(subTxID, confirmed)
+	}
+	return true
+}
+
+// fail records err as saga error and aborts, a group member only records the first error of the group.
+func (s *Saga) fail(group int, err error) {
+	s.mu.Lock()
+	if group == 0 || s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	if group == 0 {
 		s.Abort()
-		return s
 	}
+}
 
-	log = &Log{
-		Type:    ActionEnd,
-		SubTxID: subTxID,
-		Time:    time.Now(),
-		Params:  MarshalParam(s.sec, args),
+// logActionEnd logs ActionEnd paired with ActionStart log start, succeeded is only set on partial success.
+// Resource bound by the action is kept for its compensate once ActionEnd is logged, or released otherwise.
+func (s *Saga) logActionEnd(subTxDef subTxDefinition, opts ExecSubOptions, group int, start *Log, scope *valueScope, succeeded []int, failed bool) error {
+	payload, err := s.marshalPayload(subTxDef, scope)
+	if err != nil {
+		s.dropBound(scope)
+		return err
+	}
+	params, started := s.actionEndParams(start)
+	log := &Log{
+		Type:           ActionEnd,
+		SubTxID:        subTxDef.subTxID,
+		Time:           time.Now(),
+		Params:         params,
+		Started:        started,
+		IdempotencyKey: opts.IdempotencyKey,
+		Values:         scope.values(),
+		Payload:        payload,
+		Version:        subTxDef.version,
+		Succeeded:      succeeded,
+		Failed:         failed,
+		Group:          group,
+	}
+	if err := s.appendLog(log); err != nil {
+		s.dropBound(scope)
+		return err
+	}
+	s.bindResource(log, scope)
+	return nil
+}
+
+// callAction calls action of sub-transaction, retries it according to retry policy.
+func (s *Saga) callAction(ctx context.Context, subTxDef subTxDefinition, opts ExecSubOptions, args []interface{}) error {
+	retry := subTxDef.retry
+	if opts.Retry != nil {
+		retry = *opts.Retry
+	}
+	timeout := subTxDef.timeout
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout
+	}
+	if timeout == 0 {
+		timeout = s.sec.opts.defaultActionTimeout
 	}
-	err = s.store.AppendLog(s.logID, log.mustMarshal())
+	if opts.IdempotencyKey != "" {
+		ctx = context.WithValue(ctx, idempotencyKeyCtxKey{}, opts.IdempotencyKey)
+	}
+	ctx = s.decorateActionContext(ctx, subTxDef.subTxID)
+	var err error
+	var delay time.Duration
+	for i := 0; i < retry.attempts(); i++ {
+		if i > 0 {
+			delay = retry.Backoff.Delay(i, delay)
+			if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+				return err
+			}
+		}
+		if err = s.callActionOnce(ctx, timeout, subTxDef, args); err == nil {
+			return nil
+		}
+		// retry would process succeeded items again
+		var partial *PartialError
+		if errors.As(err, &partial) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Saga) callActionOnce(ctx context.Context, timeout time.Duration, subTxDef subTxDefinition, args []interface{}) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	pp := paramsPool.Get().(*[]reflect.Value)
+	params := append((*pp)[:0], reflect.ValueOf(ctx))
+	for _, arg := range args {
+		params = append(params, reflect.ValueOf(arg))
+	}
+	result, err := s.sec.call(subTxDef.action, params)
+	// clear references before putting back, so args can be garbage collected
+	for i := range params {
+		params[i] = reflect.Value{}
+	}
+	*pp = params[:0]
+	paramsPool.Put(pp)
 	if err != nil {
-		panic(fmt.Errorf("ExecSub AppendLog: %v", err))
+		return fmt.Errorf("action %s: %w", subTxDef.subTxID, err)
 	}
-	return s
+	return s.interpretResult(subTxDef.subTxID, result)
 }
 
-// ExecSubConcurrent executes sub-transactions concurrently.
+// ExecSubConcurrent executes sub-transactions concurrently as a group, each list runs in its own goroutine.
+// Group boundaries are logged by GroupStart and GroupEnd, if any member fails the saga aborts after the whole group is done,
+// and Abort compensates groups as units in reverse group order, with members of a group compensated concurrently.
+// With WithConcurrentFailFast, the first failure cancels context of actions in progress, they must honor
+// context cancellation to stop promptly. Sub-transactions not yet started are skipped after a failure either way.
 // it returns current Saga.
 func (s *Saga) ExecSubConcurrent(subTxsList ...[]ExecSubParams) *Saga {
-	var n sync.WaitGroup
+	return s.execGroup("ExecSubConcurrent", func(ctx context.Context, group int, cancel context.CancelFunc) {
+		var n sync.WaitGroup
+		for _, subTxs := range subTxsList {
+			s.acquireSem()
+			n.Add(1)
+			subTxs := subTxs
+			go func() {
+				defer n.Done()
+				defer s.releaseSem()
+				for _, subTx := range subTxs {
+					if !s.execSub(ctx, subTx.SubTxID, ExecSubOptions{}, group, subTx.Args) {
+						cancel()
+						return
+					}
+				}
+			}()
+		}
+		n.Wait()
+	})
+}
+
+// ExecSubParallel likes ExecSubConcurrent, but runs items of all lists through a pool of at most parallelism
+// goroutines rather than a goroutine per list, so items of a list run concurrently too, and the lists only
+// group items. Items start in list order, parallelism <= 0 runs all items at once.
+// The group is logged and compensated like ExecSubConcurrent: members are logged in completion order
+// and compensated concurrently as a unit, so items must not depend on each other.
+// WithMaxConcurrency and WithConcurrency bound items running simultaneously instead of lists.
+// it returns current Saga.
+func (s *Saga) ExecSubParallel(parallelism int, subTxsList ...[]ExecSubParams) *Saga {
+	var items []ExecSubParams
 	for _, subTxs := range subTxsList {
-		n.Add(1)
-		subTxs := subTxs
-		go func() {
-			defer n.Done()
-			for _, subTx := range subTxs {
-				s.ExecSub(subTx.SubTxID, subTx.Args...)
-			}
-		}()
+		items = append(items, subTxs...)
+	}
+	if parallelism <= 0 || parallelism > len(items) {
+		parallelism = len(items)
+	}
+	return s.execGroup("ExecSubParallel", func(ctx context.Context, group int, cancel context.CancelFunc) {
+		queue := make(chan ExecSubParams)
+		var n sync.WaitGroup
+		for i := 0; i < parallelism; i++ {
+			n.Add(1)
+			go func() {
+				defer n.Done()
+				for item := range queue {
+					s.acquireSem()
+					ok := s.execSub(ctx, item.SubTxID, ExecSubOptions{}, group, item.Args)
+					s.releaseSem()
+					if !ok {
+						cancel()
+					}
+				}
+			}()
+		}
+		for _, item := range items {
+			queue <- item
+		}
+		close(queue)
+		n.Wait()
+	})
+}
+
+// execGroup runs members of a concurrent group by run between GroupStart and GroupEnd logs,
+// and aborts saga if any member failed. run must cancel ctx on failure.
+func (s *Saga) execGroup(op string, run func(ctx context.Context, group int, cancel context.CancelFunc)) *Saga {
+	s.mu.Lock()
+	abort := s.abort
+	s.groups++
+	group := s.groups
+	s.mu.Unlock()
+	if abort {
+		return s
+	}
+	s.mustAppendLog(&Log{Type: GroupStart, Group: group, Time: time.Now()}, op)
+	ctx, cancel := s.context, context.CancelFunc(func() {})
+	if s.sec.opts.concurrentFailFast {
+		ctx, cancel = context.WithCancel(s.context)
+	}
+	defer cancel()
+	run(ctx, group, cancel)
+	s.mustAppendLog(&Log{Type: GroupEnd, Group: group, Time: time.Now()}, op)
+	s.mu.Lock()
+	failed := s.err != nil && !s.abort
+	s.mu.Unlock()
+	if failed {
+		s.Abort()
 	}
-	n.Wait()
 	return s
 }
 
+// acquireSem takes a slot of WithConcurrency, it's a no-op if concurrency is unlimited.
+func (s *Saga) acquireSem() {
+	if s.sem != nil {
+		s.sem <- struct{}{}
+	}
+}
+
+// releaseSem returns the slot taken by acquireSem.
+func (s *Saga) releaseSem() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// Flush blocks until saga log appended so far is durably persisted by storage,
+// it's a durability barrier at critical steps, e.g. before responding to user.
+func (s *Saga) Flush() error {
+	if err := s.store.Flush(); err != nil {
+		return &StoreError{Op: "Flush", Err: err}
+	}
+	return nil
+}
+
 // EndSaga finishes a Saga's execution.
 func (s *Saga) EndSaga() error {
+	if atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		defer s.sec.admission.release(s)
+		defer s.stopHeartbeat()
+		s.count(statSagasEnded)
+	}
+	defer func() {
+		s.span.End(s.err)
+	}()
+	if onEnd := s.sec.opts.onEnd; onEnd != nil {
+		defer func() {
+			onEnd(s.context, s.err)
+		}()
+	}
+	s.waitDetached(false)
+	s.mu.Lock()
+	abort := s.abort
+	s.mu.Unlock()
+	if !abort && s.sec.admission.inMaintenance() {
+		s.fail(0, fmt.Errorf("EndSaga: %w", ErrMaintenanceMode))
+	}
+	if s.abort {
+		s.commits = nil
+	}
+	s.logCommitIntents()
 	log := &Log{
 		Type: SagaEnd,
 		Time: time.Now(),
 	}
-	err := s.store.AppendLog(s.logID, log.mustMarshal())
+	err := s.appendLog(log)
 	if err != nil {
 		panic(fmt.Errorf("EndSaga AppendLog: %v", err))
 	}
@@ -131,6 +666,39 @@ func (s *Saga) EndSaga() error {
 	if s.compensateFail {
 		return s.err
 	}
+	s.releaseBoundResources()
+	outcome := s.newOutcome(OutcomeCompleted)
+	if s.compensationSkipped {
+		outcome.Outcome = OutcomeCompensationSkipped
+	} else if s.abort {
+		outcome.Outcome = OutcomeCompensated
+	}
+	if err := s.recordOutcome(outcome); err != nil {
+		panic(fmt.Errorf("EndSaga record outcome: %v", err))
+	}
+	if s.sec.opts.pausePollInterval > 0 {
+		// drop pause marker left by Pause without Resume
+		if err := s.store.Cleanup(pausedKeyPrefix + s.logID); err != nil {
+			panic(fmt.Errorf("EndSaga Cleanup pause marker: %v", err))
+		}
+	}
+	if s.sec.opts.commitAfterCleanup {
+		defer s.runCommits()
+	} else if !s.runCommits() {
+		// keep intents for RecoverCommits
+		return s.err
+	}
+	switch s.sec.cleanupAction(outcome) {
+	case CleanupRetain:
+		return s.err
+	case CleanupArchive:
+		if err := s.sec.archive(s.logID); err != nil {
+			panic(fmt.Errorf("EndSaga archive: %v", err))
+		}
+	}
+	if c := s.sec.cleaner; c != nil && c.enqueue(s.logID) {
+		return s.err
+	}
 	err = s.store.Cleanup(s.logID)
 	if err != nil {
 		panic(fmt.Errorf("EndSaga Cleanup: %v", err))
@@ -145,83 +713,467 @@ func (s *Saga) Abort() {
 	s.mu.Lock()
 	s.abort = true
 	s.mu.Unlock()
-	logs, err := s.store.Lookup(s.logID)
+	s.waitDetached(true)
+	s.count(statSagasAborted)
+	// stream the log and only keep entries deciding which sub-transactions need compensate
+	it, err := s.store.LookupStream(s.logID)
 	if err != nil {
-		panic(fmt.Errorf("Abort Lookup: %v", err))
+		panic(fmt.Errorf("Abort LookupStream: %v", err))
+	}
+	var logs []Log
+	params := make(startParams)
+	for it.Next() {
+		log := mustUnmarshalLog(it.Value())
+		params.restore(&log)
+		// restore correlation ID of recovered saga
+		if s.correlationID == "" {
+			s.correlationID = log.CorrelationID
+		}
+		switch log.Type {
+		case ActionEnd:
+			logs = append(logs, log)
+			s.state.restore(log)
+		case CompensateEnd, CompensateRetry, CompensationSkipped:
+			logs = append(logs, log)
+		}
 	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		panic(fmt.Errorf("Abort LookupStream: %v", err))
+	}
+	logs = append(logs, s.logDeferredActionEnds()...)
 	alog := &Log{
 		Type: SagaAbort,
 		Time: time.Now(),
 	}
-	err = s.store.AppendLog(s.logID, alog.mustMarshal())
+	err = s.appendLog(alog)
 	if err != nil {
 		panic(fmt.Errorf("Abort AppendLog: %v", err))
 	}
-	for i := len(logs) - 1; i >= 0; i-- {
-		logData := logs[i]
-		log := mustUnmarshalLog(logData)
-		if log.Type == ActionEnd {
-			if err := s.compensate(log); err != nil {
-				// save log ids of compensate failure saga instead of panic
-				// panic(fmt.Errorf("Compensate Failure: %v", err))
-				s.compensateFail = true
-				s.store.AppendLog("sagacompensate_failures", s.logID)
-				return
+	s.steps = completedSteps(logs)
+	actionEnds, retries := pendingCompensations(logs)
+	if !s.shouldCompensate(actionEnds) {
+		return
+	}
+	s.compensateAll(actionEnds, retries)
+}
+
+// shouldCompensate consults the hook set by WithShouldCompensate, and logs CompensationSkipped if it declines.
+func (s *Saga) shouldCompensate(actionEnds []Log) bool {
+	should := s.sec.opts.shouldCompensate
+	s.mu.Lock()
+	err, skip := s.err, s.skipCompensation
+	s.mu.Unlock()
+	if (should == nil && !skip) || len(actionEnds) == 0 {
+		return true
+	}
+	completed := make([]string, 0, len(actionEnds))
+	for _, log := range actionEnds {
+		completed = append(completed, log.SubTxID)
+	}
+	if !skip && should(err, completed) {
+		return true
+	}
+	log := &Log{Type: CompensationSkipped, Time: time.Now()}
+	if err != nil {
+		log.Values = map[string]string{"error": err.Error()}
+	}
+	s.mustAppendLog(log, "Abort")
+	s.compensationSkipped = true
+	return false
+}
+
+// compensateAll compensates given ActionEnd logs in reverse order,
+// retries is the number of scheduled compensate retries already made for this saga.
+// It returns false if compensation failed and has been scheduled to retry or dead-lettered.
+// Abort hooks run once around it, a re-entrant call while compensating returns false immediately.
+func (s *Saga) compensateAll(actionEnds []Log, retries int) bool {
+	if !atomic.CompareAndSwapInt32(&s.compensating, 0, 1) {
+		return false
+	}
+	defer atomic.StoreInt32(&s.compensating, 0)
+	if !s.checkCompensationDepth() {
+		return false
+	}
+	s.compensateCtx = withCompensationDepth(s.sec.inheritContext(s.context), s.depth+1)
+	if before := s.sec.opts.onBeforeAbort; before != nil {
+		s.compensateCtx = before(s.compensateCtx, s.logID)
+	}
+	ok := s.compensateUnits(actionEnds, retries) && s.releaseResources()
+	if ok {
+		s.releaseBoundResources()
+	}
+	if after := s.sec.opts.onAfterAbort; after != nil {
+		var result error
+		if !ok {
+			result = fmt.Errorf("%s: %w", s.logID, ErrCompensateFailed)
+		}
+		after(s.compensateCtx, s.logID, result)
+	}
+	return ok
+}
+
+func (s *Saga) compensateUnits(actionEnds []Log, retries int) bool {
+	if timeout := s.sec.opts.abortTimeout; timeout > 0 {
+		s.compensateDeadline = time.Now().Add(timeout)
+	}
+	// compensate units in reverse order, a unit is a single step or a whole concurrent group
+	for end := len(actionEnds); end > 0; {
+		start := end - 1
+		if group := actionEnds[start].Group; group > 0 {
+			for start > 0 && actionEnds[start-1].Group == group {
+				start--
+			}
+		}
+		if !s.compensateDeadline.IsZero() && time.Now().After(s.compensateDeadline) {
+			s.compensateFail = true
+			s.abandonCompensation(actionEnds[:end])
+			return false
+		}
+		failed, err := s.compensateUnit(actionEnds[start:end])
+		if errors.Is(err, ErrAbortTimeout) {
+			s.compensateFail = true
+			s.abandonCompensation(append(actionEnds[:start:start], failed...))
+			return false
+		}
+		if err != nil {
+			// save log ids of compensate failure saga instead of panic
+			// panic(fmt.Errorf("Compensate Failure: %v", err))
+			s.compensateFail = true
+			subTxID := failed[0].SubTxID
+			subDef := s.sec.mustFindSubTxDefVersion(subTxID, failed[0].Version)
+			switch {
+			case subDef.manualCompensate:
+				s.alertCompensateFailure(subTxID, err)
+			case errors.Is(err, ErrPermanent), subDef.compensateRetries == 0:
+				s.deadLetter(subTxID, err)
+			default:
+				s.scheduleCompensateRetry(subTxID, retries, err)
 			}
+			return false
 		}
+		end = start
 	}
+	return true
 }
 
-func (s *Saga) compensate(tlog Log) error {
-	clog := &Log{
-		Type:    CompensateStart,
-		SubTxID: tlog.SubTxID,
+// compensateUnit compensates steps of a unit concurrently, it returns the steps failed and the first error.
+func (s *Saga) compensateUnit(unit []Log) ([]Log, error) {
+	if len(unit) == 1 {
+		if err := s.compensate(unit[0]); err != nil {
+			return unit, err
+		}
+		return nil, nil
+	}
+	errs := make([]error, len(unit))
+	var wg sync.WaitGroup
+	for i := range unit {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.compensate(unit[i])
+		}(i)
+	}
+	wg.Wait()
+	var failed []Log
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed = append(failed, unit[i])
+		if first == nil || errors.Is(err, ErrAbortTimeout) {
+			first = err
+		}
+	}
+	return failed, first
+}
+
+// abandonCompensation records sub-transactions left un-compensated when abort timeout exceeded,
+// and moves the saga into dead-letter list, RetryCompensateFailure can resume them later.
+func (s *Saga) abandonCompensation(actionEnds []Log) {
+	pending := make([]string, 0, len(actionEnds))
+	for i := len(actionEnds) - 1; i >= 0; i-- {
+		pending = append(pending, actionEnds[i].SubTxID)
+	}
+	tlog := &Log{
+		Type:    AbortTimeout,
+		SubTxID: pending[0],
 		Time:    time.Now(),
 	}
-	err := s.store.AppendLog(s.logID, clog.mustMarshal())
+	err := s.appendLog(tlog)
 	if err != nil {
-		panic(fmt.Errorf("compensate AppendLog: %v", err))
+		panic(fmt.Errorf("abandonCompensation AppendLog: %v", err))
+	}
+	s.sec.opts.logger.Printf("[WARNING]Abort %s timeout, dead-lettered with un-compensated %v", s.logID, pending)
+	if err := s.sec.appendList(compensateFailuresLogID, s.logID); err != nil {
+		s.sec.opts.logger.Printf("[ERROR]Dead-letter %s failure: %v", s.logID, err)
 	}
+}
 
-	args := UnmarshalParam(s.sec, tlog.Params)
+// scheduleCompensateRetry records next retry time in log if retry schedule is not used up,
+// otherwise moves the saga into dead-letter list.
+func (s *Saga) scheduleCompensateRetry(subTxID string, retries int, cause error) {
+	delay, ok := s.sec.compensateRetryDelay(retries+1, s.prevRetryDelay)
+	if !ok {
+		s.deadLetter(subTxID, cause)
+		return
+	}
+	now := time.Now()
+	rlog := &Log{
+		Type:      CompensateRetry,
+		SubTxID:   subTxID,
+		Time:      now,
+		Attempt:   retries + 1,
+		NextRetry: now.Add(delay),
+	}
+	err := s.appendLog(rlog)
+	if err != nil {
+		panic(fmt.Errorf("scheduleCompensateRetry AppendLog: %v", err))
+	}
+	if err := s.sec.appendList(compensateRetriesLogID, s.logID); err != nil {
+		s.sec.opts.logger.Printf("[ERROR]Schedule compensate retry of %s failure: %v", s.logID, err)
+	}
+}
 
-	params := make([]reflect.Value, 0, len(args)+1)
-	// compensate.Call may always fail if s.context is canceled
-	// so we use context.Background() instead of s.context here
-	params = append(params, reflect.ValueOf(context.Background()))
-	params = append(params, args...)
+// compensateRetryDelay returns delay before given scheduled retry attempt(starts from 1),
+// prev is delay of the previous one. ok is false if retries are used up.
+func (e *ExecutionCoordinator) compensateRetryDelay(attempt int, prev time.Duration) (delay time.Duration, ok bool) {
+	if e.opts.compensateRetryMax > 0 {
+		if attempt > e.opts.compensateRetryMax {
+			return 0, false
+		}
+		return e.opts.compensateRetryBackoff.Delay(attempt, prev), true
+	}
+	schedule := e.opts.compensateRetrySchedule
+	if attempt > len(schedule) {
+		return 0, false
+	}
+	return schedule[attempt-1], true
+}
+
+// lastRetryDelay returns delay of the last scheduled compensate retry in saga log.
+func lastRetryDelay(logs []Log) time.Duration {
+	for i := len(logs) - 1; i >= 0; i-- {
+		if logs[i].Type == CompensateRetry {
+			return logs[i].NextRetry.Sub(logs[i].Time)
+		}
+	}
+	return 0
+}
+
+// deadLetter moves the saga into dead-letter list, failing which is logged and returned.
+// subTxID is empty if compensation didn't start.
+func (s *Saga) deadLetter(subTxID string, cause error) error {
+	if subTxID == "" {
+		s.sec.opts.logger.Printf("[ERROR]Saga %s not compensated, dead-lettered: %v", s.logID, cause)
+	} else {
+		s.sec.opts.logger.Printf("[WARNING]Compensate %s for %s failure, dead-lettered: %v", subTxID, s.logID, cause)
+	}
+	if err := s.sec.appendList(compensateFailuresLogID, s.logID); err != nil {
+		s.sec.opts.logger.Printf("[ERROR]Dead-letter %s failure: %v", s.logID, err)
+		return &StoreError{Op: "dead-letter " + s.logID, Err: err}
+	}
+	return nil
+}
+
+// alertCompensateFailure dead-letters the saga with high priority and fires alert hook.
+func (s *Saga) alertCompensateFailure(subTxID string, cause error) {
+	s.sec.opts.logger.Printf("[ERROR]Manual compensate %s for %s failure, need human intervention: %v", subTxID, s.logID, cause)
+	for _, key := range []string{compensateFailuresLogID, compensateAlertsLogID} {
+		if err := s.sec.appendList(key, s.logID); err != nil {
+			s.sec.opts.logger.Printf("[ERROR]Dead-letter %s failure: %v", s.logID, err)
+		}
+	}
+	if alert := s.sec.opts.alertHook; alert != nil {
+		alert(s.logID, subTxID, cause)
+	}
+}
+
+func (s *Saga) compensate(tlog Log) (err error) {
+	subDef := s.sec.mustFindSubTxDefVersion(tlog.SubTxID, tlog.Version)
+	if !subDef.idempotentCompensate {
+		// marks compensate attempted, see IdempotentCompensate
+		clog := &Log{
+			Type:    CompensateStart,
+			SubTxID: tlog.SubTxID,
+			Time:    time.Now(),
+			Step:    tlog.Step,
+		}
+		if err := s.appendLog(clog); err != nil {
+			panic(fmt.Errorf("compensate AppendLog: %v", err))
+		}
+	}
+	defer func() {
+		if err != nil {
+			s.failCompensate(tlog, err)
+		}
+	}()
 
-	subDef := s.sec.MustFindSubTxDef(tlog.SubTxID)
+	params := tlog.Params
+	if subDef.compensatePayload && !tlog.Failed {
+		if tlog.PayloadLost {
+			// retrying can't help, the saga is dead-lettered for manual repair
+			return Permanent(fmt.Errorf("compensate %s: %w", tlog.SubTxID, ErrPayloadLost))
+		}
+		if tlog.Payload == nil {
+			// action set no payload, nothing to undo
+			return s.endCompensate(tlog, nil)
+		}
+		params = []ParamData{*tlog.Payload}
+	}
+	args := UnmarshalParam(s.sec, params)
+
+	callParams := make([]reflect.Value, 0, len(args)+1)
+	// compensate.Call may always fail if s.context is canceled
+	// so we use context.Background()(or what WithOnBeforeAbort hook returns) instead of s.context here,
+	// only saga state and values copied by WithCompensateContext are kept
+	ctx := withValueScope(s.compensateCtx, &valueScope{state: s.state})
+	ctx = withSagaInfo(ctx, s, tlog.SubTxID)
+	if tlog.Succeeded != nil {
+		ctx = context.WithValue(ctx, succeededCtxKey{}, tlog.Succeeded)
+	}
+	if bound, ok := s.boundTo(tlog); ok {
+		ctx = context.WithValue(ctx, boundResourceCtxKey{}, bound)
+	} else if subDef.requireBoundResource {
+		return fmt.Errorf("compensate %s: %w", tlog.SubTxID, ErrBoundResourceLost)
+	}
+	if err := s.revealArgs(ctx, subDef, params, args); err != nil {
+		return err
+	}
+	s.count(statCompensations)
+	_, span := s.startSpan(s.context, "compensate "+tlog.SubTxID)
+	defer func() {
+		span.End(err)
+	}()
+	callParams = append(callParams, reflect.ValueOf(ctx))
+	callParams = append(callParams, args...)
 
-	const maxTry = 10
+	compensate := s.sec.compensateOf(subDef)
+	if tlog.Failed {
+		compensate = subDef.partialCompensate
+	}
+	maxTry := subDef.compensateRetries + 1
+	if subDef.manualCompensate {
+		maxTry = 1
+	}
 	var ok bool
+	var delay time.Duration
+	var output []ParamData
 	for i := 0; i < maxTry; i++ {
-		result := subDef.compensate.Call(params)
-		if !isReturnError(result) {
+		if i > 0 {
+			delay = s.sec.opts.compensateBackoff.Delay(i, delay)
+			if !s.compensateDeadline.IsZero() && time.Now().Add(delay).After(s.compensateDeadline) {
+				return fmt.Errorf("compensate %s: %w, last error: %v", tlog.SubTxID, ErrAbortTimeout, err)
+			}
+			time.Sleep(delay)
+		}
+		if err = s.waitCompensateToken(tlog.SubTxID); err != nil {
+			if errors.Is(err, ErrAbortTimeout) {
+				return err
+			}
+			continue
+		}
+		if subDef.batcher != nil && !tlog.Failed {
+			err = s.batchCompensate(ctx, subDef.batcher, args)
+		} else {
+			var result []reflect.Value
+			if result, err = s.sec.call(compensate, callParams); err != nil {
+				err = fmt.Errorf("compensate %s: %w", tlog.SubTxID, err)
+			} else if subDef.recordCompensateResult {
+				outputs, status := splitResult(result)
+				if err = s.interpretResult(tlog.SubTxID, status); err == nil {
+					output = s.sec.marshalResult(outputs)
+				}
+			} else {
+				err = s.interpretResult(tlog.SubTxID, result)
+			}
+		}
+		if err == nil && subDef.verifier.IsValid() && !tlog.Failed {
+			err = s.verifyCompensate(tlog, subDef.verifier, callParams)
+		}
+		if err == nil {
 			ok = true
 			break
 		}
-		err, _ = result[0].Interface().(error)
+		if errors.Is(err, ErrPermanent) {
+			return fmt.Errorf("compensate %s: %w", tlog.SubTxID, err)
+		}
 	}
 	if !ok {
-		return fmt.Errorf("max try compensate: %v", err)
+		return fmt.Errorf("max try compensate: %w", err)
+	}
+	return s.endCompensate(tlog, output)
+}
+
+// failCompensate logs CompensateFailed of ActionEnd log tlog.
+func (s *Saga) failCompensate(tlog Log, cause error) {
+	flog := &Log{
+		Type:    CompensateFailed,
+		SubTxID: tlog.SubTxID,
+		Time:    time.Now(),
+		Step:    tlog.Step,
+		Values:  map[string]string{"error": cause.Error()},
 	}
+	if err := s.appendLog(flog); err != nil {
+		panic(fmt.Errorf("compensate AppendLog: %v", err))
+	}
+}
 
-	clog = &Log{
+// endCompensate logs CompensateEnd of ActionEnd log tlog, result is only set by RecordCompensateResult.
+func (s *Saga) endCompensate(tlog Log, result []ParamData) error {
+	clog := &Log{
 		Type:    CompensateEnd,
 		SubTxID: tlog.SubTxID,
 		Time:    time.Now(),
+		Step:    tlog.Step,
+		Result:  result,
 	}
-	err = s.store.AppendLog(s.logID, clog.mustMarshal())
-	if err != nil {
+	if err := s.appendLog(clog); err != nil {
 		panic(fmt.Errorf("compensate AppendLog: %v", err))
 	}
 	return nil
 }
 
+// call calls fn, a panic is recovered into *PanicError unless WithRecoverActions(false).
+func (e *ExecutionCoordinator) call(fn reflect.Value, params []reflect.Value) (result []reflect.Value, err error) {
+	if !e.opts.propagatePanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return fn.Call(params), nil
+}
+
 func isReturnError(result []reflect.Value) bool {
 	if len(result) == 1 && !result[0].IsNil() {
 		return true
 	}
 	return false
 }
+
+// ResultInterpreter decides whether an action or compensate failed from its return values, see WithResultInterpreter.
+type ResultInterpreter func(result []reflect.Value) (failed bool, err error)
+
+// DefaultResultInterpreter treats a single non-nil return value as the error, it's used unless WithResultInterpreter is set.
+func DefaultResultInterpreter(result []reflect.Value) (bool, error) {
+	if !isReturnError(result) {
+		return false, nil
+	}
+	err, _ := result[0].Interface().(error)
+	return true, err
+}
+
+// interpretResult returns the error of a failed call, or nil on success.
+func (s *Saga) interpretResult(subTxID string, result []reflect.Value) error {
+	failed, err := s.sec.opts.resultInterpreter(result)
+	if !failed {
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("sub-transaction %s failed", subTxID)
+	}
+	return err
+}
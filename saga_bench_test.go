@@ -0,0 +1,98 @@
+package saga
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/kzh125/go-saga/storage/memory"
+)
+
+type benchOrder struct {
+	ID     string
+	Amount int
+}
+
+func benchAction(ctx context.Context, order *benchOrder, user string) error {
+	return nil
+}
+
+func benchCompensate(ctx context.Context, order *benchOrder, user string) error {
+	return nil
+}
+
+func BenchmarkSaga5Steps(b *testing.B) {
+	store, _ := memory.NewMemStorage()
+	sec := NewSEC(store, LogPrefix)
+	for i := 0; i < 5; i++ {
+		sec.AddSubTxDef("step"+strconv.Itoa(i), benchAction, benchCompensate)
+	}
+	order := &benchOrder{ID: "order", Amount: 100}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := sec.StartSaga(ctx, strconv.Itoa(i))
+		for j := 0; j < 5; j++ {
+			s.ExecSub("step"+strconv.Itoa(j), order, "user")
+		}
+		s.EndSaga()
+	}
+}
+
+// BenchmarkExecSubPlan runs one saga shape repeatedly, cold drops cached plans before every saga.
+func BenchmarkExecSubPlan(b *testing.B) {
+	for _, cold := range []bool{false, true} {
+		name := "cached"
+		if cold {
+			name = "cold"
+		}
+		b.Run(name, func(b *testing.B) {
+			store, _ := memory.NewMemStorage()
+			sec := NewSEC(store, LogPrefix)
+			for i := 0; i < 5; i++ {
+				sec.AddSubTxDef("step"+strconv.Itoa(i), benchAction, benchCompensate)
+			}
+			order := &benchOrder{ID: "order", Amount: 100}
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if cold {
+					sec.mu.Lock()
+					sec.resetPlans()
+					sec.mu.Unlock()
+				}
+				s := sec.StartSaga(ctx, strconv.Itoa(i))
+				for j := 0; j < 5; j++ {
+					s.ExecSub("step"+strconv.Itoa(j), order, "user")
+				}
+				s.EndSaga()
+			}
+		})
+	}
+}
+
+func BenchmarkMarshalParam(b *testing.B) {
+	store, _ := memory.NewMemStorage()
+	sec := NewSEC(store, LogPrefix)
+	sec.AddSubTxDef("step", benchAction, benchCompensate)
+	args := []interface{}{&benchOrder{ID: "order", Amount: 100}, "user"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MarshalParam(&sec, args)
+	}
+}
+
+func BenchmarkUnmarshalParam(b *testing.B) {
+	store, _ := memory.NewMemStorage()
+	sec := NewSEC(store, LogPrefix)
+	sec.AddSubTxDef("step", benchAction, benchCompensate)
+	params := MarshalParam(&sec, []interface{}{&benchOrder{ID: "order", Amount: 100}, "user"})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		UnmarshalParam(&sec, params)
+	}
+}
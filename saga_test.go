@@ -0,0 +1,1234 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/kzh125/go-saga/storage/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+type account struct {
+	balance map[string]int
+}
+
+func (a *account) deduce(ctx context.Context, name string, amount int) error {
+	a.balance[name] -= amount
+	return nil
+}
+
+func (a *account) deduceCompensate(ctx context.Context, name string, amount int) error {
+	a.balance[name] += amount
+	return nil
+}
+
+func (a *account) failDeposit(ctx context.Context, name string, amount int) error {
+	return errors.New("deposit failure")
+}
+
+func (a *account) depositCompensate(ctx context.Context, name string, amount int) error {
+	return nil
+}
+
+func TestSagaAbortCompensates(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+
+	s := sec.StartSaga(context.Background(), "1")
+	s.ExecSub("deduce", "foo", 30)
+	assert.Equal(t, 70, acc.balance["foo"])
+	s.ExecSub("deposit", "bar", 30)
+	err := s.EndSaga()
+	assert.EqualError(t, err, "deposit failure")
+	assert.Equal(t, 100, acc.balance["foo"])
+}
+
+func TestExecSubInvalidArgs(t *testing.T) {
+	for name, args := range map[string][]interface{}{
+		"too few":    {"foo"},
+		"too many":   {"foo", 10, 1},
+		"wrong type": {"foo", "10"},
+		"nil":        {nil, 10},
+	} {
+		t.Run(name, func(t *testing.T) {
+			acc := &account{balance: map[string]int{"foo": 100}}
+			sec := newTestSEC(t)
+			sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+
+			s := sec.StartSaga(context.Background(), "args")
+			s.ExecSub("deduce", "foo", 30).ExecSub("deduce", args...)
+			err := s.EndSaga()
+			assert.True(t, errors.Is(err, ErrInvalidArgs), "%v", err)
+			assert.Contains(t, err.Error(), "deduce")
+			assert.Equal(t, 100, acc.balance["foo"])
+		})
+	}
+}
+
+func TestRecoverActions(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	crash := func(ctx context.Context, name string, amount int) error {
+		var balance map[string]int
+		balance[name] = amount
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("crash", crash, acc.deduceCompensate).
+		AddSubTxDef("crashCompensate", acc.deduce, crash, CompensateRetries(0)).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "panic")
+	s.ExecSub("deduce", "foo", 10).ExecSub("crash", "foo", 10)
+	err := s.EndSaga()
+	var panicErr *PanicError
+	assert.True(t, errors.As(err, &panicErr), "%v", err)
+	assert.Contains(t, string(panicErr.Stack), "TestRecoverActions")
+	assert.Equal(t, 100, acc.balance["foo"])
+
+	s = sec.StartSaga(context.Background(), "compensate")
+	s.ExecSub("crashCompensate", "foo", 10).ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	failures, err := sec.ListCompensateFailures()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.logID}, failures)
+
+	sec = newTestSEC(t, WithRecoverActions(false))
+	sec.AddSubTxDef("crash", crash, acc.deduceCompensate)
+	s = sec.StartSaga(context.Background(), "propagate")
+	assert.Panics(t, func() { s.ExecSub("crash", "foo", 10) })
+}
+
+type failingStore struct {
+	storage.Storage
+}
+
+func (f failingStore) AppendLog(logID string, data string) error {
+	return errors.New("connection refused")
+}
+
+func (f failingStore) Flush() error {
+	return errors.New("disk full")
+}
+
+func TestStartSagaEStoreUnavailable(t *testing.T) {
+	sec := NewSEC(failingStore{}, LogPrefix)
+	s, err := sec.StartSagaE(context.Background(), "1")
+	assert.Nil(t, s)
+	var storeErr *StoreError
+	assert.True(t, errors.As(err, &storeErr))
+	assert.EqualError(t, err, "startSaga AppendLog: connection refused")
+	assert.Panics(t, func() {
+		sec.StartSaga(context.Background(), "1")
+	})
+}
+
+type hookKey struct{}
+
+func TestStartEndHooks(t *testing.T) {
+	var ended bool
+	var endErr error
+	sec := newTestSEC(t,
+		WithOnStart(func(ctx context.Context) (context.Context, error) {
+			return context.WithValue(ctx, hookKey{}, "tx"), nil
+		}),
+		WithOnEnd(func(ctx context.Context, err error) {
+			ended = ctx.Value(hookKey{}) == "tx"
+			endErr = err
+		}))
+	sec.AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "hooks")
+	s.ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.True(t, ended)
+	assert.EqualError(t, endErr, "action failure")
+
+	sec = newTestSEC(t, WithOnStart(func(ctx context.Context) (context.Context, error) {
+		return nil, errors.New("begin failure")
+	}))
+	_, err := sec.StartSagaE(context.Background(), "hooks")
+	assert.Error(t, err)
+}
+
+func TestExecSubWithOptions(t *testing.T) {
+	var keys []string
+	calls := 0
+	action := func(ctx context.Context, name string) error {
+		keys = append(keys, IdempotencyKey(ctx))
+		calls++
+		if calls < 3 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("retry", action, func(ctx context.Context, name string) error { return nil })
+
+	s := sec.StartSaga(context.Background(), "opts")
+	s.ExecSubWithOptions("retry", ExecSubOptions{
+		Retry:          &RetryPolicy{MaxAttempts: 3},
+		IdempotencyKey: "key-1",
+	}, "foo")
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, []string{"key-1", "key-1", "key-1"}, keys)
+}
+
+func TestExecSubTimeout(t *testing.T) {
+	action := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("slow", action, failCompensate, ActionTimeout(time.Hour))
+
+	s := sec.StartSaga(context.Background(), "timeout")
+	s.ExecSubWithOptions("slow", ExecSubOptions{Timeout: 10 * time.Millisecond})
+	assert.Equal(t, context.DeadlineExceeded, s.EndSaga())
+}
+
+func TestExecSubIf(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+
+	s := sec.StartSaga(context.Background(), "if")
+	s.State().Set("vip", true)
+	isVip := func(s *Saga) bool {
+		vip, _ := s.State().Get("vip")
+		return vip == true
+	}
+	s.ExecSubIf(func(s *Saga) bool { return !isVip(s) }, "deduce", "foo", 10)
+	s.ExecSubIf(isVip, "deduce", "foo", 1)
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, ActionSkipped, entries[1].Type)
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, 99, acc.balance["foo"])
+}
+
+type tenantID string
+
+type tenantKey struct{}
+
+func TestArgProvider(t *testing.T) {
+	var compensated []tenantID
+	action := func(ctx context.Context, tenant tenantID, name string) error {
+		return nil
+	}
+	compensate := func(ctx context.Context, tenant tenantID, name string) error {
+		compensated = append(compensated, tenant)
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddArgProvider(reflect.TypeOf(tenantID("")), func(ctx context.Context) interface{} {
+		return ctx.Value(tenantKey{}).(tenantID)
+	}).
+		AddSubTxDef("create", action, compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, tenantID("t1"))
+	s := sec.StartSaga(ctx, "provider")
+	s.ExecSub("create", "foo")
+	s.ExecSub("create", tenantID("t2"), "bar")
+	s.ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, []tenantID{"t2", "t1"}, compensated)
+}
+
+func TestDefaultActionTimeout(t *testing.T) {
+	var deadlines []time.Duration
+	action := func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		deadlines = append(deadlines, time.Until(deadline))
+		return nil
+	}
+	sec := newTestSEC(t, WithDefaultActionTimeout(time.Minute))
+	sec.AddSubTxDef("default", action, failCompensate).
+		AddSubTxDef("override", action, failCompensate, ActionTimeout(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sec.StartSaga(context.Background(), "1").ExecSub("default").ExecSub("override").EndSaga()
+	sec.StartSaga(ctx, "2").ExecSub("default").EndSaga()
+	if assert.Len(t, deadlines, 3) {
+		assert.True(t, deadlines[0] <= time.Minute && deadlines[0] > 59*time.Second)
+		assert.True(t, deadlines[1] > time.Minute)
+		assert.True(t, deadlines[2] <= time.Second)
+	}
+}
+
+type orders struct {
+	created     []string
+	fails       int32
+	compensated []string
+}
+
+func (o *orders) create(ctx context.Context, name string) error {
+	SetValue(ctx, "orderID", "order-"+name)
+	return nil
+}
+
+func (o *orders) cancel(ctx context.Context, name string) error {
+	if atomic.AddInt32(&o.fails, -1) >= 0 {
+		return errors.New("cancel failure")
+	}
+	var id string
+	GetValue(ctx, "orderID", &id)
+	o.compensated = append(o.compensated, id)
+	return nil
+}
+
+func (o *orders) ship(ctx context.Context) error {
+	var id string
+	if !GetValue(ctx, "orderID", &id) {
+		return errors.New("no order")
+	}
+	o.created = append(o.created, id)
+	return nil
+}
+
+func TestContextValues(t *testing.T) {
+	o := &orders{}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("create", o.create, o.cancel).
+		AddSubTxDef("ship", o.ship, func(ctx context.Context) error { return nil }).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "values")
+	s.ExecSub("create", "foo").ExecSub("ship")
+	assert.Equal(t, []string{"order-foo"}, o.created)
+
+	// compensation resumed from log restores values
+	o.fails = 10
+	s.ExecSub("fail").EndSaga()
+	assert.Empty(t, o.compensated)
+	restarted := NewSEC(sec.store, LogPrefix)
+	restarted.AddSubTxDef("create", o.create, o.cancel)
+	ok, err := restarted.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"order-foo"}, o.compensated)
+}
+
+func TestCompensateFromContext(t *testing.T) {
+	var infos []SagaInfo
+	compensate := func(ctx context.Context, name string) error {
+		info, ok := FromContext(ctx)
+		assert.True(t, ok)
+		infos = append(infos, info)
+		return nil
+	}
+	action := func(ctx context.Context, name string) error {
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("reserve", action, compensate).
+		AddSubTxDef("charge", action, compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "info")
+	s.ExecSub("reserve", "foo").
+		ExecSubWithOptions("charge", ExecSubOptions{IdempotencyKey: "charge-1"}, "foo").
+		ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	steps := []CompletedStep{{SubTxID: "reserve"}, {SubTxID: "charge", IdempotencyKey: "charge-1"}}
+	if assert.Len(t, infos, 2) {
+		assert.Equal(t, SagaInfo{ID: "info", LogID: s.logID, SubTxID: "charge", Steps: steps}, infos[0])
+		assert.Equal(t, SagaInfo{ID: "info", LogID: s.logID, SubTxID: "reserve", Steps: steps}, infos[1])
+	}
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestActionContext(t *testing.T) {
+	type helperKey struct{}
+	var infos []SagaInfo
+	action := func(ctx context.Context, name string) error {
+		info, ok := ctx.Value(helperKey{}).(SagaInfo)
+		assert.True(t, ok)
+		infos = append(infos, info)
+		return nil
+	}
+	sec := newTestSEC(t, WithActionContext(func(ctx context.Context, info SagaInfo) context.Context {
+		return context.WithValue(ctx, helperKey{}, info)
+	}))
+	compensate := func(ctx context.Context, name string) error {
+		return nil
+	}
+	sec.AddSubTxDef("reserve", action, compensate).
+		AddSubTxDef("charge", action, compensate)
+
+	s := sec.StartSaga(context.Background(), "decorated")
+	s.ExecSub("reserve", "foo").ExecSub("charge", "foo")
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, []SagaInfo{
+		{ID: "decorated", LogID: s.logID, SubTxID: "reserve"},
+		{ID: "decorated", LogID: s.logID, SubTxID: "charge"},
+	}, infos)
+}
+
+func TestSagaFlush(t *testing.T) {
+	sec := newTestSEC(t)
+	s := sec.StartSaga(context.Background(), "flush")
+	assert.NoError(t, s.Flush())
+
+	s.store = failingStore{}
+	err := s.Flush()
+	var storeErr *StoreError
+	assert.True(t, errors.As(err, &storeErr))
+	assert.EqualError(t, err, "Flush: disk full")
+}
+
+type vault struct {
+	tokens   []string
+	restored []string
+}
+
+func (v *vault) login(ctx context.Context, user string, token string) error {
+	return nil
+}
+
+func (v *vault) logout(ctx context.Context, user string, token string) error {
+	v.tokens = append(v.tokens, token)
+	return nil
+}
+
+func (v *vault) restore(ctx context.Context, position int, args []interface{}) (interface{}, error) {
+	v.restored = append(v.restored, args[0].(string))
+	return "restored-" + args[0].(string), nil
+}
+
+func TestSecretArgs(t *testing.T) {
+	v := &vault{}
+	flaky := &flakyCompensate{failures: 10}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("login", v.login, v.logout, SecretArgs(v.restore, 1)).
+		AddSubTxDef("flaky", flaky.action, flaky.compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "secret")
+	s.ExecSub("login", "foo", "s3cr3t").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, []string{"s3cr3t"}, v.tokens)
+	assert.Empty(t, v.restored)
+
+	// redacted in log, so another process has to restore it
+	s = sec.StartSaga(context.Background(), "secret2")
+	s.ExecSub("login", "bar", "s3cr3t").ExecSub("flaky", "bar").ExecSub("fail")
+	logs, err := sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	for _, log := range logs {
+		assert.NotContains(t, log, "s3cr3t")
+	}
+	restarted := NewSEC(sec.store, LogPrefix)
+	restarted.AddSubTxDef("login", v.login, v.logout, SecretArgs(v.restore, 1)).
+		AddSubTxDef("flaky", flaky.action, flaky.compensate)
+	ok, err := restarted.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"bar"}, v.restored)
+	assert.Equal(t, []string{"s3cr3t", "restored-bar"}, v.tokens)
+
+	err = sec.AddSubTxDefE("login2", v.login, v.logout, SecretArgs(nil, 1))
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+	err = sec.AddSubTxDefE("login3", v.login, v.logout, SecretArgs(v.restore, 2))
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+}
+
+func TestEndSagaWithMockStorage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	store := mocks.NewMockStorage(ctrl)
+	sec := NewSEC(store, LogPrefix)
+	sec.AddSubTxDef("deduce", (&account{balance: map[string]int{}}).deduce, func(ctx context.Context, name string, amount int) error { return nil })
+
+	gomock.InOrder(
+		store.EXPECT().AppendLog("sagamock", gomock.Any()).Times(4),
+		store.EXPECT().Cleanup("sagamock"),
+	)
+	assert.NoError(t, sec.StartSaga(context.Background(), "mock").ExecSub("deduce", "foo", 1).EndSaga())
+}
+
+func TestPartialSuccess(t *testing.T) {
+	stock := map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}
+	reserve := func(ctx context.Context, items []string) error {
+		var succeeded []int
+		for i, item := range items {
+			if i%2 == 0 {
+				stock[item]--
+				succeeded = append(succeeded, i)
+			}
+		}
+		return Partial(succeeded, errors.New("out of stock"))
+	}
+	release := func(ctx context.Context, items []string) error {
+		succeeded, ok := SucceededItems(ctx)
+		assert.True(t, ok)
+		for _, i := range succeeded {
+			stock[items[i]]++
+		}
+		return nil
+	}
+	calls := 0
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("reserve", func(ctx context.Context, items []string) error {
+		calls++
+		return reserve(ctx, items)
+	}, release, ActionRetry(RetryPolicy{MaxAttempts: 3}))
+
+	s := sec.StartSaga(context.Background(), "partial")
+	err := s.ExecSub("reserve", []string{"a", "b", "c", "d"}).EndSaga()
+	var partial *PartialError
+	assert.True(t, errors.As(err, &partial))
+	assert.Equal(t, []int{0, 2}, partial.Succeeded)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}, stock)
+}
+
+type flakyCleanupStore struct {
+	storage.Storage
+	failures int32
+}
+
+func (f *flakyCleanupStore) Cleanup(logID string) error {
+	if atomic.AddInt32(&f.failures, -1) >= 0 {
+		return errors.New("connection reset")
+	}
+	return f.Storage.Cleanup(logID)
+}
+
+func TestAsyncCleanup(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	store := &flakyCleanupStore{Storage: mem, failures: 1}
+	sec := NewSEC(store, LogPrefix, WithAsyncCleanup(10))
+	var logIDs []string
+	for i := 0; i < 3; i++ {
+		s := sec.StartSaga(context.Background(), "async-cleanup"+strconv.Itoa(i))
+		assert.NoError(t, s.EndSaga())
+		logIDs = append(logIDs, s.logID)
+	}
+	assert.NoError(t, sec.Shutdown(context.Background()))
+	for _, logID := range logIDs {
+		logs, err := mem.Lookup(logID)
+		assert.NoError(t, err)
+		assert.Empty(t, logs)
+	}
+
+	// clean up synchronously after shutdown
+	s := sec.StartSaga(context.Background(), "after-shutdown")
+	assert.NoError(t, s.EndSaga())
+	logs, err := mem.Lookup(s.logID)
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+}
+
+func TestCorrelationID(t *testing.T) {
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("fail", failAction, failCompensate)
+	ctx := WithCorrelationID(context.Background(), "req-1")
+	s := sec.StartSaga(ctx, "correlated")
+	s.ExecSub("fail")
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	for _, entry := range entries {
+		assert.Equal(t, "req-1", entry.CorrelationID)
+	}
+	status, err := sec.Status(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, "req-1", status.CorrelationID)
+}
+
+func TestExecSubConcurrentCompensatesGroups(t *testing.T) {
+	var mu sync.Mutex
+	var compensated []string
+	record := func(name string) {
+		mu.Lock()
+		compensated = append(compensated, name)
+		mu.Unlock()
+	}
+	// members of first group must be compensated concurrently to pass the barrier
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	groupCompensate := func(ctx context.Context, name string) error {
+		barrier.Done()
+		done := make(chan struct{})
+		go func() {
+			barrier.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			return ErrPermanent
+		}
+		record(name)
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("first", func(ctx context.Context, name string) error {
+		return nil
+	}, groupCompensate).
+		AddSubTxDef("second", func(ctx context.Context, name string) error {
+			return nil
+		}, func(ctx context.Context, name string) error {
+			record(name)
+			return nil
+		}).
+		AddSubTxDef("slowFail", func(ctx context.Context, name string) error {
+			time.Sleep(50 * time.Millisecond)
+			return errors.New("slow failure")
+		}, func(ctx context.Context, name string) error {
+			record(name)
+			return nil
+		})
+
+	s := sec.StartSaga(context.Background(), "groups")
+	s.ExecSubConcurrent(
+		[]ExecSubParams{{SubTxID: "first", Args: []interface{}{"a"}}},
+		[]ExecSubParams{{SubTxID: "first", Args: []interface{}{"b"}}},
+	).ExecSubConcurrent(
+		[]ExecSubParams{{SubTxID: "second", Args: []interface{}{"c"}}},
+		[]ExecSubParams{{SubTxID: "slowFail", Args: []interface{}{"d"}}, {SubTxID: "second", Args: []interface{}{"e"}}},
+	)
+	err := s.EndSaga()
+	assert.EqualError(t, err, "slow failure")
+	if assert.Len(t, compensated, 3) {
+		// the member finished before the group failed is compensated first, then the previous group
+		assert.Equal(t, "c", compensated[0])
+		assert.ElementsMatch(t, []string{"a", "b"}, compensated[1:])
+	}
+}
+
+type hiccupStore struct {
+	storage.Storage
+	failures int32
+}
+
+func (h *hiccupStore) AppendLog(logID string, data string) error {
+	if atomic.AddInt32(&h.failures, -1) >= 0 {
+		return storage.Temporary(errors.New("connection pool exhausted"))
+	}
+	return h.Storage.AppendLog(logID, data)
+}
+
+func TestStoreRetry(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+
+	sec := NewSEC(&hiccupStore{Storage: mem, failures: 1}, LogPrefix)
+	_, err = sec.StartSagaE(context.Background(), "1")
+	var storeErr *StoreError
+	if assert.True(t, errors.As(err, &storeErr)) {
+		assert.True(t, storeErr.Temporary())
+	}
+
+	sec = NewSEC(&hiccupStore{Storage: mem, failures: 2}, LogPrefix, WithStoreRetry(RetryPolicy{MaxAttempts: 3}))
+	s, err := sec.StartSagaE(context.Background(), "2")
+	assert.NoError(t, err)
+	assert.NoError(t, s.EndSaga())
+
+	sec = NewSEC(failingStore{}, LogPrefix, WithStoreRetry(RetryPolicy{MaxAttempts: 3}))
+	_, err = sec.StartSagaE(context.Background(), "3")
+	assert.True(t, errors.As(err, &storeErr))
+	assert.False(t, storeErr.Temporary())
+}
+
+// actionEndFailStore fails appending the n-th ActionEnd log if fail(n) is true.
+type actionEndFailStore struct {
+	storage.Storage
+	ends int
+	fail func(n int) bool
+}
+
+func (f *actionEndFailStore) AppendLog(logID string, data string) error {
+	if strings.HasPrefix(data, `{"type":"ActionEnd"`) {
+		f.ends++
+		if f.fail(f.ends) {
+			return errors.New("connection reset")
+		}
+	}
+	return f.Storage.AppendLog(logID, data)
+}
+
+func TestActionEndNotLogged(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100, "bar": 100}}
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	store := &actionEndFailStore{Storage: mem}
+	sec := NewSEC(store, LogPrefix)
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate, OnDangling(DanglingCompensate))
+
+	// the store recovers by Abort, which logs the end of the action ran and compensates it
+	store.fail = func(n int) bool { return n == 2 }
+	s := sec.StartSaga(context.Background(), "unlogged")
+	s.ExecSub("deduce", "foo", 10).ExecSub("deduce", "bar", 10)
+	err = s.EndSaga()
+	var storeErr *StoreError
+	assert.True(t, errors.As(err, &storeErr), "%v", err)
+	assert.Equal(t, map[string]int{"foo": 100, "bar": 100}, acc.balance)
+
+	// the store is still down in Abort, the action is left dangling
+	store.ends = 0
+	store.fail = func(n int) bool { return n >= 2 }
+	s = sec.StartSaga(context.Background(), "dangling")
+	s.ExecSub("deduce", "foo", 10)
+	assert.Panics(t, func() { s.ExecSub("deduce", "bar", 10) })
+	assert.Equal(t, map[string]int{"foo": 90, "bar": 90}, acc.balance)
+	// the process crashed by the panic
+	sec.admission.release(s)
+	store.fail = func(n int) bool { return false }
+	n, err := sec.RepairDangling(context.Background(), s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, map[string]int{"foo": 100, "bar": 100}, acc.balance)
+}
+
+func TestResultInterpreter(t *testing.T) {
+	// actions return (status, error), status false means failure without error
+	lastError := func(result []reflect.Value) (bool, error) {
+		if err, _ := result[len(result)-1].Interface().(error); err != nil {
+			return true, err
+		}
+		return !result[0].Bool(), nil
+	}
+	compensated := 0
+	sec := newTestSEC(t, WithResultInterpreter(lastError))
+	sec.AddSubTxDef("reserve", func(ctx context.Context, name string) (bool, error) {
+		return true, nil
+	}, func(ctx context.Context, name string) (bool, error) {
+		compensated++
+		return true, nil
+	}).AddSubTxDef("rejected", func(ctx context.Context, name string) (bool, error) {
+		return false, nil
+	}, func(ctx context.Context, name string) (bool, error) {
+		return true, nil
+	})
+
+	err := sec.StartSaga(context.Background(), "status").
+		ExecSub("reserve", "foo").
+		ExecSub("rejected", "foo").
+		EndSaga()
+	assert.EqualError(t, err, "sub-transaction rejected failed")
+	assert.Equal(t, 1, compensated)
+}
+
+func TestOutcomeStore(t *testing.T) {
+	outcomes, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t, WithOutcomeStore(outcomes))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+
+	assert.NoError(t, sec.StartSaga(context.Background(), "done").ExecSub("deduce", "foo", 10).EndSaga())
+	assert.Error(t, sec.StartSaga(context.Background(), "aborted").
+		ExecSub("deduce", "foo", 10).ExecSub("deposit", "foo", 10).EndSaga())
+
+	completed, err := sec.IsCompleted("done")
+	assert.NoError(t, err)
+	assert.True(t, completed)
+	completed, err = sec.IsCompleted("aborted")
+	assert.NoError(t, err)
+	assert.False(t, completed)
+	outcome, err := sec.Outcome("aborted")
+	assert.NoError(t, err)
+	if assert.NotNil(t, outcome) {
+		assert.Equal(t, OutcomeCompensated, outcome.Outcome)
+		assert.Equal(t, LogPrefix+"aborted", outcome.LogID)
+	}
+	completed, err = sec.IsCompleted("unknown")
+	assert.NoError(t, err)
+	assert.False(t, completed)
+
+	_, err = newTestSEC(t).IsCompleted("done")
+	assert.True(t, errors.Is(err, ErrNoOutcomeStore))
+}
+
+func TestPartialCompensate(t *testing.T) {
+	var undone []string
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("upload", func(ctx context.Context, name string) error {
+		if name == "broken" {
+			return errors.New("upload interrupted")
+		}
+		return nil
+	}, func(ctx context.Context, name string) error {
+		undone = append(undone, "delete "+name)
+		return nil
+	}, PartialCompensate(func(ctx context.Context, name string) error {
+		undone = append(undone, "clean chunks of "+name)
+		return nil
+	}))
+
+	err := sec.StartSaga(context.Background(), "upload").
+		ExecSub("upload", "ok").
+		ExecSub("upload", "broken").
+		EndSaga()
+	assert.EqualError(t, err, "upload interrupted")
+	assert.Equal(t, []string{"clean chunks of broken", "delete ok"}, undone)
+
+	err = newTestSEC(t).AddSubTxDefE("bad", func(ctx context.Context, name string) error {
+		return nil
+	}, func(ctx context.Context, name string) error {
+		return nil
+	}, PartialCompensate(func(ctx context.Context, n int) error {
+		return nil
+	}))
+	assert.True(t, errors.Is(err, ErrInvalidSubTx))
+}
+
+func TestPauseResume(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t, WithPausePolling(5*time.Millisecond))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+
+	s := sec.StartSaga(context.Background(), "pause")
+	s.ExecSub("deduce", "foo", 10)
+	assert.NoError(t, sec.Pause(s.logID))
+	status, err := sec.Status(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, status.Paused)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ExecSub("deduce", "foo", 10)
+	}()
+	select {
+	case <-done:
+		t.Fatal("ExecSub should block while paused")
+	case <-time.After(30 * time.Millisecond):
+	}
+	assert.NoError(t, sec.Resume(s.logID))
+	<-done
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, 80, acc.balance["foo"])
+	assert.True(t, errors.Is(sec.Resume(s.logID), ErrNotPaused))
+
+	// paused saga aborts when its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	s = sec.StartSaga(ctx, "expire")
+	s.ExecSub("deduce", "foo", 10)
+	assert.NoError(t, sec.Pause(s.logID))
+	err = s.ExecSub("deduce", "foo", 10).EndSaga()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 80, acc.balance["foo"])
+	paused, err := sec.isPaused(s.logID)
+	assert.NoError(t, err)
+	assert.False(t, paused)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	var running, peak int32
+	sec := newTestSEC(t, WithMaxConcurrency(4))
+	sec.AddSubTxDef("work", func(ctx context.Context, n int) error {
+		cur := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if cur <= old || atomic.CompareAndSwapInt32(&peak, old, cur) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}, func(ctx context.Context, n int) error {
+		return nil
+	})
+	lists := make([][]ExecSubParams, 5)
+	for i := range lists {
+		lists[i] = []ExecSubParams{{SubTxID: "work", Args: []interface{}{i}}, {SubTxID: "work", Args: []interface{}{i}}}
+	}
+
+	s := sec.StartSaga(WithConcurrency(context.Background(), 2), "limited")
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.ExecSubConcurrent(lists...)
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+
+	atomic.StoreInt32(&peak, 0)
+	s = sec.StartSaga(context.Background(), "default")
+	assert.NoError(t, s.ExecSubConcurrent(lists...).EndSaga())
+	assert.Equal(t, int32(4), atomic.LoadInt32(&peak))
+}
+
+func TestCleanupPolicy(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	archive, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := NewSEC(mem, LogPrefix, WithCleanupPolicy(func(outcome SagaOutcome) CleanupAction {
+		switch {
+		case outcome.Outcome == OutcomeCompensated:
+			return CleanupRetain
+		case outcome.ID == "vip":
+			return CleanupArchive
+		}
+		return CleanupDelete
+	}, archive))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+
+	assert.NoError(t, sec.StartSaga(context.Background(), "routine").ExecSub("deduce", "foo", 1).EndSaga())
+	assert.NoError(t, sec.StartSaga(context.Background(), "vip").ExecSub("deduce", "foo", 1).EndSaga())
+	assert.Error(t, sec.StartSaga(context.Background(), "aborted").
+		ExecSub("deduce", "foo", 1).ExecSub("deposit", "foo", 1).EndSaga())
+
+	logIDs, err := mem.LogIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{LogPrefix + "aborted"}, logIDs)
+	archived, err := archive.Lookup(LogPrefix + "vip")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, archived)
+	archivedIDs, err := archive.LogIDs()
+	assert.NoError(t, err)
+	assert.Len(t, archivedIDs, 1)
+}
+
+func TestConcurrentFailFast(t *testing.T) {
+	var canceled, ran int32
+	sec := newTestSEC(t, WithConcurrentFailFast())
+	sec.AddSubTxDef("slow", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			atomic.AddInt32(&canceled, 1)
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}, func(ctx context.Context) error {
+		return nil
+	}).AddSubTxDef("next", func(ctx context.Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}, func(ctx context.Context) error {
+		return nil
+	}).AddSubTxDef("fail", func(ctx context.Context) error {
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("fail fast")
+	}, func(ctx context.Context) error {
+		return nil
+	})
+
+	start := time.Now()
+	err := sec.StartSaga(context.Background(), "failfast").ExecSubConcurrent(
+		[]ExecSubParams{{SubTxID: "slow"}, {SubTxID: "next"}},
+		[]ExecSubParams{{SubTxID: "fail"}},
+	).EndSaga()
+	assert.EqualError(t, err, "fail fast")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&canceled))
+	// next is skipped after the failure
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ran))
+}
+
+func TestTransformArgs(t *testing.T) {
+	var acted, compensated []string
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("charge", func(ctx context.Context, card string, amount int) error {
+		acted = append(acted, card)
+		return nil
+	}, func(ctx context.Context, card string, amount int) error {
+		compensated = append(compensated, card)
+		return nil
+	}, TransformArgs(func(args []interface{}) ([]interface{}, error) {
+		if args[1].(int) <= 0 {
+			return nil, errors.New("amount must be positive")
+		}
+		card := args[0].(string)
+		return []interface{}{"****" + card[len(card)-4:], args[1]}, nil
+	})).AddSubTxDef("deposit", (&account{}).failDeposit, (&account{}).depositCompensate)
+
+	err := sec.StartSaga(context.Background(), "masked").
+		ExecSub("charge", "4111111111111111", 10).
+		ExecSub("deposit", "foo", 10).
+		EndSaga()
+	assert.EqualError(t, err, "deposit failure")
+	assert.Equal(t, []string{"4111111111111111"}, acted)
+	assert.Equal(t, []string{"****1111"}, compensated)
+
+	err = sec.StartSaga(context.Background(), "invalid").ExecSub("charge", "4111111111111111", 0).EndSaga()
+	assert.EqualError(t, err, "transform args of charge: amount must be positive")
+	assert.Len(t, acted, 1)
+}
+
+func TestExecSubStoreRetry(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	store := &hiccupStore{Storage: mem}
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := NewSEC(store, LogPrefix, WithStoreRetry(RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Base: time.Millisecond}}))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate)
+
+	s := sec.StartSaga(context.Background(), "failover")
+	atomic.StoreInt32(&store.failures, 2)
+	s.ExecSub("deduce", "foo", 10)
+	assert.Equal(t, 90, acc.balance["foo"])
+
+	// ActionStart append gives up, the saga aborts without running the action
+	atomic.StoreInt32(&store.failures, 5)
+	err = s.ExecSub("deduce", "foo", 10).EndSaga()
+	var storeErr *StoreError
+	if assert.True(t, errors.As(err, &storeErr)) {
+		assert.True(t, storeErr.Temporary())
+	}
+	assert.Equal(t, 100, acc.balance["foo"])
+}
+
+func TestDetachedAction(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100}}
+	release := make(chan struct{})
+	var notified, canceled int32
+	notify := func(ctx context.Context, name string) error {
+		select {
+		case <-release:
+			atomic.AddInt32(&notified, 1)
+			return nil
+		case <-ctx.Done():
+			atomic.AddInt32(&canceled, 1)
+			return ctx.Err()
+		}
+	}
+	var compensated int32
+	unnotify := func(ctx context.Context, name string) error {
+		atomic.AddInt32(&compensated, 1)
+		return nil
+	}
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("notify", notify, unnotify, DetachedAction()).
+		AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "detached")
+	s.ExecSub("notify", "foo").ExecSub("deduce", "foo", 10)
+	assert.Equal(t, 90, acc.balance["foo"])
+	assert.Equal(t, int32(0), atomic.LoadInt32(&notified))
+	close(release)
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notified))
+
+	// the detached action in progress is canceled by abort and not compensated
+	release = make(chan struct{})
+	s = sec.StartSaga(context.Background(), "detachedAbort")
+	s.ExecSub("notify", "foo").ExecSub("deduce", "foo", 10).ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&canceled))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&compensated))
+	assert.Equal(t, 90, acc.balance["foo"])
+}
+
+type resourceID string
+
+func TestCompensateWithPayload(t *testing.T) {
+	created := map[resourceID]bool{}
+	create := func(ctx context.Context, name string) error {
+		id := resourceID("res-" + name)
+		created[id] = true
+		SetCompensationPayload(ctx, id)
+		return nil
+	}
+	remove := func(ctx context.Context, id resourceID) error {
+		delete(created, id)
+		return nil
+	}
+	sec := newTestSEC(t)
+	assert.True(t, errors.Is(sec.AddSubTxDefE("bad", create, func(ctx context.Context, id resourceID, name string) error {
+		return nil
+	}, CompensateWithPayload()), ErrInvalidSubTx))
+	sec.AddSubTxDef("create", create, remove, CompensateWithPayload()).
+		AddSubTxDef("noop", func(ctx context.Context) error { return nil }, remove, CompensateWithPayload()).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(context.Background(), "payload")
+	s.ExecSub("create", "foo").ExecSub("noop")
+	assert.True(t, created["res-foo"])
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, "saga.resourceID", entries[2].Payload.ParamType)
+	assert.Nil(t, entries[len(entries)-1].Payload)
+
+	s.ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Empty(t, created)
+}
+
+func TestMarshalFailurePolicy(t *testing.T) {
+	for _, policy := range []MarshalFailurePolicy{MarshalFailCompensate, MarshalFailNoCompensate} {
+		acc := &account{balance: map[string]int{"foo": 100}}
+		ran := false
+		sec := newTestSEC(t, WithMarshalFailurePolicy(policy))
+		sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+			AddSubTxDef("notify", func(ctx context.Context, event map[string]interface{}) error {
+				ran = true
+				return nil
+			}, func(ctx context.Context, event map[string]interface{}) error {
+				return nil
+			})
+
+		s := sec.StartSaga(context.Background(), "unserializable"+strconv.Itoa(int(policy)))
+		s.ExecSub("deduce", "foo", 10).ExecSub("notify", map[string]interface{}{"reply": make(chan int)})
+		entries, err := sec.Replay(s.logID)
+		assert.NoError(t, err)
+		var types []LogType
+		for _, entry := range entries {
+			types = append(types, entry.Type)
+		}
+		err = s.EndSaga()
+		var marshalErr *MarshalError
+		assert.True(t, errors.As(err, &marshalErr), "%v", err)
+		assert.Equal(t, "notify", marshalErr.SubTxID)
+		assert.Equal(t, 0, marshalErr.Index)
+		assert.Equal(t, "map[string]interface {}", marshalErr.Type)
+		assert.False(t, ran)
+		if policy == MarshalFailCompensate {
+			assert.Equal(t, 100, acc.balance["foo"])
+			assert.Contains(t, types, CompensateEnd)
+		} else {
+			assert.Equal(t, 90, acc.balance["foo"])
+			assert.Contains(t, types, CompensationSkipped)
+		}
+
+		// the payload is serialized after its action ran
+		acc.balance["foo"] = 100
+		ran = false
+		sec.AddSubTxDef("subscribe", func(ctx context.Context) error {
+			ran = true
+			SetCompensationPayload(ctx, map[string]interface{}{"reply": make(chan int)})
+			return nil
+		}, func(ctx context.Context, subscription map[string]interface{}) error {
+			return nil
+		}, CompensateWithPayload())
+		s = sec.StartSaga(context.Background(), "payload"+strconv.Itoa(int(policy)))
+		s.ExecSub("deduce", "foo", 10).ExecSub("subscribe")
+		err = s.EndSaga()
+		assert.True(t, errors.As(err, &marshalErr), "%v", err)
+		assert.True(t, ran)
+		failures, err := sec.ListCompensateFailures()
+		assert.NoError(t, err)
+		if policy == MarshalFailCompensate {
+			// the step ran can't be compensated without its payload, the log is kept for manual repair
+			assert.Equal(t, []string{s.logID}, failures)
+			entries, err = sec.Replay(s.logID)
+			assert.NoError(t, err)
+			steps := StepsOf(entries)
+			if assert.Len(t, steps, 2) {
+				assert.Equal(t, "subscribe", steps[1].SubTxID)
+			}
+			var lost []bool
+			for _, entry := range entries {
+				if entry.Type == ActionEnd {
+					lost = append(lost, entry.PayloadLost)
+				}
+			}
+			assert.Equal(t, []bool{false, true}, lost)
+		} else {
+			assert.Empty(t, failures)
+		}
+		assert.Equal(t, 90, acc.balance["foo"])
+	}
+}
+
+func TestArgsOnActionStart(t *testing.T) {
+	acc := &account{balance: map[string]int{"foo": 100, "bar": 100}}
+	sec := newTestSEC(t, WithArgsOnActionStart())
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("deposit", acc.failDeposit, acc.depositCompensate)
+
+	s := sec.StartSaga(context.Background(), "crash")
+	s.ExecSub("deduce", "foo", 10).ExecSub("deduce", "bar", 20)
+	logs, err := sec.store.Lookup(s.logID)
+	assert.NoError(t, err)
+	for _, log := range unmarshalLogs(logs) {
+		if log.Type == ActionEnd {
+			assert.Empty(t, log.Params)
+			assert.NotZero(t, log.Started)
+		}
+	}
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Type: ActionEnd, SubTxID: "deduce", Args: []interface{}{"foo", 10}},
+		{Type: ActionEnd, SubTxID: "deduce", Args: []interface{}{"bar", 20}},
+	}, StepsOf(entries))
+
+	// args are resolved from ActionStart by recovery
+	ok, err := sec.resumeCompensation(s.logID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 100, acc.balance["foo"])
+	assert.Equal(t, 100, acc.balance["bar"])
+
+	s = sec.StartSaga(context.Background(), "abort")
+	s.ExecSub("deduce", "foo", 10).ExecSub("deposit", "bar", 10)
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, 100, acc.balance["foo"])
+}
+
+func TestExecSubParallel(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+	var compensated []string
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("item", func(ctx context.Context, name string) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if name == "fail" {
+			return errors.New("item failure")
+		}
+		return nil
+	}, func(ctx context.Context, name string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		compensated = append(compensated, name)
+		return nil
+	})
+	item := func(name string) ExecSubParams {
+		return ExecSubParams{SubTxID: "item", Args: []interface{}{name}}
+	}
+
+	s := sec.StartSaga(context.Background(), "parallel")
+	s.ExecSubParallel(2,
+		[]ExecSubParams{item("a"), item("b"), item("c")},
+		[]ExecSubParams{item("d")},
+	)
+	assert.NoError(t, s.EndSaga())
+	assert.Equal(t, 2, peak)
+
+	s = sec.StartSaga(context.Background(), "fail")
+	s.ExecSubParallel(0, []ExecSubParams{item("a"), item("fail")}, []ExecSubParams{item("b")})
+	assert.EqualError(t, s.EndSaga(), "item failure")
+	assert.Equal(t, 3, peak)
+	assert.ElementsMatch(t, []string{"a", "b"}, compensated)
+}
@@ -0,0 +1,71 @@
+// Package sagatest provides assertions over persisted saga log for tests of saga users,
+// so saga behavior is verified without decoding log entries by hand.
+package sagatest
+
+import (
+	"encoding/json"
+	"testing"
+
+	saga "github.com/kzh125/go-saga"
+	"github.com/kzh125/go-saga/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// AssertStepOrder asserts the saga of logID completed actions of subTxIDs in the given order.
+// store is usually a storage.Recorder, whose log is kept after the saga is cleaned up.
+func AssertStepOrder(t testing.TB, store storage.Storage, logID string, subTxIDs ...string) bool {
+	t.Helper()
+	return assertSteps(t, store, logID, saga.ActionEnd, subTxIDs)
+}
+
+// AssertCompensated asserts compensates of subTxIDs completed for the saga of logID in the given order,
+// sub-transactions are compensated in reverse order of their actions.
+func AssertCompensated(t testing.TB, store storage.Storage, logID string, subTxIDs ...string) bool {
+	t.Helper()
+	return assertSteps(t, store, logID, saga.CompensateEnd, subTxIDs)
+}
+
+func assertSteps(t testing.TB, store storage.Storage, logID string, typ saga.LogType, subTxIDs []string) bool {
+	t.Helper()
+	entries, ok := replay(t, store, logID)
+	if !ok {
+		return false
+	}
+	actual := []string{}
+	for _, step := range saga.StepsOf(entries) {
+		if step.Type == typ {
+			actual = append(actual, step.SubTxID)
+		}
+	}
+	if subTxIDs == nil {
+		subTxIDs = []string{}
+	}
+	return assert.Equal(t, subTxIDs, actual, "%s steps of %s", typ, logID)
+}
+
+// replay decodes log of logID into entries without args, which need the coordinator to decode.
+func replay(t testing.TB, store storage.Storage, logID string) ([]saga.ReplayEntry, bool) {
+	t.Helper()
+	var logs []string
+	if recorder, ok := store.(*storage.Recorder); ok {
+		logs = recorder.Recorded(logID)
+	} else {
+		var err error
+		if logs, err = store.Lookup(logID); !assert.NoError(t, err, "Lookup %s", logID) {
+			return nil, false
+		}
+	}
+	if len(logs) == 0 {
+		t.Errorf("no log of %s, it may be cleaned up, record it by storage.Recorder", logID)
+		return nil, false
+	}
+	entries := make([]saga.ReplayEntry, 0, len(logs))
+	for _, data := range logs {
+		var log saga.Log
+		if err := json.Unmarshal([]byte(data), &log); !assert.NoError(t, err, "Unmarshal log of %s", logID) {
+			return nil, false
+		}
+		entries = append(entries, saga.ReplayEntry{Log: log})
+	}
+	return entries, true
+}
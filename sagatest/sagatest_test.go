@@ -0,0 +1,38 @@
+package sagatest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	saga "github.com/kzh125/go-saga"
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssertSteps(t *testing.T) {
+	mem, err := memory.NewMemStorage()
+	assert.NoError(t, err)
+	recorder := storage.NewRecorder(mem)
+	step := func(ctx context.Context, name string) error {
+		return nil
+	}
+	sec := saga.NewSEC(recorder, saga.LogPrefix)
+	sec.AddSubTxDef("reserve", step, step).
+		AddSubTxDef("charge", step, step).
+		AddSubTxDef("ship", func(ctx context.Context) error { return errors.New("out of stock") }, func(ctx context.Context) error { return nil })
+
+	s := sec.StartSaga(context.Background(), "order")
+	s.ExecSub("reserve", "foo").ExecSub("charge", "foo").ExecSub("ship")
+	assert.Error(t, s.EndSaga())
+
+	AssertStepOrder(t, recorder, s.LogID(), "reserve", "charge")
+	AssertCompensated(t, recorder, s.LogID(), "charge", "reserve")
+
+	mock := &testing.T{}
+	assert.False(t, AssertStepOrder(mock, recorder, s.LogID(), "charge", "reserve"))
+	assert.False(t, AssertCompensated(mock, recorder, s.LogID(), "reserve"))
+	// cleaned up from storage
+	assert.False(t, AssertStepOrder(mock, mem, s.LogID(), "reserve", "charge"))
+}
@@ -0,0 +1,103 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+)
+
+// redacted is the placeholder persisted instead of secret argument.
+const redacted = `"[REDACTED]"`
+
+// RestoreSecret reconstructs the secret argument at position(after context) of a sub-transaction,
+// given other arguments restored from saga log, e.g. fetch the token from a vault by account name.
+type RestoreSecret func(ctx context.Context, position int, args []interface{}) (interface{}, error)
+
+// SecretArgs marks arguments at positions(after context, starting at 0) sensitive, e.g. passwords or tokens.
+// They're persisted as a redacted placeholder, while the real value is kept in memory to compensate
+// within the same process. A redacted argument can't be reconstructed from saga log after a crash or
+// by another process, so restore is required and called to reconstruct it in that case.
+func SecretArgs(restore RestoreSecret, positions ...int) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.restoreSecret = restore
+		def.secretArgs = make(map[int]bool, len(positions))
+		for _, position := range positions {
+			def.secretArgs[position] = true
+		}
+	}
+}
+
+// validateSecretArgs checks secret positions exist and restore is given.
+func validateSecretArgs(def subTxDefinition) error {
+	if def.secretArgs == nil {
+		return nil
+	}
+	if def.restoreSecret == nil {
+		return fmt.Errorf("subTxID %s: %w: SecretArgs requires restore", def.subTxID, ErrInvalidSubTx)
+	}
+	for position := range def.secretArgs {
+		if position < 0 || position >= def.action.Type().NumIn()-1 {
+			return fmt.Errorf("subTxID %s: %w: secret arg position %d out of range", def.subTxID, ErrInvalidSubTx, position)
+		}
+	}
+	return nil
+}
+
+// redactParams replaces secret args in params by placeholder referring to the value kept in saga.
+func (s *Saga) redactParams(def subTxDefinition, args []interface{}, params []ParamData) []ParamData {
+	if len(def.secretArgs) == 0 {
+		return params
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets == nil {
+		s.secrets = make(map[string]interface{})
+	}
+	for position := range def.secretArgs {
+		ref := strconv.FormatInt(atomic.AddInt64(&secretSeq, 1), 10)
+		s.secrets[ref] = args[position]
+		params[position].Data = redacted
+		params[position].Secret = ref
+	}
+	return params
+}
+
+var secretSeq int64
+
+// revealArgs replaces secret args decoded as zero value by the value kept in saga,
+// or reconstructs them by restore if the saga isn't started by this process.
+func (s *Saga) revealArgs(ctx context.Context, def subTxDefinition, params []ParamData, args []reflect.Value) error {
+	var missing []int
+	s.mu.Lock()
+	for i, param := range params {
+		if param.Secret == "" {
+			continue
+		}
+		if value, ok := s.secrets[param.Secret]; ok {
+			args[i] = reflect.ValueOf(value)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	s.mu.Unlock()
+	if len(missing) == 0 {
+		return nil
+	}
+	if def.restoreSecret == nil {
+		return fmt.Errorf("restore secret args of %s: %w", def.subTxID, ErrInvalidSubTx)
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Interface()
+	}
+	for _, i := range missing {
+		value, err := def.restoreSecret(ctx, i, values)
+		if err != nil {
+			return fmt.Errorf("restore secret arg %d of %s: %v", i, def.subTxID, err)
+		}
+		args[i] = reflect.ValueOf(value)
+	}
+	return nil
+}
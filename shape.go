@@ -0,0 +1,85 @@
+package saga
+
+import (
+	"reflect"
+)
+
+// maxPlanArgs is the most args of ExecSub whose shape is cached, calls with more args are resolved every time.
+const maxPlanArgs = 8
+
+// planKey identifies shape of an ExecSub call, its subTxID and dynamic types of its args.
+type planKey struct {
+	subTxID string
+	n       int
+	types   [maxPlanArgs]reflect.Type
+}
+
+// stepPlan is resolved metadata of ExecSub for one shape, sagas running the same steps with the same arg types
+// find it by a single lookup instead of resolving definition, checking args and param type names again.
+type stepPlan struct {
+	def subTxDefinition
+	// typeNames are registered names of arg types, nil if args are injected, transformed or invalid,
+	// since their types aren't known by the shape, ExecSub resolves them per call then.
+	typeNames []string
+}
+
+func planKeyOf(subTxID string, args []interface{}) (planKey, bool) {
+	key := planKey{subTxID: subTxID, n: len(args)}
+	if len(args) > maxPlanArgs {
+		return key, false
+	}
+	for i, arg := range args {
+		key.types[i] = reflect.TypeOf(arg)
+	}
+	return key, true
+}
+
+// mustFindStepPlan returns plan of ExecSub subTxID with args, the plan is cached until definitions
+// or arg providers change. Panic if not found sub-transaction like MustFindSubTxDef.
+func (e *ExecutionCoordinator) mustFindStepPlan(subTxID string, args []interface{}) *stepPlan {
+	key, ok := planKeyOf(subTxID, args)
+	if !ok {
+		return &stepPlan{def: e.MustFindSubTxDef(subTxID)}
+	}
+	e.mu.RLock()
+	plan, found := e.plans[key]
+	e.mu.RUnlock()
+	if found {
+		return plan
+	}
+	// resolve under write lock, so a plan of a definition replaced meanwhile isn't cached
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	def, found := e.subTxDefinitions.findDefinition(subTxID)
+	if !found {
+		panic("SubTxID: " + subTxID + " not found in context")
+	}
+	plan = &stepPlan{def: def, typeNames: e.resolveTypeNames(def, args)}
+	e.plans[key] = plan
+	return plan
+}
+
+// resolveTypeNames returns registered names of args types of def, or nil if they must be resolved per call.
+// It must be called with e.mu held.
+func (e *ExecutionCoordinator) resolveTypeNames(def subTxDefinition, args []interface{}) []string {
+	injected := def.action.Type().NumIn()-1 > len(args) && len(e.paramTypeRegister.providers) > 0
+	if injected || def.transformArgs != nil || checkArgs(def, args) != nil {
+		return nil
+	}
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		name, ok := e.paramTypeRegister.findTypeName(reflect.TypeOf(arg))
+		if !ok {
+			return nil
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// resetPlans drops cached plans, it must be called with e.mu held whenever definitions or arg providers change.
+func (e *ExecutionCoordinator) resetPlans() {
+	for key := range e.plans {
+		delete(e.plans, key)
+	}
+}
@@ -0,0 +1,86 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage/memory"
+)
+
+// SimulateCompensate runs compensate of subTxID as Abort would after its action succeeded with args, so compensate
+// can be unit-tested with the args it really gets rather than the ones given to ExecSub: args go through ExecSub's
+// injection and TransformArgs, are persisted with an ActionEnd log to a memory store, read back and decoded by
+// UnmarshalParam, then compensate is called from a context inherited from ctx like WithCompensateContext does,
+// with the retries and VerifyCompensate of a single compensation step. For CompensateWithPayload args is the payload.
+// Handling of a failed saga, e.g. retry scheduling, dead-lettering and abort hooks, is skipped, and the error of
+// compensate is returned. Stats, tracer and log publisher of the coordinator see the simulated saga like a real one.
+func (e *ExecutionCoordinator) SimulateCompensate(ctx context.Context, subTxID string, args ...interface{}) error {
+	e.mu.RLock()
+	def, ok := e.subTxDefinitions.findDefinition(subTxID)
+	if ok {
+		args = e.paramTypeRegister.injectArgs(ctx, def.action, args)
+	}
+	e.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("SimulateCompensate: subTxID %s not registered", subTxID)
+	}
+	store, err := memory.NewMemStorage()
+	if err != nil {
+		return errors.Annotate(err, "SimulateCompensate NewMemStorage")
+	}
+	logID := e.logPrefix + "simulated_" + subTxID
+	s := &Saga{
+		id:      "simulated_" + subTxID,
+		logID:   logID,
+		context: ctx,
+		sec:     e,
+		store:   store,
+		state:   newState(),
+		span:    nopSpan{},
+		ended:   1,
+	}
+	log := &Log{
+		Type:    ActionEnd,
+		SubTxID: subTxID,
+		Time:    time.Now(),
+		Version: def.version,
+	}
+	if def.compensatePayload {
+		if len(args) != 1 {
+			return fmt.Errorf("SimulateCompensate %s: %w: compensate with payload takes 1 argument, got %d", subTxID, ErrInvalidArgs, len(args))
+		}
+		if log.Payload, err = s.marshalPayload(def, &valueScope{payload: args[0]}); err != nil {
+			return err
+		}
+	} else {
+		persisted := args
+		if def.transformArgs != nil {
+			if persisted, err = def.transformArgs(args); err != nil {
+				return fmt.Errorf("transform args of %s: %w", subTxID, err)
+			}
+			if def.transformActionArgs {
+				args = persisted
+			}
+		}
+		if err := checkArgs(def, args); err != nil {
+			return err
+		}
+		params, err := marshalParams(e, subTxID, persisted)
+		if err != nil {
+			return err
+		}
+		log.Params = s.redactParams(def, persisted, params)
+	}
+	if err := s.appendLog(log); err != nil {
+		return errors.Annotatef(err, "AppendLog %s failure", logID)
+	}
+	data, err := store.Lookup(logID)
+	if err != nil {
+		return errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	actionEnds, _ := pendingCompensations(unmarshalLogs(data))
+	s.compensateCtx = withCompensationDepth(e.inheritContext(ctx), 1)
+	return s.compensate(actionEnds[0])
+}
@@ -0,0 +1,46 @@
+package saga
+
+// WithArgsOnActionStart persists action args only with ActionStart log, which is appended before the action runs,
+// instead of repeating them in ActionEnd log. ActionStart always carries the args so that RepairDangling can
+// compensate or retry an action interrupted by crash, by default ActionEnd repeats them to be self-contained.
+// With this option ActionEnd refers to its ActionStart instead, so large args are persisted once,
+// at the cost of resolving them from ActionStart whenever saga log is read for compensation or replay.
+// Logs written with and without this option can be mixed.
+func WithArgsOnActionStart() Option {
+	return func(o *options) {
+		o.argsOnStart = true
+	}
+}
+
+// actionEndParams returns params of ActionEnd log paired with start, which are nil if they're only persisted
+// with start(see WithArgsOnActionStart), and the reference to start pairing them.
+func (s *Saga) actionEndParams(start *Log) (params []ParamData, started int64) {
+	if s.sec.opts.argsOnStart && len(start.Params) > 0 {
+		return nil, start.Time.UnixNano()
+	}
+	return start.Params, start.Time.UnixNano()
+}
+
+// startKey identifies ActionStart log referred by ActionEnd log.
+type startKey struct {
+	subTxID string
+	time    int64
+}
+
+// startParams collects params of ActionStart logs read in order,
+// to restore params of ActionEnd logs referring to them.
+type startParams map[startKey][]ParamData
+
+// restore records params of ActionStart log, or sets params of ActionEnd log persisted with its ActionStart.
+func (p startParams) restore(log *Log) {
+	switch log.Type {
+	case ActionStart:
+		if len(log.Params) > 0 {
+			p[startKey{log.SubTxID, log.Time.UnixNano()}] = log.Params
+		}
+	case ActionEnd:
+		if log.Started != 0 && log.Params == nil {
+			log.Params = p[startKey{log.SubTxID, log.Started}]
+		}
+	}
+}
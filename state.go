@@ -0,0 +1,113 @@
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// State is a key/value store scoped to a saga, it lets caller keep results of prior steps
+// and decide following ones, e.g. in ExecSubIf predicate.
+type State struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func newState() *State {
+	return &State{values: make(map[string]interface{})}
+}
+
+// Get returns value stored under key.
+func (st *State) Get(key string) (interface{}, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	value, ok := st.values[key]
+	return value, ok
+}
+
+// Set stores value under key.
+func (st *State) Set(key string, value interface{}) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.values[key] = value
+}
+
+type valuesCtxKey struct{}
+
+// valueScope is the saga state seen by an action or compensate through its context,
+// written collects values set by the action to persist them with its ActionEnd log.
+type valueScope struct {
+	state   *State
+	mu      sync.Mutex
+	written map[string]string
+	// payload is set by SetCompensationPayload
+	payload interface{}
+	// bound is set by BindResource
+	bound *boundResource
+}
+
+func withValueScope(ctx context.Context, scope *valueScope) context.Context {
+	return context.WithValue(ctx, valuesCtxKey{}, scope)
+}
+
+// SetValue stores value into saga state from action context, so actions of subsequent steps can read it by GetValue,
+// e.g. step 1 creates an ID used by step 4. value is persisted as JSON with the action's ActionEnd log
+// and restored before compensation resumes from the log. It does nothing if ctx isn't given by a saga.
+func SetValue(ctx context.Context, key string, value interface{}) {
+	scope, ok := ctx.Value(valuesCtxKey{}).(*valueScope)
+	if !ok {
+		return
+	}
+	scope.state.Set(key, value)
+	if scope.written == nil {
+		return
+	}
+	data := mustMarshal(value)
+	scope.mu.Lock()
+	scope.written[key] = data
+	scope.mu.Unlock()
+}
+
+// GetValue decodes value stored by SetValue under key into ptr, it returns false if there is no such value.
+// Values are always decoded from JSON, so they look the same before and after recovery.
+func GetValue(ctx context.Context, key string, ptr interface{}) bool {
+	scope, ok := ctx.Value(valuesCtxKey{}).(*valueScope)
+	if !ok {
+		return false
+	}
+	value, ok := scope.state.Get(key)
+	if !ok {
+		return false
+	}
+	data, ok := value.(json.RawMessage)
+	if !ok {
+		data = json.RawMessage(mustMarshal(value))
+	}
+	mustUnmarshal(data, ptr)
+	return true
+}
+
+// values returns values written so far, nil if none.
+func (scope *valueScope) values() map[string]string {
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	if len(scope.written) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(scope.written))
+	for key, data := range scope.written {
+		values[key] = data
+	}
+	return values
+}
+
+// restore sets values persisted by ActionEnd log into state, they are kept as raw JSON.
+// Values of other entries, e.g. of shared resources enrolled, aren't saga state.
+func (st *State) restore(log Log) {
+	if log.Type != ActionEnd {
+		return
+	}
+	for key, data := range log.Values {
+		st.Set(key, json.RawMessage(data))
+	}
+}
@@ -0,0 +1,130 @@
+package saga
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// SagaStatus summarizes saga log of a saga for operators.
+type SagaStatus struct {
+	LogID         string
+	CorrelationID string
+	Started       bool
+	Ended         bool
+	Aborted       bool
+	// Completed is the number of completed actions, Compensated is the number of them compensated
+	Completed   int
+	Compensated int
+	// Paused is true if forward execution is paused by Pause
+	Paused bool
+	// Dangling is the number of actions left without result by a crash, the saga is ambiguous
+	// until they're resolved by RepairDangling
+	Dangling int
+}
+
+// correlationIDOf returns correlation ID stamped into saga log.
+func correlationIDOf(logs []Log) string {
+	for _, log := range logs {
+		if log.CorrelationID != "" {
+			return log.CorrelationID
+		}
+	}
+	return ""
+}
+
+// Status returns status of saga by its saga log.
+func (e *ExecutionCoordinator) Status(logID string) (SagaStatus, error) {
+	data, err := e.storeOf(logID).Lookup(logID)
+	if err != nil {
+		return SagaStatus{}, errors.Annotatef(err, "Lookup %s failure", logID)
+	}
+	logs := unmarshalLogs(data)
+	status := SagaStatus{
+		LogID:         logID,
+		CorrelationID: correlationIDOf(logs),
+		Dangling:      len(danglingActions(logs)),
+	}
+	for _, log := range logs {
+		switch log.Type {
+		case SagaStart:
+			status.Started = true
+		case SagaEnd:
+			status.Ended = true
+		case SagaAbort:
+			status.Aborted = true
+		case SagaPaused:
+			status.Paused = true
+		case SagaResumed:
+			status.Paused = false
+		case ActionEnd:
+			status.Completed++
+		case CompensateEnd:
+			status.Compensated++
+		}
+	}
+	return status, nil
+}
+
+// ListSagasByTimeRange returns logIDs of sagas started in [from, to) by time of their SagaStart log,
+// e.g. for dashboards and incident investigation windows. It's served by index of storage implementing
+// storage.TimeRangeLister, other storage is scanned by reading the first entry of every saga log.
+func (e *ExecutionCoordinator) ListSagasByTimeRange(from, to time.Time) ([]string, error) {
+	var matched []string
+	for _, store := range e.stores() {
+		logIDs, err := e.sagasByTimeRange(store, from, to)
+		if err != nil {
+			return nil, err
+		}
+		matched = append(matched, logIDs...)
+	}
+	return matched, nil
+}
+
+func (e *ExecutionCoordinator) sagasByTimeRange(store storage.Storage, from, to time.Time) ([]string, error) {
+	if lister, ok := store.(storage.TimeRangeLister); ok {
+		logIDs, err := lister.LogIDsByTimeRange(from, to)
+		if err != nil {
+			return nil, errors.Annotate(err, "LogIDsByTimeRange failure")
+		}
+		return logIDs, nil
+	}
+	logIDs, err := store.LogIDs()
+	if err != nil {
+		return nil, errors.Annotate(err, "LogIDs failure")
+	}
+	var matched []string
+	for _, logID := range logIDs {
+		if e.storeOf(logID) != store {
+			continue
+		}
+		started, ok, err := e.startTime(logID)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !started.Before(from) && started.Before(to) {
+			matched = append(matched, logID)
+		}
+	}
+	return matched, nil
+}
+
+// startTime returns time of SagaStart log of saga, ok is false if saga log doesn't start with SagaStart.
+func (e *ExecutionCoordinator) startTime(logID string) (started time.Time, ok bool, err error) {
+	it, err := e.storeOf(logID).LookupStream(logID)
+	if err != nil {
+		return time.Time{}, false, errors.Annotatef(err, "LookupStream %s failure", logID)
+	}
+	defer it.Close()
+	if !it.Next() {
+		return time.Time{}, false, errors.Annotatef(it.Err(), "LookupStream %s failure", logID)
+	}
+	// lists kept by coordinator, e.g. dead-letter list, share the prefix but don't hold log entries
+	var first Log
+	if err := json.Unmarshal([]byte(it.Value()), &first); err != nil {
+		return time.Time{}, false, nil
+	}
+	return first.Time, first.Type == SagaStart, nil
+}
@@ -0,0 +1,258 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+// streamBatchSize is the number of log entries LookupStream reads per read transaction
+const streamBatchSize = 100
+
+type boltStorage struct {
+	db        *bolt.DB
+	logPrefix string
+}
+
+// NewBoltStorage creates embedded durable log storage base on bbolt file at given path.
+// Each saga log is stored in a bucket named logID with sequential keys,
+// logPrefix is used to filter saga logs from other buckets in LogIDs.
+// Concurrent access is handled by bbolt transactions, but the file can only be opened by one process.
+func NewBoltStorage(path string, logPrefix string) (storage.Storage, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Open bolt db %s failure", path)
+	}
+	return &boltStorage{
+		db:        db,
+		logPrefix: logPrefix,
+	}, nil
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// AppendLog appends log into bucket of given logID.
+func (s *boltStorage) AppendLog(logID string, data string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(logID))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(seqKey(seq), []byte(data))
+	})
+}
+
+// Lookup lookups log in bucket of given logID.
+func (s *boltStorage) Lookup(logID string) ([]string, error) {
+	var data []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data = lookup(tx, logID)
+		return nil
+	})
+	return data, err
+}
+
+func lookup(tx *bolt.Tx, logID string) []string {
+	bucket := tx.Bucket([]byte(logID))
+	if bucket == nil {
+		return nil
+	}
+	data := make([]string, 0, bucket.Stats().KeyN)
+	bucket.ForEach(func(k, v []byte) error {
+		data = append(data, string(v))
+		return nil
+	})
+	return data
+}
+
+// LookupStream iterates log in bucket of given logID, reading streamBatchSize entries per read transaction.
+func (s *boltStorage) LookupStream(logID string) (storage.LogIterator, error) {
+	return &bucketIterator{db: s.db, logID: logID}, nil
+}
+
+// LookupMany lookups log in buckets of given logIDs in one read transaction.
+func (s *boltStorage) LookupMany(logIDs []string) (map[string][]string, error) {
+	logs := make(map[string][]string, len(logIDs))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, logID := range logIDs {
+			logs[logID] = lookup(tx, logID)
+		}
+		return nil
+	})
+	return logs, err
+}
+
+// Close closes bolt db.
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+// LogIDs returns names of buckets with logPrefix.
+func (s *boltStorage) LogIDs() ([]string, error) {
+	var logIDs []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if strings.HasPrefix(string(name), s.logPrefix) {
+				logIDs = append(logIDs, string(name))
+			}
+			return nil
+		})
+	})
+	return logIDs, err
+}
+
+// CountSagas counts buckets with logPrefix and prefix whose first entry is SagaStart.
+func (s *boltStorage) CountSagas(prefix string) (int, error) {
+	prefix, ok := storage.NarrowPrefix(s.logPrefix, prefix)
+	if !ok {
+		return 0, nil
+	}
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for name, _ := c.Seek([]byte(prefix)); name != nil && strings.HasPrefix(string(name), prefix); name, _ = c.Next() {
+			if bucket := tx.Bucket(name); bucket != nil {
+				if _, first := bucket.Cursor().First(); first != nil && storage.IsSagaStart(string(first)) {
+					n++
+				}
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Flush fsyncs database file, commits are already synced unless bolt's NoSync is set.
+func (s *boltStorage) Flush() error {
+	return s.db.Sync()
+}
+
+// Cleanup deletes bucket of given logID.
+func (s *boltStorage) Cleanup(logID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(logID))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// RemoveEntries deletes log equal to one of entries from bucket of given logID in a write transaction,
+// the bucket is deleted once empty.
+func (s *boltStorage) RemoveEntries(logID string, entries ...string) (int, error) {
+	removed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		removed[entry] = true
+	}
+	left := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(logID))
+		if bucket == nil {
+			return nil
+		}
+		var keys [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if removed[string(v)] {
+				keys = append(keys, append([]byte(nil), k...))
+			} else {
+				left++
+			}
+			return nil
+		})
+		// keys can't be deleted while iterating
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		if left == 0 {
+			return tx.DeleteBucket([]byte(logID))
+		}
+		return nil
+	})
+	return left, err
+}
+
+// LastLog fetches last log in bucket of given logID.
+func (s *boltStorage) LastLog(logID string) (string, error) {
+	var last string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(logID))
+		if bucket == nil {
+			return nil
+		}
+		if _, v := bucket.Cursor().Last(); v != nil {
+			last = string(v)
+		}
+		return nil
+	})
+	return last, err
+}
+
+type bucketIterator struct {
+	db    *bolt.DB
+	logID string
+	next  []byte
+	batch []string
+	pos   int
+	done  bool
+	err   error
+}
+
+func (it *bucketIterator) Next() bool {
+	if it.pos+1 < len(it.batch) {
+		it.pos++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+	var batch []string
+	it.err = it.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(it.logID))
+		if bucket == nil {
+			it.done = true
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := c.First()
+		if it.next != nil {
+			k, v = c.Seek(it.next)
+		}
+		for ; k != nil && len(batch) < streamBatchSize; k, v = c.Next() {
+			batch = append(batch, string(v))
+		}
+		if k == nil {
+			it.done = true
+		} else {
+			it.next = append([]byte(nil), k...)
+		}
+		return nil
+	})
+	it.batch, it.pos = batch, 0
+	return it.err == nil && len(batch) > 0
+}
+
+func (it *bucketIterator) Value() string {
+	return it.batch[it.pos]
+}
+
+func (it *bucketIterator) Err() error {
+	return it.err
+}
+
+func (it *bucketIterator) Close() error {
+	return nil
+}
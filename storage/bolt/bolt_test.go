@@ -0,0 +1,109 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saga-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "saga.db")
+
+	s, err := NewBoltStorage(path, "t_")
+	assert.NoError(t, err)
+	assert.NoError(t, s.AppendLog("t_11", "{1}"))
+	assert.NoError(t, s.AppendLog("t_11", "{2}"))
+	assert.NoError(t, s.AppendLog("x_11", "{1}"))
+
+	looked, err := s.Lookup("t_11")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{1}", "{2}"}, looked)
+	lastLog, err := s.LastLog("t_11")
+	assert.NoError(t, err)
+	assert.Equal(t, "{2}", lastLog)
+	logIDs, err := s.LogIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"t_11"}, logIDs)
+
+	// reopen to make sure log is durable
+	assert.NoError(t, s.Close())
+	s, err = NewBoltStorage(path, "t_")
+	assert.NoError(t, err)
+	defer s.Close()
+	logs, err := s.LookupMany([]string{"t_11", "t_12"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{1}", "{2}"}, logs["t_11"])
+	assert.Empty(t, logs["t_12"])
+
+	assert.NoError(t, s.Cleanup("t_11"))
+	assert.NoError(t, s.Cleanup("t_11"))
+	looked, err = s.Lookup("t_11")
+	assert.NoError(t, err)
+	assert.Empty(t, looked)
+	lastLog, err = s.LastLog("t_11")
+	assert.NoError(t, err)
+	assert.Equal(t, "", lastLog)
+}
+
+func TestBoltConcurrentAppendAndStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saga-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := NewBoltStorage(filepath.Join(dir, "saga.db"), "t_")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < streamBatchSize/2; j++ {
+				assert.NoError(t, s.AppendLog("t_"+strconv.Itoa(i), strconv.Itoa(j)))
+				assert.NoError(t, s.AppendLog("t_all", strconv.Itoa(j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	it, err := s.LookupStream("t_all")
+	assert.NoError(t, err)
+	n := 0
+	for it.Next() {
+		n++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, streamBatchSize/2*5, n)
+
+	it, err = s.LookupStream("t_3")
+	assert.NoError(t, err)
+	var looked []string
+	for it.Next() {
+		looked = append(looked, it.Value())
+	}
+	assert.Len(t, looked, streamBatchSize/2)
+	assert.Equal(t, "0", looked[0])
+}
+
+func TestBoltStorageContract(t *testing.T) {
+	storagetest.TestStorageContract(t, func(t *testing.T, logPrefix string) storage.Storage {
+		dir, err := ioutil.TempDir("", "saga-bolt")
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			os.RemoveAll(dir)
+		})
+		s, err := NewBoltStorage(filepath.Join(dir, "saga.db"), logPrefix)
+		assert.NoError(t, err)
+		return s
+	})
+}
@@ -0,0 +1,47 @@
+package storage
+
+import "errors"
+
+// Error classifies a storage failure, Temporary reports whether the operation may succeed when retried,
+// e.g. connection pool exhausted or server busy. Fatal errors, such as rejected commands, should not be retried.
+type Error struct {
+	Err       error
+	temporary bool
+}
+
+// Temporary wraps err as a retriable storage error, it returns nil if err is nil.
+func Temporary(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Err: err, temporary: true}
+}
+
+// Fatal wraps err as a storage error which should not be retried, it returns nil if err is nil.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the failed operation may succeed when retried.
+func (e *Error) Temporary() bool {
+	return e.temporary
+}
+
+// IsTemporary reports whether err is retriable, i.e. any error in its chain implements Temporary() bool
+// and returns true, which covers *Error as well as net.Error.
+func IsTemporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
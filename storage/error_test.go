@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTemporary(t *testing.T) {
+	busy := errors.New("busy")
+	assert.True(t, IsTemporary(Temporary(busy)))
+	assert.True(t, IsTemporary(fmt.Errorf("append: %w", Temporary(busy))))
+	assert.True(t, errors.Is(Temporary(busy), busy))
+	assert.False(t, IsTemporary(Fatal(busy)))
+	assert.False(t, IsTemporary(busy))
+	assert.False(t, IsTemporary(nil))
+	assert.True(t, IsTemporary(context.DeadlineExceeded))
+	assert.Nil(t, Temporary(nil))
+	assert.Nil(t, Fatal(nil))
+}
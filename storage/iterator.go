@@ -0,0 +1,81 @@
+package storage
+
+//go:generate mockgen -source=iterator.go -destination=mocks/iterator.go -package=mocks
+
+// LogIterator iterates over log entries of a logID in the order they were appended.
+//
+//	it, err := store.LookupStream(logID)
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		data := it.Value()
+//	}
+//	err = it.Err()
+type LogIterator interface {
+
+	// Next advances to next log entry, returns false when no more entry or an error occurred
+	Next() bool
+
+	// Value returns current log entry
+	Value() string
+
+	// Err returns the error occurred during iteration
+	Err() error
+
+	// Close releases resources held by iterator
+	Close() error
+}
+
+// LookupAsStream is a default LookupStream adapter for backends that can't stream,
+// it loads all log under given logID by Lookup and iterates them.
+func LookupAsStream(s Storage, logID string) (LogIterator, error) {
+	data, err := s.Lookup(logID)
+	if err != nil {
+		return nil, err
+	}
+	return NewSliceIterator(data), nil
+}
+
+// LookupEach is a default LookupMany adapter for backends that can't batch,
+// it lookups each logID by Lookup.
+func LookupEach(s Storage, logIDs []string) (map[string][]string, error) {
+	logs := make(map[string][]string, len(logIDs))
+	for _, logID := range logIDs {
+		data, err := s.Lookup(logID)
+		if err != nil {
+			return nil, err
+		}
+		logs[logID] = data
+	}
+	return logs, nil
+}
+
+// NewSliceIterator creates LogIterator over given log entries.
+func NewSliceIterator(data []string) LogIterator {
+	return &sliceIterator{data: data, pos: -1}
+}
+
+type sliceIterator struct {
+	data []string
+	pos  int
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos+1 >= len(it.data) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *sliceIterator) Value() string {
+	return it.data[it.pos]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
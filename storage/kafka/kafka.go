@@ -105,6 +105,16 @@ consumer_loop:
 	return data, nil
 }
 
+// LookupStream iterates log under given logID, it consumes whole topic by Lookup.
+func (s *kafkaStorage) LookupStream(logID string) (storage.LogIterator, error) {
+	return storage.LookupAsStream(s, logID)
+}
+
+// LookupMany lookups log under each of given logIDs, one topic after another.
+func (s *kafkaStorage) LookupMany(logIDs []string) (map[string][]string, error) {
+	return storage.LookupEach(s, logIDs)
+}
+
 // Close use to close storage and release resources.
 func (s *kafkaStorage) Close() error {
 	if err1 := s.producer.Close(); err1 != nil {
@@ -131,6 +141,56 @@ func (s *kafkaStorage) LogIDs() ([]string, error) {
 	return sagaTopics, nil
 }
 
+// CountSagas counts saga topics start with prefix, whose first message is SagaStart,
+// it consumes first message of each of these topics.
+func (s *kafkaStorage) CountSagas(prefix string) (int, error) {
+	topics, err := s.kz.Topics()
+	if err != nil {
+		return 0, errors.Annotate(err, "Get topic info failure")
+	}
+	n := 0
+	for _, topic := range topics {
+		if !strings.HasPrefix(topic.Name, saga.LogPrefix) || !strings.HasPrefix(topic.Name, prefix) {
+			continue
+		}
+		first, err := s.firstLog(topic.Name)
+		if err != nil {
+			return 0, err
+		}
+		if storage.IsSagaStart(first) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// firstLog consumes first message of topic logID, it returns empty string if none arrives in consumeReturnDuration.
+func (s *kafkaStorage) firstLog(logID string) (string, error) {
+	partitionConsumer, err := s.consumer.ConsumePartition(logID, 0, sarama.OffsetOldest)
+	if err != nil {
+		return "", errors.Annotatef(err, "Consume topic %s failured", logID)
+	}
+	defer func() {
+		if err := partitionConsumer.Close(); err != nil {
+			s.logger.Printf("[WARNING]Close consumer failure %v", err)
+		}
+	}()
+
+	timer := time.NewTimer(s.consumeReturnDuration)
+	defer timer.Stop()
+	select {
+	case msg := <-partitionConsumer.Messages():
+		return string(msg.Value), nil
+	case <-timer.C:
+		return "", nil
+	}
+}
+
+// Flush is a no-op since messages are sent by sync producer.
+func (s *kafkaStorage) Flush() error {
+	return nil
+}
+
 // Cleanup cleans log data for given logID
 func (s *kafkaStorage) Cleanup(logID string) error {
 	err := s.kz.DeleteTopic(logID)
@@ -1,25 +1,45 @@
 package memory
 
 import (
-	"github.com/juju/errors"
+	"strings"
+	"sync"
+
 	"github.com/kzh125/go-saga/storage"
 )
 
 type memStorage struct {
-	data map[string][]string
+	mu        sync.RWMutex
+	data      map[string][]string
+	logPrefix string
+}
+
+// Option configures memory storage created by NewMemStorage.
+type Option func(*memStorage)
+
+// WithLogPrefix makes LogIDs only return logIDs start with logPrefix, default returns all.
+func WithLogPrefix(logPrefix string) Option {
+	return func(s *memStorage) {
+		s.logPrefix = logPrefix
+	}
 }
 
 // NewMemStorage creates log storage base on memory.
 // This storage use simple `map[string][]string`, just for TestCase used.
 // NOT use this in product.
-func NewMemStorage() (storage.Storage, error) {
-	return &memStorage{
+func NewMemStorage(opts ...Option) (storage.Storage, error) {
+	s := &memStorage{
 		data: make(map[string][]string),
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
 // AppendLog appends log into queue under given logID.
 func (s *memStorage) AppendLog(logID string, data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	logQueue, ok := s.data[logID]
 	if !ok {
 		logQueue = []string{}
@@ -31,7 +51,20 @@ func (s *memStorage) AppendLog(logID string, data string) error {
 
 // Lookup lookups log under given logID.
 func (s *memStorage) Lookup(logID string) ([]string, error) {
-	return s.data[logID], nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// copy to avoid caller reading while AppendLog reallocating
+	return append([]string(nil), s.data[logID]...), nil
+}
+
+// LookupStream iterates log under given logID.
+func (s *memStorage) LookupStream(logID string) (storage.LogIterator, error) {
+	return storage.LookupAsStream(s, logID)
+}
+
+// LookupMany lookups log under each of given logIDs.
+func (s *memStorage) LookupMany(logIDs []string) (map[string][]string, error) {
+	return storage.LookupEach(s, logIDs)
 }
 
 // Close uses to close storage and release resources.
@@ -41,28 +74,83 @@ func (s *memStorage) Close() error {
 
 // LogIDs uses to take all Log ID av in current storage
 func (s *memStorage) LogIDs() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	ids := make([]string, 0, len(s.data))
 	for id := range s.data {
-		ids = append(ids, id)
+		if strings.HasPrefix(id, s.logPrefix) {
+			ids = append(ids, id)
+		}
 	}
 	return ids, nil
 }
 
+// CountSagas counts saga logs, whose first entry is SagaStart, with logPrefix and prefix.
+func (s *memStorage) CountSagas(prefix string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for id, logs := range s.data {
+		if strings.HasPrefix(id, s.logPrefix) && strings.HasPrefix(id, prefix) && len(logs) > 0 && storage.IsSagaStart(logs[0]) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Flush is a no-op since memory storage is synchronous.
+func (s *memStorage) Flush() error {
+	return nil
+}
+
 func (s *memStorage) Cleanup(logID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.data, logID)
 	return nil
 }
 
-func (s *memStorage) LastLog(logID string) (string, error) {
-	logData, ok := s.data[logID]
-	if !ok {
-		err := errors.NewErr("LogData %s not found", logID)
-		return "", &err
+// ReplacePrefix replaces the first n log entries under logID with entries if the n-th one is head.
+func (s *memStorage) ReplacePrefix(logID string, n int, head string, entries []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logData := s.data[logID]
+	if n <= 0 || len(logData) < n || logData[n-1] != head {
+		return false, nil
 	}
-	sizeOfLog := len(logData)
-	if sizeOfLog == 0 {
-		return "", errors.New("LogData is empty")
+	s.data[logID] = append(append([]string(nil), entries...), logData[n:]...)
+	return true, nil
+}
+
+// RemoveEntries removes log entries under logID equal to one of entries.
+func (s *memStorage) RemoveEntries(logID string, entries ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		removed[entry] = true
+	}
+	var left []string
+	for _, data := range s.data[logID] {
+		if !removed[data] {
+			left = append(left, data)
+		}
+	}
+	if len(left) == 0 {
+		delete(s.data, logID)
+	} else {
+		s.data[logID] = left
+	}
+	return len(left), nil
+}
+
+func (s *memStorage) LastLog(logID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	logData := s.data[logID]
+	// missing logID has no last log, like other storages
+	if len(logData) == 0 {
+		return "", nil
 	}
-	lastLog := logData[sizeOfLog-1]
-	return lastLog, nil
+	return logData[len(logData)-1], nil
 }
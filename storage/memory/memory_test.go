@@ -3,6 +3,8 @@ package memory
 import (
 	"testing"
 
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/storagetest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,3 +17,26 @@ func TestMemStorage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Contains(t, looked, "{}")
 }
+
+func TestMemStorageLookupStream(t *testing.T) {
+	s, err := NewMemStorage()
+	assert.NoError(t, err)
+	assert.NoError(t, s.AppendLog("t_11", "1"))
+	assert.NoError(t, s.AppendLog("t_11", "2"))
+	it, err := s.LookupStream("t_11")
+	assert.NoError(t, err)
+	var looked []string
+	for it.Next() {
+		looked = append(looked, it.Value())
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{"1", "2"}, looked)
+}
+
+func TestMemStorageContract(t *testing.T) {
+	storagetest.TestStorageContract(t, func(t *testing.T, logPrefix string) storage.Storage {
+		s, err := NewMemStorage(WithLogPrefix(logPrefix))
+		assert.NoError(t, err)
+		return s
+	})
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"log"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// MirrorOption configures mirror storage created by NewMirrorStore.
+type MirrorOption func(*mirrorStore)
+
+// MirrorStrict makes secondary failures fail the write operation.
+// By default secondary writes are best-effort and failures only be logged.
+func MirrorStrict() MirrorOption {
+	return func(s *mirrorStore) {
+		s.strict = true
+	}
+}
+
+// MirrorLogger sets logger used to report secondary failures in best-effort mode.
+func MirrorLogger(logger *log.Logger) MirrorOption {
+	return func(s *mirrorStore) {
+		s.logger = logger
+	}
+}
+
+type mirrorStore struct {
+	primary   Storage
+	secondary Storage
+	strict    bool
+	logger    *log.Logger
+}
+
+// NewMirrorStore creates storage that writes AppendLog & Cleanup to both primary and secondary,
+// and reads from primary only.
+// Primary write must succeed, secondary write is best-effort unless MirrorStrict is given.
+// It's useful for zero-downtime backend migration or dual-writing as a safety net.
+//
+// The storage implements Locker, TimeRangeLister, Compactor and Remover only if primary does.
+// Locks and time ranges are taken from primary, ReplacePrefix and RemoveEntries are written to primary
+// then secondary like AppendLog, a secondary not implementing them fails the secondary write.
+func NewMirrorStore(primary, secondary Storage, opts ...MirrorOption) Storage {
+	s := &mirrorStore{
+		primary:   primary,
+		secondary: secondary,
+		logger:    log.New(os.Stderr, "[saga] ", log.LstdFlags),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s.extended()
+}
+
+// extended returns s implementing optional interfaces of primary, so callers asserting them see
+// the same features as primary.
+func (s *mirrorStore) extended() Storage {
+	locker, isLocker := s.primary.(Locker)
+	lister, isLister := s.primary.(TimeRangeLister)
+	_, isCompactor := s.primary.(Compactor)
+	_, isRemover := s.primary.(Remover)
+	c, r := mirrorCompactor{s}, mirrorRemover{s}
+	switch {
+	case isLocker && isLister && isCompactor && isRemover:
+		return struct {
+			*mirrorStore
+			Locker
+			TimeRangeLister
+			Compactor
+			Remover
+		}{s, locker, lister, c, r}
+	case isLocker && isLister && isCompactor:
+		return struct {
+			*mirrorStore
+			Locker
+			TimeRangeLister
+			Compactor
+		}{s, locker, lister, c}
+	case isLocker && isLister && isRemover:
+		return struct {
+			*mirrorStore
+			Locker
+			TimeRangeLister
+			Remover
+		}{s, locker, lister, r}
+	case isLocker && isLister:
+		return struct {
+			*mirrorStore
+			Locker
+			TimeRangeLister
+		}{s, locker, lister}
+	case isLocker && isCompactor && isRemover:
+		return struct {
+			*mirrorStore
+			Locker
+			Compactor
+			Remover
+		}{s, locker, c, r}
+	case isLocker && isCompactor:
+		return struct {
+			*mirrorStore
+			Locker
+			Compactor
+		}{s, locker, c}
+	case isLocker && isRemover:
+		return struct {
+			*mirrorStore
+			Locker
+			Remover
+		}{s, locker, r}
+	case isLocker:
+		return struct {
+			*mirrorStore
+			Locker
+		}{s, locker}
+	case isLister && isCompactor && isRemover:
+		return struct {
+			*mirrorStore
+			TimeRangeLister
+			Compactor
+			Remover
+		}{s, lister, c, r}
+	case isLister && isCompactor:
+		return struct {
+			*mirrorStore
+			TimeRangeLister
+			Compactor
+		}{s, lister, c}
+	case isLister && isRemover:
+		return struct {
+			*mirrorStore
+			TimeRangeLister
+			Remover
+		}{s, lister, r}
+	case isLister:
+		return struct {
+			*mirrorStore
+			TimeRangeLister
+		}{s, lister}
+	case isCompactor && isRemover:
+		return struct {
+			*mirrorStore
+			Compactor
+			Remover
+		}{s, c, r}
+	case isCompactor:
+		return struct {
+			*mirrorStore
+			Compactor
+		}{s, c}
+	case isRemover:
+		return struct {
+			*mirrorStore
+			Remover
+		}{s, r}
+	}
+	return s
+}
+
+type mirrorCompactor struct {
+	s *mirrorStore
+}
+
+// ReplacePrefix replaces head of log in primary, then in secondary if primary did.
+func (c mirrorCompactor) ReplacePrefix(logID string, n int, head string, entries []string) (bool, error) {
+	ok, err := c.s.primary.(Compactor).ReplacePrefix(logID, n, head, entries)
+	if err != nil || !ok {
+		return ok, err
+	}
+	compactor, isCompactor := c.s.secondary.(Compactor)
+	if !isCompactor {
+		return true, c.s.secondaryFailed(errors.New("storage doesn't implement storage.Compactor"), "ReplacePrefix", logID)
+	}
+	replaced, err := compactor.ReplacePrefix(logID, n, head, entries)
+	if err == nil && !replaced {
+		err = errors.New("head of log differs from primary")
+	}
+	return true, c.s.secondaryFailed(err, "ReplacePrefix", logID)
+}
+
+type mirrorRemover struct {
+	s *mirrorStore
+}
+
+// RemoveEntries removes entries from log in primary then secondary, it returns entries left in primary.
+func (r mirrorRemover) RemoveEntries(logID string, entries ...string) (int, error) {
+	left, err := r.s.primary.(Remover).RemoveEntries(logID, entries...)
+	if err != nil {
+		return 0, err
+	}
+	remover, isRemover := r.s.secondary.(Remover)
+	if !isRemover {
+		return left, r.s.secondaryFailed(errors.New("storage doesn't implement storage.Remover"), "RemoveEntries", logID)
+	}
+	_, err = remover.RemoveEntries(logID, entries...)
+	return left, r.s.secondaryFailed(err, "RemoveEntries", logID)
+}
+
+func (s *mirrorStore) secondaryFailed(err error, op, logID string) error {
+	if err == nil {
+		return nil
+	}
+	if s.strict {
+		return errors.Annotatef(err, "Mirror %s to secondary for %s failure", op, logID)
+	}
+	s.logger.Printf("[WARNING]Mirror %s to secondary for %s failure: %v", op, logID, err)
+	return nil
+}
+
+// AppendLog appends log into primary then secondary.
+func (s *mirrorStore) AppendLog(logID string, data string) error {
+	if err := s.primary.AppendLog(logID, data); err != nil {
+		return err
+	}
+	return s.secondaryFailed(s.secondary.AppendLog(logID, data), "AppendLog", logID)
+}
+
+// Lookup lookups log from primary.
+func (s *mirrorStore) Lookup(logID string) ([]string, error) {
+	return s.primary.Lookup(logID)
+}
+
+// LookupStream iterates log from primary.
+func (s *mirrorStore) LookupStream(logID string) (LogIterator, error) {
+	return s.primary.LookupStream(logID)
+}
+
+// LookupMany lookups logs from primary.
+func (s *mirrorStore) LookupMany(logIDs []string) (map[string][]string, error) {
+	return s.primary.LookupMany(logIDs)
+}
+
+// Close closes both primary and secondary.
+func (s *mirrorStore) Close() error {
+	err1 := s.primary.Close()
+	err2 := s.secondary.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// LogIDs returns logIDs in primary.
+func (s *mirrorStore) LogIDs() ([]string, error) {
+	return s.primary.LogIDs()
+}
+
+// CountSagas counts sagas in primary.
+func (s *mirrorStore) CountSagas(prefix string) (int, error) {
+	return s.primary.CountSagas(prefix)
+}
+
+// Cleanup cleans up log in primary then secondary.
+func (s *mirrorStore) Cleanup(logID string) error {
+	if err := s.primary.Cleanup(logID); err != nil {
+		return err
+	}
+	return s.secondaryFailed(s.secondary.Cleanup(logID), "Cleanup", logID)
+}
+
+// Flush flushes primary then secondary.
+func (s *mirrorStore) Flush() error {
+	if err := s.primary.Flush(); err != nil {
+		return err
+	}
+	return s.secondaryFailed(s.secondary.Flush(), "Flush", "all logs")
+}
+
+// LastLog fetches last log from primary.
+func (s *mirrorStore) LastLog(logID string) (string, error) {
+	return s.primary.LastLog(logID)
+}
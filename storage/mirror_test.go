@@ -0,0 +1,102 @@
+package storage_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+type brokenStore struct {
+	storage.Storage
+}
+
+func (brokenStore) AppendLog(logID string, data string) error {
+	return errors.New("broken")
+}
+
+func TestMirrorStore(t *testing.T) {
+	primary, _ := memory.NewMemStorage()
+	secondary, _ := memory.NewMemStorage()
+	s := storage.NewMirrorStore(primary, secondary)
+	assert.NoError(t, s.AppendLog("t_11", "{}"))
+	looked, err := secondary.Lookup("t_11")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{}"}, looked)
+
+	assert.NoError(t, s.Cleanup("t_11"))
+	ids, err := secondary.LogIDs()
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestMirrorStoreSecondaryFailure(t *testing.T) {
+	primary, _ := memory.NewMemStorage()
+	logger := log.New(ioutil.Discard, "", 0)
+	s := storage.NewMirrorStore(primary, brokenStore{}, storage.MirrorLogger(logger))
+	assert.NoError(t, s.AppendLog("t_11", "{}"))
+	looked, err := s.Lookup("t_11")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{}"}, looked)
+
+	s = storage.NewMirrorStore(primary, brokenStore{}, storage.MirrorStrict())
+	assert.Error(t, s.AppendLog("t_11", "{}"))
+}
+
+type lockingStore struct {
+	storage.Storage
+	locked []string
+}
+
+func (s *lockingStore) TryLockSaga(logID string) (func() error, bool, error) {
+	s.locked = append(s.locked, logID)
+	return func() error { return nil }, true, nil
+}
+
+func TestMirrorStoreExtensions(t *testing.T) {
+	primary, _ := memory.NewMemStorage()
+	secondary, _ := memory.NewMemStorage()
+	s := storage.NewMirrorStore(primary, secondary)
+	_, ok := s.(storage.Locker)
+	assert.False(t, ok, "primary isn't a Locker")
+	remover, ok := s.(storage.Remover)
+	if assert.True(t, ok) {
+		assert.NoError(t, s.AppendLog("t_11", "a"))
+		assert.NoError(t, s.AppendLog("t_11", "b"))
+		left, err := remover.RemoveEntries("t_11", "a")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, left)
+		looked, err := secondary.Lookup("t_11")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, looked)
+	}
+	compactor, ok := s.(storage.Compactor)
+	if assert.True(t, ok) {
+		replaced, err := compactor.ReplacePrefix("t_11", 1, "b", []string{"c"})
+		assert.NoError(t, err)
+		assert.True(t, replaced)
+		looked, err := secondary.Lookup("t_11")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"c"}, looked)
+	}
+
+	s = storage.NewMirrorStore(primary, brokenStore{}, storage.MirrorStrict())
+	_, err := s.(storage.Remover).RemoveEntries("t_11", "c")
+	assert.Error(t, err, "secondary isn't a Remover")
+
+	locking := &lockingStore{Storage: primary}
+	s = storage.NewMirrorStore(locking, secondary)
+	locker, ok := s.(storage.Locker)
+	if assert.True(t, ok) {
+		_, locked, err := locker.TryLockSaga("t_11")
+		assert.NoError(t, err)
+		assert.True(t, locked)
+		assert.Equal(t, []string{"t_11"}, locking.locked)
+	}
+	_, ok = s.(storage.Remover)
+	assert.False(t, ok, "primary embedding Storage isn't a Remover")
+}
@@ -0,0 +1,89 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: iterator.go
+
+// Package mocks is a generated GoMock package.
+package mocks
+
+import (
+	gomock "github.com/golang/mock/gomock"
+	reflect "reflect"
+)
+
+// MockLogIterator is a mock of LogIterator interface
+type MockLogIterator struct {
+	ctrl     *gomock.Controller
+	recorder *MockLogIteratorMockRecorder
+}
+
+// MockLogIteratorMockRecorder is the mock recorder for MockLogIterator
+type MockLogIteratorMockRecorder struct {
+	mock *MockLogIterator
+}
+
+// NewMockLogIterator creates a new mock instance
+func NewMockLogIterator(ctrl *gomock.Controller) *MockLogIterator {
+	mock := &MockLogIterator{ctrl: ctrl}
+	mock.recorder = &MockLogIteratorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockLogIterator) EXPECT() *MockLogIteratorMockRecorder {
+	return m.recorder
+}
+
+// Next mocks base method
+func (m *MockLogIterator) Next() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Next")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Next indicates an expected call of Next
+func (mr *MockLogIteratorMockRecorder) Next() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockLogIterator)(nil).Next))
+}
+
+// Value mocks base method
+func (m *MockLogIterator) Value() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Value")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Value indicates an expected call of Value
+func (mr *MockLogIteratorMockRecorder) Value() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Value", reflect.TypeOf((*MockLogIterator)(nil).Value))
+}
+
+// Err mocks base method
+func (m *MockLogIterator) Err() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Err")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Err indicates an expected call of Err
+func (mr *MockLogIteratorMockRecorder) Err() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Err", reflect.TypeOf((*MockLogIterator)(nil).Err))
+}
+
+// Close mocks base method
+func (m *MockLogIterator) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close
+func (mr *MockLogIteratorMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockLogIterator)(nil).Close))
+}
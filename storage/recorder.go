@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"sync"
+)
+
+// Recorder is a storage decorator keeps a copy of every appended log, even after it's cleaned up.
+// It's useful for tests to verify what a saga run did.
+type Recorder struct {
+	Storage
+	mu   sync.Mutex
+	logs map[string][]string
+}
+
+// NewRecorder creates Recorder records logs appended to given storage.
+func NewRecorder(s Storage) *Recorder {
+	return &Recorder{
+		Storage: s,
+		logs:    make(map[string][]string),
+	}
+}
+
+// AppendLog appends log into underlying storage and records it.
+func (r *Recorder) AppendLog(logID string, data string) error {
+	if err := r.Storage.AppendLog(logID, data); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.logs[logID] = append(r.logs[logID], data)
+	r.mu.Unlock()
+	return nil
+}
+
+// Recorded returns all log appended under given logID.
+func (r *Recorder) Recorded(logID string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.logs[logID]...)
+}
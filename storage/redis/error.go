@@ -0,0 +1,44 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// temporaryReplies are prefixes of redis error replies caused by server state which may recover soon
+var temporaryReplies = []string{"LOADING", "BUSY", "TRYAGAIN", "MASTERDOWN", "CLUSTERDOWN", "OOM"}
+
+// classify wraps err as storage.Error, connection problems, exhausted pool and busy server are temporary,
+// other errors such as WRONGTYPE reply are fatal.
+func classify(err error) error {
+	if err == nil || err == redis.ErrNil {
+		return err
+	}
+	var netErr net.Error
+	var reply redis.Error
+	switch {
+	case errors.Is(err, redis.ErrPoolExhausted),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.As(err, &netErr):
+		return storage.Temporary(err)
+	case errors.As(err, &reply):
+		for _, prefix := range temporaryReplies {
+			if strings.HasPrefix(string(reply), prefix) {
+				return storage.Temporary(err)
+			}
+		}
+	}
+	return storage.Fatal(err)
+}
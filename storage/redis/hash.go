@@ -0,0 +1,228 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// WithHashMode stores all saga logs of the store under two hashes grouped by logPrefix,
+// instead of a list per logID:
+//
+//	{logPrefix}:index  logID -> number of log entries
+//	{logPrefix}:logs   logID:n -> n-th log entry
+//
+// It keeps keyspace small no matter how many sagas are stored, and LogIDs becomes a HKEYS
+// on the index hash rather than a database-wide KEYS scan.
+//
+// Tradeoffs: the two hashes are hot keys living on a single node, they can't be sharded across
+// Redis cluster(the hash tag keeps them in the same slot for scripts), per-saga TTL isn't possible,
+// and Lookup loads a saga's log by a script in one shot so LookupStream can't stream.
+// List mode is the default.
+func WithHashMode() Option {
+	return func(p *RedisStore) {
+		p.hashMode = true
+	}
+}
+
+var (
+	hashAppendScript = redis.NewScript(2, `
+local n = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+redis.call('HSET', KEYS[2], ARGV[1] .. ':' .. n, ARGV[2])
+return n`)
+
+	hashLookupScript = redis.NewScript(2, `
+local n = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if n == 0 then
+	return {}
+end
+local fields = {}
+for i = 1, n do
+	fields[i] = ARGV[1] .. ':' .. i
+end
+return redis.call('HMGET', KEYS[2], unpack(fields))`)
+
+	hashLastLogScript = redis.NewScript(2, `
+local n = redis.call('HGET', KEYS[1], ARGV[1])
+if not n then
+	return false
+end
+return redis.call('HGET', KEYS[2], ARGV[1] .. ':' .. n)`)
+
+	// hashReplacePrefixScript renumbers entries after the first ARGV[2] ones following replacing entries ARGV[4:],
+	// if the ARGV[2]-th entry is ARGV[3]
+	hashReplacePrefixScript = redis.NewScript(2, `
+local total = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+local n = tonumber(ARGV[2])
+if n <= 0 or total < n or redis.call('HGET', KEYS[2], ARGV[1] .. ':' .. n) ~= ARGV[3] then
+	return 0
+end
+local tail = {}
+for i = n + 1, total do
+	tail[#tail + 1] = redis.call('HGET', KEYS[2], ARGV[1] .. ':' .. i)
+end
+for i = 1, total do
+	redis.call('HDEL', KEYS[2], ARGV[1] .. ':' .. i)
+end
+local m = 0
+for i = 4, #ARGV do
+	m = m + 1
+	redis.call('HSET', KEYS[2], ARGV[1] .. ':' .. m, ARGV[i])
+end
+for _, entry in ipairs(tail) do
+	m = m + 1
+	redis.call('HSET', KEYS[2], ARGV[1] .. ':' .. m, entry)
+end
+redis.call('HSET', KEYS[1], ARGV[1], m)
+return 1`)
+
+	// hashRemoveEntriesScript renumbers entries of log ARGV[1] which equal none of ARGV[2:]
+	hashRemoveEntriesScript = redis.NewScript(2, `
+local total = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+local removed = {}
+for i = 2, #ARGV do
+	removed[ARGV[i]] = true
+end
+local m = 0
+for i = 1, total do
+	local field = ARGV[1] .. ':' .. i
+	local entry = redis.call('HGET', KEYS[2], field)
+	redis.call('HDEL', KEYS[2], field)
+	if entry and not removed[entry] then
+		m = m + 1
+		redis.call('HSET', KEYS[2], ARGV[1] .. ':' .. m, entry)
+	end
+end
+if m == 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+else
+	redis.call('HSET', KEYS[1], ARGV[1], m)
+end
+return m`)
+
+	hashCleanupScript = redis.NewScript(2, `
+local n = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+for i = 1, n do
+	redis.call('HDEL', KEYS[2], ARGV[1] .. ':' .. i)
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+return n`)
+)
+
+func (p *RedisStore) hashIndexKey() string {
+	return "{" + p.logPrefix + "}:index"
+}
+
+func (p *RedisStore) hashLogsKey() string {
+	return "{" + p.logPrefix + "}:logs"
+}
+
+func (p *RedisStore) hashAppendLog(logID string, data string) error {
+	conn := p.get()
+	defer conn.Close()
+	if _, err := redis.Int64(hashAppendScript.Do(conn, p.hashIndexKey(), p.hashLogsKey(), logID, data)); err != nil || !p.indexed(logID, data) {
+		return err
+	}
+	if err := p.indexStart(conn, logID); err != nil {
+		return err
+	}
+	return flushPipeline(conn)
+}
+
+func (p *RedisStore) hashLookup(logID string) ([]string, error) {
+	conn := p.get()
+	defer conn.Close()
+	replys, err := redis.Strings(hashLookupScript.Do(conn, p.hashIndexKey(), p.hashLogsKey(), logID))
+	if err != nil {
+		return nil, err
+	}
+	return nonEmpty(replys), nil
+}
+
+// nonEmpty skips the entry whose append is in progress.
+func nonEmpty(replys []string) []string {
+	logs := replys[:0]
+	for _, reply := range replys {
+		if reply != "" {
+			logs = append(logs, reply)
+		}
+	}
+	return logs
+}
+
+func (p *RedisStore) hashLookupMany(logIDs []string) (map[string][]string, error) {
+	conn := p.get()
+	defer conn.Close()
+	// make sure script is cached, so pipelined EVALSHA won't fail with NOSCRIPT
+	if err := hashLookupScript.Load(conn); err != nil {
+		return nil, err
+	}
+	for _, logID := range logIDs {
+		if err := hashLookupScript.SendHash(conn, p.hashIndexKey(), p.hashLogsKey(), logID); err != nil {
+			return nil, err
+		}
+	}
+	logs, err := receiveMany(conn, logIDs, redis.Strings)
+	if err != nil {
+		return nil, err
+	}
+	for logID, replys := range logs {
+		logs[logID] = nonEmpty(replys)
+	}
+	return logs, nil
+}
+
+func (p *RedisStore) hashLogIDs() ([]string, error) {
+	conn := p.get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("HKEYS", p.hashIndexKey()))
+	sagaTopics := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasPrefix(key, p.logPrefix) {
+			sagaTopics = append(sagaTopics, key)
+		}
+	}
+	return sagaTopics, err
+}
+
+func (p *RedisStore) hashCleanup(logID string) error {
+	conn := p.get()
+	defer conn.Close()
+	if err := hashCleanupScript.Send(conn, p.hashIndexKey(), p.hashLogsKey(), logID); err != nil {
+		return err
+	}
+	if err := conn.Send("ZREM", p.startIndexKey(), logID); err != nil {
+		return err
+	}
+	return flushPipeline(conn)
+}
+
+func (p *RedisStore) hashReplacePrefix(logID string, n int, head string, entries []string) (bool, error) {
+	conn := p.get()
+	defer conn.Close()
+	args := make([]interface{}, 0, len(entries)+5)
+	args = append(args, p.hashIndexKey(), p.hashLogsKey(), logID, n, head)
+	for _, entry := range entries {
+		args = append(args, entry)
+	}
+	return redis.Bool(hashReplacePrefixScript.Do(conn, args...))
+}
+
+func (p *RedisStore) hashRemoveEntries(conn redis.Conn, logID string, entries []string) (int, error) {
+	args := make([]interface{}, 0, len(entries)+3)
+	args = append(args, p.hashIndexKey(), p.hashLogsKey(), logID)
+	for _, entry := range entries {
+		args = append(args, entry)
+	}
+	return redis.Int(hashRemoveEntriesScript.Do(conn, args...))
+}
+
+func (p *RedisStore) hashLastLog(logID string) (string, error) {
+	conn := p.get()
+	defer conn.Close()
+	reply, err := redis.String(hashLastLogScript.Do(conn, p.hashIndexKey(), p.hashLogsKey(), logID))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return reply, err
+}
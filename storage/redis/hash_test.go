@@ -0,0 +1,49 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisHashMode(t *testing.T) {
+	s, err := NewRedisStore("127.0.0.1:6379", "", 14, 2, 5, "h_", WithHashMode())
+	assert.NoError(t, err)
+	assert.NoError(t, s.AppendLog("h_11", "{1}"))
+	assert.NoError(t, s.AppendLog("h_11", "{2}"))
+	assert.NoError(t, s.AppendLog("h_12", "{1}"))
+
+	looked, err := s.Lookup("h_11")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{1}", "{2}"}, looked)
+
+	lastLog, err := s.LastLog("h_11")
+	assert.NoError(t, err)
+	assert.Equal(t, "{2}", lastLog)
+
+	logIDs, err := s.LogIDs()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"h_11", "h_12"}, logIDs)
+
+	assert.NoError(t, s.Cleanup("h_11"))
+	assert.NoError(t, s.Cleanup("h_12"))
+	looked, err = s.Lookup("h_11")
+	assert.NoError(t, err)
+	assert.Empty(t, looked)
+	lastLog, err = s.LastLog("h_11")
+	assert.NoError(t, err)
+	assert.Equal(t, "", lastLog)
+	logIDs, err = s.LogIDs()
+	assert.NoError(t, err)
+	assert.Empty(t, logIDs)
+}
+
+func TestRedisHashModeContract(t *testing.T) {
+	storagetest.TestStorageContract(t, func(t *testing.T, logPrefix string) storage.Storage {
+		s, err := NewRedisStore("127.0.0.1:6379", "", 14, 2, 5, logPrefix, WithHashMode())
+		assert.NoError(t, err)
+		return s
+	})
+}
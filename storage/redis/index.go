@@ -0,0 +1,117 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// startIndexKey is the sorted set indexing logID by milliseconds its SagaStart entry appended at,
+// it's outside logPrefix so LogIDs doesn't return it.
+func startIndexKey(logPrefix string) string {
+	return "{" + logPrefix + "}:started"
+}
+
+// indexed reports whether data is the SagaStart entry of a saga log with logPrefix, lists sharing logPrefix,
+// e.g. dead-letter list of coordinator, aren't indexed.
+func indexed(logPrefix, logID, data string) bool {
+	return storage.IsSagaStart(data) && strings.HasPrefix(logID, logPrefix)
+}
+
+// scanCount is COUNT hint of a ZSCAN batch
+const scanCount = 1000
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// indexStart sends ZADD NX indexing logID by now into index key, so the score is kept if SagaStart is appended again.
+func indexStart(conn redis.Conn, key, logID string) error {
+	return conn.Send("ZADD", key, "NX", unixMilli(time.Now()), logID)
+}
+
+// countIndexed counts sagas in index key whose logID starts with prefix, narrowed by storage.NarrowPrefix.
+// It's a ZCARD unless prefix is longer than logPrefix, then members are matched by ZSCAN in batches,
+// so redis isn't blocked walking the whole index.
+func countIndexed(conn redis.Conn, key, logPrefix, prefix string) (int, error) {
+	if prefix == logPrefix {
+		return redis.Int(conn.Do("ZCARD", key))
+	}
+	// ZSCAN may return a member more than once
+	matched := make(map[string]struct{})
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("ZSCAN", key, cursor, "MATCH", globEscape(prefix)+"*", "COUNT", scanCount))
+		if err != nil {
+			return 0, err
+		}
+		var members []string
+		if _, err := redis.Scan(values, &cursor, &members); err != nil {
+			return 0, err
+		}
+		// members are followed by their scores
+		for i := 0; i < len(members); i += 2 {
+			matched[members[i]] = struct{}{}
+		}
+		if cursor == "0" {
+			return len(matched), nil
+		}
+	}
+}
+
+func (p *RedisStore) startIndexKey() string {
+	return startIndexKey(p.logPrefix)
+}
+
+func (p *RedisStore) indexed(logID, data string) bool {
+	return indexed(p.logPrefix, logID, data)
+}
+
+func (p *RedisStore) indexStart(conn redis.Conn, logID string) error {
+	return indexStart(conn, p.startIndexKey(), logID)
+}
+
+// CountSagas counts sagas indexed by start time whose logID starts with prefix, it's a ZCARD unless prefix is
+// longer than logPrefix. Sagas started before the index was introduced aren't counted.
+func (p *RedisStore) CountSagas(prefix string) (int, error) {
+	prefix, ok := storage.NarrowPrefix(p.logPrefix, prefix)
+	if !ok {
+		return 0, nil
+	}
+	conn := p.get()
+	defer conn.Close()
+	return countIndexed(conn, p.startIndexKey(), p.logPrefix, prefix)
+}
+
+// OldestSagas returns at most n logIDs by time their SagaStart was appended, oldest first,
+// e.g. to recover oldest sagas first. Sagas started before the index was introduced aren't returned.
+func (p *RedisStore) OldestSagas(n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	conn := p.get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("ZRANGE", p.startIndexKey(), 0, n-1))
+}
+
+// RecentSagas returns at most n logIDs by time their SagaStart was appended, most recent first.
+func (p *RedisStore) RecentSagas(n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	conn := p.get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("ZREVRANGE", p.startIndexKey(), 0, n-1))
+}
+
+// LogIDsByTimeRange returns logIDs whose SagaStart was appended in [from, to), oldest first,
+// it implements storage.TimeRangeLister with ZRANGEBYSCORE instead of reading the first entry of every saga log.
+func (p *RedisStore) LogIDsByTimeRange(from, to time.Time) ([]string, error) {
+	conn := p.get()
+	defer conn.Close()
+	max := "(" + strconv.FormatInt(unixMilli(to), 10)
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", p.startIndexKey(), unixMilli(from), max))
+}
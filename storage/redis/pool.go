@@ -0,0 +1,76 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// drainInterval is how often a replaced pool is checked for connections still in use
+const drainInterval = 100 * time.Millisecond
+
+// PoolConfig is the configuration of connection pool of RedisStore.
+type PoolConfig struct {
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+	// Wait reports whether an operation waits for a free connection of exhausted pool, see WithPoolWaitTimeout
+	Wait bool
+}
+
+// currentPool returns the pool in use.
+func (p *RedisStore) currentPool() *redis.Pool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+// PoolConfig returns configuration of the pool in use.
+func (p *RedisStore) PoolConfig() PoolConfig {
+	pool := p.currentPool()
+	return PoolConfig{
+		MaxIdle:     pool.MaxIdle,
+		MaxActive:   pool.MaxActive,
+		IdleTimeout: pool.IdleTimeout,
+		Wait:        pool.Wait,
+	}
+}
+
+// PoolStats returns statistics of the pool in use, e.g. to watch saturation by ActiveCount against MaxActive
+// and WaitCount. Statistics restart from zero after SetPoolSize.
+func (p *RedisStore) PoolStats() redis.PoolStats {
+	return p.currentPool().Stats()
+}
+
+// SetPoolSize resizes connection pool at runtime, zero means the default like NewRedisStore.
+// It's safe to call concurrently with other operations.
+//
+// redis.Pool can't be resized in place once used, so a pool of the new size replaces the current one:
+// operations started afterwards use the new pool, while the ones holding or waiting for a connection
+// of the old pool finish on it. The old pool is closed in background once none of its connections is in use,
+// so the total number of connections may exceed the new MaxActive until then.
+func (p *RedisStore) SetPoolSize(maxIdle, maxActive int) error {
+	if maxIdle < 0 || maxActive < 0 {
+		return fmt.Errorf("invalid pool size: maxIdle %d, maxActive %d", maxIdle, maxActive)
+	}
+	pool := p.newPool(maxIdle, maxActive)
+	p.mu.Lock()
+	old := p.pool
+	p.pool = pool
+	p.mu.Unlock()
+	go drain(old)
+	return nil
+}
+
+// drain closes pool once none of its connections is in use.
+func drain(pool *redis.Pool) {
+	for {
+		stats := pool.Stats()
+		if stats.ActiveCount == stats.IdleCount {
+			pool.Close()
+			return
+		}
+		time.Sleep(drainInterval)
+	}
+}
@@ -1,18 +1,85 @@
 package redis
 
 import (
+	"context"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/kzh125/go-saga/storage"
 )
 
+// streamBatchSize is the number of log entries LookupStream fetches per LRANGE
+const streamBatchSize = 100
+
 type RedisStore struct {
+	// mu guards pool replaced by SetPoolSize
+	mu        sync.RWMutex
 	pool      *redis.Pool
+	newPool   func(maxIdle, maxActive int) *redis.Pool
 	logPrefix string
+	hashMode  bool
+	// waitTimeout bounds waiting for a connection of exhausted pool, see WithPoolWaitTimeout
+	waitTimeout time.Duration
+}
+
+// Option configures RedisStore created by NewRedisStore.
+type Option func(*RedisStore)
+
+// NewRedisStore creates log storage base on Redis, each saga log is stored as a list keyed by logID by default.
+// logPrefix is used to filter saga logs from other keys in LogIDs.
+// Sagas are also indexed by start time in a sorted set, see OldestSagas.
+func NewRedisStore(dial, password string, db, maxIdle, maxActive int, logPrefix string, opts ...Option) (*RedisStore, error) {
+	store := &RedisStore{
+		newPool: func(maxIdle, maxActive int) *redis.Pool {
+			return newPool(dial, password, db, maxIdle, maxActive)
+		},
+		logPrefix: logPrefix,
+	}
+	store.pool = store.newPool(maxIdle, maxActive)
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store, nil
+}
+
+// WithPoolWaitTimeout bounds waiting for a free connection when the pool is exhausted,
+// the operation fails with a temporary storage.Error instead of blocking until a connection is released.
+func WithPoolWaitTimeout(timeout time.Duration) Option {
+	return func(p *RedisStore) {
+		p.waitTimeout = timeout
+	}
 }
 
-func NewRedisStore(dial, password string, db, maxIdle, maxActive int, logPrefix string) (*RedisStore, error) {
+// get gets a connection from pool, waiting at most waitTimeout if set.
+func (p *RedisStore) get() redis.Conn {
+	pool := p.currentPool()
+	if p.waitTimeout <= 0 {
+		return pool.Get()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.waitTimeout)
+	defer cancel()
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return errorConn{err: err}
+	}
+	return conn
+}
+
+// errorConn fails every command with err, like the connection redis.Pool.Get returns on failure.
+type errorConn struct {
+	err error
+}
+
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Close() error                                   { return nil }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
+
+func newPool(dial, password string, db, maxIdle, maxActive int) *redis.Pool {
 	if maxIdle == 0 {
 		maxIdle = 2
 	}
@@ -20,7 +87,7 @@ func NewRedisStore(dial, password string, db, maxIdle, maxActive int, logPrefix
 		maxActive = 10
 	}
 
-	pool := &redis.Pool{
+	return &redis.Pool{
 		MaxIdle:     maxIdle,
 		MaxActive:   maxActive,
 		IdleTimeout: 120 * time.Second,
@@ -50,37 +117,151 @@ func NewRedisStore(dial, password string, db, maxIdle, maxActive int, logPrefix
 			return err
 		},
 	}
-
-	return &RedisStore{
-		pool:      pool,
-		logPrefix: logPrefix,
-	}, nil
 }
 
-// AppendLog appends log data into log under given logID
+// AppendLog appends log data into log under given logID,
+// failure is a storage.Error telling whether it's temporary, e.g. pool exhausted or server busy.
 func (p *RedisStore) AppendLog(logID string, data string) error {
-	conn := p.pool.Get()
+	if p.hashMode {
+		return classify(p.hashAppendLog(logID, data))
+	}
+	conn := p.get()
 	defer conn.Close()
-	_, err := redis.Int64(conn.Do("RPUSH", logID, data))
-	return err
+	if !p.indexed(logID, data) {
+		_, err := redis.Int64(conn.Do("RPUSH", logID, data))
+		return classify(err)
+	}
+	// index start time in the same round-trip, see OldestSagas
+	if err := conn.Send("RPUSH", logID, data); err != nil {
+		return classify(err)
+	}
+	if err := p.indexStart(conn, logID); err != nil {
+		return classify(err)
+	}
+	return classify(flushPipeline(conn))
 }
 
 // Lookup uses to lookup all log under given logID
 func (p *RedisStore) Lookup(logID string) ([]string, error) {
-	conn := p.pool.Get()
+	if p.hashMode {
+		return p.hashLookup(logID)
+	}
+	conn := p.get()
 	defer conn.Close()
 	replys, err := redis.Strings(conn.Do("LRANGE", logID, 0, -1))
 	return replys, err
 }
 
+// LookupStream iterates log under given logID, fetching streamBatchSize entries per round-trip.
+// Pages aren't a snapshot: ReplacePrefix or RemoveEntries of the log meanwhile shift entries, so the iterator
+// may skip or repeat some, use Lookup to read log being compacted consistently. Appends meanwhile are safe.
+func (p *RedisStore) LookupStream(logID string) (storage.LogIterator, error) {
+	if p.hashMode {
+		return storage.LookupAsStream(p, logID)
+	}
+	return &listIterator{store: p, logID: logID}, nil
+}
+
+type listIterator struct {
+	store *RedisStore
+	logID string
+	batch []string
+	pos   int
+	next  int
+	done  bool
+	err   error
+}
+
+func (it *listIterator) Next() bool {
+	if it.pos+1 < len(it.batch) {
+		it.pos++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+	conn := it.store.get()
+	defer conn.Close()
+	batch, err := redis.Strings(conn.Do("LRANGE", it.logID, it.next, it.next+streamBatchSize-1))
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.next += len(batch)
+	it.done = len(batch) < streamBatchSize
+	it.batch, it.pos = batch, 0
+	return len(batch) > 0
+}
+
+func (it *listIterator) Value() string {
+	return it.batch[it.pos]
+}
+
+func (it *listIterator) Err() error {
+	return it.err
+}
+
+func (it *listIterator) Close() error {
+	return nil
+}
+
+// LookupMany lookups all log under each of given logIDs with a pipeline of LRANGE, in one round-trip
+func (p *RedisStore) LookupMany(logIDs []string) (map[string][]string, error) {
+	if p.hashMode {
+		return p.hashLookupMany(logIDs)
+	}
+	conn := p.get()
+	defer conn.Close()
+	for _, logID := range logIDs {
+		if err := conn.Send("LRANGE", logID, 0, -1); err != nil {
+			return nil, err
+		}
+	}
+	return receiveMany(conn, logIDs, redis.Strings)
+}
+
+// flushPipeline sends commands pipelined by Send, and returns the first error reply among theirs,
+// which Do("") leaves in the replies it returns.
+func flushPipeline(conn redis.Conn) error {
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveMany receives pipelined replies of given logIDs.
+func receiveMany(conn redis.Conn, logIDs []string, convert func(interface{}, error) ([]string, error)) (map[string][]string, error) {
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	logs := make(map[string][]string, len(logIDs))
+	for _, logID := range logIDs {
+		replys, err := convert(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		logs[logID] = replys
+	}
+	return logs, nil
+}
+
 // Close use to close storage and release resources
 func (p *RedisStore) Close() error {
-	return p.pool.Close()
+	return p.currentPool().Close()
 }
 
 // LogIDs returns exists logID
 func (p *RedisStore) LogIDs() ([]string, error) {
-	conn := p.pool.Get()
+	if p.hashMode {
+		return p.hashLogIDs()
+	}
+	conn := p.get()
 	defer conn.Close()
 	keys, err := redis.Strings(conn.Do("KEYS", "*"))
 	sagaTopics := make([]string, 0, len(keys))
@@ -93,17 +274,33 @@ func (p *RedisStore) LogIDs() ([]string, error) {
 	return sagaTopics, err
 }
 
-// Cleanup cleans up all log data in logID
+// Flush is a no-op since every command is acknowledged by redis before returning.
+func (p *RedisStore) Flush() error {
+	return nil
+}
+
+// Cleanup cleans up all log data in logID and its start index entry in a pipeline, failing if either does.
 func (p *RedisStore) Cleanup(logID string) error {
-	conn := p.pool.Get()
+	if p.hashMode {
+		return p.hashCleanup(logID)
+	}
+	conn := p.get()
 	defer conn.Close()
-	_, err := conn.Do("DEL", logID)
-	return err
+	if err := conn.Send("DEL", logID); err != nil {
+		return err
+	}
+	if err := conn.Send("ZREM", p.startIndexKey(), logID); err != nil {
+		return err
+	}
+	return flushPipeline(conn)
 }
 
 // LastLog fetch last log entry with given logID
 func (p *RedisStore) LastLog(logID string) (string, error) {
-	conn := p.pool.Get()
+	if p.hashMode {
+		return p.hashLastLog(logID)
+	}
+	conn := p.get()
 	defer conn.Close()
 	replys, err := redis.Strings(conn.Do("LRANGE", logID, -1, -1))
 	if len(replys) == 0 {
@@ -111,3 +308,77 @@ func (p *RedisStore) LastLog(logID string) (string, error) {
 	}
 	return replys[0], err
 }
+
+// replacePrefixScript replaces the first ARGV[1] entries of list KEYS[1] with ARGV[3:] if the last of them is ARGV[2],
+// keeping TTL of the list
+var replacePrefixScript = redis.NewScript(1, `
+local n = tonumber(ARGV[1])
+if n <= 0 or redis.call('LINDEX', KEYS[1], n - 1) ~= ARGV[2] then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[1])
+local tail = redis.call('LRANGE', KEYS[1], n, -1)
+redis.call('DEL', KEYS[1])
+for i = 3, #ARGV do
+	redis.call('RPUSH', KEYS[1], ARGV[i])
+end
+for _, entry in ipairs(tail) do
+	redis.call('RPUSH', KEYS[1], entry)
+end
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1`)
+
+// ReplacePrefix replaces the first n log entries under logID with entries by a script if the n-th one is head,
+// it implements storage.Compactor.
+func (p *RedisStore) ReplacePrefix(logID string, n int, head string, entries []string) (bool, error) {
+	if p.hashMode {
+		ok, err := p.hashReplacePrefix(logID, n, head, entries)
+		return ok, classify(err)
+	}
+	conn := p.get()
+	defer conn.Close()
+	args := make([]interface{}, 0, len(entries)+3)
+	args = append(args, logID, n, head)
+	for _, entry := range entries {
+		args = append(args, entry)
+	}
+	ok, err := redis.Bool(replacePrefixScript.Do(conn, args...))
+	return ok, classify(err)
+}
+
+// removeEntriesScript removes entries ARGV from list KEYS[1], and returns the number of entries left
+var removeEntriesScript = redis.NewScript(1, `
+for i = 1, #ARGV do
+	redis.call('LREM', KEYS[1], 0, ARGV[i])
+end
+return redis.call('LLEN', KEYS[1])`)
+
+// RemoveEntries removes log entries under logID equal to one of entries by a script, it implements storage.Remover.
+func (p *RedisStore) RemoveEntries(logID string, entries ...string) (int, error) {
+	conn := p.get()
+	defer conn.Close()
+	var left int
+	var err error
+	if p.hashMode {
+		left, err = p.hashRemoveEntries(conn, logID, entries)
+	} else {
+		args := make([]interface{}, 0, len(entries)+1)
+		args = append(args, logID)
+		for _, entry := range entries {
+			args = append(args, entry)
+		}
+		left, err = redis.Int(removeEntriesScript.Do(conn, args...))
+	}
+	if err != nil {
+		return 0, classify(err)
+	}
+	if left == 0 {
+		// the log is gone, so is it from the start index
+		if _, err := conn.Do("ZREM", p.startIndexKey(), logID); err != nil {
+			return 0, classify(err)
+		}
+	}
+	return left, nil
+}
@@ -1,8 +1,12 @@
 package redis
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/storagetest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,3 +55,157 @@ func TestRedisStorage2(t *testing.T) {
 	assert.NoError(t, err)
 	t.Log("logIds:", logIds)
 }
+
+func TestRedisLookupStream(t *testing.T) {
+	s, err := NewRedisStore("127.0.0.1:6379", "", 14, 2, 5, "t_")
+	assert.NoError(t, err)
+	defer s.Cleanup("t_stream")
+	for i := 0; i < streamBatchSize+10; i++ {
+		assert.NoError(t, s.AppendLog("t_stream", strconv.Itoa(i)))
+	}
+
+	it, err := s.LookupStream("t_stream")
+	assert.NoError(t, err)
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		assert.Equal(t, strconv.Itoa(n), it.Value())
+		n++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, streamBatchSize+10, n)
+}
+
+func TestRedisLookupMany(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithHashMode()}} {
+		s, err := NewRedisStore("127.0.0.1:6379", "", 14, 2, 5, "m_", opts...)
+		assert.NoError(t, err)
+		assert.NoError(t, s.AppendLog("m_1", "{1}"))
+		assert.NoError(t, s.AppendLog("m_1", "{2}"))
+		assert.NoError(t, s.AppendLog("m_2", "{3}"))
+
+		logs, err := s.LookupMany([]string{"m_1", "m_2", "m_3"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"{1}", "{2}"}, logs["m_1"])
+		assert.Equal(t, []string{"{3}"}, logs["m_2"])
+		assert.Empty(t, logs["m_3"])
+		assert.NoError(t, s.Cleanup("m_1"))
+		assert.NoError(t, s.Cleanup("m_2"))
+	}
+}
+
+func TestRedisStorageContract(t *testing.T) {
+	storagetest.TestStorageContract(t, func(t *testing.T, logPrefix string) storage.Storage {
+		s, err := NewRedisStore("127.0.0.1:6379", "", 14, 2, 5, logPrefix)
+		assert.NoError(t, err)
+		return s
+	})
+}
+
+func TestRedisAppendLogErrorClass(t *testing.T) {
+	s, err := NewRedisStore("127.0.0.1:6379", "", 14, 1, 1, "e_", WithPoolWaitTimeout(50*time.Millisecond))
+	assert.NoError(t, err)
+
+	conn := s.currentPool().Get()
+	_, err = conn.Do("SET", "e_1", "not a list")
+	assert.NoError(t, err)
+	// the only connection is in use
+	err = s.AppendLog("e_2", "{}")
+	assert.Error(t, err)
+	assert.True(t, storage.IsTemporary(err))
+	it, err := s.LookupStream("e_2")
+	assert.NoError(t, err)
+	assert.False(t, it.Next(), "stream waits for connection no longer than append")
+	assert.Error(t, it.Err())
+	assert.NoError(t, conn.Close())
+
+	err = s.AppendLog("e_1", "{}")
+	assert.Error(t, err)
+	assert.False(t, storage.IsTemporary(err))
+	// error reply to a pipelined command is reported as well
+	err = s.AppendLog("e_1", `{"type":"SagaStart"}`)
+	assert.Error(t, err)
+	assert.False(t, storage.IsTemporary(err))
+	assert.NoError(t, s.Cleanup("e_1"))
+
+	h, err := NewRedisStore("127.0.0.1:6379", "", 14, 2, 5, "eh_", WithHashMode())
+	assert.NoError(t, err)
+	conn = h.currentPool().Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", h.startIndexKey(), "not a sorted set")
+	assert.NoError(t, err)
+	err = h.AppendLog("eh_1", `{"type":"SagaStart"}`)
+	assert.Error(t, err)
+	assert.False(t, storage.IsTemporary(err))
+	// error reply to ZREM of cleanup is reported
+	assert.Error(t, h.Cleanup("eh_1"))
+	_, err = conn.Do("DEL", h.startIndexKey())
+	assert.NoError(t, err)
+	assert.NoError(t, h.Cleanup("eh_1"))
+
+	_, err = conn.Do("SET", s.startIndexKey(), "not a sorted set")
+	assert.NoError(t, err)
+	assert.Error(t, s.Cleanup("e_1"))
+	_, err = conn.Do("DEL", s.startIndexKey())
+	assert.NoError(t, err)
+}
+
+func TestRedisSetPoolSize(t *testing.T) {
+	s, err := NewRedisStore("127.0.0.1:6379", "", 14, 1, 1, "p_", WithPoolWaitTimeout(50*time.Millisecond))
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, PoolConfig{MaxIdle: 1, MaxActive: 1, IdleTimeout: 120 * time.Second, Wait: true}, s.PoolConfig())
+
+	// the only connection is in use
+	conn := s.currentPool().Get()
+	assert.NoError(t, conn.Err())
+	assert.Equal(t, 1, s.PoolStats().ActiveCount)
+	assert.True(t, storage.IsTemporary(s.AppendLog("p_1", "{}")))
+
+	assert.Error(t, s.SetPoolSize(-1, 2))
+	assert.NoError(t, s.SetPoolSize(2, 4))
+	assert.Equal(t, 4, s.PoolConfig().MaxActive)
+	assert.NoError(t, s.AppendLog("p_1", "{}"))
+	assert.Equal(t, 1, s.PoolStats().ActiveCount)
+
+	// connection of the old pool still works
+	_, err = conn.Do("PING")
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, s.Cleanup("p_1"))
+}
+
+func TestRedisStartIndex(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithHashMode()}} {
+		s, err := NewRedisStore("127.0.0.1:6379", "", 14, 2, 5, "z_", opts...)
+		assert.NoError(t, err)
+		from := time.Now()
+		for _, logID := range []string{"z_1", "z_2", "z_3"} {
+			assert.NoError(t, s.AppendLog(logID, `{"type":"SagaStart","subTxID":"1"}`))
+			assert.NoError(t, s.AppendLog(logID, `{"type":"SagaEnd"}`))
+			time.Sleep(2 * time.Millisecond)
+		}
+		// not a saga log
+		assert.NoError(t, s.AppendLog("z_failures", "z_1"))
+
+		oldest, err := s.OldestSagas(2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"z_1", "z_2"}, oldest)
+		recent, err := s.RecentSagas(10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"z_3", "z_2", "z_1"}, recent)
+		inRange, err := s.LogIDsByTimeRange(from, time.Now().Add(time.Millisecond))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"z_1", "z_2", "z_3"}, inRange)
+		inRange, err = s.LogIDsByTimeRange(from.Add(-time.Hour), from.Add(-time.Minute))
+		assert.NoError(t, err)
+		assert.Empty(t, inRange)
+
+		for _, logID := range []string{"z_1", "z_2", "z_3", "z_failures"} {
+			assert.NoError(t, s.Cleanup(logID))
+		}
+		recent, err = s.RecentSagas(10)
+		assert.NoError(t, err)
+		assert.Empty(t, recent)
+	}
+}
@@ -0,0 +1,224 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// streamField is the field name of log data in stream entry
+const streamField = "data"
+
+// RedisStreamStore stores each saga log as a Redis stream keyed by logID.
+// Auto-generated stream entry IDs give total ordering of log entries, and streams allow
+// consumer groups to share recovery work across multiple coordinator instances.
+type RedisStreamStore struct {
+	pool      *redis.Pool
+	logPrefix string
+}
+
+// NewRedisStreamStore creates log storage base on Redis streams, requires Redis 5.0 or above.
+// logPrefix is used to filter saga logs from other keys in LogIDs.
+func NewRedisStreamStore(dial, password string, db, maxIdle, maxActive int, logPrefix string) (*RedisStreamStore, error) {
+	return &RedisStreamStore{
+		pool:      newPool(dial, password, db, maxIdle, maxActive),
+		logPrefix: logPrefix,
+	}, nil
+}
+
+// AppendLog appends log data into stream of given logID by XADD, SagaStart of a saga log is also indexed
+// by start time in the same round-trip, see CountSagas. Failure is a storage.Error telling whether it's temporary.
+func (p *RedisStreamStore) AppendLog(logID string, data string) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+	if !indexed(p.logPrefix, logID, data) {
+		_, err := redis.String(conn.Do("XADD", logID, "*", streamField, data))
+		return classify(err)
+	}
+	if err := conn.Send("XADD", logID, "*", streamField, data); err != nil {
+		return classify(err)
+	}
+	if err := indexStart(conn, startIndexKey(p.logPrefix), logID); err != nil {
+		return classify(err)
+	}
+	return classify(flushPipeline(conn))
+}
+
+// Lookup uses to lookup all log in stream of given logID by XRANGE
+func (p *RedisStreamStore) Lookup(logID string) ([]string, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+	_, logs, err := streamEntries(conn.Do("XRANGE", logID, "-", "+"))
+	return logs, err
+}
+
+// LookupStream iterates log in stream of given logID, fetching streamBatchSize entries per XRANGE
+func (p *RedisStreamStore) LookupStream(logID string) (storage.LogIterator, error) {
+	return &streamIterator{pool: p.pool, logID: logID, start: "-"}, nil
+}
+
+// LookupMany lookups all log in streams of given logIDs with a pipeline of XRANGE, in one round-trip
+func (p *RedisStreamStore) LookupMany(logIDs []string) (map[string][]string, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+	for _, logID := range logIDs {
+		if err := conn.Send("XRANGE", logID, "-", "+"); err != nil {
+			return nil, err
+		}
+	}
+	return receiveMany(conn, logIDs, func(reply interface{}, err error) ([]string, error) {
+		_, logs, err := streamEntries(reply, err)
+		return logs, err
+	})
+}
+
+// Close use to close storage and release resources
+func (p *RedisStreamStore) Close() error {
+	return p.pool.Close()
+}
+
+// LogIDs returns exists logID
+func (p *RedisStreamStore) LogIDs() ([]string, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("KEYS", p.logPrefix+"*"))
+	sagaTopics := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasPrefix(key, p.logPrefix) {
+			sagaTopics = append(sagaTopics, key)
+		}
+	}
+	return sagaTopics, err
+}
+
+// globEscape escapes glob special characters of KEYS or SCAN pattern.
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+// CountSagas counts sagas indexed by time of SagaStart whose logID starts with prefix, like RedisStore.CountSagas.
+// Sagas started before the index was introduced aren't counted.
+func (p *RedisStreamStore) CountSagas(prefix string) (int, error) {
+	prefix, ok := storage.NarrowPrefix(p.logPrefix, prefix)
+	if !ok {
+		return 0, nil
+	}
+	conn := p.pool.Get()
+	defer conn.Close()
+	return countIndexed(conn, startIndexKey(p.logPrefix), p.logPrefix, prefix)
+}
+
+// Flush is a no-op since every command is acknowledged by redis before returning.
+func (p *RedisStreamStore) Flush() error {
+	return nil
+}
+
+// Cleanup cleans up stream of given logID and removes it from start index in one round-trip.
+func (p *RedisStreamStore) Cleanup(logID string) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+	if err := conn.Send("DEL", logID); err != nil {
+		return err
+	}
+	if err := conn.Send("ZREM", startIndexKey(p.logPrefix), logID); err != nil {
+		return err
+	}
+	return flushPipeline(conn)
+}
+
+// LastLog fetch last log entry in stream of given logID by XREVRANGE
+func (p *RedisStreamStore) LastLog(logID string) (string, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+	_, logs, err := streamEntries(conn.Do("XREVRANGE", logID, "+", "-", "COUNT", 1))
+	if len(logs) == 0 {
+		return "", err
+	}
+	return logs[0], err
+}
+
+// streamEntries converts XRANGE reply into entry IDs and log data.
+func streamEntries(reply interface{}, err error) ([]string, []string, error) {
+	entries, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	logs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		idAndFields, err := redis.Values(entry, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(idAndFields) != 2 {
+			return nil, nil, redis.Error("unexpected stream entry")
+		}
+		id, err := redis.String(idAndFields[0], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields, err := redis.StringMap(idAndFields[1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		logs = append(logs, fields[streamField])
+	}
+	return ids, logs, nil
+}
+
+type streamIterator struct {
+	pool  *redis.Pool
+	logID string
+	start string
+	batch []string
+	pos   int
+	done  bool
+	err   error
+}
+
+func (it *streamIterator) Next() bool {
+	if it.pos+1 < len(it.batch) {
+		it.pos++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+	conn := it.pool.Get()
+	defer conn.Close()
+	// start is inclusive, fetch one more and drop the entry returned by last batch
+	count := streamBatchSize
+	if it.start != "-" {
+		count++
+	}
+	ids, batch, err := streamEntries(conn.Do("XRANGE", it.logID, it.start, "+", "COUNT", count))
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.done = len(batch) < count
+	if len(ids) > 0 {
+		if it.start != "-" {
+			ids, batch = ids[1:], batch[1:]
+		}
+	}
+	if len(ids) > 0 {
+		it.start = ids[len(ids)-1]
+	}
+	it.batch, it.pos = batch, 0
+	return len(batch) > 0
+}
+
+func (it *streamIterator) Value() string {
+	return it.batch[it.pos]
+}
+
+func (it *streamIterator) Err() error {
+	return it.err
+}
+
+func (it *streamIterator) Close() error {
+	return nil
+}
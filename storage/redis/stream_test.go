@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStreamStorage(t *testing.T) {
+	s, err := NewRedisStreamStore("127.0.0.1:6379", "", 14, 2, 5, "s_")
+	assert.NoError(t, err)
+	assert.NoError(t, s.AppendLog("s_11", "{1}"))
+	assert.NoError(t, s.AppendLog("s_11", "{2}"))
+
+	looked, err := s.Lookup("s_11")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{1}", "{2}"}, looked)
+
+	lastLog, err := s.LastLog("s_11")
+	assert.NoError(t, err)
+	assert.Equal(t, "{2}", lastLog)
+
+	logIDs, err := s.LogIDs()
+	assert.NoError(t, err)
+	assert.Contains(t, logIDs, "s_11")
+
+	assert.NoError(t, s.Cleanup("s_11"))
+	looked, err = s.Lookup("s_11")
+	assert.NoError(t, err)
+	assert.Empty(t, looked)
+	lastLog, err = s.LastLog("s_11")
+	assert.NoError(t, err)
+	assert.Equal(t, "", lastLog)
+}
+
+func TestRedisStreamLookupStream(t *testing.T) {
+	s, err := NewRedisStreamStore("127.0.0.1:6379", "", 14, 2, 5, "s_")
+	assert.NoError(t, err)
+	defer s.Cleanup("s_stream")
+	for i := 0; i < streamBatchSize*2+10; i++ {
+		assert.NoError(t, s.AppendLog("s_stream", strconv.Itoa(i)))
+	}
+
+	it, err := s.LookupStream("s_stream")
+	assert.NoError(t, err)
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		assert.Equal(t, strconv.Itoa(n), it.Value())
+		n++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, streamBatchSize*2+10, n)
+}
+
+func TestRedisStreamLookupMany(t *testing.T) {
+	s, err := NewRedisStreamStore("127.0.0.1:6379", "", 14, 2, 5, "s_")
+	assert.NoError(t, err)
+	assert.NoError(t, s.AppendLog("s_1", "{1}"))
+	assert.NoError(t, s.AppendLog("s_2", "{2}"))
+	defer s.Cleanup("s_1")
+	defer s.Cleanup("s_2")
+
+	logs, err := s.LookupMany([]string{"s_1", "s_2", "s_3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{1}"}, logs["s_1"])
+	assert.Equal(t, []string{"{2}"}, logs["s_2"])
+	assert.Empty(t, logs["s_3"])
+}
+
+func TestRedisStreamStorageContract(t *testing.T) {
+	storagetest.TestStorageContract(t, func(t *testing.T, logPrefix string) storage.Storage {
+		s, err := NewRedisStreamStore("127.0.0.1:6379", "", 14, 2, 5, logPrefix)
+		assert.NoError(t, err)
+		return s
+	})
+}
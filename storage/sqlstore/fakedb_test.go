@@ -0,0 +1,277 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeDriver is a database/sql driver serving the statements sqlstore issues with default tables from memory,
+// so the storage is tested without a database server. Statements of MySQL dialect are rewritten to Postgres one
+// before served. Connections opened with the same name share a database, statements aren't isolated
+// by transactions but each is atomic.
+type fakeDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeDB
+}
+
+var fake = &fakeDriver{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("sqlstorefake", fake)
+}
+
+type fakeRow struct {
+	id        int
+	logID     string
+	data      string
+	createdAt int64
+}
+
+type fakeLock struct {
+	owner     string
+	expiresAt int64
+}
+
+type fakeDB struct {
+	mu     sync.Mutex
+	nextID int
+	logs   []fakeRow
+	starts map[string]int64
+	locks  map[string]fakeLock
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		db = &fakeDB{starts: make(map[string]int64), locks: make(map[string]fakeLock)}
+		d.dbs[name] = db
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+var insertIgnore = regexp.MustCompile(`^INSERT IGNORE INTO (.*)$`)
+
+// Prepare rewrites MySQL placeholders and INSERT IGNORE to Postgres dialect.
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if m := insertIgnore.FindStringSubmatch(query); m != nil {
+		query = "INSERT INTO " + m[1] + " ON CONFLICT DO NOTHING"
+	}
+	for n := 1; strings.Contains(query, "?"); n++ {
+		query = strings.Replace(query, "?", "$"+strconv.Itoa(n), 1)
+	}
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE "):
+		return driver.RowsAffected(0), nil
+	case s.query == "INSERT INTO saga_logs (log_id, data, created_at) VALUES ($1, $2, $3)":
+		db.nextID++
+		db.logs = append(db.logs, fakeRow{id: db.nextID, logID: args[0].(string), data: args[1].(string), createdAt: args[2].(int64)})
+		return driver.RowsAffected(1), nil
+	case s.query == "INSERT INTO saga_logs_starts (log_id, created_at) VALUES ($1, $2) ON CONFLICT DO NOTHING":
+		if _, ok := db.starts[args[0].(string)]; ok {
+			return driver.RowsAffected(0), nil
+		}
+		db.starts[args[0].(string)] = args[1].(int64)
+		return driver.RowsAffected(1), nil
+	case s.query == "DELETE FROM saga_logs_starts WHERE log_id = $1":
+		delete(db.starts, args[0].(string))
+		return driver.RowsAffected(1), nil
+	case s.query == "INSERT INTO saga_locks (log_id, owner, expires_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING":
+		if _, ok := db.locks[args[0].(string)]; ok {
+			return driver.RowsAffected(0), nil
+		}
+		db.locks[args[0].(string)] = fakeLock{owner: args[1].(string), expiresAt: args[2].(int64)}
+		return driver.RowsAffected(1), nil
+	case s.query == "UPDATE saga_locks SET owner = $1, expires_at = $2 WHERE log_id = $3 AND expires_at < $4":
+		lock, ok := db.locks[args[2].(string)]
+		if !ok || lock.expiresAt >= args[3].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		db.locks[args[2].(string)] = fakeLock{owner: args[0].(string), expiresAt: args[1].(int64)}
+		return driver.RowsAffected(1), nil
+	case s.query == "UPDATE saga_locks SET expires_at = $1 WHERE log_id = $2 AND owner = $3":
+		lock, ok := db.locks[args[1].(string)]
+		if !ok || lock.owner != args[2] {
+			return driver.RowsAffected(0), nil
+		}
+		db.locks[args[1].(string)] = fakeLock{owner: lock.owner, expiresAt: args[0].(int64)}
+		return driver.RowsAffected(1), nil
+	case s.query == "UPDATE saga_locks SET expires_at = $1 WHERE log_id = $2":
+		lock, ok := db.locks[args[1].(string)]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		db.locks[args[1].(string)] = fakeLock{owner: lock.owner, expiresAt: args[0].(int64)}
+		return driver.RowsAffected(1), nil
+	case s.query == "DELETE FROM saga_locks WHERE log_id = $1 AND owner = $2":
+		if lock, ok := db.locks[args[0].(string)]; !ok || lock.owner != args[1] {
+			return driver.RowsAffected(0), nil
+		}
+		delete(db.locks, args[0].(string))
+		return driver.RowsAffected(1), nil
+	case s.query == "DELETE FROM saga_logs WHERE log_id = $1":
+		return db.deleteLogs(args[0].(string), nil), nil
+	case strings.HasPrefix(s.query, "DELETE FROM saga_logs WHERE log_id = $1 AND data IN ("):
+		entries := make(map[string]bool)
+		for _, arg := range args[1:] {
+			entries[arg.(string)] = true
+		}
+		return db.deleteLogs(args[0].(string), entries), nil
+	}
+	return nil, fmt.Errorf("fakedb: unsupported exec %q", s.query)
+}
+
+// deleteLogs deletes rows of logID, whose data is in entries unless entries is nil.
+func (db *fakeDB) deleteLogs(logID string, entries map[string]bool) driver.Result {
+	kept := db.logs[:0]
+	var n int64
+	for _, row := range db.logs {
+		if row.logID == logID && (entries == nil || entries[row.data]) {
+			n++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	db.logs = kept
+	return driver.RowsAffected(n)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var values []driver.Value
+	switch s.query {
+	case "SELECT data FROM saga_logs WHERE log_id = $1 ORDER BY id":
+		for _, row := range db.logs {
+			if row.logID == args[0] {
+				values = append(values, row.data)
+			}
+		}
+	case "SELECT data FROM saga_logs WHERE log_id = $1 ORDER BY id DESC LIMIT 1":
+		for _, row := range db.logs {
+			if row.logID == args[0] {
+				values = []driver.Value{row.data}
+			}
+		}
+	case "SELECT COUNT(*) FROM saga_logs WHERE log_id = $1":
+		var n int64
+		for _, row := range db.logs {
+			if row.logID == args[0] {
+				n++
+			}
+		}
+		values = append(values, n)
+	case "SELECT DISTINCT log_id FROM saga_logs":
+		for logID := range db.firstCreated() {
+			values = append(values, logID)
+		}
+	case "SELECT log_id FROM saga_logs_starts WHERE created_at >= $1 AND created_at < $2 ORDER BY created_at":
+		var logIDs []string
+		for logID, created := range db.starts {
+			if created >= args[0].(int64) && created < args[1].(int64) {
+				logIDs = append(logIDs, logID)
+			}
+		}
+		sort.Slice(logIDs, func(i, j int) bool {
+			return db.starts[logIDs[i]] < db.starts[logIDs[j]]
+		})
+		for _, logID := range logIDs {
+			values = append(values, logID)
+		}
+	case "SELECT COUNT(*) FROM saga_logs_starts WHERE log_id LIKE $1 ESCAPE '!'":
+		pattern := args[0].(string)
+		prefix := strings.NewReplacer("!!", "!", "!%", "%", "!_", "_").Replace(strings.TrimSuffix(pattern, "%"))
+		var n int64
+		for logID := range db.starts {
+			if strings.HasPrefix(logID, prefix) {
+				n++
+			}
+		}
+		values = append(values, n)
+	default:
+		return nil, fmt.Errorf("fakedb: unsupported query %q", s.query)
+	}
+	return &fakeRows{values: values}, nil
+}
+
+// firstCreated returns created_at of the first row of each logID.
+func (db *fakeDB) firstCreated() map[string]int64 {
+	created := make(map[string]int64)
+	for _, row := range db.logs {
+		if _, ok := created[row.logID]; !ok {
+			created[row.logID] = row.createdAt
+		}
+	}
+	return created
+}
+
+// fakeRows are single column rows.
+type fakeRows struct {
+	values []driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"value"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
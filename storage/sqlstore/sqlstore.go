@@ -0,0 +1,390 @@
+package sqlstore
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/kzh125/go-saga/storage"
+)
+
+// Dialect holds SQL differences between databases.
+type Dialect struct {
+	// Placeholder returns placeholder of the n-th(1-based) statement argument
+	Placeholder func(n int) string
+	// InsertIgnore returns statement inserting a row into table, which does nothing if the key exists
+	InsertIgnore func(table, columns, values string) string
+	// Schema returns statements creating logs table, locks table and starts table indexing saga logs by start time
+	Schema func(logsTable, locksTable, startsTable string) []string
+}
+
+// Postgres is dialect of PostgreSQL 9.5 or above.
+var Postgres = Dialect{
+	Placeholder: func(n int) string {
+		return fmt.Sprintf("$%d", n)
+	},
+	InsertIgnore: func(table, columns, values string) string {
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING", table, columns, values)
+	},
+	Schema: func(logsTable, locksTable, startsTable string) []string {
+		return []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id BIGSERIAL PRIMARY KEY, log_id VARCHAR(255) NOT NULL, data TEXT NOT NULL, created_at BIGINT NOT NULL)", logsTable),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_log_id ON %s (log_id, id)", logsTable, logsTable),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (log_id VARCHAR(255) PRIMARY KEY, owner VARCHAR(32) NOT NULL, expires_at BIGINT NOT NULL)", locksTable),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (log_id VARCHAR(255) PRIMARY KEY, created_at BIGINT NOT NULL)", startsTable),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_created_at ON %s (created_at)", startsTable, startsTable),
+		}
+	},
+}
+
+// MySQL is dialect of MySQL 5.7 or above.
+var MySQL = Dialect{
+	Placeholder: func(n int) string {
+		return "?"
+	},
+	InsertIgnore: func(table, columns, values string) string {
+		return fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES (%s)", table, columns, values)
+	},
+	Schema: func(logsTable, locksTable, startsTable string) []string {
+		return []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id BIGINT AUTO_INCREMENT PRIMARY KEY, log_id VARCHAR(255) NOT NULL, data LONGTEXT NOT NULL, created_at BIGINT NOT NULL, INDEX (log_id, id))", logsTable),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (log_id VARCHAR(255) PRIMARY KEY, owner VARCHAR(32) NOT NULL, expires_at BIGINT NOT NULL)", locksTable),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (log_id VARCHAR(255) PRIMARY KEY, created_at BIGINT NOT NULL, INDEX (created_at))", startsTable),
+		}
+	},
+}
+
+type sqlStorage struct {
+	db         *sql.DB
+	dialect    Dialect
+	logsTable  string
+	locksTable string
+	// startsTable indexes saga logs by time their SagaStart entry was inserted, it's named after logsTable
+	startsTable string
+	logPrefix   string
+	lockLease   time.Duration
+}
+
+// Option configures SQL storage created by NewSQLStorage.
+type Option func(*sqlStorage)
+
+// WithTables sets names of logs table and locks table, default are saga_logs and saga_locks.
+// Starts table indexing saga logs is named after logs table with suffix _starts.
+func WithTables(logsTable, locksTable string) Option {
+	return func(s *sqlStorage) {
+		s.logsTable = logsTable
+		s.locksTable = locksTable
+	}
+}
+
+// WithLockLease sets how long a lock taken by TryLockSaga lasts without being renewed, default is 30s.
+// The lock is renewed every third of lease while held, so a lock of a dead process is taken over after lease.
+func WithLockLease(lease time.Duration) Option {
+	return func(s *sqlStorage) {
+		s.lockLease = lease
+	}
+}
+
+// NewSQLStorage creates log storage base on SQL database, each log entry is a row of logs table ordered by id.
+// It creates tables if not exist, logPrefix is used to filter saga logs from other logIDs in LogIDs.
+// The storage implements storage.Locker by a lease row of locks table, see TryLockSaga,
+// so coordinator replicas sharing the database divide recovery work.
+// Close closes db.
+func NewSQLStorage(db *sql.DB, dialect Dialect, logPrefix string, opts ...Option) (storage.Storage, error) {
+	s := &sqlStorage{
+		db:         db,
+		dialect:    dialect,
+		logsTable:  "saga_logs",
+		locksTable: "saga_locks",
+		logPrefix:  logPrefix,
+		lockLease:  30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.startsTable = s.logsTable + "_starts"
+	for _, stmt := range dialect.Schema(s.logsTable, s.locksTable, s.startsTable) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, errors.Annotatef(err, "Create table failure: %s", stmt)
+		}
+	}
+	return s, nil
+}
+
+func (s *sqlStorage) bind(n int) string {
+	return s.dialect.Placeholder(n)
+}
+
+// AppendLog inserts log data as a row under given logID, stamped with current time in unix nanoseconds.
+// A SagaStart entry of a saga log is also inserted into starts table in the same transaction,
+// which keeps the time of the first one if SagaStart is appended again.
+func (s *sqlStorage) AppendLog(logID string, data string) error {
+	insert := fmt.Sprintf("INSERT INTO %s (log_id, data, created_at) VALUES (%s, %s, %s)",
+		s.logsTable, s.bind(1), s.bind(2), s.bind(3))
+	now := time.Now().UnixNano()
+	if !storage.IsSagaStart(data) || !strings.HasPrefix(logID, s.logPrefix) {
+		_, err := s.db.Exec(insert, logID, data, now)
+		return err
+	}
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(insert, logID, data, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(s.dialect.InsertIgnore(s.startsTable, "log_id, created_at", s.bind(1)+", "+s.bind(2)), logID, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// LogIDsByTimeRange returns logIDs whose SagaStart entry was inserted in [from, to) by an index range scan
+// of starts table, oldest first. Sagas started before starts table was introduced aren't returned.
+func (s *sqlStorage) LogIDsByTimeRange(from, to time.Time) ([]string, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT log_id FROM %s WHERE created_at >= %s AND created_at < %s ORDER BY created_at",
+		s.startsTable, s.bind(1), s.bind(2)), from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLogIDs(rows)
+}
+
+// Lookup selects all log under given logID in append order.
+func (s *sqlStorage) Lookup(logID string) ([]string, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT data FROM %s WHERE log_id = %s ORDER BY id", s.logsTable, s.bind(1)), logID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var logs []string
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		logs = append(logs, data)
+	}
+	return logs, rows.Err()
+}
+
+// LookupStream iterates log under given logID loaded by Lookup.
+func (s *sqlStorage) LookupStream(logID string) (storage.LogIterator, error) {
+	return storage.LookupAsStream(s, logID)
+}
+
+// LookupMany lookups log under each of given logIDs.
+func (s *sqlStorage) LookupMany(logIDs []string) (map[string][]string, error) {
+	return storage.LookupEach(s, logIDs)
+}
+
+// Close closes db.
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+// LogIDs returns logIDs start with logPrefix.
+func (s *sqlStorage) LogIDs() ([]string, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT DISTINCT log_id FROM %s", s.logsTable))
+	if err != nil {
+		return nil, err
+	}
+	return s.scanLogIDs(rows)
+}
+
+// CountSagas counts saga logs in starts table whose logID starts with logPrefix and prefix by a COUNT query.
+// Sagas started before starts table was introduced aren't counted.
+func (s *sqlStorage) CountSagas(prefix string) (int, error) {
+	prefix, ok := storage.NarrowPrefix(s.logPrefix, prefix)
+	if !ok {
+		return 0, nil
+	}
+	var n int
+	err := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE log_id LIKE %s ESCAPE '!'",
+		s.startsTable, s.bind(1)), likePrefix(prefix)).Scan(&n)
+	return n, err
+}
+
+// likePrefix returns LIKE pattern matching strings start with prefix, escaped by '!'.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
+
+// scanLogIDs reads logIDs start with logPrefix from rows and closes rows.
+func (s *sqlStorage) scanLogIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var logIDs []string
+	for rows.Next() {
+		var logID string
+		if err := rows.Scan(&logID); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(logID, s.logPrefix) {
+			logIDs = append(logIDs, logID)
+		}
+	}
+	return logIDs, rows.Err()
+}
+
+// Cleanup deletes all log under given logID and its row in starts table.
+func (s *sqlStorage) Cleanup(logID string) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{s.logsTable, s.startsTable} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE log_id = %s", table, s.bind(1)), logID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveEntries deletes rows under given logID whose data equals one of entries, and counts the rows left
+// in the same transaction, the row in starts table is deleted with the last one.
+func (s *sqlStorage) RemoveEntries(logID string, entries ...string) (int, error) {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) > 0 {
+		binds := make([]string, len(entries))
+		args := make([]interface{}, 0, len(entries)+1)
+		args = append(args, logID)
+		for i, entry := range entries {
+			binds[i] = s.bind(i + 2)
+			args = append(args, entry)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE log_id = %s AND data IN (%s)",
+			s.logsTable, s.bind(1), strings.Join(binds, ", ")), args...); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	var left int
+	if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE log_id = %s", s.logsTable, s.bind(1)), logID).Scan(&left); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if left == 0 {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE log_id = %s", s.startsTable, s.bind(1)), logID); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return left, tx.Commit()
+}
+
+// LastLog selects the last log under given logID, it returns empty string if there is none.
+func (s *sqlStorage) LastLog(logID string) (string, error) {
+	var data string
+	err := s.db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE log_id = %s ORDER BY id DESC LIMIT 1",
+		s.logsTable, s.bind(1)), logID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return data, err
+}
+
+// Flush is a no-op since every statement is committed before returning.
+func (s *sqlStorage) Flush() error {
+	return nil
+}
+
+// TryLockSaga takes the lease row of logID in locks table with a random owner, by an UPDATE of the row
+// whose lease expired, or an insert ignored if the row exists. Each is a single statement, no connection or
+// transaction is held with the lock. The lease is renewed in background until unlock deletes the row of owner.
+// Leases are stamped by clock of replicas, which should be synchronized well within lease; a replica unable
+// to renew in time loses the lock to others, then unlock reports it.
+func (s *sqlStorage) TryLockSaga(logID string) (func() error, bool, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, false, errors.Annotate(err, "Generate lock owner failure")
+	}
+	owner := hex.EncodeToString(token)
+	now := time.Now()
+	res, err := s.db.Exec(fmt.Sprintf("UPDATE %s SET owner = %s, expires_at = %s WHERE log_id = %s AND expires_at < %s",
+		s.locksTable, s.bind(1), s.bind(2), s.bind(3), s.bind(4)), owner, now.Add(s.lockLease).UnixNano(), logID, now.UnixNano())
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if n == 0 {
+		res, err = s.db.Exec(s.dialect.InsertIgnore(s.locksTable, "log_id, owner, expires_at", s.bind(1)+", "+s.bind(2)+", "+s.bind(3)),
+			logID, owner, now.Add(s.lockLease).UnixNano())
+		if err != nil {
+			return nil, false, err
+		}
+		if n, err = res.RowsAffected(); err != nil || n == 0 {
+			return nil, false, err
+		}
+	}
+
+	l := &lease{s: s, logID: logID, owner: owner, done: make(chan struct{}), stopped: make(chan struct{})}
+	go l.renew()
+	return l.unlock, true, nil
+}
+
+// lease is a lock taken by TryLockSaga, which is renewed until unlock.
+type lease struct {
+	s       *sqlStorage
+	logID   string
+	owner   string
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// renew extends expiry of the lease every third of lease until unlock, it stops if the row isn't owned anymore.
+// A failed renewal is retried on next tick.
+func (l *lease) renew() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(l.s.lockLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		res, err := l.s.db.Exec(fmt.Sprintf("UPDATE %s SET expires_at = %s WHERE log_id = %s AND owner = %s",
+			l.s.locksTable, l.s.bind(1), l.s.bind(2), l.s.bind(3)), time.Now().Add(l.s.lockLease).UnixNano(), l.logID, l.owner)
+		if err != nil {
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return
+		}
+	}
+}
+
+// unlock stops renewal and deletes the row if it's still owned, it reports the lock was lost to others before.
+func (l *lease) unlock() error {
+	l.once.Do(func() { close(l.done) })
+	<-l.stopped
+	res, err := l.s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE log_id = %s AND owner = %s",
+		l.s.locksTable, l.s.bind(1), l.s.bind(2)), l.logID, l.owner)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.Errorf("lock of %s was lost after lease expired", l.logID)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/kzh125/go-saga/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var dbSeq int32
+
+var dialects = map[string]Dialect{"Postgres": Postgres, "MySQL": MySQL}
+
+// newFakeStorage creates storage on a new in-memory database served by fakeDriver, opened by n handles
+// as if shared by coordinator replicas.
+func newFakeStorage(t *testing.T, dialect Dialect, logPrefix string, n int, opts ...Option) []*sqlStorage {
+	name := "db" + strconv.Itoa(int(atomic.AddInt32(&dbSeq, 1)))
+	stores := make([]*sqlStorage, n)
+	for i := range stores {
+		db, err := sql.Open("sqlstorefake", name)
+		require.NoError(t, err)
+		s, err := NewSQLStorage(db, dialect, logPrefix, opts...)
+		require.NoError(t, err)
+		stores[i] = s.(*sqlStorage)
+	}
+	return stores
+}
+
+func TestSQLStorageContract(t *testing.T) {
+	for name, dialect := range dialects {
+		dialect := dialect
+		t.Run(name, func(t *testing.T) {
+			storagetest.TestStorageContract(t, func(t *testing.T, logPrefix string) storage.Storage {
+				return newFakeStorage(t, dialect, logPrefix, 1)[0]
+			})
+		})
+	}
+}
+
+func TestSQLStorageTryLockSaga(t *testing.T) {
+	for name, dialect := range dialects {
+		dialect := dialect
+		t.Run(name, func(t *testing.T) {
+			testTryLockSaga(t, dialect)
+		})
+	}
+}
+
+func testTryLockSaga(t *testing.T, dialect Dialect) {
+	const lease = 60 * time.Millisecond
+	stores := newFakeStorage(t, dialect, "l_", 2, WithLockLease(lease))
+	defer stores[0].Close()
+	defer stores[1].Close()
+	replica0, replica1 := stores[0], stores[1]
+
+	unlock, ok, err := replica0.TryLockSaga("l_1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, ok, err = replica1.TryLockSaga("l_1")
+	require.NoError(t, err)
+	assert.False(t, ok, "saga locked by another replica")
+	unlock2, ok, err := replica1.TryLockSaga("l_2")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, unlock2())
+
+	// lease is renewed while held
+	time.Sleep(3 * lease)
+	_, ok, err = replica1.TryLockSaga("l_1")
+	require.NoError(t, err)
+	assert.False(t, ok, "lease renewed by holder")
+
+	assert.NoError(t, unlock())
+	unlock, ok, err = replica1.TryLockSaga("l_1")
+	require.NoError(t, err)
+	assert.True(t, ok, "lock released by unlock")
+	assert.NoError(t, unlock())
+
+	// lease of a dead process expires
+	_, err = replica0.db.Exec(dialect.InsertIgnore("saga_locks", "log_id, owner, expires_at",
+		dialect.Placeholder(1)+", "+dialect.Placeholder(2)+", "+dialect.Placeholder(3)), "l_4", "dead", time.Now().Add(-time.Second).UnixNano())
+	require.NoError(t, err)
+	// long lease isn't renewed while the test expires it
+	replica1.lockLease = time.Hour
+	unlock, ok, err = replica1.TryLockSaga("l_4")
+	require.NoError(t, err)
+	assert.True(t, ok, "expired lease taken over")
+
+	// unlock reports lock taken over by others
+	_, err = replica0.db.Exec("UPDATE saga_locks SET expires_at = "+dialect.Placeholder(1)+" WHERE log_id = "+dialect.Placeholder(2), 0, "l_4")
+	require.NoError(t, err)
+	unlock0, ok, err := replica0.TryLockSaga("l_4")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Error(t, unlock())
+	assert.NoError(t, unlock0())
+
+	// exactly one of concurrent replicas gets the lock
+	var locked int32
+	var wg sync.WaitGroup
+	unlocks := make(chan func() error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(locker storage.Locker) {
+			defer wg.Done()
+			unlock, ok, err := locker.TryLockSaga("l_3")
+			assert.NoError(t, err)
+			if ok {
+				atomic.AddInt32(&locked, 1)
+				unlocks <- unlock
+			}
+		}(stores[i%2])
+	}
+	wg.Wait()
+	close(unlocks)
+	assert.Equal(t, int32(1), locked)
+	for unlock := range unlocks {
+		assert.NoError(t, unlock())
+	}
+}
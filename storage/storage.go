@@ -1,5 +1,12 @@
 package storage
 
+import (
+	"strings"
+	"time"
+)
+
+//go:generate mockgen -source=storage.go -destination=mocks/storage.go -package=mocks
+
 // Storage uses to support save and lookup saga log.
 type Storage interface {
 
@@ -9,15 +16,88 @@ type Storage interface {
 	// Lookup uses to lookup all log under given logID
 	Lookup(logID string) ([]string, error)
 
+	// LookupStream likes Lookup, but iterates log under given logID without loading all of them into memory
+	LookupStream(logID string) (LogIterator, error)
+
+	// LookupMany lookups all log under each of given logIDs in one batch, missing logID maps to empty log
+	LookupMany(logIDs []string) (map[string][]string, error)
+
 	// Close use to close storage and release resources
 	Close() error
 
 	// LogIDs returns exists logID
 	LogIDs() ([]string, error)
 
+	// CountSagas returns the number of saga logs, whose first entry IsSagaStart, among logIDs LogIDs would return
+	// starting with prefix, without materializing them, e.g. for monitoring to sample it frequently.
+	// Lists kept by coordinator under the same prefix aren't counted.
+	CountSagas(prefix string) (int, error)
+
 	// Cleanup cleans up all log data in logID
 	Cleanup(logID string) error
 
 	// LastLog fetch last log entry with given logID
 	LastLog(logID string) (string, error)
+
+	// Flush blocks until log appended before are durably persisted, it's a no-op for synchronous storage
+	Flush() error
+}
+
+// NarrowPrefix returns the prefix matching logIDs which start with both logPrefix and prefix,
+// ok is false if no logID does.
+func NarrowPrefix(logPrefix, prefix string) (narrowed string, ok bool) {
+	switch {
+	case strings.HasPrefix(prefix, logPrefix):
+		return prefix, true
+	case strings.HasPrefix(logPrefix, prefix):
+		return logPrefix, true
+	}
+	return "", false
+}
+
+// sagaStartPrefix is how a marshaled SagaStart entry begins, type is the first field of saga log
+const sagaStartPrefix = `{"type":"SagaStart"`
+
+// IsSagaStart reports whether data is a SagaStart entry, which saga logs begin with.
+// Lists kept by coordinator under logPrefix, e.g. dead-letter and heartbeat lists, never begin with it.
+func IsSagaStart(data string) bool {
+	return strings.HasPrefix(data, sagaStartPrefix)
+}
+
+// Locker is implemented by storage able to lock a saga across processes, e.g. coordinator replicas sharing storage.
+// Coordinator only resumes compensation of a saga while it holds the lock, so replicas divide recovery work
+// without compensating a saga twice.
+type Locker interface {
+
+	// TryLockSaga tries to lock saga of given logID without blocking, ok is false if it's locked by others.
+	// The lock is held until unlock is called.
+	TryLockSaga(logID string) (unlock func() error, ok bool, err error)
+}
+
+// TimeRangeLister is implemented by storage indexing saga logs by time of their SagaStart entry,
+// so sagas started in a time range are listed without scanning every saga log.
+type TimeRangeLister interface {
+
+	// LogIDsByTimeRange returns logIDs whose SagaStart entry(see IsSagaStart) was appended in [from, to),
+	// lists sharing logPrefix, e.g. dead-letter lists of coordinator, aren't returned
+	LogIDsByTimeRange(from, to time.Time) ([]string, error)
+}
+
+// Compactor is implemented by storage able to rewrite the head of a log atomically, so long-running saga logs
+// can be compacted without losing entries appended meanwhile.
+type Compactor interface {
+
+	// ReplacePrefix atomically replaces the first n log entries under logID with entries, keeping the ones after them,
+	// if the n-th entry is head, i.e. the prefix is still the one read by caller. ok is false, and nothing is replaced,
+	// if the log has less than n entries or the n-th one isn't head, e.g. it's compacted by others.
+	ReplacePrefix(logID string, n int, head string, entries []string) (ok bool, err error)
+}
+
+// Remover is implemented by storage able to remove entries from a log atomically, so lists of logIDs shared by
+// coordinator replicas, e.g. the dead-letter list, are pruned without losing entries appended meanwhile.
+type Remover interface {
+
+	// RemoveEntries atomically removes every log entry under logID equal to one of entries,
+	// and returns the number of entries left. A log left empty is cleaned up.
+	RemoveEntries(logID string, entries ...string) (left int, err error)
 }
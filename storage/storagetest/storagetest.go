@@ -0,0 +1,283 @@
+// Package storagetest provides a conformance suite every storage.Storage implementation should pass,
+// so backends behave the same way from the coordinator's point of view.
+package storagetest
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kzh125/go-saga/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory creates the storage under test whose LogIDs only returns logIDs starting with logPrefix.
+// The storage may be shared with previous runs, the suite cleans up logIDs it uses before and after.
+type Factory func(t *testing.T, logPrefix string) storage.Storage
+
+// TestStorageContract runs the storage conformance suite against storages created by factory:
+//
+//   - AppendLog keeps append order, which Lookup, LookupStream and LookupMany return
+//   - LastLog returns the last appended log, or "" without error for a missing logID
+//   - LogIDs only returns logIDs with the storage's prefix
+//   - CountSagas counts saga logs, which start with SagaStart, among LogIDs starting with given prefix
+//   - Cleanup removes all log of logID and is idempotent
+//   - Flush succeeds and keeps log readable
+//   - concurrent AppendLog to the same or different logIDs loses nothing
+//   - ReplacePrefix of storage.Compactor replaces the head of log it's given and keeps the rest
+//   - RemoveEntries of storage.Remover removes matching entries and keeps the rest in order
+//   - LogIDsByTimeRange of storage.TimeRangeLister lists saga logs started in range, not lists sharing the prefix
+func TestStorageContract(t *testing.T, factory Factory) {
+	t.Run("AppendLookup", func(t *testing.T) {
+		s := newStorage(t, factory, "c1_", "c1_order")
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, s.AppendLog("c1_order", strconv.Itoa(i)))
+		}
+		logs, err := s.Lookup("c1_order")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"0", "1", "2", "3", "4"}, logs)
+
+		it, err := s.LookupStream("c1_order")
+		require.NoError(t, err)
+		var streamed []string
+		for it.Next() {
+			streamed = append(streamed, it.Value())
+		}
+		assert.NoError(t, it.Err())
+		assert.NoError(t, it.Close())
+		assert.Equal(t, logs, streamed)
+
+		many, err := s.LookupMany([]string{"c1_order", "c1_missing"})
+		require.NoError(t, err)
+		assert.Equal(t, logs, many["c1_order"])
+		assert.Empty(t, many["c1_missing"])
+
+		missing, err := s.Lookup("c1_missing")
+		require.NoError(t, err)
+		assert.Empty(t, missing)
+	})
+
+	t.Run("LastLog", func(t *testing.T) {
+		s := newStorage(t, factory, "c2_", "c2_last", "c2_missing")
+		last, err := s.LastLog("c2_missing")
+		require.NoError(t, err)
+		assert.Equal(t, "", last)
+		assert.NoError(t, s.AppendLog("c2_last", "1"))
+		assert.NoError(t, s.AppendLog("c2_last", "2"))
+		last, err = s.LastLog("c2_last")
+		require.NoError(t, err)
+		assert.Equal(t, "2", last)
+	})
+
+	t.Run("LogIDs", func(t *testing.T) {
+		s := newStorage(t, factory, "c3_", "c3_1", "c3_2", "x3_1")
+		for _, logID := range []string{"c3_1", "c3_2", "x3_1"} {
+			assert.NoError(t, s.AppendLog(logID, "1"))
+		}
+		logIDs, err := s.LogIDs()
+		require.NoError(t, err)
+		sort.Strings(logIDs)
+		assert.Equal(t, []string{"c3_1", "c3_2"}, logIDs)
+	})
+
+	t.Run("CountSagas", func(t *testing.T) {
+		s := newStorage(t, factory, "c7_", "c7_a1", "c7_a2", "c7_b1", "x7_a1", "c7_alerts")
+		for _, logID := range []string{"c7_a1", "c7_a2", "c7_b1", "x7_a1"} {
+			assert.NoError(t, s.AppendLog(logID, sagaStart))
+			assert.NoError(t, s.AppendLog(logID, "1"))
+		}
+		// only saga logs are counted, not lists kept by coordinator under the prefix
+		assert.NoError(t, s.AppendLog("c7_alerts", "c7_a1"))
+		for prefix, expected := range map[string]int{"": 3, "c7_": 3, "c7_a": 2, "c7_b1": 1, "c7_c": 0, "x7_": 0} {
+			n, err := s.CountSagas(prefix)
+			require.NoError(t, err)
+			assert.Equal(t, expected, n, prefix)
+		}
+		assert.NoError(t, s.Cleanup("c7_a1"))
+		n, err := s.CountSagas("")
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		s := newStorage(t, factory, "c4_", "c4_1", "c4_2")
+		assert.NoError(t, s.AppendLog("c4_1", "1"))
+		assert.NoError(t, s.AppendLog("c4_2", "1"))
+		assert.NoError(t, s.Cleanup("c4_1"))
+		assert.NoError(t, s.Cleanup("c4_1"))
+		logs, err := s.Lookup("c4_1")
+		require.NoError(t, err)
+		assert.Empty(t, logs)
+		last, err := s.LastLog("c4_1")
+		require.NoError(t, err)
+		assert.Equal(t, "", last)
+		logIDs, err := s.LogIDs()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"c4_2"}, logIDs)
+		logs, err = s.Lookup("c4_2")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1"}, logs)
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		s := newStorage(t, factory, "c6_", "c6_1")
+		assert.NoError(t, s.AppendLog("c6_1", "1"))
+		assert.NoError(t, s.Flush())
+		logs, err := s.Lookup("c6_1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1"}, logs)
+	})
+
+	t.Run("ReplacePrefix", func(t *testing.T) {
+		s := newStorage(t, factory, "c8_", "c8_1")
+		compactor, ok := s.(storage.Compactor)
+		if !ok {
+			t.Skip("storage doesn't implement storage.Compactor")
+		}
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, s.AppendLog("c8_1", strconv.Itoa(i)))
+		}
+		// the prefix read is gone
+		ok, err := compactor.ReplacePrefix("c8_1", 3, "1", []string{"a"})
+		require.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = compactor.ReplacePrefix("c8_1", 3, "2", []string{"a"})
+		require.NoError(t, err)
+		assert.True(t, ok)
+		logs, err := s.Lookup("c8_1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "3", "4"}, logs)
+		assert.NoError(t, s.AppendLog("c8_1", "5"))
+		last, err := s.LastLog("c8_1")
+		require.NoError(t, err)
+		assert.Equal(t, "5", last)
+
+		ok, err = compactor.ReplacePrefix("c8_1", 5, "4", []string{"b"})
+		require.NoError(t, err)
+		assert.False(t, ok)
+		logs, err = s.Lookup("c8_1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "3", "4", "5"}, logs)
+	})
+
+	t.Run("RemoveEntries", func(t *testing.T) {
+		s := newStorage(t, factory, "c9_", "c9_1", "c9_missing")
+		remover, ok := s.(storage.Remover)
+		if !ok {
+			t.Skip("storage doesn't implement storage.Remover")
+		}
+		for _, data := range []string{"a", "b", "a", "c", "d"} {
+			assert.NoError(t, s.AppendLog("c9_1", data))
+		}
+		left, err := remover.RemoveEntries("c9_1", "a", "c", "x")
+		require.NoError(t, err)
+		assert.Equal(t, 2, left)
+		logs, err := s.Lookup("c9_1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b", "d"}, logs)
+		assert.NoError(t, s.AppendLog("c9_1", "e"))
+		last, err := s.LastLog("c9_1")
+		require.NoError(t, err)
+		assert.Equal(t, "e", last)
+
+		left, err = remover.RemoveEntries("c9_1", "b", "d", "e")
+		require.NoError(t, err)
+		assert.Equal(t, 0, left)
+		logs, err = s.Lookup("c9_1")
+		require.NoError(t, err)
+		assert.Empty(t, logs)
+		logIDs, err := s.LogIDs()
+		require.NoError(t, err)
+		assert.Empty(t, logIDs)
+
+		left, err = remover.RemoveEntries("c9_missing", "a")
+		require.NoError(t, err)
+		assert.Equal(t, 0, left)
+	})
+
+	t.Run("LogIDsByTimeRange", func(t *testing.T) {
+		s := newStorage(t, factory, "c10_", "c10_1", "c10_2", "c10_compensate_failures", "x10_1")
+		lister, ok := s.(storage.TimeRangeLister)
+		if !ok {
+			t.Skip("storage doesn't implement storage.TimeRangeLister")
+		}
+		from := time.Now().Add(-time.Minute)
+		for _, logID := range []string{"c10_1", "c10_2", "x10_1"} {
+			assert.NoError(t, s.AppendLog(logID, sagaStart))
+			assert.NoError(t, s.AppendLog(logID, "1"))
+		}
+		// a list kept by coordinator under the prefix, whose first entry isn't SagaStart
+		assert.NoError(t, s.AppendLog("c10_compensate_failures", "c10_2"))
+		// SagaStart appended again keeps the start time
+		assert.NoError(t, s.AppendLog("c10_1", sagaStart))
+		to := time.Now().Add(time.Minute)
+		logIDs, err := lister.LogIDsByTimeRange(from, to)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"c10_1", "c10_2"}, logIDs)
+		logIDs, err = lister.LogIDsByTimeRange(to, to.Add(time.Minute))
+		require.NoError(t, err)
+		assert.Empty(t, logIDs)
+
+		assert.NoError(t, s.Cleanup("c10_1"))
+		logIDs, err = lister.LogIDsByTimeRange(from, to)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"c10_2"}, logIDs)
+	})
+
+	t.Run("ConcurrentAppend", func(t *testing.T) {
+		const writers, n = 5, 20
+		logIDs := []string{"c5_all"}
+		for i := 0; i < writers; i++ {
+			logIDs = append(logIDs, "c5_"+strconv.Itoa(i))
+		}
+		s := newStorage(t, factory, "c5_", logIDs...)
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < n; j++ {
+					assert.NoError(t, s.AppendLog("c5_"+strconv.Itoa(i), strconv.Itoa(j)))
+					assert.NoError(t, s.AppendLog("c5_all", strconv.Itoa(j)))
+				}
+			}(i)
+		}
+		wg.Wait()
+		all, err := s.Lookup("c5_all")
+		require.NoError(t, err)
+		assert.Len(t, all, writers*n)
+		for i := 0; i < writers; i++ {
+			logs, err := s.Lookup("c5_" + strconv.Itoa(i))
+			require.NoError(t, err)
+			if assert.Len(t, logs, n) {
+				// a single writer's log keeps its order
+				for j, log := range logs {
+					assert.Equal(t, strconv.Itoa(j), log)
+				}
+			}
+		}
+	})
+}
+
+// sagaStart is a SagaStart entry as saga marshals it
+const sagaStart = `{"type":"SagaStart","time":"2020-01-02T15:04:05Z"}`
+
+// newStorage creates storage by factory and cleans up logIDs now and when the test finishes,
+// the storage is closed after the final cleanup.
+func newStorage(t *testing.T, factory Factory, logPrefix string, logIDs ...string) storage.Storage {
+	s := factory(t, logPrefix)
+	cleanup := func() {
+		for _, logID := range logIDs {
+			assert.NoError(t, s.Cleanup(logID))
+		}
+	}
+	cleanup()
+	t.Cleanup(func() {
+		assert.NoError(t, s.Close())
+	})
+	t.Cleanup(cleanup)
+	return s
+}
@@ -0,0 +1,115 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// ListSagasAtStep returns logIDs of sagas not ended whose current step is subTxID: its action started
+// without ActionEnd, e.g. a downstream hangs or the process crashed during it, or the saga is paused
+// on the async sub-transaction waiting for Confirm.
+func (e *ExecutionCoordinator) ListSagasAtStep(subTxID string) ([]string, error) {
+	logIDs, err := e.logIDs()
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	for _, logID := range logIDs {
+		if _, ok, err := e.startTime(logID); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		data, err := e.storeOf(logID).Lookup(logID)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Lookup %s failure", logID)
+		}
+		if atStep(unmarshalLogs(data), subTxID) {
+			matched = append(matched, logID)
+		}
+	}
+	return matched, nil
+}
+
+// atStep reports whether saga log stops at subTxID.
+func atStep(logs []Log, subTxID string) bool {
+	if len(logs) == 0 {
+		return false
+	}
+	for _, log := range logs {
+		if log.Type == SagaEnd {
+			return false
+		}
+	}
+	for _, start := range danglingActions(logs) {
+		if start.SubTxID == subTxID {
+			return true
+		}
+	}
+	last := logs[len(logs)-1]
+	return last.Type == ActionPaused && last.SubTxID == subTxID
+}
+
+// CompensateSagasAtStep rolls back sagas listed by ListSagasAtStep with bounded concurrency(see WithRecoveryConcurrency),
+// it scopes remediation to sagas affected by a broken downstream rather than all in-flight ones.
+// A saga whose action of subTxID is dangling is repaired by RepairDangling according to OnDangling of the sub-transaction,
+// otherwise its executed steps are compensated. Sagas running in this coordinator are skipped, since their caller
+// still drives them. It returns logIDs rolled back and the ones failed, err is only returned when sagas
+// can't be listed or ctx is done.
+func (e *ExecutionCoordinator) CompensateSagasAtStep(ctx context.Context, subTxID string) (compensated, failed []string, err error) {
+	logIDs, err := e.ListSagasAtStep(subTxID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, e.opts.recoveryConcurrency)
+	for _, logID := range logIDs {
+		if e.admission.isLive(logID) {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(logID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			compensateErr := e.compensateAtStep(ctx, logID)
+			mu.Lock()
+			defer mu.Unlock()
+			if compensateErr != nil {
+				e.opts.logger.Printf("[WARNING]Compensate %s at %s failure: %v", logID, subTxID, compensateErr)
+				failed = append(failed, logID)
+				return
+			}
+			compensated = append(compensated, logID)
+		}(logID)
+	}
+	wg.Wait()
+	return compensated, failed, ctx.Err()
+}
+
+func (e *ExecutionCoordinator) compensateAtStep(ctx context.Context, logID string) error {
+	n, err := e.RepairDangling(ctx, logID)
+	if n > 0 || err != nil {
+		return err
+	}
+	ok, err := e.resumeCompensation(logID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w", logID, ErrCompensateFailed)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package saga
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Span is a unit of traced work created by Tracer.
+type Span interface {
+	// End finishes the span with result of the work
+	End(err error)
+}
+
+// Tracer creates spans of sagas, actions and compensates, e.g. an adapter of OpenTelemetry.
+type Tracer interface {
+	// Start starts span named name as child of the span in ctx, and returns ctx carrying the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Stats are cheap counters updated by every saga, whether sampled for tracing or not.
+type Stats struct {
+	SagasStarted  int64
+	SagasEnded    int64
+	SagasAborted  int64
+	Actions       int64
+	Compensations int64
+}
+
+// ContextCopier copies values, e.g. trace span and baggage, of the original saga context src onto
+// compensate context dst and returns the result. src may have been canceled, dst must not inherit that.
+type ContextCopier func(dst, src context.Context) context.Context
+
+// CopyContextValues returns ContextCopier copies values of keys present in src.
+// Values stored under unexported keys, e.g. OpenTelemetry span, need a ContextCopier using accessors of their package.
+func CopyContextValues(keys ...interface{}) ContextCopier {
+	return func(dst, src context.Context) context.Context {
+		for _, key := range keys {
+			if value := src.Value(key); value != nil {
+				dst = context.WithValue(dst, key, value)
+			}
+		}
+		return dst
+	}
+}
+
+// WithCompensateContext sets copiers applied in order to build the parent of compensate contexts from
+// a fresh context.Background() and the original saga context, so rollback carries trace and baggage
+// of the saga without being canceled with it, e.g. for OpenTelemetry:
+//
+//	saga.WithCompensateContext(func(dst, src context.Context) context.Context {
+//		dst = trace.ContextWithSpanContext(dst, trace.SpanContextFromContext(src))
+//		return baggage.ContextWithBaggage(dst, baggage.FromContext(src))
+//	})
+//
+// The result is given to WithOnBeforeAbort hook. Recovered sagas have no original context to copy from.
+func WithCompensateContext(copiers ...ContextCopier) Option {
+	return func(o *options) {
+		o.compensateContext = append(o.compensateContext, copiers...)
+	}
+}
+
+// inheritContext builds base of compensate contexts from saga context ctx.
+func (e *ExecutionCoordinator) inheritContext(ctx context.Context) context.Context {
+	base := context.Background()
+	for _, copier := range e.opts.compensateContext {
+		base = copier(base, ctx)
+	}
+	return base
+}
+
+type sampledCtxKey struct{}
+
+// IsSampled reports whether the saga of ctx is sampled for tracing, see WithTracer.
+// The decision is made once by StartSaga and holds for all spans of the saga.
+func IsSampled(ctx context.Context) bool {
+	sampled, _ := ctx.Value(sampledCtxKey{}).(bool)
+	return sampled
+}
+
+// Stats returns a snapshot of counters of sagas coordinated by e.
+func (e *ExecutionCoordinator) Stats() Stats {
+	return e.stats.snapshot()
+}
+
+func (st *Stats) snapshot() Stats {
+	return Stats{
+		SagasStarted:  atomic.LoadInt64(&st.SagasStarted),
+		SagasEnded:    atomic.LoadInt64(&st.SagasEnded),
+		SagasAborted:  atomic.LoadInt64(&st.SagasAborted),
+		Actions:       atomic.LoadInt64(&st.Actions),
+		Compensations: atomic.LoadInt64(&st.Compensations),
+	}
+}
+
+// sample decides whether a new saga is traced.
+func (e *ExecutionCoordinator) sample() bool {
+	if e.opts.tracer == nil {
+		return false
+	}
+	rate := e.opts.traceSampleRate
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// startSpan starts span if the saga is sampled.
+func (s *Saga) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if !s.sampled {
+		return ctx, nopSpan{}
+	}
+	ctx, span := s.sec.opts.tracer.Start(ctx, name)
+	s.labelSpan(span)
+	return ctx, span
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(err error) {}
@@ -0,0 +1,188 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type rootSpanKey struct{}
+
+// recordTracer records span names grouped by root span
+type recordTracer struct {
+	mu    sync.Mutex
+	spans map[string][]string
+	ended int
+}
+
+func (r *recordTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	root, ok := ctx.Value(rootSpanKey{}).(string)
+	if !ok {
+		root = name
+		ctx = context.WithValue(ctx, rootSpanKey{}, root)
+	}
+	r.mu.Lock()
+	r.spans[root] = append(r.spans[root], name)
+	r.mu.Unlock()
+	return ctx, r
+}
+
+func (r *recordTracer) End(err error) {
+	r.mu.Lock()
+	r.ended++
+	r.mu.Unlock()
+}
+
+func TestTracerSampling(t *testing.T) {
+	tracer := &recordTracer{spans: make(map[string][]string)}
+	acc := &account{balance: map[string]int{}}
+	sec := newTestSEC(t, WithTracer(tracer, 0.5))
+	sec.AddSubTxDef("deduce", func(ctx context.Context, name string, amount int) error {
+		tracer.mu.Lock()
+		defer tracer.mu.Unlock()
+		_, traced := tracer.spans["saga "+name]
+		assert.Equal(t, traced, IsSampled(ctx))
+		return acc.deduce(ctx, name, amount)
+	}, acc.deduceCompensate).AddSubTxDef("fail", failAction, failCompensate)
+
+	const n = 200
+	var s *Saga
+	for i := 0; i < n; i++ {
+		id := "trace" + strconv.Itoa(i)
+		s = sec.StartSaga(context.Background(), id).ExecSub("deduce", id, 1).ExecSub("fail")
+		s.EndSaga()
+	}
+	assert.True(t, len(tracer.spans) > 0 && len(tracer.spans) < n, "sampled %d of %d", len(tracer.spans), n)
+	for root, spans := range tracer.spans {
+		// a sampled saga is fully traced
+		assert.Equal(t, []string{root, "action deduce", "action fail", "compensate deduce"}, spans)
+	}
+	assert.Equal(t, len(tracer.spans)*4, tracer.ended)
+	// a repeated EndSaga isn't counted
+	s.EndSaga()
+	assert.Equal(t, Stats{SagasStarted: n, SagasEnded: n, SagasAborted: n, Actions: 2 * n, Compensations: n}, sec.Stats())
+}
+
+func TestTracerSampleAll(t *testing.T) {
+	tracer := &recordTracer{spans: make(map[string][]string)}
+	sec := newTestSEC(t, WithTracer(tracer, 1))
+	sec.AddSubTxDef("fail", failAction, failCompensate)
+	for i := 0; i < 10; i++ {
+		sec.StartSaga(context.Background(), "all"+strconv.Itoa(i)).ExecSub("fail").EndSaga()
+	}
+	assert.Len(t, tracer.spans, 10)
+}
+
+type traceIDKey struct{}
+type baggageKey struct{}
+
+func TestCompensateContext(t *testing.T) {
+	var traceID, baggage interface{}
+	var ctxErr error
+	compensate := func(ctx context.Context) error {
+		traceID, baggage, ctxErr = ctx.Value(traceIDKey{}), ctx.Value(baggageKey{}), ctx.Err()
+		return nil
+	}
+	sec := newTestSEC(t, WithCompensateContext(CopyContextValues(traceIDKey{})))
+	sec.AddSubTxDef("step", func(ctx context.Context) error { return nil }, compensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), traceIDKey{}, "trace-1"))
+	ctx = context.WithValue(ctx, baggageKey{}, "not copied")
+	s := sec.StartSaga(ctx, "inherit")
+	s.ExecSub("step")
+	cancel()
+	s.ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+	assert.Equal(t, "trace-1", traceID)
+	assert.Nil(t, baggage)
+	assert.NoError(t, ctxErr)
+}
+
+// labeledTracer records attributes set on spans.
+type labeledTracer struct {
+	mu    sync.Mutex
+	attrs []map[string]string
+}
+
+type labeledSpan struct {
+	tracer *labeledTracer
+}
+
+func (l *labeledTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, labeledSpan{tracer: l}
+}
+
+func (s labeledSpan) End(err error) {}
+
+func (s labeledSpan) SetAttributes(attrs map[string]string) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.attrs = append(s.tracer.attrs, attrs)
+}
+
+func TestLabels(t *testing.T) {
+	tracer := &labeledTracer{}
+	acc := &account{balance: map[string]int{"foo": 100}}
+	sec := newTestSEC(t, WithTracer(tracer, 1), WithLabelAllowlist("tenant"))
+	sec.AddSubTxDef("deduce", acc.deduce, acc.deduceCompensate).
+		AddSubTxDef("fail", failAction, failCompensate)
+
+	for i, tenant := range []string{"a", "b", "a"} {
+		ctx := WithTags(context.Background(), map[string]string{"tenant": tenant, "order": strconv.Itoa(i)})
+		s := sec.StartSaga(ctx, "labeled"+strconv.Itoa(i)).ExecSub("deduce", "foo", 1)
+		if tenant == "b" {
+			s.ExecSub("fail")
+		}
+		s.EndSaga()
+	}
+	sec.StartSaga(context.Background(), "unlabeled").EndSaga()
+
+	assert.Equal(t, []LabeledStats{
+		{Labels: map[string]string{"tenant": "a"}, Stats: Stats{SagasStarted: 2, SagasEnded: 2, Actions: 2}},
+		{Labels: map[string]string{"tenant": "b"}, Stats: Stats{SagasStarted: 1, SagasEnded: 1, SagasAborted: 1, Actions: 2, Compensations: 1}},
+	}, sec.LabeledStats())
+	assert.Equal(t, Stats{SagasStarted: 4, SagasEnded: 4, SagasAborted: 1, Actions: 4, Compensations: 1}, sec.Stats())
+	// saga, actions and compensate spans of labeled sagas
+	assert.Len(t, tracer.attrs, 2+4+2)
+	for _, attrs := range tracer.attrs {
+		assert.NotContains(t, attrs, "order")
+	}
+
+	// tags are persisted with SagaStart
+	tags := map[string]string{"tenant": "c", "order": "4"}
+	s := sec.StartSaga(WithTags(context.Background(), tags), "persisted")
+	entries, err := sec.Replay(s.logID)
+	assert.NoError(t, err)
+	assert.Equal(t, tags, entries[0].Values)
+	assert.NoError(t, s.EndSaga())
+}
+
+func TestTagsNotRestoredAsState(t *testing.T) {
+	compensateDown := true
+	var found []bool
+	sec := newTestSEC(t)
+	sec.AddSubTxDef("order", func(ctx context.Context) error {
+		return nil
+	}, func(ctx context.Context) error {
+		if compensateDown {
+			return errors.New("order service down")
+		}
+		var tenant string
+		found = append(found, GetValue(ctx, "tenant", &tenant))
+		return nil
+	}).AddSubTxDef("fail", failAction, failCompensate)
+
+	s := sec.StartSaga(WithTags(context.Background(), map[string]string{"tenant": "c"}), "tagged")
+	s.ExecSub("order").ExecSub("fail")
+	assert.Error(t, s.EndSaga())
+
+	// tags persisted with SagaStart aren't state of the recovered saga
+	compensateDown = false
+	assert.NoError(t, sec.RetryCompensateFailure(context.Background(), s.logID))
+	assert.Equal(t, []bool{false}, found)
+}
@@ -0,0 +1,48 @@
+package saga
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// VerifyCompensate registers verifier checking compensate really reverted the action, e.g. by reading
+// the balance back, for compensates which may report success without effect. verifier takes the same
+// arguments as compensate and returns error like it. It runs after every successful compensate attempt
+// and before CompensateEnd is logged, its outcome is logged by CompensateVerified or CompensateVerifyFailed.
+// A rejected compensation is an attempt failed with ErrVerifyFailed: it's retried, scheduled for retry
+// or dead-lettered like compensate failures.
+func VerifyCompensate(verifier interface{}) SubTxOption {
+	return func(def *subTxDefinition) {
+		def.verifier = reflect.ValueOf(verifier)
+	}
+}
+
+// validateVerifier checks verifier accepts the arguments of compensate.
+func validateVerifier(def subTxDefinition) error {
+	if !def.verifier.IsValid() {
+		return nil
+	}
+	if _, err := validateSubTxFunc(def.subTxID, "verifier", def.verifier.Interface()); err != nil {
+		return err
+	}
+	return validateCompensate(def.subTxID, def.compensate, def.verifier)
+}
+
+// verifyCompensate calls verifier with params compensate of tlog was called with, and logs its outcome.
+func (s *Saga) verifyCompensate(tlog Log, verifier reflect.Value, params []reflect.Value) error {
+	result, err := s.sec.call(verifier, params)
+	if err == nil {
+		err = s.interpretResult(tlog.SubTxID, result)
+	}
+	vlog := &Log{Type: CompensateVerified, SubTxID: tlog.SubTxID, Time: time.Now(), Step: tlog.Step}
+	if err != nil {
+		err = fmt.Errorf("verify compensate %s: %w: %v", tlog.SubTxID, ErrVerifyFailed, err)
+		vlog.Type = CompensateVerifyFailed
+		vlog.Values = map[string]string{"error": err.Error()}
+	}
+	if appendErr := s.appendLog(vlog); appendErr != nil {
+		panic(fmt.Errorf("verifyCompensate AppendLog: %v", appendErr))
+	}
+	return err
+}